@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	log "github.com/spf13/jwalterweatherman"
@@ -23,10 +24,44 @@ type Configuration struct {
 	Mode         string
 	Cert         string
 	Key          string
+	// The kv store backend: "bolt" (default), "memory" or "etcd"
+	KVStoreBackend string
+	// The etcd backend configuration (etcd backend only)
+	Etcd store.EtcdConfig
+	// The encryption at rest of the kv store values
+	Encryption store.EncryptionConfig
+	// The api authentication
+	Auth AuthConfig
+	// Tenants defined in the configuration, in addition to the stored ones
+	Tenants []Tenant
+	// The audit log retention
+	Audit AuditConfig
+	// The retention of the idempotency keys of the lifecycle requests
+	Idempotency IdempotencyConfig
+	// The api rate and concurrency limits
+	Limits LimitsConfig
+	// The api http server limits
+	Server ServerConfig
+	// The TLS configuration of the https mode
+	TLS TLSConfig
+	// The api listeners, Mode/Host/Port is the only one if empty
+	Listeners []ListenerConfig
+	// The plugins configuration
+	Plugins PluginsConfig
+}
+
+// The plugins configuration
+type PluginsConfig struct {
+	// The deprecated legacy plugin protocol: "allow" (default) or "deny"
+	LegacyProtocol string
+	// The interval of the plugin health checks e.g. "10s" (default), "0s" disables them
+	HealthCheckInterval string
+	// The failed health checks in a row after which a plugin is reloaded (default 3)
+	HealthFailureThreshold int
 }
 
 var (
-	mainStore  *store.KVStore = nil
+	mainStore  store.Store = nil
 	startPath  string
 	confPath   string
 	apiService *APIService
@@ -43,12 +78,11 @@ func Start() {
 	var configuration Configuration
 	var configerr error
 
-	startPath, _ = filepath.Abs(filepath.Dir(os.Args[0]))
-	confPath = filepath.Join(startPath, "conf")
+	initPaths()
 
 	configuration, configerr = loadConfigs()
 	if configerr != nil {
-		fmt.Printf(configerr.Error())
+		fmt.Println(configerr.Error())
 		os.Exit(1)
 	}
 	fmt.Printf("Configuration loaded...")
@@ -72,7 +106,29 @@ func Start() {
 	log.INFO.Printf("APIService Started")
 
 	// Start the Plugin Registry service
-	err := pluginmanager.PluginStoreInit(mainStore)
+	switch configuration.Plugins.LegacyProtocol {
+	case "", "allow":
+		pluginmanager.AllowLegacyProtocol = true
+	case "deny":
+		pluginmanager.AllowLegacyProtocol = false
+	default:
+		log.FATAL.Fatalf("Aborting, Invalid Plugins LegacyProtocol: %s", configuration.Plugins.LegacyProtocol)
+		return
+	}
+	healthInterval, err := parseDuration("Plugins HealthCheckInterval", configuration.Plugins.HealthCheckInterval, pluginmanager.DefaultHealthInterval.String())
+	if err != nil {
+		log.FATAL.Fatalf("Aborting, %v", err)
+		return
+	}
+	if configuration.Plugins.HealthFailureThreshold < 0 {
+		log.FATAL.Fatalf("Aborting, Invalid Plugins HealthFailureThreshold: %d", configuration.Plugins.HealthFailureThreshold)
+		return
+	}
+	pluginmanager.HealthCheckInterval = healthInterval
+	if configuration.Plugins.HealthFailureThreshold > 0 {
+		pluginmanager.HealthFailureThreshold = configuration.Plugins.HealthFailureThreshold
+	}
+	err = pluginmanager.PluginStoreInit(mainStore)
 	if err != nil {
 		log.INFO.Printf("pluginStoreInit Failed")
 		os.Exit(1)
@@ -97,6 +153,12 @@ func startApiService(configuration *Configuration) error {
 	return nil
 }
 
+// Set the agent start and conf paths
+func initPaths() {
+	startPath, _ = filepath.Abs(filepath.Dir(os.Args[0]))
+	confPath = filepath.Join(startPath, "conf")
+}
+
 // load the config data from the file
 func loadConfigs() (Configuration, error) {
 
@@ -115,13 +177,36 @@ func loadConfigs() (Configuration, error) {
 	return configuration, nil
 }
 
+// Get the kv store configuration, the relative paths are resolved from the start path
+func getStoreConfig(configuration *Configuration) store.Config {
+	encryption := configuration.Encryption
+	if encryption.KeyFile != "" {
+		encryption.KeyFile = filepath.Join(startPath, encryption.KeyFile)
+	}
+	oldKeyFiles := make([]string, len(encryption.OldKeyFiles))
+	for i, file := range encryption.OldKeyFiles {
+		oldKeyFiles[i] = filepath.Join(startPath, file)
+	}
+	encryption.OldKeyFiles = oldKeyFiles
+
+	return store.Config{
+		Backend:    configuration.KVStoreBackend,
+		Path:       filepath.Join(startPath, configuration.KVStoreName),
+		Etcd:       configuration.Etcd,
+		Encryption: encryption,
+	}
+}
+
 // Init KV store
 func initKVStore(configuration *Configuration) error {
 	var err error
 
-	fname := filepath.Join(startPath, configuration.KVStoreName)
-	log.INFO.Printf("KVStore file: %s\n", fname)
-	mainStore, err = store.NewKVStore(fname)
+	storeConf := getStoreConfig(configuration)
+	log.INFO.Printf("KVStore backend: %s\n", storeConf.Backend)
+	if storeConf.Backend == "" || storeConf.Backend == store.BoltBackend {
+		log.INFO.Printf("KVStore file: %s\n", storeConf.Path)
+	}
+	mainStore, err = store.New(storeConf)
 	if err != nil {
 		return err
 	}
@@ -129,6 +214,28 @@ func initKVStore(configuration *Configuration) error {
 	return nil
 }
 
+// ReEncryptStore rewrites the encrypted buckets of the kv store with the
+// primary key. It is run offline, while the agent is stopped.
+func ReEncryptStore() (int, error) {
+	initPaths()
+
+	configuration, err := loadConfigs()
+	if err != nil {
+		return 0, err
+	}
+	if !configuration.Encryption.Enabled() {
+		return 0, ConfigError("No encryption key configured")
+	}
+
+	kvstore, err := store.New(getStoreConfig(&configuration))
+	if err != nil {
+		return 0, err
+	}
+	defer kvstore.Close()
+
+	return kvstore.(*store.EncryptedStore).ReEncrypt()
+}
+
 // initialize logging...
 func initLogging(configuration *Configuration) {
 
@@ -159,9 +266,22 @@ func initLogging(configuration *Configuration) {
 	}
 }
 
-// stop the agent
+// stop the agent. The api requests and the lifecycle operations are drained
+// before the plugins are unloaded and the kv store closed.
 func Stop() {
-	apiService.Stop()
+	timeout, err := apiService.Config.Server.shutdownTimeout()
+	if err != nil {
+		timeout, _ = defaultServerConfig.shutdownTimeout()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := apiService.Stop(ctx); err != nil {
+		log.ERROR.Printf("APIServer stopped with error: %v", err)
+	}
 	pluginmanager.PlugStoreStop()
+	if err := mainStore.Close(); err != nil {
+		log.ERROR.Printf("Failed to close the KV store: %v", err)
+	}
 	log.INFO.Printf("Agent stopped\n")
 }
@@ -1,36 +1,63 @@
 package agent
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	log "github.com/spf13/jwalterweatherman"
 	"net/http"
+	"org.openappstack/singularity/client"
 	"org.openappstack/singularity/pluginmanager"
 	"path/filepath"
-	"strconv"
+	"strings"
+	"sync"
 )
 
 type APIService struct {
 	Config *Configuration
+	// Authenticates the api requests
+	auth *Authenticator
+	// Authorizes the api requests
+	authz *Authorizer
+	// Records the audit trail
+	audit *Auditor
+	// Caches the results of the lifecycle requests by idempotency key
+	idempotency *Idempotency
+	// The rate limits of all the requests and of the lifecycle ones
+	limiter          *RateLimiter
+	lifecycleLimiter *RateLimiter
+	// The slots of the in-progress lifecycle operations, nil for no limit
+	operationSlots chan struct{}
+	// Serializes the operations on each controller
+	operationLocks *controllerLocks
+	// The routes of the tenant scoped api
+	tenantRoutes []tenantRoute
+	// The registered routes, as in the OpenAPI spec
+	routes []apiRoute
+	// Closed when the service starts stopping
+	closing chan struct{}
+	// The in-progress lifecycle operations, waited for at shutdown
+	operations sync.WaitGroup
+	opLock     sync.Mutex
+	stopping   bool
 }
 
-type ControllerStartReq struct {
-	Name    string `json:"name"`
-	Version string `json:"version"`
-	CIL     string `json:"cil"` // The Controller Instance Location (a path in case of
-	// non-containerized and a container-id in case of containerzed)
-	Deploy string `json:"deploy"`
+// A registered route and its methods, as in the OpenAPI spec
+type apiRoute struct {
+	path    string
+	methods []string
 }
 
-type ControllerStartResp struct {
-	CId string `json:"cid"` // The unique Controller Identifier
-}
-
-type ControllerStopReq struct {
-	CId string `json:"cid"` // The unique Controller Identifier
-}
+// The api types, shared with the clients
+type (
+	ControllerStartReq  = client.ControllerStartReq
+	ControllerStartResp = client.ControllerStartResp
+	ControllerStopReq   = client.ControllerStopReq
+	ControllerConfigReq = client.ControllerConfigReq
+)
 
 type Controller struct {
+	Tenant    string
 	Name      string
 	Version   string
 	CIL       string
@@ -38,23 +65,18 @@ type Controller struct {
 	Pid_cid   string // Process id or container id
 	CId       string
 	InitParam []byte // in a grey area -- currently not being used
+	// The secret references (parameter name -> secret name), never the values
+	SecretRefs map[string]string
+	Running    bool
+	// The health of the plugin of the running controller, empty until it changes
+	PluginHealth string
 }
 
-type Response struct {
-	// Response is used for sending Json Response to the Client i.e. { "Success": "true", Message}
-	Success string `json: "suuccess"`
-	Message string `json: "message"`
-}
-
-// APIServer for the http server
-var apiServer *HTTPServer
+// The api type, shared with the clients
+type Response = client.Response
 
-// Use this map for controller
-var runningControllerInstances map[string]Controller
-var cidControllerMap map[string]Controller
-
-// Controller unique id
-var uniqueId int
+// APIServers for the http listeners
+var apiServers []*HTTPServer
 
 // Start the CommandApi Service
 func (service *APIService) Start() error {
@@ -62,167 +84,506 @@ func (service *APIService) Start() error {
 
 	var serverErr error
 
-	//TODO:  Load the old running controller info from kvstore
-	/*** XXX: Temp ***/ runningControllerInstances = make(map[string]Controller)
-	//TODO:  Load the old controller conf info from kvstore
-	/*** XXX: Temp ***/ cidControllerMap = make(map[string]Controller)
-	//TODO:  Load the old uniqueId from kvstore
-	/*** XXX: Temp ***/ uniqueId = 0
+	listeners := configuration.listeners()
+	for _, listener := range listeners {
+		if serverErr = listener.validate(configuration.Auth.ClientAuth); serverErr != nil {
+			log.FATAL.Fatalf("Aborting, %s", serverErr)
+			return serverErr
+		}
+	}
+	service.closing = make(chan struct{})
+
+	// Load the controllers and the uniqueId from the kvstore
+	if serverErr = loadControllers(); serverErr != nil {
+		log.FATAL.Fatalf("Aborting, Failed to load the controllers: %s", serverErr)
+		return serverErr
+	}
+	if serverErr = clearOperations(); serverErr != nil {
+		log.FATAL.Fatalf("Aborting, Failed to clear the interrupted operations: %s", serverErr)
+		return serverErr
+	}
+	if serverErr = migrateSecrets(); serverErr != nil {
+		log.FATAL.Fatalf("Aborting, Failed to migrate the secrets: %s", serverErr)
+		return serverErr
+	}
 
 	certFile := filepath.Join(startPath, configuration.Cert)
 	keyFile := filepath.Join(startPath, configuration.Key)
+	tlsConfig := configuration.TLS
+	tlsConfig.Certificates = make([]CertificateConfig, len(configuration.TLS.Certificates))
+	for i, cert := range configuration.TLS.Certificates {
+		tlsConfig.Certificates[i] = CertificateConfig{filepath.Join(startPath, cert.Cert), filepath.Join(startPath, cert.Key)}
+	}
+	if tlsConfig.SelfSigned && usesHttps(listeners) {
+		hosts := tlsConfig.SelfSignedHosts
+		if len(hosts) == 0 {
+			hosts = []string{"localhost", "127.0.0.1", configuration.Host}
+		}
+		if serverErr = ensureSelfSigned(certFile, keyFile, hosts); serverErr != nil {
+			log.FATAL.Fatalf("Aborting, Failed to generate the self-signed certificate: %s", serverErr)
+			return serverErr
+		}
+	}
 
-	// start command server
-	commandConfig := &HttpConfiguration{
-		Mode:      configuration.Mode,
-		Address:   configuration.Host,
-		Port:      configuration.Port,
-		Registrar: service,
-		Cert:      certFile,
-		Key:       keyFile,
+	service.auth, serverErr = NewAuthenticator(configuration.Auth)
+	if serverErr != nil {
+		log.FATAL.Fatalf("Aborting, Invalid authentication configuration: %s", serverErr)
+		return serverErr
+	}
+	service.authz, serverErr = NewAuthorizer(configuration.Auth)
+	if serverErr != nil {
+		log.FATAL.Fatalf("Aborting, Invalid authorization configuration: %s", serverErr)
+		return serverErr
+	}
+	service.audit, serverErr = NewAuditor(configuration.Audit)
+	if serverErr != nil {
+		log.FATAL.Fatalf("Aborting, Invalid audit configuration: %s", serverErr)
+		return serverErr
 	}
-	apiServer, serverErr = NewHTTPServer(commandConfig)
+	service.audit.Start()
+	pluginmanager.AddPluginEventListener(service.audit.RecordPluginEvent)
+	pluginmanager.AddPluginEventListener(recordPluginHealth)
+	service.idempotency, serverErr = NewIdempotency(configuration.Idempotency)
 	if serverErr != nil {
-		log.FATAL.Fatalf("Aborting, Error while Creating the Command Api Server: %s", serverErr)
+		log.FATAL.Fatalf("Aborting, Invalid idempotency configuration: %s", serverErr)
+		return serverErr
+	}
+	service.idempotency.Start()
+
+	if serverErr = configuration.Limits.validate(); serverErr != nil {
+		log.FATAL.Fatalf("Aborting, Invalid limits configuration: %s", serverErr)
 		return serverErr
 	}
-	apiServer.Start()
+	service.limiter = NewRateLimiter(configuration.Limits.RequestRate, configuration.Limits.RequestBurst)
+	service.lifecycleLimiter = NewRateLimiter(configuration.Limits.LifecycleRate, configuration.Limits.LifecycleBurst)
+	if max := configuration.Limits.MaxLifecycleOperations; max > 0 {
+		service.operationSlots = make(chan struct{}, max)
+	}
+	service.operationLocks = newControllerLocks(configuration.Limits.ControllerOperations)
+
+	clientCA := ""
+	if configuration.Auth.ClientCA != "" {
+		clientCA = filepath.Join(startPath, configuration.Auth.ClientCA)
+	}
 
-	log.INFO.Printf("APIServer started at : %s", apiServer.addr)
+	// start command servers, one per listener
+	commandConfig := HttpConfiguration{
+		Registrar:  service,
+		Cert:       certFile,
+		Key:        keyFile,
+		ClientCA:   clientCA,
+		ClientAuth: configuration.Auth.ClientAuth,
+		TLS:        tlsConfig,
+	}
+	if serverErr = configuration.Server.apply(&commandConfig); serverErr == nil {
+		_, serverErr = configuration.Server.shutdownTimeout()
+	}
+	if serverErr != nil {
+		log.FATAL.Fatalf("Aborting, Invalid server configuration: %s", serverErr)
+		return serverErr
+	}
+	apiServers = nil
+	for _, listener := range listeners {
+		server, serverErr := NewHTTPServer(service.listenerConfig(listener, commandConfig))
+		if serverErr != nil {
+			log.FATAL.Fatalf("Aborting, Error while Creating the Command Api Server %s: %s", listener.name(), serverErr)
+			return serverErr
+		}
+		server.Start()
+		apiServers = append(apiServers, server)
+		log.INFO.Printf("APIServer %s started at : %s", listener.name(), server.addr)
+	}
 
 	return nil
 }
 
-// Stop the Command Api service
-func (service *APIService) Stop() error {
-	//Store data to KVStore
-	apiServer.Shutdown()
+// Check if a listener serves https
+func usesHttps(listeners []ListenerConfig) bool {
+	for _, listener := range listeners {
+		if listener.Mode == "https" {
+			return true
+		}
+	}
+	return false
+}
+
+// Closed when the api service starts stopping, the long-lived requests
+// (e.g. the watch streams) must then end
+func serviceClosing() <-chan struct{} {
+	if apiService == nil {
+		return nil
+	}
+	return apiService.closing
+}
+
+// Stop the Command Api service. The in-flight requests and the in-progress
+// lifecycle operations are waited for until the context is done.
+func (service *APIService) Stop(ctx context.Context) error {
+	close(service.closing)
+
+	// Drain the listeners in parallel, they share the deadline
+	errs := make(chan error, len(apiServers))
+	for _, server := range apiServers {
+		go func(server *HTTPServer) { errs <- server.Shutdown(ctx) }(server)
+	}
+	var err error
+	for range apiServers {
+		if shutdownErr := <-errs; shutdownErr != nil {
+			err = shutdownErr
+		}
+	}
+	service.waitOperations(ctx)
+	service.audit.Stop()
+	service.idempotency.Stop()
 	log.INFO.Printf("APIServer stopped")
-	return nil
+	return err
+}
+
+// Register an in-progress lifecycle operation, refused once stopping
+func (service *APIService) beginOperation() bool {
+	service.opLock.Lock()
+	defer service.opLock.Unlock()
+	if service.stopping {
+		return false
+	}
+	service.operations.Add(1)
+	return true
+}
+
+// End an in-progress lifecycle operation
+func (service *APIService) endOperation() {
+	service.operations.Done()
+}
+
+// Refuse the new lifecycle operations and wait for the in-progress ones
+func (service *APIService) waitOperations(ctx context.Context) {
+	service.opLock.Lock()
+	service.stopping = true
+	service.opLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		service.operations.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.WARN.Printf("Timed out waiting for the in-progress lifecycle operations")
+	}
 }
 
 // All api functionality is registered here...
 func (api *APIService) Register(s *HTTPServer) {
 
+	// The routes are registered again for each listener
+	api.tenantRoutes = nil
+	api.routes = nil
+
+	get, post, getPost := []string{"GET"}, []string{"POST"}, []string{"GET", "POST"}
+
 	// Lifecycle service api
-	s.mux.HandleFunc("/v1/api/lifecycle/start", start)
-	s.mux.HandleFunc("/v1/api/lifecycle/stop", stop)
+	api.handleDefaultTenant(s, "lifecycle/start", post, nil, ActionOperate, ActionOperate, api.idempotency.Wrap(api.lifecycleLimiter.Wrap(start)))
+	api.handleDefaultTenant(s, "lifecycle/stop", post, nil, ActionOperate, ActionOperate, api.idempotency.Wrap(api.lifecycleLimiter.Wrap(stop)))
+	api.handleDefaultTenant(s, "lifecycle/logs", get, nil, ActionRead, ActionRead, logs)
+	api.handleDefaultTenant(s, "lifecycle/config", post, nil, ActionOperate, ActionOperate, api.idempotency.Wrap(api.lifecycleLimiter.Wrap(configure)))
+
+	// Plugin health api
+	api.routes = append(api.routes, apiRoute{pluginsPath + "{name}/health", get})
+	s.mux.HandleFunc(pluginsPath, pluginsRouter(allowMethods("", get, nil, api.authz.Wrap(ActionRead, ActionRead, pluginHealth))))
+
+	// KVStore watch api, only the tenant scoped one is restricted to the tenant
+	api.handle(s, "/v1/api/watch", get, ActionRead, ActionRead, watch)
+	api.handleTenant(s, "watch", get, nil, ActionRead, ActionRead, watch)
+
+	// Secrets api
+	api.handleDefaultTenant(s, "secrets/", []string{"GET", "POST", "PUT"}, []string{"GET", "DELETE"}, ActionOperate, ActionAdmin, secrets)
+
+	// Audit api
+	api.handle(s, "/v1/api/audit", get, ActionAdmin, ActionAdmin, audit)
+	api.handleTenant(s, "audit", get, nil, ActionAdmin, ActionAdmin, audit)
+
+	// Tenant api and tenant scoped routes
+	api.handle(s, strings.TrimSuffix(tenantsPath, "/"), getPost, ActionRead, ActionAdmin, tenants)
+	api.routes = append(api.routes, apiRoute{tenantsPath + "{tenant}", tenantMethods})
+	s.mux.HandleFunc(tenantsPath, api.tenantRouter)
+
+	// Authentication and authorization api
+	api.handlePrefix(s, tokensPath, getPost, []string{"DELETE"}, ActionAdmin, ActionAdmin, tokens)
+	api.handlePrefix(s, usersPath, getPost, []string{"DELETE"}, ActionAdmin, ActionAdmin, users)
+	api.handlePrefix(s, bindingsPath, getPost, []string{"DELETE"}, ActionAdmin, ActionAdmin, bindings)
+
+	// OpenAPI spec of this api
+	api.handle(s, "/v1/api/openapi.json", get, ActionRead, ActionRead, openapi)
+
+	// The unknown api paths, and the v2 api served by the same handlers
+	s.mux.HandleFunc(apiPath, notFound)
+	s.mux.HandleFunc(apiV2Path, api.v2Router(s.mux))
+	for _, route := range api.routes {
+		api.routes = append(api.routes, apiRoute{apiV2Path + strings.TrimPrefix(route.path, apiPath), route.methods})
+	}
+}
+
+// Register a route. The identity must be allowed readAction for the GET
+// requests and writeAction for the others.
+func (api *APIService) handle(s *HTTPServer, path string, methods []string, readAction, writeAction string, handler http.HandlerFunc) {
+	api.routes = append(api.routes, apiRoute{path, methods})
+	s.mux.HandleFunc(path, allowMethods("", methods, nil, api.authz.Wrap(readAction, writeAction, handler)))
+}
+
+// Register a route for a path and all its sub paths, the sub paths allow itemMethods
+func (api *APIService) handlePrefix(s *HTTPServer, prefix string, methods, itemMethods []string, readAction, writeAction string, handler http.HandlerFunc) {
+	api.routes = append(api.routes, apiRoute{strings.TrimSuffix(prefix, "/"), methods}, apiRoute{prefix + "{id}", itemMethods})
+	wrapped := allowMethods(prefix, methods, itemMethods, api.authz.Wrap(readAction, writeAction, handler))
+	s.mux.HandleFunc(strings.TrimSuffix(prefix, "/"), wrapped)
+	s.mux.HandleFunc(prefix, wrapped)
+}
+
+// Serves the OpenAPI 3 document of the api
+func openapi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(client.OpenAPISpec())
 }
 
 // Starts controller deployed at a given location
 func start(w http.ResponseWriter, r *http.Request) {
 	log.DEBUG.Printf("Executing API - start")
 
-	decoder := json.NewDecoder(r.Body)
+	done, ok := apiService.lifecycleOperation(w, r)
+	if !ok {
+		return
+	}
+	defer done()
 
 	req := &ControllerStartReq{}
+	if !decodeRequest(w, r, "ControllerStartReq", req) {
+		return
+	}
+
+	tenant := tenantFromRequest(r)
+	if !authorizeResource(w, r, ActionOperate, &Resource{Tenant: tenant, Controller: req.Name}) {
+		return
+	}
 
-	decodeErr := decoder.Decode(req)
-	if decodeErr != nil {
-		WriteJsonResponse(Response{"false", fmt.Sprintf("Invalid request: Failed to Decode: %v", decodeErr)}, 400, w)
-		log.DEBUG.Printf("Failed to decode request: %v", decodeErr)
+	// Serialize the operations on the controller
+	release, ok := apiService.lockController(w, r, tenant, req.CIL)
+	if !ok {
 		return
 	}
+	defer release()
 
 	// Check if the controller is already started -- using the CIL
-	controller, ok := runningControllerInstances[req.CIL]
+	controller, ok := controllers.runningAt(tenant, req.CIL)
 	if ok {
-		WriteJsonResponse(Response{"false", fmt.Sprintf("Controller is already started at: %s", req.CIL)}, 400, w)
+		writeError(w, r, 409, client.CodeConflict, fmt.Sprintf("Controller is already started at: %s", req.CIL))
 		log.DEBUG.Printf("Controller is already started at: %s", req.CIL)
 		return
 	}
 
+	// Check the plugin binding and reserve the quota slot of the controller,
+	// released once it runs or failed to start
+	releaseQuota, quotaErr := reserveQuota(tenant, req.Name)
+	if quotaErr != nil {
+		code := client.CodeForbidden
+		if errors.Is(quotaErr, errQuotaExceeded) {
+			code = client.CodeQuotaExceeded
+		}
+		writeError(w, r, 403, code, quotaErr.Error())
+		log.DEBUG.Printf("Refused to start controller %s for tenant %s: %v", req.Name, tenant, quotaErr)
+		return
+	}
+	defer releaseQuota()
+
 	// Create a controller instance and mappit to a unique controller id
-	controller = Controller{Name: req.Name, Version: req.Version, CIL: req.CIL, Deploy: req.Deploy, Pid_cid: "", InitParam: nil}
+	controller = Controller{Tenant: tenant, Name: req.Name, Version: req.Version, CIL: req.CIL, Deploy: req.Deploy, Pid_cid: "", InitParam: nil, SecretRefs: req.Secrets}
+
+	// Resolve the referenced secrets
+	secretValues, secretErr := resolveSecrets(tenant, controller.SecretRefs)
+	if secretErr != nil {
+		writeError(w, r, 400, client.CodeInvalidRequest, fmt.Sprintf("Invalid secrets for controller: %s : Error: %v", controller.Name, secretErr))
+		log.DEBUG.Printf("Failed to resolve secrets for controller: %s : Error: %v", controller.Name, secretErr)
+		return
+	}
 
 	// Get the plugin for the controller
-	lifecyclePlugin, pluginerr := pluginmanager.GetManagePlugin(controller.Name, controller.Version)
+	lifecyclePlugin, pluginerr := getManagePlugin(controller.Name, controller.Version)
 	if pluginerr != nil {
-		WriteJsonResponse(Response{"false", fmt.Sprintf("failed to load proper plugin for controller: %s of Version: %s : Error: %v", controller.Name, controller.Version, pluginerr)}, 400, w)
+		writeError(w, r, 502, client.CodePluginFailure, fmt.Sprintf("failed to load proper plugin for controller: %s of Version: %s : Error: %v", controller.Name, controller.Version, pluginerr))
 		log.DEBUG.Printf("Fialed to load plugin for controller: %s of Version: %s: Error: %v", controller.Name, controller.Version, pluginerr)
 		return
 	}
 
 	// Send request to the plugin
 	controller.CId = GetUniqueControllerID()
-	initError := lifecyclePlugin.Init(controller.CId, []byte(controller.CIL))
+	auditCId(r, controller.CId)
+	// The progress reported by the plugin is recorded until the start ends
+	ctx := pluginmanager.WithProgress(r.Context(), func(progress *pluginmanager.Progress) {
+		recordProgress(&controller, "start", progress)
+	})
+	defer endProgress(&controller)
+	initError := lifecyclePlugin.Init(ctx, controller.CId, []byte(controller.CIL), secretValues)
 	if initError != nil {
-		WriteJsonResponse(Response{"false", fmt.Sprintf("Failed to initialize lifecycle plugin for controller: %s : Error: %v", controller.Name, initError)}, 400, w)
+		writePluginError(w, r, initError, fmt.Sprintf("Failed to initialize lifecycle plugin for controller: %s : Error: %v", controller.Name, initError))
 		log.DEBUG.Printf("Failed to init controller : %s : Error: %v", controller.Name, initError)
 		return
 	}
-	startError := lifecyclePlugin.Start(controller.CId, nil)
+	startError := lifecyclePlugin.Start(ctx, controller.CId, nil)
 	if startError != nil {
-		WriteJsonResponse(Response{"false", fmt.Sprintf("Failed to start lifecycle plugin for controller: %s : Error: %v", controller.Name, startError)}, 400, w)
+		writePluginError(w, r, startError, fmt.Sprintf("Failed to start lifecycle plugin for controller: %s : Error: %v", controller.Name, startError))
 		log.DEBUG.Printf("Failed to start controller : %s : Error: %v", controller.Name, startError)
 		return
 	}
 
-	// Map the controller instance to the CId map -- using the CId
-	cidControllerMap[controller.CId] = controller
-	/*** TODO : Need to be stored in KV STore ***/
-
-	// map the controller instance to the start map -- using the CIL
-	runningControllerInstances[controller.CIL] = controller
-	/*** TODO : Need to be stored in KV STore ***/
+	// Map the controller instance by CId and by CIL
+	controller.Running = true
+	controllers.put(controller)
+	saveController(controller)
 
-	WriteJsonResponse(Response{"true", controller.CId}, 200, w)
+	log.INFO.Printf("Controller %s of tenant %s started at %s with CId %s by %s", controller.Name, tenant, controller.CIL, controller.CId, IdentityFromRequest(r))
+	writeResult(w, r, controller.CId, ControllerStartResp{CId: controller.CId})
 }
 
 // Stop Controller deployed at a given location
 func stop(w http.ResponseWriter, r *http.Request) {
 	log.DEBUG.Printf("Executing API - stop")
 
-	decoder := json.NewDecoder(r.Body)
+	done, ok := apiService.lifecycleOperation(w, r)
+	if !ok {
+		return
+	}
+	defer done()
 
 	req := &ControllerStopReq{}
-
-	decodeErr := decoder.Decode(req)
-	if decodeErr != nil {
-		WriteJsonResponse(Response{"false", fmt.Sprintf("Invalid request: Failed to Decode: %v", decodeErr)}, 400, w)
-		log.DEBUG.Printf("Failed to decode request: %v", decodeErr)
+	if !decodeRequest(w, r, "ControllerStopReq", req) {
 		return
 	}
 
-	// Get the Controller details
-	controller, ok := cidControllerMap[req.CId]
+	// Get the Controller details, only the controllers of the tenant are visible
+	auditCId(r, req.CId)
+	tenant := tenantFromRequest(r)
+	controller, ok := controllers.get(tenant, req.CId)
 	if !ok {
-		WriteJsonResponse(Response{"false", fmt.Sprintf("Invalid controller id: %s", req.CId)}, 400, w)
+		writeError(w, r, 404, client.CodeNotFound, fmt.Sprintf("Invalid controller id: %s", req.CId))
 		log.DEBUG.Printf("Invalid controller id: %s", req.CId)
 		return
 	}
 
+	if !authorizeResource(w, r, ActionOperate, &Resource{Tenant: tenant, Controller: controller.Name, CId: controller.CId}) {
+		return
+	}
+
+	// Serialize the operations on the controller
+	release, locked := apiService.lockController(w, r, tenant, controller.CIL)
+	if !locked {
+		return
+	}
+	defer release()
+
 	// Check if the controller is already started -- using the CIL
-	controller, ok = runningControllerInstances[controller.CIL]
-	if !ok {
-		WriteJsonResponse(Response{"false", fmt.Sprintf("Controller has mot started at: %s", controller.CIL)}, 400, w)
+	running, ok := controllers.runningAt(tenant, controller.CIL)
+	if !ok || running.CId != controller.CId {
+		writeError(w, r, 409, client.CodeConflict, fmt.Sprintf("Controller has mot started at: %s", controller.CIL))
 		log.DEBUG.Printf("Controller has not started at: %s", controller.CIL)
 		return
 	}
 
 	// Get the plugin for the controller
-	lifecyclePlugin, pluginerr := pluginmanager.GetManagePlugin(controller.Name, controller.Version)
+	lifecyclePlugin, pluginerr := getManagePlugin(controller.Name, controller.Version)
 	if pluginerr != nil {
-		WriteJsonResponse(Response{"false", fmt.Sprintf("failed to load proper plugin for controller: %s of Version: %s : Error: %v", controller.Name, controller.Version, pluginerr)}, 400, w)
+		writeError(w, r, 502, client.CodePluginFailure, fmt.Sprintf("failed to load proper plugin for controller: %s of Version: %s : Error: %v", controller.Name, controller.Version, pluginerr))
 		log.DEBUG.Printf("Fialed to load plugin for controller: %s of Version: %s: Error: %v", controller.Name, controller.Version, pluginerr)
 		return
 	}
 
 	// send request to the plugin
-	stopError := lifecyclePlugin.Stop(controller.CId, nil)
+	stopError := lifecyclePlugin.Stop(r.Context(), controller.CId, nil)
 	if stopError != nil {
-		WriteJsonResponse(Response{"false", fmt.Sprintf("Failed to stop lifecycle plugin for controller: %s : Error: %v", controller.Name, stopError)}, 400, w)
+		writePluginError(w, r, stopError, fmt.Sprintf("Failed to stop lifecycle plugin for controller: %s : Error: %v", controller.Name, stopError))
 		log.DEBUG.Printf("Failed to start controller : %s : Error: %v", controller.Name, stopError)
 		return
 	}
 
-	// Delete the controller from the running controller map
-	delete(runningControllerInstances, controller.CIL)
+	// Delete the controller from the running controllers
+	controller.Running = false
+	controllers.put(controller)
+	saveController(controller)
+	log.INFO.Printf("Controller %s of tenant %s stopped at %s (CId %s) by %s", controller.Name, tenant, controller.CIL, controller.CId, IdentityFromRequest(r))
 
-	WriteJsonResponse(Response{"true", ""}, 200, w)
+	writeResult(w, r, "", nil)
 }
 
-// Get the unique controller id
-func GetUniqueControllerID() string {
-	return strconv.Itoa(uniqueId)
+// Push a configuration to a running controller, the referenced secrets are
+// resolved like at start
+func configure(w http.ResponseWriter, r *http.Request) {
+	log.DEBUG.Printf("Executing API - configure")
+
+	done, ok := apiService.lifecycleOperation(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
+	req := &ControllerConfigReq{}
+	if !decodeRequest(w, r, "ControllerConfigReq", req) {
+		return
+	}
+
+	// Get the Controller details, only the controllers of the tenant are visible
+	auditCId(r, req.CId)
+	tenant := tenantFromRequest(r)
+	controller, ok := controllers.get(tenant, req.CId)
+	if !ok {
+		writeError(w, r, 404, client.CodeNotFound, fmt.Sprintf("Invalid controller id: %s", req.CId))
+		log.DEBUG.Printf("Invalid controller id: %s", req.CId)
+		return
+	}
+
+	if !authorizeResource(w, r, ActionOperate, &Resource{Tenant: tenant, Controller: controller.Name, CId: controller.CId}) {
+		return
+	}
+
+	// Serialize the operations on the controller
+	release, locked := apiService.lockController(w, r, tenant, controller.CIL)
+	if !locked {
+		return
+	}
+	defer release()
+
+	running, ok := controllers.runningAt(tenant, controller.CIL)
+	if !ok || running.CId != controller.CId {
+		writeError(w, r, 409, client.CodeConflict, fmt.Sprintf("Controller has not started at: %s", controller.CIL))
+		log.DEBUG.Printf("Controller has not started at: %s", controller.CIL)
+		return
+	}
+
+	// Resolve the referenced secrets
+	secretValues, secretErr := resolveSecrets(tenant, req.Secrets)
+	if secretErr != nil {
+		writeError(w, r, 400, client.CodeInvalidRequest, fmt.Sprintf("Invalid secrets for controller: %s : Error: %v", controller.Name, secretErr))
+		log.DEBUG.Printf("Failed to resolve secrets for controller: %s : Error: %v", controller.Name, secretErr)
+		return
+	}
+
+	// Get the plugin for the controller
+	lifecyclePlugin, pluginerr := getManagePlugin(controller.Name, controller.Version)
+	if pluginerr != nil {
+		writeError(w, r, 502, client.CodePluginFailure, fmt.Sprintf("failed to load proper plugin for controller: %s of Version: %s : Error: %v", controller.Name, controller.Version, pluginerr))
+		log.DEBUG.Printf("Failed to load plugin for controller: %s of Version: %s: Error: %v", controller.Name, controller.Version, pluginerr)
+		return
+	}
+
+	// send request to the plugin
+	configError := lifecyclePlugin.Configure(r.Context(), controller.CId, []byte(req.Config), secretValues)
+	switch {
+	case errors.Is(configError, pluginmanager.ErrNotSupported):
+		writeError(w, r, 501, client.CodeNotImplemented, fmt.Sprintf("The plugin of controller %s does not support the configurations", controller.Name))
+		return
+	case configError != nil:
+		writePluginError(w, r, configError, fmt.Sprintf("Failed to configure lifecycle plugin for controller: %s : Error: %v", controller.Name, configError))
+		log.DEBUG.Printf("Failed to configure controller : %s : Error: %v", controller.Name, configError)
+		return
+	}
+
+	log.INFO.Printf("Controller %s of tenant %s configured at %s (CId %s) by %s", controller.Name, tenant, controller.CIL, controller.CId, IdentityFromRequest(r))
+	writeResult(w, r, "", nil)
 }
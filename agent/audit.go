@@ -0,0 +1,383 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"org.openappstack/singularity/client"
+	"org.openappstack/singularity/pluginmanager"
+	store "org.openappstack/singularity/store"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Default number of days the audit records are kept
+	defaultAuditRetentionDays = 90
+
+	// Interval between the purges of the expired audit records
+	auditPurgeInterval = time.Hour
+
+	// Maximum size of a request body summarized in an audit record
+	maxAuditBody = 64 * 1024
+
+	// Maximum length of a field value in a request summary
+	maxAuditValue = 64
+
+	// The audit record kinds
+	AuditApi    = "api"
+	AuditPlugin = "plugin"
+
+	// The audit record outcomes
+	AuditSuccess = "success"
+	AuditDenied  = "denied"
+	AuditFailure = "failure"
+)
+
+var (
+	// The request fields never written to the audit log
+	auditRedactedFields = map[string]bool{"value": true, "token": true, "password": true, "passphrase": true}
+)
+
+// The audit log configuration
+type AuditConfig struct {
+	// Days the audit records are kept, 90 if 0
+	RetentionDays int
+	// Maximum number of audit records kept, no limit if 0
+	MaxRecords int
+}
+
+// The api type, shared with the clients
+type AuditRecord = client.AuditRecord
+
+type auditKey struct{}
+
+// Records the audit trail in the kv store. The records are only ever
+// appended, and deleted once past the retention.
+type Auditor struct {
+	conf AuditConfig
+	seq  uint64
+	stop chan struct{}
+	once sync.Once
+}
+
+// Create the auditor of the configuration
+func NewAuditor(conf AuditConfig) (*Auditor, error) {
+	if conf.RetentionDays < 0 || conf.MaxRecords < 0 {
+		return nil, ConfigError("Invalid audit retention")
+	}
+	if conf.RetentionDays == 0 {
+		conf.RetentionDays = defaultAuditRetentionDays
+	}
+	return &Auditor{conf: conf, stop: make(chan struct{})}, nil
+}
+
+// Start purging the expired records periodically
+func (audit *Auditor) Start() {
+	audit.purge()
+	go func() {
+		ticker := time.NewTicker(auditPurgeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				audit.purge()
+			case <-audit.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop the purge of the expired records
+func (audit *Auditor) Stop() {
+	audit.once.Do(func() { close(audit.stop) })
+}
+
+// Get the key of a record, the records are ordered by time
+func auditRecordKey(t time.Time, seq uint64) string {
+	return fmt.Sprintf("%020d-%08d", t.UnixNano(), seq%100000000)
+}
+
+// Append a record to the audit log
+func (audit *Auditor) Record(record *AuditRecord) {
+	record.Time = time.Now().UTC()
+	record.Id = auditRecordKey(record.Time, atomic.AddUint64(&audit.seq, 1))
+	data, err := json.Marshal(record)
+	if err == nil {
+		err = mainStore.Set(store.Audit_bucket, []byte(record.Id), data)
+	}
+	if err != nil {
+		log.ERROR.Printf("Failed to record audit %s %s by %s: %v", record.Route, record.Outcome, record.Identity, err)
+	}
+}
+
+// Record a plugin event
+func (audit *Auditor) RecordPluginEvent(event pluginmanager.PluginEvent) {
+	record := &AuditRecord{
+		Kind:     AuditPlugin,
+		Identity: "system",
+		Route:    "plugin " + event.Type,
+		Summary:  fmt.Sprintf("type=%s controller=%s version=%s pid=%d", event.PluginType, event.Controller, event.Version, event.Pid),
+		Outcome:  AuditSuccess,
+		Error:    event.Error,
+	}
+	if event.Type == pluginmanager.PluginEventCrash || event.Error != "" {
+		record.Outcome = AuditFailure
+	}
+	audit.Record(record)
+}
+
+// Delete the records past the retention
+func (audit *Auditor) purge() {
+	var keys []string
+	mainStore.GetAll(store.Audit_bucket, func(k, v []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	})
+	sort.Strings(keys)
+
+	cutoff := auditRecordKey(time.Now().AddDate(0, 0, -audit.conf.RetentionDays), 0)
+	expired := sort.SearchStrings(keys, cutoff)
+	if max := audit.conf.MaxRecords; max > 0 && len(keys)-expired > max {
+		expired = len(keys) - max
+	}
+	for _, k := range keys[:expired] {
+		if err := mainStore.Del(store.Audit_bucket, []byte(k)); err != nil {
+			log.ERROR.Printf("Failed to purge audit record %s: %v", k, err)
+			return
+		}
+	}
+	if expired > 0 {
+		log.INFO.Printf("Purged %d audit records", expired)
+	}
+}
+
+// Records the status and the beginning of a response
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+func (w *auditResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *auditResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	if room := 1024 - len(w.body); room > 0 {
+		if len(data) < room {
+			room = len(data)
+		}
+		w.body = append(w.body, data[:room]...)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Wrap a handler, the mutating requests are recorded once answered. It
+// must wrap the authentication to also record the rejected requests.
+func (audit *Auditor) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		// The handlers read the whole body again and enforce its limit, only
+		// the bodies up to maxAuditBody are summarized
+		var body []byte
+		if r.Body != nil {
+			body, _ = ioutil.ReadAll(io.LimitReader(r.Body, maxRequestBody+1))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		}
+		summary := fmt.Sprintf("(%d bytes)", len(body))
+		if len(body) <= maxAuditBody {
+			summary = summarizeRequest(body)
+		}
+		record := &AuditRecord{
+			Kind:      AuditApi,
+			Identity:  "anonymous",
+			Source:    r.RemoteAddr,
+			Route:     r.Method + " " + r.URL.Path,
+			Summary:   summary,
+			RequestId: requestIdOf(r),
+		}
+		recorder := &auditResponseWriter{ResponseWriter: w}
+		handler.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), auditKey{}, record)))
+
+		record.Status = recorder.status
+		switch {
+		case record.Status == 401 || record.Status == 403:
+			record.Outcome = AuditDenied
+		case record.Status >= 400:
+			record.Outcome = AuditFailure
+		default:
+			record.Outcome = AuditSuccess
+		}
+		if record.Outcome != AuditSuccess {
+			resp := Response{}
+			if json.Unmarshal(recorder.body, &resp) == nil {
+				record.Error = resp.Message
+			}
+		}
+		audit.Record(record)
+	})
+}
+
+// Get the audit record of a request being served
+func auditRecordOf(r *http.Request) *AuditRecord {
+	record, _ := r.Context().Value(auditKey{}).(*AuditRecord)
+	return record
+}
+
+// Set the authenticated identity of a request in its audit record
+func auditIdentity(r *http.Request, identity *Identity) {
+	if record := auditRecordOf(r); record != nil {
+		record.Identity = identity.Name
+		record.Auth = identity.Method
+	}
+}
+
+// Set the tenant of a request in its audit record
+func auditTenant(r *http.Request, tenant string) {
+	if record := auditRecordOf(r); record != nil {
+		record.Tenant = tenant
+	}
+}
+
+// Set the controller targeted or created by a request in its audit record
+func auditCId(r *http.Request, cid string) {
+	if record := auditRecordOf(r); record != nil {
+		record.CId = cid
+	}
+}
+
+// Summarize a json request as its sorted top level fields, without the sensitive values
+func summarizeRequest(body []byte) string {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return ""
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return fmt.Sprintf("(%d bytes)", len(body))
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		value := string(fields[name])
+		if auditRedactedFields[strings.ToLower(name)] {
+			value = "<redacted>"
+		} else if len(value) > maxAuditValue {
+			value = value[:maxAuditValue] + "..."
+		}
+		parts = append(parts, name+"="+value)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Audit api, the records of the tenant scoped requests are restricted to the tenant:
+//
+//	GET /v1/api/audit   list the records, the parameters are
+//	  from, to : the time range (RFC 3339)
+//	  identity : the identity of the records
+//	  kind     : "api" or "plugin"
+//	  limit    : the maximum number of records, the latest ones
+//	  format   : "jsonl" to export the records as json lines
+func audit(w http.ResponseWriter, r *http.Request) {
+	log.DEBUG.Printf("Executing API - audit")
+
+	if r.Method != "GET" {
+		writeError(w, r, 405, client.CodeMethodNotAllowed, fmt.Sprintf("Unsupported request: %s %s", r.Method, r.URL.Path))
+		return
+	}
+
+	query := r.URL.Query()
+	var from, to time.Time
+	for param, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if value := query.Get(param); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				writeError(w, r, 400, client.CodeInvalidRequest, fmt.Sprintf("Invalid %s: %s", param, value))
+				return
+			}
+			*t = parsed
+		}
+	}
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			writeError(w, r, 400, client.CodeInvalidRequest, fmt.Sprintf("Invalid limit: %s", value))
+			return
+		}
+	}
+	tenant, scoped := tenantOf(r)
+	identity, kind := query.Get("identity"), query.Get("kind")
+
+	records := []AuditRecord{}
+	err := mainStore.GetAll(store.Audit_bucket, func(k, v []byte) error {
+		record := AuditRecord{}
+		if err := json.Unmarshal(v, &record); err != nil {
+			return fmt.Errorf("Corrupted audit record %s", k)
+		}
+		switch {
+		case !from.IsZero() && record.Time.Before(from), !to.IsZero() && !record.Time.Before(to):
+		case scoped && record.Tenant != tenant:
+		case identity != "" && record.Identity != identity:
+		case kind != "" && record.Kind != kind:
+		default:
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, r, 500, client.CodeInternal, fmt.Sprintf("Failed to read the audit log: %v", err))
+		return
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Id < records[j].Id })
+	if limit > 0 && len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+
+	if query.Get("format") == "jsonl" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		w.WriteHeader(200)
+		encoder := json.NewEncoder(w)
+		for _, record := range records {
+			if err := encoder.Encode(record); err != nil {
+				return
+			}
+		}
+		return
+	}
+	WriteJsonResponse(records, 200, w)
+}
+
+// Unwrap gives the http.ResponseController access to the underlying writer
+func (w *auditResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
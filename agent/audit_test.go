@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	store "org.openappstack/singularity/store"
+	"strings"
+	"testing"
+)
+
+func TestAuditLargeBody(t *testing.T) {
+	mainStore = store.NewMemStore()
+	defer func() { mainStore = nil }()
+	audit, err := NewAuditor(AuditConfig{})
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	var received []byte
+	handler := audit.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+		if err != nil {
+			w.WriteHeader(413)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	records := func() (list []AuditRecord) {
+		mainStore.GetAll(store.Audit_bucket, func(k, v []byte) error {
+			record := AuditRecord{}
+			json.Unmarshal(v, &record)
+			list = append(list, record)
+			return nil
+		})
+		return list
+	}
+
+	// The handler reads the whole body past the summarized size
+	body := []byte(`{"name": "onos", "config": "` + strings.Repeat("x", 2*maxAuditBody) + `"}`)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/v1/api/lifecycle/start", bytes.NewReader(body)))
+	if recorder.Code != 200 || !bytes.Equal(received, body) {
+		t.Errorf("Unexpected response %d, received %d of %d bytes", recorder.Code, len(received), len(body))
+	}
+	if list := records(); len(list) != 1 || list[0].Summary != fmt.Sprintf("(%d bytes)", len(body)) {
+		t.Errorf("Unexpected audit records %+v", list)
+	}
+
+	// The limit of the request bodies still applies
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/v1/api/lifecycle/start", bytes.NewReader(make([]byte, maxRequestBody+1))))
+	if recorder.Code != 413 {
+		t.Errorf("Expected the body over the limit to be refused, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/v1/api/secrets", strings.NewReader(`{"name": "db", "value": "hidden"}`)))
+	if list := records(); len(list) != 3 || list[2].Summary != "name=\"db\" value=<redacted>" {
+		t.Errorf("Unexpected audit records %+v", list)
+	}
+}
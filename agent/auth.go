@@ -0,0 +1,311 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	"net/http"
+	"org.openappstack/singularity/client"
+	store "org.openappstack/singularity/store"
+	"strings"
+	"time"
+)
+
+const (
+	// Prefix of the token hashes in the configuration
+	tokenHashPrefix = "sha256:"
+
+	// Route prefix of the token api
+	tokensPath = "/v1/api/auth/tokens/"
+
+	// The authentication methods
+	AuthNone     = "none"
+	AuthToken    = "token"
+	AuthCert     = "cert"
+	AuthListener = "listener"
+)
+
+// The authentication configuration
+type AuthConfig struct {
+	// Reject the requests without a valid token or client certificate
+	Enabled bool
+	// Tokens defined in the configuration, only their hash is stored
+	Tokens []StaticToken
+	// CA certificate file used to verify the client certificates (https only)
+	ClientCA string
+	// "require" to reject the tls connections without a client certificate,
+	// "optional" (default) to also accept the token authenticated clients
+	ClientAuth string
+	// Role bindings defined in the configuration, in addition to the stored ones
+	Bindings []RoleBinding
+}
+
+// A token defined in the configuration
+type StaticToken struct {
+	Identity string
+	// The tenant the token is restricted to, all the tenants if empty
+	Tenant string
+	// "sha256:<hex>" of the token, see "singularity auth token-hash"
+	Hash string
+}
+
+// The api types, shared with the clients
+type (
+	StoredToken     = client.StoredToken
+	TokenCreateReq  = client.TokenCreateReq
+	TokenCreateResp = client.TokenCreateResp
+)
+
+// The authenticated identity of a request
+type Identity struct {
+	Name   string
+	Method string
+	// The tenant the identity is restricted to, all the tenants if empty
+	Tenant string
+}
+
+type identityKey struct{}
+
+// Authenticates the api requests
+type Authenticator struct {
+	conf   AuthConfig
+	tokens map[string]StaticToken // hash -> token
+}
+
+// Create the authenticator of the configuration
+func NewAuthenticator(conf AuthConfig) (*Authenticator, error) {
+	auth := &Authenticator{conf: conf, tokens: make(map[string]StaticToken)}
+	for _, token := range conf.Tokens {
+		if !strings.HasPrefix(token.Hash, tokenHashPrefix) || token.Identity == "" {
+			return nil, ConfigError(fmt.Sprintf("Invalid token for identity %q, expected %s<hex>", token.Identity, tokenHashPrefix))
+		}
+		auth.tokens[strings.ToLower(strings.TrimPrefix(token.Hash, tokenHashPrefix))] = token
+	}
+	return auth, nil
+}
+
+// Hash a token as stored in the configuration and the kv store
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Generate a new random token
+func GenerateToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Get the identity of an authenticated request
+func IdentityFromRequest(r *http.Request) *Identity {
+	if identity, ok := r.Context().Value(identityKey{}).(*Identity); ok {
+		return identity
+	}
+	return &Identity{Name: "anonymous", Method: AuthNone}
+}
+
+// Get the identity of a request as logged for auditing
+func (identity *Identity) String() string {
+	if identity.Tenant != "" {
+		return fmt.Sprintf("%s(%s)@%s", identity.Name, identity.Method, identity.Tenant)
+	}
+	return fmt.Sprintf("%s(%s)", identity.Name, identity.Method)
+}
+
+// Wrap a handler, the requests reach it only once authenticated
+func (auth *Authenticator) Wrap(handler http.Handler) http.Handler {
+	return auth.WrapListener(&ListenerConfig{}, handler)
+}
+
+// Wrap a handler served on a listener, as per the listener auth policy
+func (auth *Authenticator) WrapListener(listener *ListenerConfig, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := auth.authenticate(r, listener)
+		if err != nil {
+			log.INFO.Printf("Authentication failed for %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="singularity"`)
+			writeError(w, r, 401, client.CodeUnauthenticated, "Authentication required")
+			return
+		}
+		log.INFO.Printf("API request %s %s by %s from %s", r.Method, r.URL.Path, identity, r.RemoteAddr)
+		auditIdentity(r, identity)
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+	})
+}
+
+// Get the identity of a request from its bearer token or its client certificate
+func (auth *Authenticator) authenticate(r *http.Request, listener *ListenerConfig) (*Identity, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if !strings.HasPrefix(header, "Bearer ") {
+			return nil, fmt.Errorf("unsupported authorization scheme")
+		}
+		return auth.lookupToken(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+	}
+
+	// The certificate chain is verified by the tls listener against the client CA
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		return &Identity{Name: name, Method: AuthCert, Tenant: userTenant(name)}, nil
+	}
+
+	switch {
+	case listener.AuthPolicy == ListenerAuthTrusted:
+		return &Identity{Name: listener.TrustedIdentity, Method: AuthListener, Tenant: userTenant(listener.TrustedIdentity)}, nil
+	case auth.conf.Enabled, listener.AuthPolicy == ListenerAuthRequire:
+		return nil, fmt.Errorf("no credentials")
+	}
+	return &Identity{Name: "anonymous", Method: AuthNone}, nil
+}
+
+// Get the identity owning a token
+func (auth *Authenticator) lookupToken(token string) (*Identity, error) {
+	hash := HashToken(token)
+
+	for staticHash, static := range auth.tokens {
+		if subtle.ConstantTimeCompare([]byte(staticHash), []byte(hash)) == 1 {
+			return &Identity{Name: static.Identity, Method: AuthToken, Tenant: static.Tenant}, nil
+		}
+	}
+
+	data, err := mainStore.Get(store.Tokens_bucket, []byte(hash))
+	if err != nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+	stored := &StoredToken{}
+	if err := json.Unmarshal(data, stored); err != nil {
+		return nil, fmt.Errorf("corrupted token")
+	}
+	if !stored.Expires.IsZero() && time.Now().After(stored.Expires) {
+		return nil, fmt.Errorf("expired token %s", stored.Id)
+	}
+	// The tenant of the user prevails over the tenant of its tokens
+	tenant := userTenant(stored.Identity)
+	if tenant == "" {
+		tenant = stored.Tenant
+	}
+	return &Identity{Name: stored.Identity, Method: AuthToken, Tenant: tenant}, nil
+}
+
+// Get the tenant a user is restricted to
+func userTenant(name string) string {
+	if user, err := getUser(name); err == nil {
+		return user.Tenant
+	}
+	return ""
+}
+
+// Token api. The tokens are only returned once, at creation:
+//
+//	POST   /v1/api/auth/tokens/      create a token {"identity", "tenant", "ttl"}
+//	GET    /v1/api/auth/tokens/      list the tokens (ids and identities only)
+//	DELETE /v1/api/auth/tokens/<id>  revoke a token
+func tokens(w http.ResponseWriter, r *http.Request) {
+	log.DEBUG.Printf("Executing API - tokens")
+
+	id := routeId(r, tokensPath)
+
+	switch {
+	case r.Method == "POST" && id == "":
+		createToken(w, r)
+	case r.Method == "GET" && id == "":
+		listTokens(w, r)
+	case r.Method == "DELETE" && id != "":
+		revokeToken(w, r, id)
+	default:
+		writeError(w, r, 405, client.CodeMethodNotAllowed, fmt.Sprintf("Unsupported request: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// Create a token stored in the kv store
+func createToken(w http.ResponseWriter, r *http.Request) {
+	req := &TokenCreateReq{}
+	if !decodeRequest(w, r, "TokenCreateReq", req) {
+		return
+	}
+	user, err := getUser(req.Identity)
+	if err != nil {
+		writeError(w, r, 400, client.CodeInvalidRequest, fmt.Sprintf("Unknown user: %s", req.Identity))
+		return
+	}
+	if req.Tenant == "" {
+		req.Tenant = user.Tenant
+	}
+	if req.Tenant != "" {
+		if _, err := getTenant(req.Tenant); err != nil || !identityInTenant(&Identity{Tenant: user.Tenant}, req.Tenant) {
+			writeError(w, r, 400, client.CodeInvalidRequest, fmt.Sprintf("Invalid tenant for user %s: %s", req.Identity, req.Tenant))
+			return
+		}
+	}
+
+	token, err := GenerateToken()
+	if err != nil {
+		writeError(w, r, 500, client.CodeInternal, "Failed to generate the token")
+		return
+	}
+	hash := HashToken(token)
+	stored := &StoredToken{Id: hash[:12], Identity: req.Identity, Tenant: req.Tenant, Created: time.Now().UTC()}
+	if req.TTL != "" {
+		ttl, parseErr := time.ParseDuration(req.TTL)
+		if parseErr != nil || ttl <= 0 {
+			writeError(w, r, 400, client.CodeInvalidRequest, fmt.Sprintf("Invalid ttl: %s", req.TTL))
+			return
+		}
+		stored.Expires = stored.Created.Add(ttl)
+	}
+
+	data, _ := json.Marshal(stored)
+	if err := mainStore.Set(store.Tokens_bucket, []byte(hash), data); err != nil {
+		writeError(w, r, 500, client.CodeInternal, fmt.Sprintf("Failed to store the token: %v", err))
+		return
+	}
+
+	log.INFO.Printf("Token %s created for %s by %s", stored.Id, stored.Identity, IdentityFromRequest(r))
+	WriteJsonResponse(TokenCreateResp{Id: stored.Id, Token: token}, 200, w)
+}
+
+// List the tokens stored in the kv store
+func listTokens(w http.ResponseWriter, r *http.Request) {
+	list := []StoredToken{}
+	err := mainStore.GetAll(store.Tokens_bucket, func(k, v []byte) error {
+		stored := StoredToken{}
+		if err := json.Unmarshal(v, &stored); err != nil {
+			return err
+		}
+		list = append(list, stored)
+		return nil
+	})
+	if err != nil {
+		writeError(w, r, 500, client.CodeInternal, fmt.Sprintf("Failed to list the tokens: %v", err))
+		return
+	}
+	WriteJsonResponse(list, 200, w)
+}
+
+// Revoke a token stored in the kv store
+func revokeToken(w http.ResponseWriter, r *http.Request, id string) {
+	var hash []byte
+	mainStore.GetAll(store.Tokens_bucket, func(k, v []byte) error {
+		if strings.HasPrefix(string(k), id) && len(id) == 12 {
+			hash = append([]byte{}, k...)
+		}
+		return nil
+	})
+	if hash == nil {
+		writeError(w, r, 404, client.CodeNotFound, fmt.Sprintf("Unknown token: %s", id))
+		return
+	}
+	if err := mainStore.Del(store.Tokens_bucket, hash); err != nil {
+		writeError(w, r, 500, client.CodeInternal, fmt.Sprintf("Failed to revoke the token: %v", err))
+		return
+	}
+	log.INFO.Printf("Token %s revoked by %s", id, IdentityFromRequest(r))
+	writeResult(w, r, id, nil)
+}
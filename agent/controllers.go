@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	"org.openappstack/singularity/pluginmanager"
+	store "org.openappstack/singularity/store"
+	"strconv"
+	"sync"
+)
+
+// The controllers of the agent, keyed by tenant and CId, and the running ones
+// keyed by tenant and CIL. It owns the maps, the handlers only access them
+// through its methods. The operations on a controller are serialized by the
+// controller locks, the table only keeps each access consistent.
+type controllerTable struct {
+	lock    sync.RWMutex
+	byCId   map[string]Controller
+	running map[string]Controller
+	// The quota slots of the starts in progress, by tenant
+	reserved map[string]int
+	// The next unique controller id
+	nextId int
+}
+
+// The controllers of the agent
+var controllers = newControllerTable()
+
+// Get the lifecycle plugin of a controller, replaced by the tests
+var getManagePlugin = pluginmanager.GetManagePlugin
+
+func newControllerTable() *controllerTable {
+	return &controllerTable{byCId: map[string]Controller{}, running: map[string]Controller{}, reserved: map[string]int{}}
+}
+
+// Get a controller of a tenant by CId
+func (table *controllerTable) get(tenant, cid string) (Controller, bool) {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+	controller, ok := table.byCId[controllerKey(tenant, cid)]
+	return controller, ok
+}
+
+// Get the controller running at a location of a tenant
+func (table *controllerTable) runningAt(tenant, cil string) (Controller, bool) {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+	controller, ok := table.running[controllerKey(tenant, cil)]
+	return controller, ok
+}
+
+// Count the running controllers of a tenant
+func (table *controllerTable) countRunning(tenant string) int {
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+	return table.countRunningLocked(tenant)
+}
+
+// Count the running controllers of a tenant, the table lock must be held
+func (table *controllerTable) countRunningLocked(tenant string) int {
+	count := 0
+	for _, controller := range table.running {
+		if controller.Tenant == tenant {
+			count++
+		}
+	}
+	return count
+}
+
+// Reserve a slot for a controller start of a tenant running at most max
+// controllers (no limit if 0), the running controllers and the starts in
+// progress count. False if the tenant has no slot left.
+func (table *controllerTable) reserve(tenant string, max int) bool {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	if max > 0 && table.countRunningLocked(tenant)+table.reserved[tenant] >= max {
+		return false
+	}
+	table.reserved[tenant]++
+	return true
+}
+
+// Release the slot of a controller start, once the controller runs or failed to start
+func (table *controllerTable) unreserve(tenant string) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	if table.reserved[tenant]--; table.reserved[tenant] <= 0 {
+		delete(table.reserved, tenant)
+	}
+}
+
+// Record a controller, running at its location or stopped
+func (table *controllerTable) put(controller Controller) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	table.byCId[controllerKey(controller.Tenant, controller.CId)] = controller
+	if controller.Running {
+		table.running[controllerKey(controller.Tenant, controller.CIL)] = controller
+	} else if running, ok := table.running[controllerKey(controller.Tenant, controller.CIL)]; ok && running.CId == controller.CId {
+		delete(table.running, controllerKey(controller.Tenant, controller.CIL))
+	}
+}
+
+// Set the plugin health of the running controllers served by a plugin, the
+// changed controllers are returned
+func (table *controllerTable) setPluginHealth(serves func(Controller) bool, health string) []Controller {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	var changed []Controller
+	for key, controller := range table.running {
+		if controller.PluginHealth == health || !serves(controller) {
+			continue
+		}
+		controller.PluginHealth = health
+		table.running[key] = controller
+		table.byCId[controllerKey(controller.Tenant, controller.CId)] = controller
+		changed = append(changed, controller)
+	}
+	return changed
+}
+
+// Get a new unique controller id
+func (table *controllerTable) newId() string {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	id := strconv.Itoa(table.nextId)
+	table.nextId++
+	return id
+}
+
+// Get the unique controller id
+func GetUniqueControllerID() string {
+	return controllers.newId()
+}
+
+// Store a controller in the kvstore
+func saveController(controller Controller) {
+	data, err := json.Marshal(controller)
+	if err == nil {
+		err = mainStore.Set(store.Controllers_bucket, tenantStoreKey(controller.Tenant, controller.CId), data)
+	}
+	if err != nil {
+		log.ERROR.Printf("Failed to store controller %s (CId %s): %v", controller.Name, controller.CId, err)
+	}
+}
+
+// Load the controllers stored in the kvstore and the next unique id
+func loadControllers() error {
+	table := newControllerTable()
+	err := mainStore.GetAll(store.Controllers_bucket, func(k, v []byte) error {
+		controller := Controller{}
+		if err := json.Unmarshal(v, &controller); err != nil {
+			return fmt.Errorf("Corrupted controller %s: %v", k, err)
+		}
+		table.put(controller)
+		if id, err := strconv.Atoi(controller.CId); err == nil && id >= table.nextId {
+			table.nextId = id + 1
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	controllers.lock.Lock()
+	defer controllers.lock.Unlock()
+	controllers.byCId, controllers.running, controllers.nextId = table.byCId, table.running, table.nextId
+	return nil
+}
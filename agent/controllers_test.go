@@ -0,0 +1,292 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"org.openappstack/singularity/pluginmanager"
+	store "org.openappstack/singularity/store"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A lifecycle plugin recording the controllers it runs
+type fakeManagePlugin struct {
+	lock       sync.Mutex
+	locations  map[string]string // CId -> CIL
+	running    map[string]bool   // CIL
+	violations []string
+	// Start waits for the end of the request
+	hang bool
+	// Start lasts at least delay
+	delay time.Duration
+	// The log lines of the controllers, the logs are not supported if nil
+	logs []string
+	// The secrets pushed with the configurations by CId, the configurations
+	// are not supported if nil
+	configs map[string]map[string][]byte
+}
+
+func (plugin *fakeManagePlugin) Init(ctx context.Context, controllerId string, data []byte, secrets map[string][]byte) error {
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+	plugin.locations[controllerId] = string(data)
+	return nil
+}
+
+func (plugin *fakeManagePlugin) Start(ctx context.Context, controllerId string, data []byte) error {
+	if plugin.hang {
+		<-ctx.Done()
+		return fmt.Errorf("Request to plugin could not be made: %w", ctx.Err())
+	}
+	time.Sleep(plugin.delay)
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+	cil := plugin.locations[controllerId]
+	if plugin.running[cil] {
+		plugin.violations = append(plugin.violations, "started twice at "+cil)
+	}
+	plugin.running[cil] = true
+	return nil
+}
+
+func (plugin *fakeManagePlugin) Stop(ctx context.Context, controllerId string, data []byte) error {
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+	cil := plugin.locations[controllerId]
+	if !plugin.running[cil] {
+		plugin.violations = append(plugin.violations, "stopped twice at "+cil)
+	}
+	delete(plugin.running, cil)
+	return nil
+}
+
+func (plugin *fakeManagePlugin) Configure(ctx context.Context, controllerId string, data []byte, secrets map[string][]byte) error {
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+	if plugin.configs == nil {
+		return pluginmanager.ErrNotSupported
+	}
+	plugin.configs[controllerId] = secrets
+	return nil
+}
+
+func (plugin *fakeManagePlugin) Logs(ctx context.Context, request *pluginmanager.LogsRequest, line func(*pluginmanager.LogLine) error) error {
+	if plugin.logs == nil {
+		return pluginmanager.ErrNotSupported
+	}
+	lines := plugin.logs
+	if request.Tail > 0 && request.Tail < len(lines) {
+		lines = lines[len(lines)-request.Tail:]
+	}
+	for _, text := range lines {
+		if err := line(&pluginmanager.LogLine{Time: time.Now(), Line: text}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hammer start and stop on a few locations, run with -race
+func TestConcurrentLifecycle(t *testing.T) {
+	for _, policy := range []string{ControllerOpsReject, ControllerOpsSerialize} {
+		t.Run(policy, func(t *testing.T) {
+			mainStore = store.NewMemStore()
+			saved, savedPlugin := apiService, getManagePlugin
+			defer func() { mainStore, apiService, getManagePlugin = nil, saved, savedPlugin }()
+			if err := loadControllers(); err != nil {
+				t.Fatalf("Err: %s", err)
+			}
+			apiService = &APIService{Config: &Configuration{}, authz: &Authorizer{}, operationLocks: newControllerLocks(policy)}
+			plugin := &fakeManagePlugin{locations: map[string]string{}, running: map[string]bool{}}
+			getManagePlugin = func(controller, version string) (pluginmanager.ManagePlugin, error) {
+				return plugin, nil
+			}
+
+			var wg sync.WaitGroup
+			for i := 0; i < 16; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					cil := fmt.Sprintf("/opt/onos-%d", i%3)
+					for j := 0; j < 20; j++ {
+						body := fmt.Sprintf(`{"name": "onos", "version": "1.0", "cil": %q, "deploy": "local"}`, cil)
+						recorder := httptest.NewRecorder()
+						start(recorder, httptest.NewRequest("POST", "/v2/api/lifecycle/start", strings.NewReader(body)))
+						if recorder.Code != 200 {
+							// Busy or already started, read the table meanwhile
+							runningControllers(DefaultTenant)
+							continue
+						}
+						resp := ControllerStartResp{}
+						json.Unmarshal(recorder.Body.Bytes(), &resp)
+						if _, ok := controllers.get(DefaultTenant, resp.CId); !ok {
+							t.Errorf("Started controller %s is unknown", resp.CId)
+						}
+						for {
+							recorder = httptest.NewRecorder()
+							stop(recorder, httptest.NewRequest("POST", "/v2/api/lifecycle/stop", strings.NewReader(fmt.Sprintf(`{"cid": %q}`, resp.CId))))
+							if recorder.Code != 409 {
+								break
+							}
+						}
+						if recorder.Code != 204 {
+							t.Errorf("Failed to stop controller %s: %d %s", resp.CId, recorder.Code, recorder.Body.String())
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			if len(plugin.violations) > 0 {
+				t.Errorf("Concurrent operations on a controller: %v", plugin.violations)
+			}
+			if count := runningControllers(DefaultTenant); count != 0 {
+				t.Errorf("Expected no running controllers, got %d", count)
+			}
+			if len(plugin.locations) == 0 {
+				t.Errorf("No controller was started")
+			}
+		})
+	}
+}
+
+// The concurrent starts on different locations don't exceed the quota
+func TestConcurrentQuota(t *testing.T) {
+	mainStore = store.NewMemStore()
+	saved, savedPlugin := apiService, getManagePlugin
+	defer func() { mainStore, apiService, getManagePlugin = nil, saved, savedPlugin }()
+	if err := loadControllers(); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	apiService = &APIService{Config: &Configuration{Tenants: []Tenant{{Name: DefaultTenant, MaxControllers: 2}}}, authz: &Authorizer{},
+		operationLocks: newControllerLocks(ControllerOpsReject)}
+	plugin := &fakeManagePlugin{locations: map[string]string{}, running: map[string]bool{}, delay: 20 * time.Millisecond}
+	getManagePlugin = func(controller, version string) (pluginmanager.ManagePlugin, error) {
+		return plugin, nil
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	codes := map[int]int{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"name": "onos", "version": "1.0", "cil": "/opt/onos-%d", "deploy": "local"}`, i)
+			recorder := httptest.NewRecorder()
+			start(recorder, httptest.NewRequest("POST", "/v2/api/lifecycle/start", strings.NewReader(body)))
+			lock.Lock()
+			codes[recorder.Code]++
+			lock.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	if codes[200] != 2 || codes[403] != 6 || runningControllers(DefaultTenant) != 2 {
+		t.Errorf("Expected 2 controllers started and 6 refused, got %v, %d running", codes, runningControllers(DefaultTenant))
+	}
+	if len(controllers.reserved) != 0 {
+		t.Errorf("Unexpected slots left reserved %v", controllers.reserved)
+	}
+}
+
+func TestLifecyclePluginTimeout(t *testing.T) {
+	mainStore = store.NewMemStore()
+	saved, savedPlugin := apiService, getManagePlugin
+	defer func() { mainStore, apiService, getManagePlugin = nil, saved, savedPlugin }()
+	if err := loadControllers(); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	apiService = &APIService{Config: &Configuration{}, authz: &Authorizer{}, operationLocks: newControllerLocks(ControllerOpsReject)}
+	plugin := &fakeManagePlugin{locations: map[string]string{}, running: map[string]bool{}, hang: true}
+	getManagePlugin = func(controller, version string) (pluginmanager.ManagePlugin, error) {
+		return plugin, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	body := `{"name": "onos", "version": "1.0", "cil": "/opt/onos", "deploy": "local"}`
+	recorder := httptest.NewRecorder()
+	start(recorder, httptest.NewRequest("POST", "/v2/api/lifecycle/start", strings.NewReader(body)).WithContext(ctx))
+
+	errResp := ErrorResponse{}
+	json.Unmarshal(recorder.Body.Bytes(), &errResp)
+	if recorder.Code != 504 || errResp.Code != "plugin_timeout" {
+		t.Errorf("Expected 504 plugin_timeout, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if _, ok := controllers.runningAt(DefaultTenant, "/opt/onos"); ok {
+		t.Errorf("The timed out controller is running")
+	}
+}
+
+func TestControllerConfigSecrets(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "store.key")
+	if err := store.GenerateKeyFile(keyFile); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	encrypted, err := store.NewEncryptedStore(store.NewMemStore(), store.EncryptionConfig{KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	mainStore = encrypted
+	saved, savedPlugin := apiService, getManagePlugin
+	defer func() { mainStore, apiService, getManagePlugin = nil, saved, savedPlugin }()
+	if err := loadControllers(); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	apiService = &APIService{Config: &Configuration{}, authz: &Authorizer{}, operationLocks: newControllerLocks(ControllerOpsReject)}
+	plugin := &fakeManagePlugin{locations: map[string]string{}, running: map[string]bool{}, configs: map[string]map[string][]byte{}}
+	getManagePlugin = func(controller, version string) (pluginmanager.ManagePlugin, error) {
+		return plugin, nil
+	}
+	controllers.put(Controller{Tenant: DefaultTenant, Name: "onos", Version: "1.0", CId: "1", CIL: "/opt/onos", Running: true})
+	controllers.put(Controller{Tenant: DefaultTenant, Name: "onos", Version: "1.0", CId: "2", CIL: "/opt/onos-2"})
+
+	recorder := httptest.NewRecorder()
+	secrets(recorder, httptest.NewRequest("POST", "/v1/api/secrets/", strings.NewReader(`{"name": "onos-admin", "value": "karaf"}`)))
+	if recorder.Code != 200 {
+		t.Fatalf("Unexpected response %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	push := func(body string) (int, string) {
+		recorder := httptest.NewRecorder()
+		configure(recorder, httptest.NewRequest("POST", "/v2/api/lifecycle/config", strings.NewReader(body)))
+		errResp := ErrorResponse{}
+		json.Unmarshal(recorder.Body.Bytes(), &errResp)
+		return recorder.Code, errResp.Code
+	}
+
+	// The referenced secrets reach the plugin with the configuration
+	if code, _ := push(`{"cid": "1", "config": "{}", "secrets": {"password": "onos-admin"}}`); code != 204 {
+		t.Fatalf("Unexpected response %d", code)
+	}
+	if value := plugin.configs["1"]["password"]; string(value) != "karaf" {
+		t.Errorf("Unexpected secret delivered %q", value)
+	}
+
+	for _, test := range []struct {
+		body string
+		code int
+		err  string
+	}{
+		{`{"cid": "1", "config": "{}", "secrets": {"password": "unknown"}}`, 400, "invalid_request"},
+		{`{"cid": "1"}`, 400, "invalid_request"},
+		{`{"cid": "2", "config": "{}"}`, 409, "conflict"},
+		{`{"cid": "3", "config": "{}"}`, 404, "not_found"},
+	} {
+		if code, err := push(test.body); code != test.code || err != test.err {
+			t.Errorf("Expected %d %s for %s, got %d %s", test.code, test.err, test.body, code, err)
+		}
+	}
+
+	// A plugin without configurations
+	plugin.configs = nil
+	if code, err := push(`{"cid": "1", "config": "{}"}`); code != 501 || err != "not_implemented" {
+		t.Errorf("Expected 501 not_implemented, got %d %s", code, err)
+	}
+}
@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	"net/http"
+	"org.openappstack/singularity/client"
+	"regexp"
+	"strings"
+)
+
+const (
+	// Route prefix of the v2 api, served by the v1 handlers
+	apiV2Path = "/v2/api/"
+
+	// The header carrying the request id
+	requestIdHeader = "X-Request-Id"
+)
+
+var (
+	// The request ids accepted from the clients
+	requestIdRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+)
+
+// The api types, shared with the clients
+type (
+	ErrorResponse = client.ErrorResponse
+	ErrorDetail   = client.ErrorDetail
+)
+
+type apiVersionKey struct{}
+
+type requestIdKey struct{}
+
+// Get the api version of a request, 1 or 2
+func apiVersion(r *http.Request) int {
+	if version, ok := r.Context().Value(apiVersionKey{}).(int); ok {
+		return version
+	}
+	if strings.HasPrefix(r.URL.Path, apiV2Path) {
+		return 2
+	}
+	return 1
+}
+
+// Get the id of a request
+func requestIdOf(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdKey{}).(string)
+	return id
+}
+
+// Wrap a handler, the requests get the client X-Request-Id, or a new one,
+// which is returned in the response
+func withRequestId(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIdHeader)
+		if !requestIdRegexp.MatchString(id) {
+			random := make([]byte, 8)
+			rand.Read(random)
+			id = hex.EncodeToString(random)
+		}
+		w.Header().Set(requestIdHeader, id)
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)))
+	})
+}
+
+// Serve the v2 api with the v1 handlers. The handlers see the request on
+// the v1 path with the version set in the context.
+func (api *APIService) v2Router(mux *http.ServeMux) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		versioned := r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, 2))
+		v1Url := *r.URL
+		v1Url.Path = apiPath + strings.TrimPrefix(r.URL.Path, apiV2Path)
+		v1Url.RawPath = ""
+		versioned.URL = &v1Url
+		mux.ServeHTTP(w, versioned)
+	}
+}
+
+// Write a failed request, as a Response in v1 and an ErrorResponse in v2
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	writeErrorDetails(w, r, status, code, message, nil)
+}
+
+// Write a failed request with its details
+func writeErrorDetails(w http.ResponseWriter, r *http.Request, status int, code, message string, details []ErrorDetail) {
+	if status >= 500 {
+		log.ERROR.Printf("API request %s %s (request id %s) failed: %s", r.Method, r.URL.Path, requestIdOf(r), message)
+	}
+	if apiVersion(r) == 1 {
+		WriteJsonResponse(Response{Success: "false", Message: message}, status, w)
+		return
+	}
+	WriteJsonResponse(ErrorResponse{Code: code, Message: message, Details: details, RequestId: requestIdOf(r)}, status, w)
+}
+
+// Write a failed plugin request, 504 if the plugin missed its deadline
+func writePluginError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeError(w, r, http.StatusGatewayTimeout, client.CodePluginTimeout, message)
+		return
+	}
+	writeError(w, r, http.StatusBadGateway, client.CodePluginFailure, message)
+}
+
+// Write a successful request, as a Response with the message in v1 and as
+// the result in v2 (204 No Content if nil)
+func writeResult(w http.ResponseWriter, r *http.Request, message string, result interface{}) {
+	switch {
+	case apiVersion(r) == 1:
+		WriteJsonResponse(Response{Success: "true", Message: message}, 200, w)
+	case result == nil:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		WriteJsonResponse(result, 200, w)
+	}
+}
+
+// Write an unsupported method of a route
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request, allowed []string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, r, http.StatusMethodNotAllowed, client.CodeMethodNotAllowed, fmt.Sprintf("Unsupported request: %s %s", r.Method, r.URL.Path))
+}
+
+// Write an unknown api path
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, client.CodeNotFound, fmt.Sprintf("Unknown api path: %s", r.URL.Path))
+}
+
+// Wrap a route handler, the request reaches it only if its method is
+// allowed. The item methods apply to the sub paths of a prefix route.
+func allowMethods(prefix string, methods, itemMethods []string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		allowed := methods
+		if prefix != "" && routeId(r, prefix) != "" {
+			allowed = itemMethods
+		}
+		for _, method := range allowed {
+			if r.Method == method {
+				handler(w, r)
+				return
+			}
+		}
+		writeMethodNotAllowed(w, r, allowed)
+	}
+}
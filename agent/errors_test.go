@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"org.openappstack/singularity/client"
+	"testing"
+)
+
+func TestErrorModel(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/api/things/", allowMethods("/v1/api/things/", []string{"GET"}, []string{"DELETE"}, func(w http.ResponseWriter, r *http.Request) {
+		if routeId(r, "/v1/api/things/") == "" {
+			writeError(w, r, 404, client.CodeNotFound, "Unknown thing")
+			return
+		}
+		writeResult(w, r, "deleted", nil)
+	}))
+	mux.HandleFunc(apiV2Path, (&APIService{}).v2Router(mux))
+	handler := withRequestId(mux)
+
+	serve := func(method, path, requestId string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if requestId != "" {
+			req.Header.Set(requestIdHeader, requestId)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// v1 keeps the Response body
+	resp := serve("GET", "/v1/api/things/", "")
+	v1 := Response{}
+	if resp.Code != 404 || resp.Header().Get("Content-Type") != "application/json" || resp.Header().Get(requestIdHeader) == "" {
+		t.Fatalf("Unexpected v1 response %d %v", resp.Code, resp.Header())
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &v1); err != nil || v1.Success != "false" || v1.Message != "Unknown thing" {
+		t.Fatalf("Unexpected v1 body %s", resp.Body.String())
+	}
+
+	// v2 returns an ErrorResponse with the request id
+	resp = serve("GET", "/v2/api/things/", "req-1")
+	v2 := ErrorResponse{}
+	if err := json.Unmarshal(resp.Body.Bytes(), &v2); err != nil || resp.Code != 404 || v2.Code != client.CodeNotFound || v2.RequestId != "req-1" {
+		t.Fatalf("Unexpected v2 response %d %s", resp.Code, resp.Body.String())
+	}
+
+	// The methods are checked per route
+	resp = serve("POST", "/v2/api/things/", "")
+	if resp.Code != 405 || resp.Header().Get("Allow") != "GET" {
+		t.Fatalf("Unexpected response to an unsupported method %d %v", resp.Code, resp.Header())
+	}
+	if json.Unmarshal(resp.Body.Bytes(), &v2) != nil || v2.Code != client.CodeMethodNotAllowed {
+		t.Fatalf("Unexpected v2 body %s", resp.Body.String())
+	}
+
+	// v2 answers 204 without result, v1 a Response
+	if resp = serve("DELETE", "/v2/api/things/a", ""); resp.Code != 204 {
+		t.Fatalf("Unexpected v2 delete response %d", resp.Code)
+	}
+	if resp = serve("DELETE", "/v1/api/things/a", ""); resp.Code != 200 {
+		t.Fatalf("Unexpected v1 delete response %d", resp.Code)
+	}
+}
@@ -1,10 +1,13 @@
 package agent
 
 import (
-	"crypto/rand"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
@@ -23,8 +26,12 @@ type HttpHandlerRegistrar interface {
 // in a RESTful manner
 type HTTPServer struct {
 	mux      *http.ServeMux
+	handler  http.Handler
 	listener net.Listener
 	addr     string
+	server   *http.Server
+	// Reloads the certificates (https only)
+	certs *certReloader
 }
 
 // configuration for the http server
@@ -35,6 +42,82 @@ type HttpConfiguration struct {
 	Registrar HttpHandlerRegistrar
 	Cert      string
 	Key       string
+	// Optional middleware wrapping the mux (e.g. authentication)
+	Middleware func(http.Handler) http.Handler
+	// Optional CA certificate to verify the client certificates (https only)
+	ClientCA string
+	// "require" to reject the clients without certificate, "optional" otherwise
+	ClientAuth string
+	// The TLS versions, ciphers, protocols and certificates (https only)
+	TLS TLSConfig
+	// Optional ownership and mode of the unix socket
+	Socket FilePermissions
+	// The server limits, no limit if 0
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+}
+
+// The http server limits as configured, the durations are e.g. "30s"
+type ServerConfig struct {
+	ReadTimeout       string
+	ReadHeaderTimeout string
+	WriteTimeout      string
+	IdleTimeout       string
+	MaxHeaderBytes    int
+	// Time the in-flight requests are waited for at shutdown
+	ShutdownTimeout string
+}
+
+// The default http server limits
+var defaultServerConfig = ServerConfig{
+	ReadTimeout:       "30s",
+	ReadHeaderTimeout: "10s",
+	WriteTimeout:      "60s",
+	IdleTimeout:       "120s",
+	MaxHeaderBytes:    64 * 1024,
+	ShutdownTimeout:   "30s",
+}
+
+// Parse a configured duration, the default is used if empty
+func parseDuration(name, value, def string) (time.Duration, error) {
+	if value == "" {
+		value = def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, ConfigError(fmt.Sprintf("Invalid %s: %s", name, value))
+	}
+	return d, nil
+}
+
+// Set the server limits of a http configuration
+func (conf ServerConfig) apply(config *HttpConfiguration) error {
+	var err error
+	if config.ReadTimeout, err = parseDuration("ReadTimeout", conf.ReadTimeout, defaultServerConfig.ReadTimeout); err != nil {
+		return err
+	}
+	if config.ReadHeaderTimeout, err = parseDuration("ReadHeaderTimeout", conf.ReadHeaderTimeout, defaultServerConfig.ReadHeaderTimeout); err != nil {
+		return err
+	}
+	if config.WriteTimeout, err = parseDuration("WriteTimeout", conf.WriteTimeout, defaultServerConfig.WriteTimeout); err != nil {
+		return err
+	}
+	if config.IdleTimeout, err = parseDuration("IdleTimeout", conf.IdleTimeout, defaultServerConfig.IdleTimeout); err != nil {
+		return err
+	}
+	config.MaxHeaderBytes = conf.MaxHeaderBytes
+	if config.MaxHeaderBytes == 0 {
+		config.MaxHeaderBytes = defaultServerConfig.MaxHeaderBytes
+	}
+	return nil
+}
+
+// Get the shutdown timeout
+func (conf ServerConfig) shutdownTimeout() (time.Duration, error) {
+	return parseDuration("ShutdownTimeout", conf.ShutdownTimeout, defaultServerConfig.ShutdownTimeout)
 }
 
 // unixSocketAddr tests if a given address describes a domain socket,
@@ -124,7 +207,7 @@ GROUP:
 }
 
 // Create a listener as per the http configuration
-func getListener(httpAddr net.Addr, config *HttpConfiguration) (net.Listener, error) {
+func getListener(httpAddr net.Addr, config *HttpConfiguration) (net.Listener, *certReloader, error) {
 
 	if config.Mode == "http" {
 		socketPath, isSocket := unixSocketAddr(config.Address)
@@ -133,35 +216,63 @@ func getListener(httpAddr net.Addr, config *HttpConfiguration) (net.Listener, er
 				fmt.Printf("[WARN] agent: Replacing socket %q", socketPath)
 			}
 			if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
-				return nil, fmt.Errorf("error removing socket file: %s", err)
+				return nil, nil, fmt.Errorf("error removing socket file: %s", err)
 			}
 		}
 
 		ln, err := net.Listen(httpAddr.Network(), httpAddr.String())
 		if err != nil {
-			return nil, fmt.Errorf("Failed to get Listen on %s: %v", httpAddr.String(), err)
+			return nil, nil, fmt.Errorf("Failed to get Listen on %s: %v", httpAddr.String(), err)
 		}
 		var listener net.Listener
 		if isSocket {
+			if config.Socket != nil {
+				if err := setFilePermissions(socketPath, config.Socket); err != nil {
+					ln.Close()
+					return nil, nil, fmt.Errorf("Failed to set the socket permissions: %v", err)
+				}
+			}
 			listener = ln
 		} else {
 			listener = tcpKeepAliveListener{ln.(*net.TCPListener)}
 		}
-		return listener, nil
+		return listener, nil, nil
 	} else {
-		cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+		tlsConfig, certs, err := buildTLSConfig(config)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to load Certificate : %v", err)
+			return nil, nil, err
 		}
-		tlsConfig := tls.Config{Certificates: []tls.Certificate{cert}}
-		tlsConfig.Rand = rand.Reader
 		service := httpAddr.String()
-		listener, err := tls.Listen("tcp", service, &tlsConfig)
+		listener, err := tls.Listen("tcp", service, tlsConfig)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to get Listen on %s: %v", httpAddr.String(), err)
+			certs.Stop()
+			return nil, nil, fmt.Errorf("Failed to get Listen on %s: %v", httpAddr.String(), err)
 		}
-		return listener, nil
+		return listener, certs, nil
+	}
+}
+
+// Configure the verification of the client certificates
+func setClientAuth(tlsConfig *tls.Config, config *HttpConfiguration) error {
+	pem, err := ioutil.ReadFile(config.ClientCA)
+	if err != nil {
+		return fmt.Errorf("Failed to load client CA : %v", err)
 	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("Invalid client CA : %s", config.ClientCA)
+	}
+	tlsConfig.ClientCAs = pool
+
+	switch config.ClientAuth {
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case "", "optional":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return fmt.Errorf("Invalid client auth : %s", config.ClientAuth)
+	}
+	return nil
 }
 
 // Create a new HTTP Server
@@ -169,7 +280,7 @@ func NewHTTPServer(config *HttpConfiguration) (*HTTPServer, error) {
 
 	var server *HTTPServer
 
-	if config.Port > 0 {
+	if _, isSocket := unixSocketAddr(config.Address); config.Port > 0 || isSocket {
 
 		httpAddr, err := getListenerAddr(config.Address, config.Port)
 		if err != nil {
@@ -177,7 +288,7 @@ func NewHTTPServer(config *HttpConfiguration) (*HTTPServer, error) {
 		}
 
 		// Get listener for the Http server
-		listener, err := getListener(httpAddr, config)
+		listener, certs, err := getListener(httpAddr, config)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to set Listner: %s", err)
 		}
@@ -188,8 +299,24 @@ func NewHTTPServer(config *HttpConfiguration) (*HTTPServer, error) {
 		// Create the server
 		server = &HTTPServer{
 			mux:      mux,
+			handler:  mux,
 			listener: listener,
 			addr:     httpAddr.String(),
+			certs:    certs,
+		}
+		if config.Middleware != nil {
+			server.handler = config.Middleware(mux)
+		}
+		server.server = &http.Server{
+			Handler:           server.handler,
+			ReadTimeout:       config.ReadTimeout,
+			ReadHeaderTimeout: config.ReadHeaderTimeout,
+			WriteTimeout:      config.WriteTimeout,
+			IdleTimeout:       config.IdleTimeout,
+			MaxHeaderBytes:    config.MaxHeaderBytes,
+		}
+		if config.TLS.DisableHTTP2 {
+			server.server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
 		}
 
 		// register the http handlers
@@ -219,17 +346,25 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 // Start the http Server
 func (s *HTTPServer) Start() {
 
-	go http.Serve(s.listener, s.mux)
+	go func() {
+		if err := s.server.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+			log.ERROR.Printf("http: Server (%v) failed: %v", s.addr, err)
+		}
+	}()
 
 }
 
-// Shutdown is used to shutdown the HTTP server
-func (s *HTTPServer) Shutdown() error {
+// Shutdown is used to shutdown the HTTP server. It stops accepting the
+// connections and waits for the in-flight requests until the context is
+// done, the remaining connections are then closed.
+func (s *HTTPServer) Shutdown(ctx context.Context) error {
 	if s != nil {
-		fmt.Printf("[DEBUG] http: Shutting down http server (%v)\n", s.addr)
-		err := s.listener.Close()
+		log.DEBUG.Printf("http: Shutting down http server (%v)", s.addr)
+		s.certs.Stop()
+		err := s.server.Shutdown(ctx)
 		if err != nil {
-			fmt.Printf("[ERROR] Failed to close http listener: %v\n", err)
+			log.ERROR.Printf("http: Failed to drain the http server (%v): %v", s.addr, err)
+			s.server.Close()
 			return err
 		}
 	}
@@ -243,8 +378,8 @@ func WriteJsonResponse(v interface{}, code int, w http.ResponseWriter) error {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return err
 	}
-	w.WriteHeader(code)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
 	w.Write(js)
 	return nil
 }
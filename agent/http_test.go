@@ -1,8 +1,11 @@
 package agent
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"testing"
+	"time"
 )
 
 var httpServ *HTTPServer
@@ -16,18 +19,18 @@ const (
 	keyFile    = "../conf/key.pem"
 )
 
-type APIService struct {
+type testRegistrar struct {
 }
 
-func (service APIService) Register(s *HTTPServer) {
+func (service testRegistrar) Register(s *HTTPServer) {
 	fmt.Printf("Registering the http server")
 }
 
 func TestHttpServerCreation(t *testing.T) {
-	var service APIService
+	var service testRegistrar
 	var serverErr error
 
-	service = APIService{}
+	service = testRegistrar{}
 
 	httpServConf := &HttpConfiguration{
 		Mode:      "http",
@@ -48,7 +51,7 @@ func TestHttpServerCreation(t *testing.T) {
 }
 
 func TestHttpsServerCreation(t *testing.T) {
-	var service APIService
+	var service testRegistrar
 	var serverErr error
 
 	httpServConf := &HttpConfiguration{
@@ -71,7 +74,7 @@ func TestHttpsServerCreation(t *testing.T) {
 
 func TestHttpServerStop(t *testing.T) {
 	var serverErr error
-	serverErr = httpServ.Shutdown()
+	serverErr = httpServ.Shutdown(context.Background())
 	if serverErr != nil {
 		t.Fatalf("Server stop failed. Err: %s", serverErr)
 	}
@@ -79,8 +82,67 @@ func TestHttpServerStop(t *testing.T) {
 
 func TestHttpsServerStop(t *testing.T) {
 	var serverErr error
-	serverErr = httpsServ.Shutdown()
+	serverErr = httpsServ.Shutdown(context.Background())
 	if serverErr != nil {
 		t.Fatalf("Server stop failed. Err: %s", serverErr)
 	}
 }
+
+type slowRegistrar struct {
+	started chan struct{}
+}
+
+func (service slowRegistrar) Register(s *HTTPServer) {
+	s.mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(service.started)
+		time.Sleep(200 * time.Millisecond)
+		WriteJsonResponse(Response{Success: "true", Message: "done"}, 200, w)
+	})
+}
+
+func TestHttpServerShutdownDrains(t *testing.T) {
+	service := slowRegistrar{started: make(chan struct{})}
+	server, err := NewHTTPServer(&HttpConfiguration{
+		Mode:      "http",
+		Address:   address,
+		Port:      8183,
+		Registrar: service,
+	})
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	server.Start()
+	saved, savedServers := apiService, apiServers
+	defer func() { apiService, apiServers = saved, savedServers }()
+	audit, _ := NewAuditor(AuditConfig{})
+	idempotency, _ := NewIdempotency(IdempotencyConfig{})
+	apiService = &APIService{closing: make(chan struct{}), audit: audit, idempotency: idempotency}
+	apiServers = []*HTTPServer{server}
+
+	result := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + server.addr + "/slow")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != 200 {
+				err = fmt.Errorf("status %d", resp.StatusCode)
+			}
+		}
+		result <- err
+	}()
+	<-service.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := apiService.Stop(ctx); err != nil {
+		t.Fatalf("Server shutdown failed. Err: %s", err)
+	}
+	if err := <-result; err != nil {
+		t.Fatalf("The in-flight request was dropped: %v", err)
+	}
+	select {
+	case <-serviceClosing():
+	default:
+		t.Fatalf("The service is not closing after the stop")
+	}
+}
@@ -0,0 +1,231 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	"io/ioutil"
+	"net/http"
+	"org.openappstack/singularity/client"
+	store "org.openappstack/singularity/store"
+	"sync"
+	"time"
+)
+
+const (
+	// Default retention of the idempotency keys
+	defaultIdempotencyTTL = "24h"
+
+	// Interval between the purges of the expired idempotency keys
+	idempotencyPurgeInterval = time.Hour
+
+	// The header of the idempotency keys, and of the replayed responses
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+
+	// Maximum length of an idempotency key
+	maxIdempotencyKey = 255
+)
+
+// The idempotency keys configuration
+type IdempotencyConfig struct {
+	// The retention of the keys e.g. "24h"
+	TTL string
+}
+
+// The result of a request, cached by idempotency key
+type idempotentResult struct {
+	RequestHash string    `json:"requestHash"`
+	Status      int       `json:"status"`
+	Body        []byte    `json:"body"`
+	Created     time.Time `json:"created"`
+}
+
+// Caches the results of the successful requests made with an Idempotency-Key
+// in the kv store, the retries get the cached result
+type Idempotency struct {
+	ttl      time.Duration
+	lock     sync.Mutex
+	inflight map[string]bool
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// Create the idempotency cache of the configuration
+func NewIdempotency(conf IdempotencyConfig) (*Idempotency, error) {
+	ttl, err := parseDuration("Idempotency TTL", conf.TTL, defaultIdempotencyTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &Idempotency{ttl: ttl, inflight: map[string]bool{}, stop: make(chan struct{})}, nil
+}
+
+// Start purging the expired keys periodically
+func (idem *Idempotency) Start() {
+	idem.purge()
+	go func() {
+		ticker := time.NewTicker(idempotencyPurgeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				idem.purge()
+			case <-idem.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop the purge of the expired keys
+func (idem *Idempotency) Stop() {
+	idem.once.Do(func() { close(idem.stop) })
+}
+
+// Delete the expired keys
+func (idem *Idempotency) purge() {
+	var expired []string
+	mainStore.GetAll(store.Idempotency_bucket, func(k, v []byte) error {
+		result := &idempotentResult{}
+		if json.Unmarshal(v, result) != nil || idem.expired(result) {
+			expired = append(expired, string(k))
+		}
+		return nil
+	})
+	for _, k := range expired {
+		if err := mainStore.Del(store.Idempotency_bucket, []byte(k)); err != nil {
+			log.ERROR.Printf("Failed to purge idempotency key %s: %v", k, err)
+			return
+		}
+	}
+	if len(expired) > 0 {
+		log.INFO.Printf("Purged %d idempotency keys", len(expired))
+	}
+}
+
+// Check if a cached result is past the retention
+func (idem *Idempotency) expired(result *idempotentResult) bool {
+	return time.Since(result.Created) > idem.ttl
+}
+
+// Get the storage key of an idempotency key, the keys are scoped to the
+// tenant and the identity of the request
+func idempotencyStoreKey(r *http.Request, key string) []byte {
+	hash := sha256.Sum256([]byte(IdentityFromRequest(r).Name + "\x00" + key))
+	return tenantStoreKey(tenantFromRequest(r), hex.EncodeToString(hash[:]))
+}
+
+// Get the hash of a request, a key is only replayed for the same request
+func idempotencyRequestHash(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "v%d %s %s\n", apiVersion(r), r.Method, r.URL.Path)
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Get the cached result of a key, if not expired
+func (idem *Idempotency) lookup(storeKey []byte) (*idempotentResult, bool) {
+	data, err := mainStore.Get(store.Idempotency_bucket, storeKey)
+	if err != nil {
+		return nil, false
+	}
+	result := &idempotentResult{}
+	if json.Unmarshal(data, result) != nil || idem.expired(result) {
+		return nil, false
+	}
+	return result, true
+}
+
+// Records the status and the body of a response
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *idempotencyRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *idempotencyRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+// Get the wrapped writer, e.g. for http.ResponseController
+func (w *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Wrap a route handler, the requests with an Idempotency-Key are served once
+// and their retries get the cached result
+func (idem *Idempotency) Wrap(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if idem == nil || key == "" {
+			handler(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			writeErrorDetails(w, r, 400, client.CodeInvalidRequest, "Invalid request: the Idempotency-Key is too long",
+				[]ErrorDetail{{Field: idempotencyKeyHeader, Message: fmt.Sprintf("must be at most %d characters long", maxIdempotencyKey)}})
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+		if err != nil {
+			writeError(w, r, http.StatusRequestEntityTooLarge, client.CodeInvalidRequest, "Invalid request: the body is too large")
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		storeKey := idempotencyStoreKey(r, key)
+		requestHash := idempotencyRequestHash(r, body)
+
+		idem.lock.Lock()
+		if idem.inflight[string(storeKey)] {
+			idem.lock.Unlock()
+			writeError(w, r, 409, client.CodeConflict, "A request with this Idempotency-Key is in progress")
+			return
+		}
+		if result, ok := idem.lookup(storeKey); ok {
+			idem.lock.Unlock()
+			if result.RequestHash != requestHash {
+				writeError(w, r, 409, client.CodeConflict, "The Idempotency-Key was used for a different request")
+				return
+			}
+			log.INFO.Printf("Replaying the result of %s %s for idempotency key %q", r.Method, r.URL.Path, key)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set(idempotentReplayedHeader, "true")
+			w.WriteHeader(result.Status)
+			w.Write(result.Body)
+			return
+		}
+		idem.inflight[string(storeKey)] = true
+		idem.lock.Unlock()
+		defer func() {
+			idem.lock.Lock()
+			delete(idem.inflight, string(storeKey))
+			idem.lock.Unlock()
+		}()
+
+		recorder := &idempotencyRecorder{ResponseWriter: w}
+		handler(recorder, r)
+
+		// Only the successes are cached, a failed request may be retried
+		if recorder.status == 0 || recorder.status >= 300 {
+			return
+		}
+		data, _ := json.Marshal(&idempotentResult{RequestHash: requestHash, Status: recorder.status, Body: recorder.body.Bytes(), Created: time.Now().UTC()})
+		if err := mainStore.Set(store.Idempotency_bucket, storeKey, data); err != nil {
+			log.ERROR.Printf("Failed to store the result of idempotency key %q: %v", key, err)
+		}
+	}
+}
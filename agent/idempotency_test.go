@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	store "org.openappstack/singularity/store"
+	"strings"
+	"testing"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	mainStore = store.NewMemStore()
+	defer func() { mainStore = nil }()
+
+	idem, err := NewIdempotency(IdempotencyConfig{})
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	calls := 0
+	fail := false
+	handler := idem.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if fail {
+			WriteJsonResponse(ErrorResponse{Code: "plugin_failure"}, 502, w)
+			return
+		}
+		WriteJsonResponse(ControllerStartResp{CId: "1"}, 200, w)
+	})
+
+	serve := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v2/api/lifecycle/start", strings.NewReader(body))
+		req.Header.Set(idempotencyKeyHeader, key)
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		return recorder
+	}
+
+	first := serve("retry-1", `{"name": "onos"}`)
+	retry := serve("retry-1", `{"name": "onos"}`)
+	if calls != 1 || retry.Code != 200 || retry.Body.String() != first.Body.String() || retry.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Fatalf("The retry was not replayed: %d calls, %d %s", calls, retry.Code, retry.Body.String())
+	}
+
+	if resp := serve("retry-1", `{"name": "other"}`); resp.Code != 409 || calls != 1 {
+		t.Fatalf("The key was reused for a different request: %d", resp.Code)
+	}
+
+	// The failures are not cached
+	fail = true
+	serve("retry-2", `{"name": "onos"}`)
+	fail = false
+	if resp := serve("retry-2", `{"name": "onos"}`); resp.Code != 200 || calls != 3 {
+		t.Fatalf("A failed request was replayed: %d, %d calls", resp.Code, calls)
+	}
+
+	// Without a key every request is served
+	handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/v2/api/lifecycle/start", strings.NewReader(`{}`)))
+	if calls != 4 {
+		t.Fatalf("A request without key was not served")
+	}
+}
@@ -0,0 +1,216 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	"math"
+	"net"
+	"net/http"
+	"org.openappstack/singularity/client"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// The policies of the concurrent operations on a controller
+	ControllerOpsReject    = "reject"    // answer 409 while an operation is in progress
+	ControllerOpsSerialize = "serialize" // wait for the in-progress operation
+
+	// Minimum interval between the sweeps of the idle clients of a rate limiter
+	rateLimitSweepInterval = time.Minute
+)
+
+// The api rate and concurrency limits
+type LimitsConfig struct {
+	// Requests per second per client (its identity, or its address if
+	// anonymous) and the burst above the rate, 0 for no limit
+	RequestRate  float64
+	RequestBurst int
+	// Lifecycle requests per second per client and their burst, 0 for no limit
+	LifecycleRate  float64
+	LifecycleBurst int
+	// Maximum number of lifecycle operations in progress, 0 for no limit
+	MaxLifecycleOperations int
+	// The concurrent operations on a controller: "reject" (default) or "serialize"
+	ControllerOperations string
+}
+
+// Check the limits are well formed
+func (conf *LimitsConfig) validate() error {
+	switch {
+	case conf.RequestRate < 0 || conf.RequestBurst < 0 || conf.LifecycleRate < 0 || conf.LifecycleBurst < 0 || conf.MaxLifecycleOperations < 0:
+		return ConfigError("Invalid Limits: the rates, bursts and maximums can't be negative")
+	case conf.ControllerOperations != "" && conf.ControllerOperations != ControllerOpsReject && conf.ControllerOperations != ControllerOpsSerialize:
+		return ConfigError(fmt.Sprintf("Invalid Limits: unknown ControllerOperations %q", conf.ControllerOperations))
+	}
+	return nil
+}
+
+// A token bucket of a client
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limits the rate of the requests of each client with a token bucket
+type RateLimiter struct {
+	rate      float64
+	burst     float64
+	lock      sync.Mutex
+	clients   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// Create a rate limiter, nil (no limit) if the rate is 0. The burst is at
+// least 1 request.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimiter{rate: rate, burst: math.Max(float64(burst), 1), clients: map[string]*tokenBucket{}}
+}
+
+// Take a token of a client, or get the wait until the next one
+func (limiter *RateLimiter) take(client string, now time.Time) (bool, time.Duration) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	if now.Sub(limiter.lastSweep) > rateLimitSweepInterval {
+		limiter.sweep(now)
+	}
+	bucket, ok := limiter.clients[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: limiter.burst, last: now}
+		limiter.clients[client] = bucket
+	}
+	bucket.tokens = math.Min(limiter.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*limiter.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / limiter.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// Forget the clients whose bucket is full again
+func (limiter *RateLimiter) sweep(now time.Time) {
+	refill := time.Duration(limiter.burst / limiter.rate * float64(time.Second))
+	for client, bucket := range limiter.clients {
+		if now.Sub(bucket.last) > refill {
+			delete(limiter.clients, client)
+		}
+	}
+	limiter.lastSweep = now
+}
+
+// Get the client of a request for the rate limits, its identity if
+// authenticated and its address otherwise
+func rateLimitClient(r *http.Request) string {
+	if identity := IdentityFromRequest(r); identity.Method != AuthNone {
+		return "identity:" + identity.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "address:" + host
+}
+
+// Wrap a handler, the requests above the rate of their client are answered
+// 429 with a Retry-After. It must be wrapped by the authentication.
+func (limiter *RateLimiter) Wrap(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if limiter == nil {
+			handler(w, r)
+			return
+		}
+		client := rateLimitClient(r)
+		if ok, wait := limiter.take(client, time.Now()); !ok {
+			log.DEBUG.Printf("Rate limited %s %s from %s", r.Method, r.URL.Path, client)
+			writeRateLimited(w, r, wait, "Too many requests, retry later")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Write a rate limited request
+func writeRateLimited(w http.ResponseWriter, r *http.Request, wait time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, r, http.StatusTooManyRequests, client.CodeRateLimited, message)
+}
+
+// Serializes the operations on each controller
+type controllerLocks struct {
+	serialize bool
+	lock      sync.Mutex
+	held      map[string]chan struct{}
+}
+
+func newControllerLocks(policy string) *controllerLocks {
+	return &controllerLocks{serialize: policy == ControllerOpsSerialize, held: map[string]chan struct{}{}}
+}
+
+// Lock a controller, waiting for the in-progress operation if serialized.
+// Returns false if the controller is busy or the request is cancelled.
+func (locks *controllerLocks) acquire(ctx context.Context, key string) (func(), bool) {
+	for {
+		locks.lock.Lock()
+		busy, held := locks.held[key]
+		if !held {
+			done := make(chan struct{})
+			locks.held[key] = done
+			locks.lock.Unlock()
+			return func() {
+				locks.lock.Lock()
+				delete(locks.held, key)
+				locks.lock.Unlock()
+				close(done)
+			}, true
+		}
+		locks.lock.Unlock()
+		if !locks.serialize {
+			return nil, false
+		}
+		select {
+		case <-busy:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// Lock a controller of a tenant by location for a lifecycle operation. The
+// refusal is written to the response.
+func (service *APIService) lockController(w http.ResponseWriter, r *http.Request, tenant, cil string) (func(), bool) {
+	release, ok := service.operationLocks.acquire(r.Context(), controllerKey(tenant, cil))
+	if !ok && r.Context().Err() == nil {
+		writeError(w, r, 409, client.CodeConflict, fmt.Sprintf("An operation on the controller at %s is in progress", cil))
+	}
+	return release, ok
+}
+
+// Begin a lifecycle operation, within the maximum of in-progress operations.
+// The refusal is written to the response.
+func (service *APIService) lifecycleOperation(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	if !service.beginOperation() {
+		writeError(w, r, 503, client.CodeUnavailable, "The agent is shutting down")
+		return nil, false
+	}
+	if service.operationSlots == nil {
+		return service.endOperation, true
+	}
+	select {
+	case service.operationSlots <- struct{}{}:
+		return func() {
+			<-service.operationSlots
+			service.endOperation()
+		}, true
+	default:
+		service.endOperation()
+		writeRateLimited(w, r, time.Second, "Too many lifecycle operations in progress, retry later")
+		return nil, false
+	}
+}
@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.take("a", now); !ok {
+			t.Fatalf("Request %d within the burst was limited", i)
+		}
+	}
+	ok, wait := limiter.take("a", now)
+	if ok || wait <= 0 || wait > 500*time.Millisecond {
+		t.Errorf("Expected a limit with a wait of at most 500ms, got %v %v", ok, wait)
+	}
+	if ok, _ := limiter.take("b", now); !ok {
+		t.Errorf("Another client was limited")
+	}
+	if ok, _ := limiter.take("a", now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("The bucket was not refilled")
+	}
+
+	limiter.sweep(now.Add(time.Hour))
+	if len(limiter.clients) != 0 {
+		t.Errorf("Expected the idle clients to be swept, got %d", len(limiter.clients))
+	}
+	if NewRateLimiter(0, 10) != nil {
+		t.Errorf("Expected no limiter for a zero rate")
+	}
+}
+
+func TestRateLimiterWrap(t *testing.T) {
+	limiter := NewRateLimiter(1, 1)
+	handler := limiter.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	})
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v2/api/tenants", nil)
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		return recorder
+	}
+	if code := serve().Code; code != 204 {
+		t.Fatalf("Expected 204, got %d", code)
+	}
+	limited := serve()
+	if limited.Code != http.StatusTooManyRequests || limited.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 with Retry-After 1, got %d %q", limited.Code, limited.Header().Get("Retry-After"))
+	}
+}
+
+func TestControllerLocks(t *testing.T) {
+	locks := newControllerLocks(ControllerOpsReject)
+	release, ok := locks.acquire(context.Background(), "t/cil")
+	if !ok {
+		t.Fatalf("Failed to lock a free controller")
+	}
+	if _, ok := locks.acquire(context.Background(), "t/cil"); ok {
+		t.Errorf("Locked a busy controller")
+	}
+	if other, ok := locks.acquire(context.Background(), "t/other"); !ok {
+		t.Errorf("Failed to lock another controller")
+	} else {
+		other()
+	}
+	release()
+	if again, ok := locks.acquire(context.Background(), "t/cil"); !ok {
+		t.Errorf("Failed to lock a released controller")
+	} else {
+		again()
+	}
+
+	locks = newControllerLocks(ControllerOpsSerialize)
+	release, _ = locks.acquire(context.Background(), "t/cil")
+	acquired := make(chan bool)
+	go func() {
+		_, ok := locks.acquire(context.Background(), "t/cil")
+		acquired <- ok
+	}()
+	time.Sleep(10 * time.Millisecond)
+	release()
+	if !<-acquired {
+		t.Errorf("The serialized operation failed to lock the controller")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, ok := locks.acquire(ctx, "t/cil"); ok {
+		t.Errorf("Locked a busy controller past the request deadline")
+	}
+}
@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// The listener authentication policies
+	ListenerAuthDefault = ""        // as per the Auth configuration
+	ListenerAuthRequire = "require" // reject the requests without credentials
+	ListenerAuthTrusted = "trusted" // accept the requests without credentials as TrustedIdentity
+)
+
+// A listener of the api, in addition to or instead of Mode/Host/Port
+type ListenerConfig struct {
+	// Name of the listener in the logs, its address by default
+	Name string
+	// "http" or "https"
+	Mode string
+	// An IP address, or unix:///path/to/socket (http mode only)
+	Address string
+	Port    int
+	// Owner, group id and mode (e.g. "0660") of the unix socket
+	SocketUser  string
+	SocketGroup string
+	SocketMode  string
+	// The authentication policy: "" as per Auth, "require" or "trusted"
+	AuthPolicy string
+	// The identity of the requests without credentials (trusted policy only)
+	TrustedIdentity string
+	// Overrides Auth.ClientAuth for this listener (https only)
+	ClientAuth string
+}
+
+// The unix socket permissions of a listener
+type socketPermissions struct {
+	listener *ListenerConfig
+}
+
+func (p socketPermissions) User() string  { return p.listener.SocketUser }
+func (p socketPermissions) Group() string { return p.listener.SocketGroup }
+func (p socketPermissions) Mode() string  { return p.listener.SocketMode }
+
+// Get the configured listeners, the legacy Mode/Host/Port is the only
+// listener if none is configured
+func (configuration *Configuration) listeners() []ListenerConfig {
+	if len(configuration.Listeners) > 0 {
+		return configuration.Listeners
+	}
+	return []ListenerConfig{{Mode: configuration.Mode, Address: configuration.Host, Port: configuration.Port}}
+}
+
+// Check a listener is well formed, clientAuth is the client certificate
+// policy of the listeners without their own
+func (listener *ListenerConfig) validate(clientAuth string) error {
+	_, isSocket := unixSocketAddr(listener.Address)
+	if listener.ClientAuth != "" {
+		clientAuth = listener.ClientAuth
+	}
+	switch {
+	case listener.Mode != "http" && listener.Mode != "https":
+		return ConfigError(fmt.Sprintf("Invalid listener %s: unknown mode %q", listener.name(), listener.Mode))
+	case isSocket && listener.Mode != "http":
+		return ConfigError(fmt.Sprintf("Invalid listener %s: unix sockets are only supported in http mode", listener.name()))
+	case !isSocket && listener.Port <= 0:
+		return ConfigError(fmt.Sprintf("Invalid listener %s: a port is required", listener.name()))
+	case listener.AuthPolicy != ListenerAuthDefault && listener.AuthPolicy != ListenerAuthRequire && listener.AuthPolicy != ListenerAuthTrusted:
+		return ConfigError(fmt.Sprintf("Invalid listener %s: unknown auth policy %q", listener.name(), listener.AuthPolicy))
+	case listener.AuthPolicy == ListenerAuthTrusted && listener.TrustedIdentity == "":
+		return ConfigError(fmt.Sprintf("Invalid listener %s: the trusted policy requires a TrustedIdentity", listener.name()))
+	case listener.AuthPolicy == ListenerAuthTrusted && !isSocket && !(listener.Mode == "https" && clientAuth == "require"):
+		// Every network client would run as the trusted identity
+		return ConfigError(fmt.Sprintf("Invalid listener %s: the trusted policy requires a unix socket or client certificates (ClientAuth \"require\")", listener.name()))
+	}
+	return nil
+}
+
+// Get the name of a listener in the logs
+func (listener *ListenerConfig) name() string {
+	if listener.Name != "" {
+		return listener.Name
+	}
+	if strings.HasPrefix(listener.Address, "unix://") {
+		return listener.Address
+	}
+	return fmt.Sprintf("%s://%s:%d", listener.Mode, listener.Address, listener.Port)
+}
+
+// Build the http configuration of a listener
+func (service *APIService) listenerConfig(listener ListenerConfig, base HttpConfiguration) *HttpConfiguration {
+	config := base
+	config.Mode = listener.Mode
+	config.Address = listener.Address
+	config.Port = listener.Port
+	if listener.ClientAuth != "" {
+		config.ClientAuth = listener.ClientAuth
+	}
+	if path, isSocket := unixSocketAddr(listener.Address); isSocket {
+		if !filepath.IsAbs(path) {
+			config.Address = "unix://" + filepath.Join(startPath, path)
+		}
+		if listener.SocketUser != "" || listener.SocketGroup != "" || listener.SocketMode != "" {
+			config.Socket = socketPermissions{&listener}
+		}
+	}
+	config.Middleware = func(handler http.Handler) http.Handler {
+		return withRequestId(service.audit.Wrap(service.auth.WrapListener(&listener, service.limiter.Wrap(handler.ServeHTTP))))
+	}
+	return &config
+}
@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenerValidation(t *testing.T) {
+	valid := []ListenerConfig{
+		{Mode: "https", Address: "127.0.0.1", Port: 8083},
+		{Mode: "http", Address: "unix:///tmp/singularity.sock", AuthPolicy: ListenerAuthTrusted, TrustedIdentity: "local-admin"},
+		{Mode: "https", Address: "127.0.0.1", Port: 8083, AuthPolicy: ListenerAuthTrusted, TrustedIdentity: "local-admin", ClientAuth: "require"},
+	}
+	for _, listener := range valid {
+		if err := listener.validate(""); err != nil {
+			t.Fatalf("Valid listener %s rejected: %v", listener.name(), err)
+		}
+	}
+
+	invalid := []ListenerConfig{
+		{Mode: "https", Address: "unix:///tmp/singularity.sock"},
+		{Mode: "http", Address: "127.0.0.1"},
+		{Mode: "ftp", Address: "127.0.0.1", Port: 21},
+		{Mode: "http", Address: "unix:///tmp/singularity.sock", AuthPolicy: ListenerAuthTrusted},
+		{Mode: "http", Address: "127.0.0.1", Port: 8083, AuthPolicy: "maybe"},
+		{Mode: "http", Address: "127.0.0.1", Port: 8083, AuthPolicy: ListenerAuthTrusted, TrustedIdentity: "local-admin"},
+		{Mode: "https", Address: "127.0.0.1", Port: 8083, AuthPolicy: ListenerAuthTrusted, TrustedIdentity: "local-admin", ClientAuth: "optional"},
+	}
+	for _, listener := range invalid {
+		if err := listener.validate(""); err == nil {
+			t.Fatalf("Invalid listener %s accepted", listener.name())
+		}
+	}
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "api.sock")
+	listener := ListenerConfig{Mode: "http", Address: "unix://" + socket, SocketMode: "0600"}
+
+	config := &HttpConfiguration{
+		Mode:      listener.Mode,
+		Address:   listener.Address,
+		Registrar: testRegistrar{},
+		Socket:    socketPermissions{&listener},
+	}
+	server, err := NewHTTPServer(config)
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	server.mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		WriteJsonResponse(Response{Success: "true", Message: "pong"}, 200, w)
+	})
+	server.Start()
+	defer server.Shutdown(context.Background())
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("Socket mode is %v, expected 0600", info.Mode().Perm())
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://singularity/ping")
+	if err != nil {
+		t.Fatalf("Request over the socket failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Unexpected status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"org.openappstack/singularity/client"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// A path parameter e.g. "{name}"
+var pathParam = regexp.MustCompile(`\{[a-z]+\}`)
+
+// Normalize a route so that a registered route and its spec path are equal
+func normalizeRoute(path string, methods []string) string {
+	sorted := append([]string{}, methods...)
+	sort.Strings(sorted)
+	return strings.TrimSuffix(pathParam.ReplaceAllString(path, "{}"), "/") + " " + strings.Join(sorted, ",")
+}
+
+func TestOpenAPISpecMatchesRoutes(t *testing.T) {
+	spec := struct {
+		Paths map[string]map[string]interface{} `json:"paths"`
+	}{}
+	if err := json.Unmarshal(client.OpenAPISpec(), &spec); err != nil {
+		t.Fatalf("Invalid spec: %v", err)
+	}
+
+	api := &APIService{}
+	api.Register(&HTTPServer{mux: http.NewServeMux()})
+
+	routes := map[string]bool{}
+	for _, route := range api.routes {
+		routes[normalizeRoute(route.path, route.methods)] = true
+	}
+	documented := map[string]bool{}
+	for path, operations := range spec.Paths {
+		var methods []string
+		for method := range operations {
+			methods = append(methods, strings.ToUpper(method))
+		}
+		documented[normalizeRoute(path, methods)] = true
+	}
+
+	var missing, undocumented []string
+	for route := range routes {
+		if !documented[route] {
+			undocumented = append(undocumented, route)
+		}
+	}
+	for path := range documented {
+		if !routes[path] {
+			missing = append(missing, path)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(undocumented)
+	if len(undocumented) > 0 {
+		t.Errorf("Routes missing from the OpenAPI spec: %v", undocumented)
+	}
+	if len(missing) > 0 {
+		t.Errorf("OpenAPI spec paths without a route: %v", missing)
+	}
+}
@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	"net/http"
+	"org.openappstack/singularity/client"
+	"org.openappstack/singularity/pluginmanager"
+	store "org.openappstack/singularity/store"
+	"strconv"
+	"time"
+)
+
+// The api types, shared with the clients
+type OperationProgress = client.OperationProgress
+type LogLine = client.LogLine
+
+// Record the progress reported by the plugin of a lifecycle operation, the
+// clients follow it by watching the operations bucket
+func recordProgress(controller *Controller, operation string, progress *pluginmanager.Progress) {
+	log.DEBUG.Printf("Controller %s (CId %s) %s: %d%% %s", controller.Name, controller.CId, operation, progress.Percent, progress.Message)
+
+	data, err := json.Marshal(&OperationProgress{CId: controller.CId, Name: controller.Name, CIL: controller.CIL, Operation: operation, Percent: progress.Percent, Message: progress.Message, Updated: time.Now()})
+	if err == nil {
+		err = mainStore.Set(store.Operations_bucket, tenantStoreKey(controller.Tenant, controller.CId), data)
+	}
+	if err != nil {
+		log.ERROR.Printf("Failed to record the progress of controller %s (CId %s): %v", controller.Name, controller.CId, err)
+	}
+}
+
+// Remove the progress of an ended lifecycle operation
+func endProgress(controller *Controller) {
+	if err := mainStore.Del(store.Operations_bucket, tenantStoreKey(controller.Tenant, controller.CId)); err != nil {
+		log.ERROR.Printf("Failed to remove the progress of controller %s (CId %s): %v", controller.Name, controller.CId, err)
+	}
+}
+
+// Remove the progress of the operations interrupted by a restart of the agent
+func clearOperations() error {
+	var keys [][]byte
+	err := mainStore.GetAll(store.Operations_bucket, func(k, v []byte) error {
+		keys = append(keys, append([]byte(nil), k...))
+		return nil
+	})
+	for _, key := range keys {
+		if err == nil {
+			err = mainStore.Del(store.Operations_bucket, key)
+		}
+	}
+	return err
+}
+
+// Stream the log lines of a controller as json lines. The request parameters are
+//
+//	cid    : the controller id
+//	follow : if "true" the new lines are streamed until the client leaves
+//	tail   : the number of the last lines to start with (all if 0)
+func logs(w http.ResponseWriter, r *http.Request) {
+	log.DEBUG.Printf("Executing API - logs")
+
+	query := r.URL.Query()
+	cid := query.Get("cid")
+	if cid == "" {
+		writeError(w, r, 400, client.CodeInvalidRequest, "Missing controller id")
+		return
+	}
+	tail := 0
+	if t := query.Get("tail"); t != "" {
+		var parseErr error
+		if tail, parseErr = strconv.Atoi(t); parseErr != nil || tail < 0 {
+			writeError(w, r, 400, client.CodeInvalidRequest, fmt.Sprintf("Invalid tail: %s", t))
+			return
+		}
+	}
+	follow := query.Get("follow") == "true"
+
+	tenant := tenantFromRequest(r)
+	controller, ok := controllers.get(tenant, cid)
+	if !ok {
+		writeError(w, r, 404, client.CodeNotFound, fmt.Sprintf("Controller not found: %s", cid))
+		return
+	}
+	if !authorizeResource(w, r, ActionRead, &Resource{Tenant: tenant, Controller: controller.Name, CId: controller.CId}) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, 500, client.CodeInternal, "Streaming is not supported")
+		return
+	}
+
+	lifecyclePlugin, pluginerr := getManagePlugin(controller.Name, controller.Version)
+	if pluginerr != nil {
+		writeError(w, r, 502, client.CodePluginFailure, fmt.Sprintf("failed to load proper plugin for controller: %s of Version: %s : Error: %v", controller.Name, controller.Version, pluginerr))
+		return
+	}
+
+	// The stream ends with the client or with the service
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	closing := serviceClosing()
+	go func() {
+		select {
+		case <-closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if follow {
+		// The stream outlasts the server write timeout, until the client leaves
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	}
+
+	// The header is written with the first line, the errors of the plugin
+	// are answered until then
+	started := false
+	begin := func() {
+		if !started {
+			started = true
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(200)
+		}
+	}
+	encoder := json.NewEncoder(w)
+	logsErr := lifecyclePlugin.Logs(ctx, &pluginmanager.LogsRequest{ControllerId: controller.CId, Follow: follow, Tail: tail}, func(line *pluginmanager.LogLine) error {
+		begin()
+		if err := encoder.Encode(&LogLine{Time: line.Time, Line: line.Line}); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	switch {
+	case logsErr == nil || started:
+		if logsErr != nil {
+			log.DEBUG.Printf("Logs stream of controller %s (CId %s) ended: %v", controller.Name, controller.CId, logsErr)
+		}
+		begin()
+	case errors.Is(logsErr, pluginmanager.ErrNotSupported):
+		writeError(w, r, 501, client.CodeNotImplemented, fmt.Sprintf("The plugin of controller %s does not support the logs", controller.Name))
+	default:
+		writePluginError(w, r, logsErr, fmt.Sprintf("Failed to get the logs of controller: %s : Error: %v", controller.Name, logsErr))
+		log.DEBUG.Printf("Failed to get the logs of controller : %s : Error: %v", controller.Name, logsErr)
+	}
+}
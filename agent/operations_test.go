@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"org.openappstack/singularity/pluginmanager"
+	store "org.openappstack/singularity/store"
+	"testing"
+)
+
+func TestOperationProgress(t *testing.T) {
+	mainStore = store.NewMemStore()
+	defer func() { mainStore = nil }()
+
+	controller := &Controller{Tenant: DefaultTenant, Name: "onos", CId: "7", CIL: "/opt/onos"}
+	recordProgress(controller, "start", &pluginmanager.Progress{Percent: 40, Message: "pulling image"})
+
+	data, err := mainStore.Get(store.Operations_bucket, tenantStoreKey(DefaultTenant, "7"))
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	progress := OperationProgress{}
+	if err := json.Unmarshal(data, &progress); err != nil || progress.Percent != 40 || progress.Operation != "start" || progress.CIL != "/opt/onos" {
+		t.Errorf("Unexpected progress %s %v", data, err)
+	}
+
+	endProgress(controller)
+	if data, _ := mainStore.Get(store.Operations_bucket, tenantStoreKey(DefaultTenant, "7")); data != nil {
+		t.Errorf("The progress of the ended operation is kept: %s", data)
+	}
+
+	// The operations interrupted by a restart are cleared
+	recordProgress(controller, "start", &pluginmanager.Progress{Percent: 10})
+	if err := clearOperations(); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if data, _ := mainStore.Get(store.Operations_bucket, tenantStoreKey(DefaultTenant, "7")); data != nil {
+		t.Errorf("The interrupted operation is kept: %s", data)
+	}
+}
+
+func TestControllerLogs(t *testing.T) {
+	mainStore = store.NewMemStore()
+	saved, savedPlugin := apiService, getManagePlugin
+	defer func() { mainStore, apiService, getManagePlugin = nil, saved, savedPlugin }()
+	if err := loadControllers(); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	apiService = &APIService{Config: &Configuration{}, authz: &Authorizer{}}
+	plugin := &fakeManagePlugin{locations: map[string]string{}, running: map[string]bool{}, logs: []string{"one", "two", "three"}}
+	getManagePlugin = func(controller, version string) (pluginmanager.ManagePlugin, error) {
+		return plugin, nil
+	}
+	controllers.put(Controller{Tenant: DefaultTenant, Name: "onos", Version: "1.0", CId: "1", CIL: "/opt/onos", Running: true})
+
+	recorder := httptest.NewRecorder()
+	logs(recorder, httptest.NewRequest("GET", "/v2/api/lifecycle/logs?cid=1&tail=2", nil))
+	if recorder.Code != 200 || recorder.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Unexpected response %d %s", recorder.Code, recorder.Body.String())
+	}
+	var lines []string
+	scanner := bufio.NewScanner(recorder.Body)
+	for scanner.Scan() {
+		line := LogLine{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("Err: %s", err)
+		}
+		lines = append(lines, line.Line)
+	}
+	if len(lines) != 2 || lines[0] != "two" || lines[1] != "three" {
+		t.Errorf("Unexpected log lines %v", lines)
+	}
+
+	for _, test := range []struct {
+		query string
+		code  int
+		err   string
+	}{
+		{"tail=1", 400, "invalid_request"},
+		{"cid=1&tail=-1", 400, "invalid_request"},
+		{"cid=2", 404, "not_found"},
+	} {
+		recorder = httptest.NewRecorder()
+		logs(recorder, httptest.NewRequest("GET", "/v2/api/lifecycle/logs?"+test.query, nil))
+		errResp := ErrorResponse{}
+		json.Unmarshal(recorder.Body.Bytes(), &errResp)
+		if recorder.Code != test.code || errResp.Code != test.err {
+			t.Errorf("Expected %d %s for %q, got %d %s", test.code, test.err, test.query, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	// A plugin without logs
+	plugin.logs = nil
+	recorder = httptest.NewRecorder()
+	logs(recorder, httptest.NewRequest("GET", "/v2/api/lifecycle/logs?cid=1", nil))
+	errResp := ErrorResponse{}
+	json.Unmarshal(recorder.Body.Bytes(), &errResp)
+	if recorder.Code != 501 || errResp.Code != "not_implemented" {
+		t.Errorf("Expected 501 not_implemented, got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
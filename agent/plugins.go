@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	"net/http"
+	"org.openappstack/singularity/client"
+	"org.openappstack/singularity/pluginmanager"
+	"strings"
+)
+
+const (
+	// The plugins api, by controller name
+	pluginsPath = "/v1/api/plugins/"
+)
+
+// The api type, shared with the clients
+type PluginHealth = client.PluginHealth
+
+// Get the health of the plugins of a controller, replaced by the tests
+var getPluginHealth = pluginmanager.GetPluginHealth
+
+// Record the health changes of a plugin on the running controllers it serves,
+// the clients follow them by watching the controllers bucket
+func recordPluginHealth(event pluginmanager.PluginEvent) {
+	var health string
+	switch event.Type {
+	case pluginmanager.PluginEventHealthy:
+		health = pluginmanager.PluginHealthy
+	case pluginmanager.PluginEventUnhealthy:
+		health = pluginmanager.PluginUnhealthy
+	default:
+		return
+	}
+	served := controllers.setPluginHealth(func(controller Controller) bool {
+		return event.Serves(controller.Name, controller.Version)
+	}, health)
+	for _, controller := range served {
+		log.INFO.Printf("Plugin of controller %s (CId %s) is %s", controller.Name, controller.CId, health)
+		saveController(controller)
+	}
+}
+
+// Get the controller name of a plugin health path, empty for the other paths
+func pluginHealthName(r *http.Request) string {
+	rest := strings.TrimPrefix(r.URL.Path, pluginsPath)
+	name := strings.TrimSuffix(rest, "/health")
+	if name == rest || strings.Contains(name, "/") {
+		return ""
+	}
+	return name
+}
+
+// Route the plugins api, the unknown paths are not found whatever the method
+func pluginsRouter(health http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if pluginHealthName(r) == "" {
+			notFound(w, r)
+			return
+		}
+		health(w, r)
+	}
+}
+
+// Get the health of the loaded plugins of a controller, an empty list if
+// the plugin is discovered but not loaded yet
+func pluginHealth(w http.ResponseWriter, r *http.Request) {
+	log.DEBUG.Printf("Executing API - pluginHealth")
+
+	name := pluginHealthName(r)
+	if !authorizeResource(w, r, ActionRead, &Resource{Tenant: tenantFromRequest(r), Controller: name}) {
+		return
+	}
+
+	healths, err := getPluginHealth(name)
+	if errors.Is(err, pluginmanager.ErrPluginNotFound) {
+		writeError(w, r, 404, client.CodeNotFound, fmt.Sprintf("No plugin for controller: %s", name))
+		return
+	}
+	if err != nil {
+		writeError(w, r, 500, client.CodeInternal, fmt.Sprintf("Failed to get the plugin health of controller %s: %v", name, err))
+		return
+	}
+
+	result := make([]PluginHealth, 0, len(healths))
+	for _, health := range healths {
+		result = append(result, PluginHealth{
+			Controller: health.Controller,
+			Version:    health.Version,
+			Status:     health.Status,
+			Pid:        health.Pid,
+			Protocol:   health.Protocol,
+			Failures:   health.Failures,
+			LastCheck:  health.LastCheck,
+			LastError:  health.LastError,
+			Reloads:    health.Reloads,
+		})
+	}
+	WriteJsonResponse(result, 200, w)
+}
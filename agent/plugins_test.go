@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"org.openappstack/singularity/pluginmanager"
+	store "org.openappstack/singularity/store"
+	"testing"
+)
+
+func TestPluginHealth(t *testing.T) {
+	saved, savedHealth := apiService, getPluginHealth
+	defer func() { apiService, getPluginHealth = saved, savedHealth }()
+	apiService = &APIService{Config: &Configuration{}, authz: &Authorizer{}}
+	getPluginHealth = func(controller string) ([]pluginmanager.PluginHealth, error) {
+		switch controller {
+		case "onos":
+			return []pluginmanager.PluginHealth{{Controller: "onos", Version: "1.0", Status: pluginmanager.PluginUnhealthy, Pid: 42, Failures: 3, LastError: "timeout", Reloads: 1}}, nil
+		case "odl":
+			return []pluginmanager.PluginHealth{}, nil
+		}
+		return nil, pluginmanager.ErrPluginNotFound
+	}
+	handler := pluginsRouter(pluginHealth)
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/v1/api/plugins/onos/health", nil))
+	var healths []PluginHealth
+	if err := json.Unmarshal(recorder.Body.Bytes(), &healths); err != nil || recorder.Code != 200 {
+		t.Fatalf("Unexpected response %d %s", recorder.Code, recorder.Body.String())
+	}
+	if len(healths) != 1 || healths[0].Status != "unhealthy" || healths[0].Pid != 42 || healths[0].Reloads != 1 {
+		t.Errorf("Unexpected health %+v", healths)
+	}
+
+	for _, test := range []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/v1/api/plugins/odl/health", 200, "[]"},
+		{"/v1/api/plugins/other/health", 404, ""},
+		{"/v1/api/plugins/onos", 404, ""},
+		{"/v1/api/plugins/onos/1.0/health", 404, ""},
+	} {
+		recorder = httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest("GET", test.path, nil))
+		if recorder.Code != test.code || (test.body != "" && recorder.Body.String() != test.body) {
+			t.Errorf("Expected %d for %s, got %d %s", test.code, test.path, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestRecordPluginHealth(t *testing.T) {
+	mainStore = store.NewMemStore()
+	defer func() { mainStore = nil }()
+	if err := loadControllers(); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	controllers.put(Controller{Tenant: DefaultTenant, Name: "onos", Version: "1.0", CId: "1", CIL: "/opt/onos", Running: true})
+	controllers.put(Controller{Tenant: DefaultTenant, Name: "onos", Version: "2.0", CId: "2", CIL: "/opt/onos2", Running: true})
+	controllers.put(Controller{Tenant: DefaultTenant, Name: "onos", Version: "1.0", CId: "3", CIL: "/opt/onos3"})
+
+	recordPluginHealth(pluginmanager.PluginEvent{Type: pluginmanager.PluginEventUnhealthy, Controller: "onos", Version: "1.0"})
+	for cid, expected := range map[string]string{"1": "unhealthy", "2": "", "3": ""} {
+		if controller, _ := controllers.get(DefaultTenant, cid); controller.PluginHealth != expected {
+			t.Errorf("Expected plugin health %q of controller %s, got %q", expected, cid, controller.PluginHealth)
+		}
+	}
+	data, err := mainStore.Get(store.Controllers_bucket, tenantStoreKey(DefaultTenant, "1"))
+	stored := Controller{}
+	if err != nil || json.Unmarshal(data, &stored) != nil || stored.PluginHealth != "unhealthy" {
+		t.Errorf("Unexpected stored controller %s %v", data, err)
+	}
+	if controller, _ := controllers.runningAt(DefaultTenant, "/opt/onos"); controller.PluginHealth != "unhealthy" {
+		t.Errorf("Unexpected running controller %+v", controller)
+	}
+
+	// The other plugin events don't change the controllers
+	recordPluginHealth(pluginmanager.PluginEvent{Type: pluginmanager.PluginEventLoad, Controller: "onos", Version: "1.0"})
+	recordPluginHealth(pluginmanager.PluginEvent{Type: pluginmanager.PluginEventHealthy, Controller: "onos", Version: "1.0"})
+	if controller, _ := controllers.get(DefaultTenant, "1"); controller.PluginHealth != "healthy" {
+		t.Errorf("Unexpected controller %+v", controller)
+	}
+}
@@ -0,0 +1,367 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	"net/http"
+	"org.openappstack/singularity/client"
+	store "org.openappstack/singularity/store"
+	"strings"
+	"time"
+)
+
+const (
+	// The actions a role may be allowed to perform
+	ActionRead    = "read"    // read the state
+	ActionOperate = "operate" // start and stop controllers
+	ActionAdmin   = "admin"   // manage secrets, users, tokens and bindings
+
+	// The roles
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+
+	// Route prefixes of the user and binding apis
+	usersPath    = "/v1/api/auth/users/"
+	bindingsPath = "/v1/api/auth/bindings/"
+)
+
+var (
+	// The actions allowed per role
+	roleActions = map[string][]string{
+		RoleViewer:   {ActionRead},
+		RoleOperator: {ActionRead, ActionOperate},
+		RoleAdmin:    {ActionRead, ActionOperate, ActionAdmin},
+	}
+)
+
+// The api types, shared with the clients
+type (
+	Scope       = client.Scope
+	RoleBinding = client.RoleBinding
+	User        = client.User
+)
+
+// The resource targeted by a request
+type Resource struct {
+	Tenant     string
+	Controller string
+	CId        string
+}
+
+// Authorizes the identities as per their role bindings, from the
+// configuration and from the kv store
+type Authorizer struct {
+	enabled  bool
+	bindings []RoleBinding
+}
+
+// Create the authorizer of the configuration
+func NewAuthorizer(conf AuthConfig) (*Authorizer, error) {
+	for _, binding := range conf.Bindings {
+		if err := validateBinding(&binding); err != nil {
+			return nil, ConfigError(err.Error())
+		}
+	}
+	return &Authorizer{enabled: conf.Enabled, bindings: conf.Bindings}, nil
+}
+
+// Check a binding is well formed
+func validateBinding(binding *RoleBinding) error {
+	if binding.Identity == "" {
+		return fmt.Errorf("Invalid role binding: identity is required")
+	}
+	if _, ok := roleActions[binding.Role]; !ok {
+		return fmt.Errorf("Invalid role binding: unknown role %q", binding.Role)
+	}
+	return nil
+}
+
+// Check if a list is empty or contains a value. An empty value matches any list.
+func matchScope(list []string, value string) bool {
+	if len(list) == 0 || value == "" {
+		return true
+	}
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a scope restricts nothing
+func unscoped(scope *Scope) bool {
+	return len(scope.Tenants) == 0 && len(scope.Controllers) == 0 && len(scope.CIds) == 0
+}
+
+// Check if a scope covers a resource for an action. A nil resource only
+// checks the role, except for the administration of the agent (users,
+// tokens, bindings, tenants, audit) reserved to the unscoped bindings: a
+// scoped admin would otherwise bind itself an unscoped role.
+func scopeCovers(scope *Scope, action string, resource *Resource) bool {
+	if resource == nil {
+		return action != ActionAdmin || unscoped(scope)
+	}
+	return matchScope(scope.Tenants, resource.Tenant) && matchScope(scope.Controllers, resource.Controller) &&
+		matchScope(scope.CIds, resource.CId)
+}
+
+// Check if a role allows an action
+func roleAllows(role, action string) bool {
+	for _, allowed := range roleActions[role] {
+		if allowed == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Get all the bindings of an identity
+func (authz *Authorizer) bindingsOf(name string) []RoleBinding {
+	var result []RoleBinding
+	for _, binding := range authz.bindings {
+		if binding.Identity == name {
+			result = append(result, binding)
+		}
+	}
+	mainStore.GetAll(store.Bindings_bucket, func(k, v []byte) error {
+		binding := RoleBinding{}
+		if json.Unmarshal(v, &binding) == nil && binding.Identity == name {
+			result = append(result, binding)
+		}
+		return nil
+	})
+	return result
+}
+
+// Check if an identity may perform an action on a resource
+func (authz *Authorizer) Allowed(identity *Identity, action string, resource *Resource) bool {
+	if !authz.enabled {
+		return true
+	}
+	if user, err := getUser(identity.Name); err == nil && user.Disabled {
+		return false
+	}
+	if resource != nil && !identityInTenant(identity, resource.Tenant) {
+		return false
+	}
+	// The administration of the agent (users, tokens, tenants) is reserved
+	// to the identities not restricted to a tenant
+	if resource == nil && identity.Tenant != "" && action == ActionAdmin {
+		return false
+	}
+	for _, binding := range authz.bindingsOf(identity.Name) {
+		if roleAllows(binding.Role, action) && scopeCovers(&binding.Scope, action, resource) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap a route handler, the request reaches it only if the identity may
+// perform the action on some resource (of the tenant of a tenant scoped
+// request). The GET requests need readAction, the others writeAction.
+func (authz *Authorizer) Wrap(readAction, writeAction string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action := writeAction
+		if r.Method == "GET" || r.Method == "HEAD" {
+			action = readAction
+		}
+		identity := IdentityFromRequest(r)
+		var resource *Resource
+		if tenant, scoped := tenantOf(r); scoped {
+			resource = &Resource{Tenant: tenant}
+		}
+		if !authz.Allowed(identity, action, resource) {
+			log.INFO.Printf("Access denied to %s for %s %s", identity, r.Method, r.URL.Path)
+			writeError(w, r, 403, client.CodeForbidden, fmt.Sprintf("Access denied: %s is not allowed to %s", identity.Name, action))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Check if the identity of a request may perform an action on a resource.
+// The denial is written to the response.
+func authorizeResource(w http.ResponseWriter, r *http.Request, action string, resource *Resource) bool {
+	identity := IdentityFromRequest(r)
+	if apiService.authz.Allowed(identity, action, resource) {
+		return true
+	}
+	log.INFO.Printf("Access denied to %s for %s on controller %q (CId %q) of tenant %s", identity, action, resource.Controller, resource.CId, resource.Tenant)
+	writeError(w, r, 403, client.CodeForbidden, fmt.Sprintf("Access denied: %s is not allowed to %s this controller", identity.Name, action))
+	return false
+}
+
+// Get an api user
+func getUser(name string) (*User, error) {
+	data, err := mainStore.Get(store.Users_bucket, []byte(name))
+	if err != nil {
+		return nil, err
+	}
+	user := &User{}
+	if err := json.Unmarshal(data, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Get the last path element of a route with a prefix, empty for the route itself
+func routeId(r *http.Request, prefix string) string {
+	if r.URL.Path == strings.TrimSuffix(prefix, "/") {
+		return ""
+	}
+	return strings.TrimPrefix(r.URL.Path, prefix)
+}
+
+// User api:
+//
+//	POST   /v1/api/auth/users/        create or update a user {"name", "tenant", "disabled"}
+//	GET    /v1/api/auth/users/        list the users
+//	DELETE /v1/api/auth/users/<name>  delete a user, its tokens and bindings
+func users(w http.ResponseWriter, r *http.Request) {
+	log.DEBUG.Printf("Executing API - users")
+
+	name := routeId(r, usersPath)
+	switch {
+	case r.Method == "POST" && name == "":
+		user := &User{}
+		if !decodeRequest(w, r, "User", user) {
+			return
+		}
+		if user.Tenant != "" {
+			if _, err := getTenant(user.Tenant); err != nil {
+				writeError(w, r, 400, client.CodeInvalidRequest, fmt.Sprintf("Unknown tenant: %s", user.Tenant))
+				return
+			}
+		}
+		user.Created = time.Now().UTC()
+		if old, err := getUser(user.Name); err == nil {
+			user.Created = old.Created
+		}
+		data, _ := json.Marshal(user)
+		if err := mainStore.Set(store.Users_bucket, []byte(user.Name), data); err != nil {
+			writeError(w, r, 500, client.CodeInternal, fmt.Sprintf("Failed to store the user: %v", err))
+			return
+		}
+		log.INFO.Printf("User %s (tenant: %q, disabled: %v) saved by %s", user.Name, user.Tenant, user.Disabled, IdentityFromRequest(r))
+		writeResult(w, r, user.Name, user)
+	case r.Method == "GET" && name == "":
+		list := []User{}
+		err := mainStore.GetAll(store.Users_bucket, func(k, v []byte) error {
+			user := User{}
+			if err := json.Unmarshal(v, &user); err != nil {
+				return err
+			}
+			list = append(list, user)
+			return nil
+		})
+		if err != nil {
+			writeError(w, r, 500, client.CodeInternal, fmt.Sprintf("Failed to list the users: %v", err))
+			return
+		}
+		WriteJsonResponse(list, 200, w)
+	case r.Method == "DELETE" && name != "":
+		if _, err := getUser(name); err != nil {
+			writeError(w, r, 404, client.CodeNotFound, fmt.Sprintf("Unknown user: %s", name))
+			return
+		}
+		deleteMatching(store.Tokens_bucket, func(v []byte) bool {
+			token := StoredToken{}
+			return json.Unmarshal(v, &token) == nil && token.Identity == name
+		})
+		deleteMatching(store.Bindings_bucket, func(v []byte) bool {
+			binding := RoleBinding{}
+			return json.Unmarshal(v, &binding) == nil && binding.Identity == name
+		})
+		if err := mainStore.Del(store.Users_bucket, []byte(name)); err != nil {
+			writeError(w, r, 500, client.CodeInternal, fmt.Sprintf("Failed to delete the user: %v", err))
+			return
+		}
+		log.INFO.Printf("User %s deleted by %s", name, IdentityFromRequest(r))
+		writeResult(w, r, name, nil)
+	default:
+		writeError(w, r, 405, client.CodeMethodNotAllowed, fmt.Sprintf("Unsupported request: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// Delete the values of a bucket matching a filter
+func deleteMatching(bucket []byte, match func(v []byte) bool) {
+	var keys [][]byte
+	mainStore.GetAll(bucket, func(k, v []byte) error {
+		if match(v) {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		return nil
+	})
+	for _, k := range keys {
+		if err := mainStore.Del(bucket, k); err != nil {
+			log.ERROR.Printf("Failed to delete %s from %s: %v", k, bucket, err)
+		}
+	}
+}
+
+// Role binding api:
+//
+//	POST   /v1/api/auth/bindings/      bind a role {"identity", "role", "scope"}
+//	GET    /v1/api/auth/bindings/      list the bindings (configured and stored)
+//	DELETE /v1/api/auth/bindings/<id>  delete a stored binding
+func bindings(w http.ResponseWriter, r *http.Request) {
+	log.DEBUG.Printf("Executing API - bindings")
+
+	id := routeId(r, bindingsPath)
+	switch {
+	case r.Method == "POST" && id == "":
+		binding := &RoleBinding{}
+		if !decodeRequest(w, r, "RoleBinding", binding) {
+			return
+		}
+		if err := validateBinding(binding); err != nil {
+			writeError(w, r, 400, client.CodeInvalidRequest, err.Error())
+			return
+		}
+		token, err := GenerateToken()
+		if err != nil {
+			writeError(w, r, 500, client.CodeInternal, "Failed to generate the binding id")
+			return
+		}
+		binding.Id = token[:16]
+		data, _ := json.Marshal(binding)
+		if err := mainStore.Set(store.Bindings_bucket, []byte(binding.Id), data); err != nil {
+			writeError(w, r, 500, client.CodeInternal, fmt.Sprintf("Failed to store the binding: %v", err))
+			return
+		}
+		log.INFO.Printf("Role %s bound to %s (binding %s) by %s", binding.Role, binding.Identity, binding.Id, IdentityFromRequest(r))
+		writeResult(w, r, binding.Id, binding)
+	case r.Method == "GET" && id == "":
+		list := append([]RoleBinding{}, apiService.authz.bindings...)
+		err := mainStore.GetAll(store.Bindings_bucket, func(k, v []byte) error {
+			binding := RoleBinding{}
+			if err := json.Unmarshal(v, &binding); err != nil {
+				return err
+			}
+			list = append(list, binding)
+			return nil
+		})
+		if err != nil {
+			writeError(w, r, 500, client.CodeInternal, fmt.Sprintf("Failed to list the bindings: %v", err))
+			return
+		}
+		WriteJsonResponse(list, 200, w)
+	case r.Method == "DELETE" && id != "":
+		if _, err := mainStore.Get(store.Bindings_bucket, []byte(id)); err != nil {
+			writeError(w, r, 404, client.CodeNotFound, fmt.Sprintf("Unknown binding: %s", id))
+			return
+		}
+		if err := mainStore.Del(store.Bindings_bucket, []byte(id)); err != nil {
+			writeError(w, r, 500, client.CodeInternal, fmt.Sprintf("Failed to delete the binding: %v", err))
+			return
+		}
+		log.INFO.Printf("Binding %s deleted by %s", id, IdentityFromRequest(r))
+		writeResult(w, r, id, nil)
+	default:
+		writeError(w, r, 405, client.CodeMethodNotAllowed, fmt.Sprintf("Unsupported request: %s %s", r.Method, r.URL.Path))
+	}
+}
@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"context"
+	"net/http/httptest"
+	store "org.openappstack/singularity/store"
+	"strings"
+	"testing"
+)
+
+func TestScopedAdmin(t *testing.T) {
+	mainStore = store.NewMemStore()
+	saved := apiService
+	defer func() { mainStore, apiService = nil, saved }()
+	authz, err := NewAuthorizer(AuthConfig{Enabled: true, Bindings: []RoleBinding{
+		{Identity: "alice", Role: RoleAdmin},
+		{Identity: "bob", Role: RoleAdmin, Scope: Scope{Controllers: []string{"onos"}}},
+		{Identity: "carol", Role: RoleAdmin, Scope: Scope{Tenants: []string{"lab1"}}},
+	}})
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	apiService = &APIService{Config: &Configuration{}, authz: authz}
+	handler := authz.Wrap(ActionAdmin, ActionAdmin, bindings)
+
+	for identity, code := range map[string]int{"alice": 200, "bob": 403, "carol": 403} {
+		request := httptest.NewRequest("POST", "/v1/api/auth/bindings", strings.NewReader(`{"identity": "`+identity+`", "role": "admin"}`))
+		request = request.WithContext(context.WithValue(request.Context(), identityKey{}, &Identity{Name: identity}))
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		if recorder.Code != code {
+			t.Errorf("Expected %d for the binding by %s, got %d %s", code, identity, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	// The scoped admins still administer their scope
+	if !authz.Allowed(&Identity{Name: "bob"}, ActionAdmin, &Resource{Tenant: DefaultTenant, Controller: "onos"}) {
+		t.Errorf("Expected bob to administer onos")
+	}
+	if !authz.Allowed(&Identity{Name: "carol"}, ActionAdmin, &Resource{Tenant: "lab1"}) {
+		t.Errorf("Expected carol to administer lab1")
+	}
+	if !authz.Allowed(&Identity{Name: "bob"}, ActionRead, nil) {
+		t.Errorf("Expected bob to read the unscoped routes")
+	}
+}
@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	"net/http"
+	"org.openappstack/singularity/client"
+	store "org.openappstack/singularity/store"
+	"time"
+)
+
+const (
+	// Route prefix of the secrets api
+	secretsPath = "/v1/api/secrets/"
+)
+
+// A named secret as stored in the kv store. The value never leaves the agent
+// except towards the lifecycle plugins.
+type Secret struct {
+	Name    string
+	Value   []byte
+	Created time.Time
+	Updated time.Time
+}
+
+// The api types, shared with the clients
+type (
+	SecretPutReq = client.SecretPutReq
+	SecretInfo   = client.SecretInfo
+)
+
+// Check if the secrets can be stored, they are only accepted on an encrypted store
+func secretsEnabled() bool {
+	_, encrypted := mainStore.(*store.EncryptedStore)
+	return encrypted
+}
+
+// Get a secret of a tenant by name
+func getSecret(tenant, name string) (*Secret, error) {
+	data, err := mainStore.Get(store.Secrets_bucket, tenantStoreKey(tenant, name))
+	if err != nil {
+		return nil, err
+	}
+	secret := &Secret{}
+	if err := json.Unmarshal(data, secret); err != nil {
+		return nil, fmt.Errorf("Corrupted secret %s", name)
+	}
+	return secret, nil
+}
+
+// Resolve the secret references of a request (parameter name -> secret name)
+// to the secret values (parameter name -> value) of a tenant
+func resolveSecrets(tenant string, refs map[string]string) (map[string][]byte, error) {
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	if !secretsEnabled() {
+		return nil, fmt.Errorf("Secrets are not enabled")
+	}
+	secrets := make(map[string][]byte, len(refs))
+	for param, name := range refs {
+		secret, err := getSecret(tenant, name)
+		if err == store.ErrNoSuchKey {
+			return nil, fmt.Errorf("Unknown secret: %s", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read secret %s: %v", name, err)
+		}
+		secrets[param] = secret.Value
+	}
+	return secrets, nil
+}
+
+// Secrets api. The secrets are write-only and belong to the tenant of the request:
+//
+//	POST   /v1/api/secrets/        create or update a secret {"name", "value"}
+//	GET    /v1/api/secrets/        list the secrets (names and dates only)
+//	GET    /v1/api/secrets/<name>  get the secret info (name and dates only)
+//	DELETE /v1/api/secrets/<name>  delete a secret
+func secrets(w http.ResponseWriter, r *http.Request) {
+	log.DEBUG.Printf("Executing API - secrets")
+
+	if !secretsEnabled() {
+		writeError(w, r, 503, client.CodeUnavailable, "Secrets require the kv store encryption to be configured")
+		return
+	}
+
+	name := routeId(r, secretsPath)
+	tenant := tenantFromRequest(r)
+
+	switch {
+	case r.Method == "POST" && name == "", r.Method == "PUT" && name == "":
+		putSecret(w, r, tenant)
+	case r.Method == "GET" && name == "":
+		listSecrets(w, r, tenant)
+	case r.Method == "GET":
+		getSecretInfo(w, r, tenant, name)
+	case r.Method == "DELETE" && name != "":
+		deleteSecret(w, r, tenant, name)
+	default:
+		writeError(w, r, 405, client.CodeMethodNotAllowed, fmt.Sprintf("Unsupported request: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// Create or update a secret
+func putSecret(w http.ResponseWriter, r *http.Request, tenant string) {
+	req := &SecretPutReq{}
+	if !decodeRequest(w, r, "SecretPutReq", req) {
+		return
+	}
+
+	now := time.Now().UTC()
+	secret := &Secret{Name: req.Name, Value: []byte(req.Value), Created: now, Updated: now}
+	if old, err := getSecret(tenant, req.Name); err == nil {
+		secret.Created = old.Created
+	}
+
+	data, err := json.Marshal(secret)
+	if err != nil {
+		writeError(w, r, 500, client.CodeInternal, "Failed to encode the secret")
+		return
+	}
+	if err := mainStore.Set(store.Secrets_bucket, tenantStoreKey(tenant, secret.Name), data); err != nil {
+		writeError(w, r, 500, client.CodeInternal, fmt.Sprintf("Failed to store the secret: %v", err))
+		log.ERROR.Printf("Failed to store secret %s of tenant %s: %v", secret.Name, tenant, err)
+		return
+	}
+
+	log.INFO.Printf("Secret %s of tenant %s stored", secret.Name, tenant)
+	writeResult(w, r, secret.Name, SecretInfo{Name: secret.Name, Created: secret.Created, Updated: secret.Updated})
+}
+
+// List the secrets of a tenant without their values
+func listSecrets(w http.ResponseWriter, r *http.Request, tenant string) {
+	infos := []SecretInfo{}
+	prefix := tenantStoreKey(tenant, "")
+	err := mainStore.GetAll(store.Secrets_bucket, func(k, v []byte) error {
+		if !bytes.HasPrefix(k, prefix) {
+			return nil
+		}
+		secret := &Secret{}
+		if err := json.Unmarshal(v, secret); err != nil {
+			return fmt.Errorf("Corrupted secret %s", k)
+		}
+		infos = append(infos, SecretInfo{Name: secret.Name, Created: secret.Created, Updated: secret.Updated})
+		return nil
+	})
+	if err != nil {
+		writeError(w, r, 500, client.CodeInternal, fmt.Sprintf("Failed to list the secrets: %v", err))
+		return
+	}
+	WriteJsonResponse(infos, 200, w)
+}
+
+// Get the information of a secret without its value
+func getSecretInfo(w http.ResponseWriter, r *http.Request, tenant, name string) {
+	secret, err := getSecret(tenant, name)
+	if err != nil {
+		writeError(w, r, 404, client.CodeNotFound, fmt.Sprintf("Unknown secret: %s", name))
+		return
+	}
+	WriteJsonResponse(SecretInfo{Name: secret.Name, Created: secret.Created, Updated: secret.Updated}, 200, w)
+}
+
+// Delete a secret
+func deleteSecret(w http.ResponseWriter, r *http.Request, tenant, name string) {
+	if _, err := getSecret(tenant, name); err != nil {
+		writeError(w, r, 404, client.CodeNotFound, fmt.Sprintf("Unknown secret: %s", name))
+		return
+	}
+	if err := mainStore.Del(store.Secrets_bucket, tenantStoreKey(tenant, name)); err != nil {
+		writeError(w, r, 500, client.CodeInternal, fmt.Sprintf("Failed to delete the secret: %v", err))
+		return
+	}
+	log.INFO.Printf("Secret %s of tenant %s deleted", name, tenant)
+	writeResult(w, r, name, nil)
+}
@@ -0,0 +1,325 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	"net/http"
+	"net/url"
+	"org.openappstack/singularity/client"
+	store "org.openappstack/singularity/store"
+	"strings"
+)
+
+const (
+	// The tenant of the requests made on the unscoped api paths
+	DefaultTenant = "default"
+
+	// Route prefix of the tenant scoped api e.g. /v1/api/tenants/<tenant>/lifecycle/start
+	tenantsPath = "/v1/api/tenants/"
+
+	// Route prefix of the unscoped api
+	apiPath = "/v1/api/"
+)
+
+var (
+	// The buckets whose keys are prefixed by the tenant
+	tenantBuckets = []string{string(store.Controllers_bucket), string(store.Secrets_bucket), string(store.Operations_bucket)}
+
+	// The quota error of reserveQuota
+	errQuotaExceeded = errors.New("Quota exceeded")
+
+	// The methods of /v1/api/tenants/<tenant>
+	tenantMethods = []string{"GET", "DELETE"}
+)
+
+// The api types, shared with the clients
+type (
+	Tenant     = client.Tenant
+	TenantInfo = client.TenantInfo
+)
+
+type tenantKey struct{}
+
+// A route of the tenant scoped api
+type tenantRoute struct {
+	path    string // relative to the tenant e.g. "lifecycle/start" or "secrets/"
+	handler http.HandlerFunc
+}
+
+// Get the tenant of a request, and if the request was made on a tenant scoped route
+func tenantOf(r *http.Request) (string, bool) {
+	if tenant, ok := r.Context().Value(tenantKey{}).(string); ok {
+		return tenant, true
+	}
+	return DefaultTenant, false
+}
+
+// Get the tenant of a request
+func tenantFromRequest(r *http.Request) string {
+	tenant, _ := tenantOf(r)
+	return tenant
+}
+
+// Set the tenant of a request
+func withTenant(r *http.Request, tenant string) *http.Request {
+	auditTenant(r, tenant)
+	return r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant))
+}
+
+// Get the storage key of an object owned by a tenant
+func tenantStoreKey(tenant, id string) []byte {
+	return []byte(tenant + "/" + id)
+}
+
+// Get the key of a controller in the controller maps
+func controllerKey(tenant, id string) string {
+	return tenant + "/" + id
+}
+
+// Check if an event belongs to a tenant
+func tenantEvent(tenant string, ev *store.Event) bool {
+	return matchScope(tenantBuckets, ev.Bucket) && strings.HasPrefix(ev.Key, tenant+"/")
+}
+
+// Get a tenant by name, from the configuration or the kv store
+func getTenant(name string) (*Tenant, error) {
+	for _, tenant := range apiService.Config.Tenants {
+		if tenant.Name == name {
+			return &tenant, nil
+		}
+	}
+	data, err := mainStore.Get(store.Tenants_bucket, []byte(name))
+	if err == nil {
+		tenant := &Tenant{}
+		if err := json.Unmarshal(data, tenant); err != nil {
+			return nil, err
+		}
+		return tenant, nil
+	}
+	if name == DefaultTenant {
+		return &Tenant{Name: DefaultTenant}, nil
+	}
+	return nil, err
+}
+
+// Get all the tenants, from the configuration and the kv store
+func listTenants() ([]Tenant, error) {
+	list := append([]Tenant{}, apiService.Config.Tenants...)
+	hasDefault := false
+	for _, tenant := range list {
+		hasDefault = hasDefault || tenant.Name == DefaultTenant
+	}
+	err := mainStore.GetAll(store.Tenants_bucket, func(k, v []byte) error {
+		tenant := Tenant{}
+		if err := json.Unmarshal(v, &tenant); err != nil {
+			return err
+		}
+		hasDefault = hasDefault || tenant.Name == DefaultTenant
+		list = append(list, tenant)
+		return nil
+	})
+	if !hasDefault {
+		list = append([]Tenant{{Name: DefaultTenant}}, list...)
+	}
+	return list, err
+}
+
+// Count the running controllers of a tenant
+func runningControllers(tenant string) int {
+	return controllers.countRunning(tenant)
+}
+
+// Reserve the quota slot of a tenant starting one more controller of a
+// plugin, the concurrent starts can't exceed the quota. The slot must be
+// released by the returned function once the start is over.
+func reserveQuota(tenant, plugin string) (func(), error) {
+	t, err := getTenant(tenant)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown tenant: %s", tenant)
+	}
+	if !matchScope(t.Plugins, plugin) {
+		return nil, fmt.Errorf("Plugin %s is not bound to tenant %s", plugin, tenant)
+	}
+	if !controllers.reserve(tenant, t.MaxControllers) {
+		return nil, fmt.Errorf("%w: tenant %s may run at most %d controllers", errQuotaExceeded, tenant, t.MaxControllers)
+	}
+	return func() { controllers.unreserve(tenant) }, nil
+}
+
+// Register a route of the tenant scoped api. The route is served on
+// /v1/api/tenants/<tenant>/<path> with the same handler as /v1/api/<path>.
+// The sub paths of the routes ending with "/" allow itemMethods.
+func (api *APIService) handleTenant(s *HTTPServer, path string, methods, itemMethods []string, readAction, writeAction string, handler http.HandlerFunc) {
+	api.routes = append(api.routes, tenantApiRoutes(tenantsPath+"{tenant}/"+path, methods, itemMethods)...)
+	wrapped := allowMethods(prefixOf(apiPath+path), methods, itemMethods, api.authz.Wrap(readAction, writeAction, handler))
+	api.tenantRoutes = append(api.tenantRoutes, tenantRoute{path, wrapped})
+}
+
+// Register a route of the tenant scoped api also served on the unscoped path
+// for the default tenant
+func (api *APIService) handleDefaultTenant(s *HTTPServer, path string, methods, itemMethods []string, readAction, writeAction string, handler http.HandlerFunc) {
+	api.handleTenant(s, path, methods, itemMethods, readAction, writeAction, handler)
+
+	wrapped := allowMethods(prefixOf(apiPath+path), methods, itemMethods, api.authz.Wrap(readAction, writeAction, handler))
+	defaultHandler := func(w http.ResponseWriter, r *http.Request) {
+		wrapped(w, withTenant(r, DefaultTenant))
+	}
+	api.routes = append(api.routes, tenantApiRoutes(apiPath+path, methods, itemMethods)...)
+	s.mux.HandleFunc(apiPath+path, defaultHandler)
+	if strings.HasSuffix(path, "/") {
+		s.mux.HandleFunc(apiPath+strings.TrimSuffix(path, "/"), defaultHandler)
+	}
+}
+
+// Get the prefix of a route serving its sub paths, "" for the others
+func prefixOf(path string) string {
+	if strings.HasSuffix(path, "/") {
+		return path
+	}
+	return ""
+}
+
+// Get the routes of a path and, if it ends with "/", of its sub paths
+func tenantApiRoutes(path string, methods, itemMethods []string) []apiRoute {
+	if !strings.HasSuffix(path, "/") {
+		return []apiRoute{{path, methods}}
+	}
+	return []apiRoute{{strings.TrimSuffix(path, "/"), methods}, {path + "{id}", itemMethods}}
+}
+
+// Dispatch the tenant scoped requests to the route handlers. The handlers
+// see the request on the unscoped path with the tenant set in the context.
+func (api *APIService) tenantRouter(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, tenantsPath)
+	parts := strings.SplitN(rest, "/", 2)
+	tenant := parts[0]
+
+	if len(parts) == 1 || parts[1] == "" {
+		allowMethods(tenantsPath, []string{"GET", "POST"}, tenantMethods, api.authz.Wrap(ActionRead, ActionAdmin, tenants))(w, r)
+		return
+	}
+
+	if _, err := getTenant(tenant); err != nil {
+		writeError(w, r, 404, client.CodeNotFound, fmt.Sprintf("Unknown tenant: %s", tenant))
+		return
+	}
+
+	sub := parts[1]
+	for _, route := range api.tenantRoutes {
+		if sub == route.path || sub == strings.TrimSuffix(route.path, "/") ||
+			(strings.HasSuffix(route.path, "/") && strings.HasPrefix(sub, route.path)) {
+			scoped := withTenant(r, tenant)
+			scopedUrl := *r.URL
+			scopedUrl.Path = apiPath + sub
+			scoped.URL = &scopedUrl
+			route.handler(w, scoped)
+			return
+		}
+	}
+	notFound(w, r)
+}
+
+// Tenant api:
+//
+//	POST   /v1/api/tenants           create or update a tenant {"name", "maxControllers", "plugins"}
+//	GET    /v1/api/tenants           list the tenants
+//	GET    /v1/api/tenants/<name>    get a tenant and its usage
+//	DELETE /v1/api/tenants/<name>    delete a tenant without controllers
+func tenants(w http.ResponseWriter, r *http.Request) {
+	log.DEBUG.Printf("Executing API - tenants")
+
+	name := strings.TrimSuffix(routeId(r, tenantsPath), "/")
+	switch {
+	case r.Method == "POST" && name == "":
+		tenant := &Tenant{}
+		if !decodeRequest(w, r, "Tenant", tenant) {
+			return
+		}
+		data, _ := json.Marshal(tenant)
+		if err := mainStore.Set(store.Tenants_bucket, []byte(tenant.Name), data); err != nil {
+			writeError(w, r, 500, client.CodeInternal, fmt.Sprintf("Failed to store the tenant: %v", err))
+			return
+		}
+		log.INFO.Printf("Tenant %s (max controllers: %d) saved by %s", tenant.Name, tenant.MaxControllers, IdentityFromRequest(r))
+		writeResult(w, r, tenant.Name, tenant)
+	case r.Method == "GET" && name == "":
+		list, err := listTenants()
+		if err != nil {
+			writeError(w, r, 500, client.CodeInternal, fmt.Sprintf("Failed to list the tenants: %v", err))
+			return
+		}
+		infos := []TenantInfo{}
+		identity := IdentityFromRequest(r)
+		for _, tenant := range list {
+			if identity.Tenant == "" || identity.Tenant == tenant.Name {
+				infos = append(infos, TenantInfo{Tenant: tenant, RunningControllers: runningControllers(tenant.Name)})
+			}
+		}
+		WriteJsonResponse(infos, 200, w)
+	case r.Method == "GET":
+		tenant, err := getTenant(name)
+		if err != nil || !identityInTenant(IdentityFromRequest(r), name) {
+			writeError(w, r, 404, client.CodeNotFound, fmt.Sprintf("Unknown tenant: %s", name))
+			return
+		}
+		WriteJsonResponse(TenantInfo{Tenant: *tenant, RunningControllers: runningControllers(name)}, 200, w)
+	case r.Method == "DELETE":
+		if _, err := mainStore.Get(store.Tenants_bucket, []byte(name)); err != nil {
+			writeError(w, r, 404, client.CodeNotFound, fmt.Sprintf("Unknown tenant (or defined in the configuration): %s", name))
+			return
+		}
+		if runningControllers(name) > 0 {
+			writeError(w, r, 409, client.CodeConflict, fmt.Sprintf("Tenant %s still has running controllers", name))
+			return
+		}
+		if err := mainStore.Del(store.Tenants_bucket, []byte(name)); err != nil {
+			writeError(w, r, 500, client.CodeInternal, fmt.Sprintf("Failed to delete the tenant: %v", err))
+			return
+		}
+		log.INFO.Printf("Tenant %s deleted by %s", name, IdentityFromRequest(r))
+		writeResult(w, r, name, nil)
+	default:
+		writeError(w, r, 405, client.CodeMethodNotAllowed, fmt.Sprintf("Unsupported request: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// Check if an identity may access a tenant
+func identityInTenant(identity *Identity, tenant string) bool {
+	return identity.Tenant == "" || identity.Tenant == tenant
+}
+
+// Build the tenant scoped path of an api path e.g. for the clients
+func TenantPath(tenant, path string) string {
+	return tenantsPath + url.PathEscape(tenant) + "/" + strings.TrimPrefix(path, apiPath)
+}
+
+// Move the secrets stored before the tenants to the default tenant
+func migrateSecrets() error {
+	var names []string
+	err := mainStore.GetAll(store.Secrets_bucket, func(k, v []byte) error {
+		if !strings.Contains(string(k), "/") {
+			names = append(names, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		data, err := mainStore.Get(store.Secrets_bucket, []byte(name))
+		if err != nil {
+			return err
+		}
+		if err := mainStore.Set(store.Secrets_bucket, tenantStoreKey(DefaultTenant, name), data); err != nil {
+			return err
+		}
+		if err := mainStore.Del(store.Secrets_bucket, []byte(name)); err != nil {
+			return err
+		}
+		log.INFO.Printf("Secret %s moved to tenant %s", name, DefaultTenant)
+	}
+	return nil
+}
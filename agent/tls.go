@@ -0,0 +1,309 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// Default interval between the checks of the certificate files
+	defaultCertReloadInterval = "10s"
+
+	// Validity of the generated self-signed certificates
+	selfSignedValidity = 365 * 24 * time.Hour
+)
+
+var (
+	// The configurable minimum TLS versions
+	tlsVersions = map[string]uint16{
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+)
+
+// The TLS configuration of the https mode
+type TLSConfig struct {
+	// Minimum TLS version, "1.2" (default) or "1.3"
+	MinVersion string
+	// Cipher suite names (TLS 1.2), the Go secure defaults if empty
+	CipherSuites []string
+	// Only serve HTTP/1.1 (no ALPN "h2")
+	DisableHTTP2 bool
+	// Additional certificates selected by SNI, Cert/Key is the default one
+	Certificates []CertificateConfig
+	// Interval between the checks of the certificate files, "0" to only
+	// reload on SIGHUP
+	ReloadInterval string
+	// Generate a self-signed Cert/Key on first run if they don't exist
+	SelfSigned bool
+	// The host names and addresses of the generated certificate
+	SelfSignedHosts []string
+}
+
+// A certificate and its key
+type CertificateConfig struct {
+	Cert string
+	Key  string
+}
+
+// Serves the certificates by SNI and reloads them when their files change
+type certReloader struct {
+	files    []CertificateConfig
+	lock     sync.RWMutex
+	certs    []*tls.Certificate
+	modTimes []time.Time
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// Load the certificates, the first one is the default
+func newCertReloader(files []CertificateConfig) (*certReloader, error) {
+	reloader := &certReloader{files: files, stop: make(chan struct{})}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Get the modification time of the files of a certificate
+func certModTime(files CertificateConfig) time.Time {
+	var latest time.Time
+	for _, file := range []string{files.Cert, files.Key} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// Load all the certificates, the current ones are kept on failure
+func (reloader *certReloader) reload() error {
+	certs := make([]*tls.Certificate, len(reloader.files))
+	modTimes := make([]time.Time, len(reloader.files))
+	for i, files := range reloader.files {
+		modTimes[i] = certModTime(files)
+		cert, err := tls.LoadX509KeyPair(files.Cert, files.Key)
+		if err != nil {
+			return fmt.Errorf("Failed to load Certificate %s : %v", files.Cert, err)
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return fmt.Errorf("Failed to parse Certificate %s : %v", files.Cert, err)
+			}
+		}
+		certs[i] = &cert
+	}
+
+	reloader.lock.Lock()
+	reloader.certs = certs
+	reloader.modTimes = modTimes
+	reloader.lock.Unlock()
+	return nil
+}
+
+// Check if a certificate file changed since loaded
+func (reloader *certReloader) changed() bool {
+	reloader.lock.RLock()
+	defer reloader.lock.RUnlock()
+	for i, files := range reloader.files {
+		if !certModTime(files).Equal(reloader.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Select the certificate matching the server name, the default one otherwise
+func (reloader *certReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.lock.RLock()
+	defer reloader.lock.RUnlock()
+	if hello.ServerName != "" {
+		for _, cert := range reloader.certs {
+			if cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return reloader.certs[0], nil
+}
+
+// Reload the certificates on SIGHUP and, if interval is not 0, when their files change
+func (reloader *certReloader) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				reloader.reloadAndLog("SIGHUP")
+			case <-tick:
+				if reloader.changed() {
+					reloader.reloadAndLog("file change")
+				}
+			case <-reloader.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Reload the certificates and log the outcome
+func (reloader *certReloader) reloadAndLog(reason string) {
+	if err := reloader.reload(); err != nil {
+		log.ERROR.Printf("Certificate reload on %s failed, keeping the current certificates: %v", reason, err)
+		return
+	}
+	log.INFO.Printf("Certificates reloaded on %s", reason)
+}
+
+// Stop watching the certificates
+func (reloader *certReloader) Stop() {
+	if reloader != nil {
+		reloader.once.Do(func() { close(reloader.stop) })
+	}
+}
+
+// Build the tls configuration of a https server
+func buildTLSConfig(config *HttpConfiguration) (*tls.Config, *certReloader, error) {
+	conf := config.TLS
+
+	minVersion := uint16(tls.VersionTLS12)
+	if conf.MinVersion != "" {
+		var ok bool
+		if minVersion, ok = tlsVersions[conf.MinVersion]; !ok {
+			return nil, nil, fmt.Errorf("Invalid TLS MinVersion : %s", conf.MinVersion)
+		}
+	}
+
+	var suites []uint16
+	for _, name := range conf.CipherSuites {
+		id, ok := cipherSuiteId(name)
+		if !ok {
+			return nil, nil, fmt.Errorf("Invalid or insecure TLS cipher suite : %s", name)
+		}
+		suites = append(suites, id)
+	}
+
+	interval, err := parseDuration("TLS ReloadInterval", conf.ReloadInterval, defaultCertReloadInterval)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files := append([]CertificateConfig{{config.Cert, config.Key}}, conf.Certificates...)
+	reloader, err := newCertReloader(files)
+	if err != nil {
+		return nil, nil, err
+	}
+	reloader.watch(interval)
+
+	tlsConfig := &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   suites,
+		GetCertificate: reloader.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+		Rand:           rand.Reader,
+	}
+	if conf.DisableHTTP2 {
+		tlsConfig.NextProtos = []string{"http/1.1"}
+	}
+	if config.ClientCA != "" {
+		if err := setClientAuth(tlsConfig, config); err != nil {
+			reloader.Stop()
+			return nil, nil, err
+		}
+	}
+	return tlsConfig, reloader, nil
+}
+
+// Get the id of a secure cipher suite
+func cipherSuiteId(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// Generate a self-signed certificate and its key if the certificate doesn't exist
+func ensureSelfSigned(certFile, keyFile string, hosts []string) error {
+	if _, err := os.Stat(certFile); err == nil {
+		return nil
+	}
+	log.INFO.Printf("Generating a self-signed certificate %s for %v", certFile, hosts)
+	return GenerateSelfSigned(certFile, keyFile, hosts)
+}
+
+// Generate a self-signed certificate for the host names and addresses
+func GenerateSelfSigned(certFile, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Singularity"}, CommonName: "singularity"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Generate a certificate for a host in a directory
+func testCert(t *testing.T, dir, host string) CertificateConfig {
+	files := CertificateConfig{filepath.Join(dir, host+".pem"), filepath.Join(dir, host+".key")}
+	if err := GenerateSelfSigned(files.Cert, files.Key, []string{host}); err != nil {
+		t.Fatalf("Failed to generate certificate for %s: %v", host, err)
+	}
+	return files
+}
+
+func TestCertReloaderSNI(t *testing.T) {
+	dir := t.TempDir()
+	reloader, err := newCertReloader([]CertificateConfig{testCert(t, dir, "a.example"), testCert(t, dir, "b.example")})
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+
+	for serverName, expected := range map[string]string{"a.example": "a.example", "b.example": "b.example", "": "a.example", "c.example": "a.example"} {
+		cert, err := reloader.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Fatalf("Err: %s", err)
+		}
+		if cert.Leaf.DNSNames[0] != expected {
+			t.Fatalf("Server name %q got certificate of %s, expected %s", serverName, cert.Leaf.DNSNames[0], expected)
+		}
+	}
+}
+
+func TestCertReloaderReload(t *testing.T) {
+	dir := t.TempDir()
+	files := testCert(t, dir, "a.example")
+	reloader, err := newCertReloader([]CertificateConfig{files})
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	before, _ := reloader.GetCertificate(&tls.ClientHelloInfo{})
+
+	// A broken certificate is not loaded
+	future := time.Now().Add(time.Minute)
+	os.WriteFile(files.Cert, []byte("broken"), 0644)
+	os.Chtimes(files.Cert, future, future)
+	if !reloader.changed() {
+		t.Fatalf("The certificate change is not detected")
+	}
+	if err := reloader.reload(); err == nil {
+		t.Fatalf("A broken certificate was loaded")
+	}
+	if current, _ := reloader.GetCertificate(&tls.ClientHelloInfo{}); current != before {
+		t.Fatalf("The current certificate was not kept")
+	}
+
+	// A renewed certificate is loaded
+	testCert(t, dir, "a.example")
+	if err := reloader.reload(); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	after, _ := reloader.GetCertificate(&tls.ClientHelloInfo{})
+	if after.Leaf.SerialNumber.Cmp(before.Leaf.SerialNumber) == 0 {
+		t.Fatalf("The renewed certificate was not loaded")
+	}
+}
+
+func TestBuildTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	files := testCert(t, dir, "localhost")
+	config := &HttpConfiguration{Cert: files.Cert, Key: files.Key}
+
+	config.TLS = TLSConfig{MinVersion: "1.3", DisableHTTP2: true, ReloadInterval: "0"}
+	tlsConfig, certs, err := buildTLSConfig(config)
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	certs.Stop()
+	if tlsConfig.MinVersion != tls.VersionTLS13 || len(tlsConfig.NextProtos) != 1 {
+		t.Fatalf("Unexpected tls configuration: %v %v", tlsConfig.MinVersion, tlsConfig.NextProtos)
+	}
+
+	for _, invalid := range []TLSConfig{{MinVersion: "1.0"}, {CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}} {
+		config.TLS = invalid
+		if _, _, err := buildTLSConfig(config); err == nil {
+			t.Fatalf("Invalid tls configuration accepted: %+v", invalid)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"org.openappstack/singularity/client"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	// Maximum size of a request body
+	maxRequestBody = 1 << 20
+)
+
+// A json schema of the OpenAPI spec, only the keywords used by the spec
+// are supported
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref"`
+	Type                 string                 `json:"type"`
+	Required             []string               `json:"required"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	AdditionalProperties *jsonSchema            `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []string               `json:"enum"`
+	Pattern              string                 `json:"pattern"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+}
+
+var (
+	// The schemas of the OpenAPI spec, loaded once
+	specSchemas     map[string]*jsonSchema
+	specSchemasErr  error
+	specSchemasOnce sync.Once
+
+	// The compiled schema patterns
+	schemaPatterns     = map[string]*regexp.Regexp{}
+	schemaPatternsLock sync.Mutex
+)
+
+// Get a schema of the OpenAPI spec by name
+func specSchema(name string) (*jsonSchema, error) {
+	specSchemasOnce.Do(func() {
+		spec := struct {
+			Components struct {
+				Schemas map[string]*jsonSchema `json:"schemas"`
+			} `json:"components"`
+		}{}
+		specSchemasErr = json.Unmarshal(client.OpenAPISpec(), &spec)
+		specSchemas = spec.Components.Schemas
+	})
+	if specSchemasErr != nil {
+		return nil, specSchemasErr
+	}
+	schema, ok := specSchemas[strings.TrimPrefix(name, "#/components/schemas/")]
+	if !ok {
+		return nil, fmt.Errorf("Unknown schema: %s", name)
+	}
+	return schema, nil
+}
+
+// Get a compiled schema pattern
+func schemaPattern(pattern string) (*regexp.Regexp, error) {
+	schemaPatternsLock.Lock()
+	defer schemaPatternsLock.Unlock()
+	if re, ok := schemaPatterns[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	schemaPatterns[pattern] = re
+	return re, nil
+}
+
+// Validate a decoded json value against a schema. The problems are
+// appended to details, the values are never quoted.
+func (schema *jsonSchema) validate(field string, value interface{}, details []ErrorDetail) []ErrorDetail {
+	if schema.Ref != "" {
+		ref, err := specSchema(schema.Ref)
+		if err != nil {
+			return append(details, ErrorDetail{Field: field, Message: err.Error()})
+		}
+		return ref.validate(field, value, details)
+	}
+	invalid := func(format string, args ...interface{}) []ErrorDetail {
+		return append(details, ErrorDetail{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	if value == nil {
+		// Treated as absent, as json.Unmarshal does
+		return details
+	}
+
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return invalid("must be an object")
+		}
+		for _, name := range schema.Required {
+			if _, ok := object[name]; !ok {
+				details = append(details, ErrorDetail{Field: joinField(field, name), Message: "is required"})
+			}
+		}
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if property, ok := schema.Properties[name]; ok {
+				details = property.validate(joinField(field, name), object[name], details)
+			} else if schema.AdditionalProperties != nil {
+				details = schema.AdditionalProperties.validate(joinField(field, name), object[name], details)
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return invalid("must be an array")
+		}
+		if schema.Items != nil {
+			for i, item := range array {
+				details = schema.Items.validate(fmt.Sprintf("%s[%d]", field, i), item, details)
+			}
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return invalid("must be a string")
+		}
+		length := utf8.RuneCountInString(s)
+		switch {
+		case schema.MinLength != nil && length < *schema.MinLength:
+			if *schema.MinLength == 1 {
+				return invalid("must not be empty")
+			}
+			return invalid("must be at least %d characters long", *schema.MinLength)
+		case schema.MaxLength != nil && length > *schema.MaxLength:
+			return invalid("must be at most %d characters long", *schema.MaxLength)
+		case len(schema.Enum) > 0 && !enumContains(schema.Enum, s):
+			return invalid("must be one of %s", strings.Join(schema.Enum, ", "))
+		}
+		if schema.Pattern != "" {
+			re, err := schemaPattern(schema.Pattern)
+			if err != nil {
+				return invalid("has an invalid schema pattern")
+			}
+			if !re.MatchString(s) {
+				return invalid("must match %s", schema.Pattern)
+			}
+		}
+	case "integer", "number":
+		n, ok := value.(float64)
+		if !ok || (schema.Type == "integer" && n != float64(int64(n))) {
+			return invalid("must be an %s", schema.Type)
+		}
+		switch {
+		case schema.Minimum != nil && n < *schema.Minimum:
+			return invalid("must be at least %v", *schema.Minimum)
+		case schema.Maximum != nil && n > *schema.Maximum:
+			return invalid("must be at most %v", *schema.Maximum)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return invalid("must be a boolean")
+		}
+	}
+	return details
+}
+
+// Check if an enum contains a value
+func enumContains(enum []string, value string) bool {
+	for _, allowed := range enum {
+		if allowed == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Join the name of a field to its parent e.g. "scope.tenants"
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+// Decode the json body of a request into v, once validated against a schema
+// of the OpenAPI spec. The failure is written to the response.
+func decodeRequest(w http.ResponseWriter, r *http.Request, schemaName string, v interface{}) bool {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	if err != nil {
+		writeError(w, r, http.StatusRequestEntityTooLarge, client.CodeInvalidRequest, "Invalid request: the body is too large")
+		return false
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		// The decoder error may quote the request, never echo it
+		writeError(w, r, 400, client.CodeInvalidRequest, "Invalid request: the body is not valid json")
+		return false
+	}
+	schema, err := specSchema(schemaName)
+	if err != nil {
+		writeError(w, r, 500, client.CodeInternal, err.Error())
+		return false
+	}
+	if value == nil {
+		value = map[string]interface{}{}
+	}
+	if details := schema.validate("", value, nil); len(details) > 0 {
+		message := "Invalid request:"
+		for _, detail := range details {
+			message += fmt.Sprintf(" %s %s;", detail.Field, detail.Message)
+		}
+		writeErrorDetails(w, r, 400, client.CodeInvalidRequest, strings.TrimSuffix(message, ";"), details)
+		return false
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		writeError(w, r, 400, client.CodeInvalidRequest, "Invalid request: the body does not match the schema")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"org.openappstack/singularity/client"
+	"strings"
+	"testing"
+)
+
+func TestDecodeRequest(t *testing.T) {
+	decode := func(schema, body string, v interface{}) (bool, ErrorResponse) {
+		req := httptest.NewRequest("POST", "/v2/api/lifecycle/start", strings.NewReader(body))
+		recorder := httptest.NewRecorder()
+		ok := decodeRequest(recorder, req, schema, v)
+		resp := ErrorResponse{}
+		if !ok {
+			json.Unmarshal(recorder.Body.Bytes(), &resp)
+		}
+		return ok, resp
+	}
+
+	req := &ControllerStartReq{}
+	if ok, resp := decode("ControllerStartReq", `{"name": "onos", "version": "1.0", "cil": "/opt/onos", "deploy": "native"}`, req); !ok || req.Name != "onos" {
+		t.Fatalf("Valid request rejected: %v", resp)
+	}
+
+	ok, resp := decode("ControllerStartReq", `{"name": "", "version": 1, "deploy": "native"}`, &ControllerStartReq{})
+	if ok || resp.Code != client.CodeInvalidRequest {
+		t.Fatalf("Invalid request accepted")
+	}
+	fields := map[string]bool{}
+	for _, detail := range resp.Details {
+		fields[detail.Field] = true
+	}
+	for _, field := range []string{"name", "version", "cil"} {
+		if !fields[field] {
+			t.Fatalf("No error detail for field %s: %v", field, resp.Details)
+		}
+	}
+
+	if ok, _ := decode("Tenant", `{"name": "Not a tenant", "maxControllers": -1}`, &Tenant{}); ok {
+		t.Fatalf("Invalid tenant accepted")
+	}
+	if ok, _ := decode("RoleBinding", `{"identity": "alice", "role": "admin", "scope": {"tenants": ["a", 1]}}`, &RoleBinding{}); ok {
+		t.Fatalf("Invalid binding scope accepted")
+	}
+	if ok, _ := decode("SecretPutReq", `{"name": "db-password", "value": "hunter2"`, &SecretPutReq{}); ok {
+		t.Fatalf("Truncated json accepted")
+	}
+}
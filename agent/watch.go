@@ -0,0 +1,255 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	"net/http"
+	"org.openappstack/singularity/client"
+	store "org.openappstack/singularity/store"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Default time a long-poll watch request waits for a change
+	defaultWatchTimeout = 30 * time.Second
+
+	// Maximum time a long-poll watch request may wait for a change
+	maxWatchTimeout = 5 * time.Minute
+)
+
+var (
+	// The watchable buckets and the action their watch needs. The auth, audit
+	// and idempotency buckets (cached responses) are reserved to the admins.
+	watchActions = map[string]string{
+		string(store.Controllers_bucket):      ActionRead,
+		string(store.Operations_bucket):       ActionRead,
+		string(store.Secrets_bucket):          ActionRead, // the values are redacted
+		string(store.Tenants_bucket):          ActionRead,
+		string(store.Plugin_instances_bucket): ActionRead,
+		string(store.Tokens_bucket):           ActionAdmin,
+		string(store.Users_bucket):            ActionAdmin,
+		string(store.Bindings_bucket):         ActionAdmin,
+		string(store.Audit_bucket):            ActionAdmin,
+		string(store.Idempotency_bucket):      ActionAdmin,
+	}
+)
+
+// The api type, shared with the clients
+type WatchResp = client.WatchResp
+
+// Watch the changes of the kv store. The tenant scoped requests, and the
+// requests of the tenant restricted identities, only see the changes of the
+// tenant objects. The identities only see the buckets and the controllers
+// their role bindings allow. The request parameters are
+//
+//	bucket   : the bucket to watch (all the buckets if empty)
+//	prefix   : the key prefix to watch (relative to the tenant if scoped)
+//	revision : replay the changes made after this revision
+//	timeout  : the maximum long-poll wait (e.g. "30s")
+//	stream   : if "true" the events are streamed as json lines until the client leaves
+func watch(w http.ResponseWriter, r *http.Request) {
+	log.DEBUG.Printf("Executing API - watch")
+
+	query := r.URL.Query()
+
+	var revision uint64
+	if rev := query.Get("revision"); rev != "" {
+		var parseErr error
+		revision, parseErr = strconv.ParseUint(rev, 10, 64)
+		if parseErr != nil {
+			writeError(w, r, 400, client.CodeInvalidRequest, fmt.Sprintf("Invalid revision: %s", rev))
+			return
+		}
+	}
+
+	timeout := defaultWatchTimeout
+	if t := query.Get("timeout"); t != "" {
+		var parseErr error
+		timeout, parseErr = time.ParseDuration(t)
+		if parseErr != nil || timeout <= 0 {
+			writeError(w, r, 400, client.CodeInvalidRequest, fmt.Sprintf("Invalid timeout: %s", t))
+			return
+		}
+		if timeout > maxWatchTimeout {
+			timeout = maxWatchTimeout
+		}
+	}
+
+	bucket, prefix := query.Get("bucket"), query.Get("prefix")
+	identity := IdentityFromRequest(r)
+	tenant, scoped := tenantOf(r)
+	if !scoped && identity.Tenant != "" {
+		tenant, scoped = identity.Tenant, true
+	}
+	if bucket != "" {
+		action, watchable := watchActions[bucket]
+		if !watchable || (scoped && !matchScope(tenantBuckets, bucket)) {
+			writeError(w, r, 400, client.CodeInvalidRequest, fmt.Sprintf("Invalid bucket: %s", bucket))
+			return
+		}
+		var resource *Resource
+		if scoped {
+			resource = &Resource{Tenant: tenant}
+		}
+		if !apiService.authz.Allowed(identity, action, resource) {
+			writeError(w, r, 403, client.CodeForbidden, fmt.Sprintf("Access denied: %s is not allowed to watch %s", identity.Name, bucket))
+			return
+		}
+	}
+	visible := func(ev *store.Event) bool { return eventVisible(identity, ev) }
+	if scoped {
+		prefix = string(tenantStoreKey(tenant, prefix))
+		visible = func(ev *store.Event) bool { return tenantEvent(tenant, ev) && eventVisible(identity, ev) }
+	}
+
+	watcher, watchErr := mainStore.WatchFrom([]byte(bucket), []byte(prefix), revision)
+	if watchErr != nil {
+		if errors.Is(watchErr, store.ErrCompacted) {
+			writeError(w, r, 410, client.CodeCompacted, fmt.Sprintf("Failed to watch: %v", watchErr))
+		} else {
+			writeError(w, r, 500, client.CodeInternal, fmt.Sprintf("Failed to watch: %v", watchErr))
+		}
+		log.DEBUG.Printf("Failed to watch from revision %d: %v", revision, watchErr)
+		return
+	}
+	defer watcher.Close()
+
+	if query.Get("stream") == "true" {
+		streamEvents(w, r, watcher, visible)
+		return
+	}
+
+	// The long-poll may outlast the server write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + 10*time.Second))
+
+	resp := WatchResp{Revision: mainStore.Revision(), Events: []store.Event{}}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// Wait for the first visible event, then collect what is already pending.
+	// The revision follows the hidden events, they don't end the wait.
+WAIT:
+	for len(resp.Events) == 0 {
+		select {
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				break WAIT
+			}
+			resp.Revision = ev.Revision
+			if visible(&ev) {
+				resp.Events = append(resp.Events, ev)
+			}
+		case <-timer.C:
+			break WAIT
+		case <-serviceClosing():
+			break WAIT
+		case <-r.Context().Done():
+			return
+		}
+	}
+COLLECT:
+	for {
+		select {
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				break COLLECT
+			}
+			resp.Revision = ev.Revision
+			if visible(&ev) {
+				resp.Events = append(resp.Events, ev)
+			}
+		default:
+			break COLLECT
+		}
+	}
+
+	for i := range resp.Events {
+		resp.Events[i] = redactEvent(resp.Events[i])
+	}
+	WriteJsonResponse(resp, 200, w)
+}
+
+// Stream the visible events of a watcher as json lines
+func streamEvents(w http.ResponseWriter, r *http.Request, watcher *store.Watcher, visible func(*store.Event) bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, 500, client.CodeInternal, "Streaming is not supported")
+		return
+	}
+
+	// The stream outlasts the server write timeout, until the client leaves
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				// The watcher was dropped, the client has to resume from its last revision
+				if err := watcher.Err(); err != nil {
+					log.DEBUG.Printf("Watch stream closed: %v", err)
+				}
+				return
+			}
+			if !visible(&ev) {
+				continue
+			}
+			if err := encoder.Encode(redactEvent(ev)); err != nil {
+				log.DEBUG.Printf("Failed to write watch event: %v", err)
+				return
+			}
+			flusher.Flush()
+		case <-serviceClosing():
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Check if an identity may see an event, as per the action its bucket needs
+// and, for the tenant objects, the tenant and the controller of the event
+func eventVisible(identity *Identity, ev *store.Event) bool {
+	action, watchable := watchActions[ev.Bucket]
+	if !watchable {
+		return false
+	}
+	return apiService.authz.Allowed(identity, action, eventResource(ev))
+}
+
+// Get the resource of an event, nil for the objects of no tenant
+func eventResource(ev *store.Event) *Resource {
+	if !matchScope(tenantBuckets, ev.Bucket) {
+		return nil
+	}
+	tenant, id, _ := strings.Cut(ev.Key, "/")
+	resource := &Resource{Tenant: tenant}
+	if ev.Bucket == string(store.Secrets_bucket) {
+		return resource
+	}
+	// The controllers and their operations, the deleted ones by their CId
+	resource.CId = id
+	object := struct{ Name string }{}
+	if json.Unmarshal(ev.Value, &object) == nil {
+		resource.Controller = object.Name
+	} else if controller, found := controllers.get(tenant, id); found {
+		resource.Controller = controller.Name
+	}
+	return resource
+}
+
+// Remove the values that must not leave the agent from an event
+func redactEvent(ev store.Event) store.Event {
+	if ev.Bucket == string(store.Secrets_bucket) {
+		ev.Value = nil
+	}
+	return ev
+}
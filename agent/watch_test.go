@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	store "org.openappstack/singularity/store"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWatchAuthorization(t *testing.T) {
+	mainStore = store.NewMemStore()
+	saved := apiService
+	defer func() { mainStore, apiService = nil, saved }()
+	authz, err := NewAuthorizer(AuthConfig{Enabled: true, Bindings: []RoleBinding{
+		{Identity: "alice", Role: RoleAdmin},
+		{Identity: "bob", Role: RoleViewer, Scope: Scope{Controllers: []string{"onos"}}},
+		{Identity: "carol", Role: RoleAdmin, Scope: Scope{Tenants: []string{DefaultTenant}}},
+	}})
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	apiService = &APIService{Config: &Configuration{}, authz: authz}
+
+	mainStore.Set(store.Tenants_bucket, []byte("first"), []byte("{}"))
+	first := mainStore.Revision()
+	onos, _ := json.Marshal(&Controller{Tenant: DefaultTenant, Name: "onos", CId: "1"})
+	odl, _ := json.Marshal(&Controller{Tenant: DefaultTenant, Name: "odl", CId: "2"})
+	mainStore.Set(store.Controllers_bucket, tenantStoreKey(DefaultTenant, "1"), onos)
+	mainStore.Set(store.Controllers_bucket, tenantStoreKey(DefaultTenant, "2"), odl)
+	mainStore.Set(store.Audit_bucket, []byte("1"), []byte("{}"))
+	mainStore.Set(store.Idempotency_bucket, []byte("key"), []byte("cached response"))
+
+	request := func(identity, query string) (int, []store.Event) {
+		r := httptest.NewRequest("GET", "/v1/api/watch?timeout=10ms&revision="+strconv.FormatUint(first, 10)+query, nil)
+		r = r.WithContext(context.WithValue(r.Context(), identityKey{}, &Identity{Name: identity}))
+		recorder := httptest.NewRecorder()
+		watch(recorder, r)
+		resp := WatchResp{}
+		json.Unmarshal(recorder.Body.Bytes(), &resp)
+		return recorder.Code, resp.Events
+	}
+
+	for _, test := range []struct {
+		identity, bucket string
+		code             int
+	}{
+		{"alice", "audit", 200},
+		{"alice", "idempotency_keys", 200},
+		{"alice", "_meta", 400},
+		{"bob", "controllers", 200},
+		{"bob", "audit", 403},
+		{"bob", "idempotency_keys", 403},
+		{"bob", "auth_bindings", 403},
+		{"carol", "audit", 403},
+	} {
+		if code, _ := request(test.identity, "&bucket="+test.bucket); code != test.code {
+			t.Errorf("Expected %d for the watch of %s by %s, got %d", test.code, test.bucket, test.identity, code)
+		}
+	}
+
+	// The watch of all the buckets only shows the visible events
+	_, events := request("bob", "")
+	if len(events) != 1 || events[0].Key != string(tenantStoreKey(DefaultTenant, "1")) {
+		t.Errorf("Unexpected events of bob %+v", events)
+	}
+	if _, events = request("alice", ""); len(events) != 4 {
+		t.Errorf("Unexpected events of alice %+v", events)
+	}
+}
+
+func TestWatchHiddenEvents(t *testing.T) {
+	mainStore = store.NewMemStore()
+	saved := apiService
+	defer func() { mainStore, apiService = nil, saved }()
+	authz, err := NewAuthorizer(AuthConfig{Enabled: true, Bindings: []RoleBinding{
+		{Identity: "bob", Role: RoleViewer, Scope: Scope{Controllers: []string{"onos"}}},
+	}})
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	apiService = &APIService{Config: &Configuration{}, authz: authz}
+	onos, _ := json.Marshal(&Controller{Tenant: DefaultTenant, Name: "onos", CId: "1"})
+	odl, _ := json.Marshal(&Controller{Tenant: DefaultTenant, Name: "odl", CId: "2"})
+
+	request := func(timeout string) WatchResp {
+		r := httptest.NewRequest("GET", "/v1/api/watch?bucket=controllers&timeout="+timeout+"&revision="+strconv.FormatUint(mainStore.Revision(), 10), nil)
+		r = r.WithContext(context.WithValue(r.Context(), identityKey{}, &Identity{Name: "bob"}))
+		recorder := httptest.NewRecorder()
+		watch(recorder, r)
+		resp := WatchResp{}
+		json.Unmarshal(recorder.Body.Bytes(), &resp)
+		return resp
+	}
+
+	// The hidden event doesn't end the wait for the visible one
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		mainStore.Set(store.Controllers_bucket, tenantStoreKey(DefaultTenant, "2"), odl)
+		time.Sleep(20 * time.Millisecond)
+		mainStore.Set(store.Controllers_bucket, tenantStoreKey(DefaultTenant, "1"), onos)
+	}()
+	resp := request("5s")
+	if len(resp.Events) != 1 || resp.Events[0].Key != string(tenantStoreKey(DefaultTenant, "1")) || resp.Revision != mainStore.Revision() {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+
+	// Without visible event the wait ends with the timeout, past the hidden events
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		mainStore.Set(store.Controllers_bucket, tenantStoreKey(DefaultTenant, "2"), odl)
+	}()
+	started := time.Now()
+	resp = request("100ms")
+	if len(resp.Events) != 0 || resp.Revision != mainStore.Revision() || time.Since(started) < 100*time.Millisecond {
+		t.Errorf("Unexpected response %+v after %v", resp, time.Since(started))
+	}
+}
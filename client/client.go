@@ -0,0 +1,332 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A client of the agent api
+type Client struct {
+	// The agent address e.g. "https://127.0.0.1:8083"
+	BaseURL string
+	// The api token, client certificates are set in HTTPClient
+	Token string
+	// The tenant of the tenant scoped requests, the default tenant if empty
+	Tenant     string
+	HTTPClient *http.Client
+	// The retries of the lifecycle requests on network errors. They are
+	// sent with an Idempotency-Key so that a retry is never applied twice.
+	Retries int
+}
+
+// The route prefix of the api used by the client
+const apiPath = "/v2/api/"
+
+// A failed api request
+type Error struct {
+	Status int
+	ErrorResponse
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status))
+	}
+	message := fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Message)
+	for _, detail := range e.Details {
+		message += fmt.Sprintf("\n  %s: %s", detail.Field, detail.Message)
+	}
+	if e.RequestId != "" {
+		message += fmt.Sprintf(" (request id %s)", e.RequestId)
+	}
+	return message
+}
+
+// Create a client of the agent at a base url
+func New(baseURL, token string) *Client {
+	return &Client{BaseURL: baseURL, Token: token, HTTPClient: http.DefaultClient}
+}
+
+// Send a request to the api and decode the json response in out
+func (c *Client) Do(method, path string, body, out interface{}) error {
+	return c.do(method, path, nil, body, out)
+}
+
+// Send a request with an Idempotency-Key, retried on network errors
+func (c *Client) doIdempotent(method, path string, body, out interface{}) error {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	header := http.Header{"Idempotency-Key": {hex.EncodeToString(random)}}
+	for attempt := 0; ; attempt++ {
+		err := c.do(method, path, header, body, out)
+		if _, failed := err.(*Error); err == nil || failed || attempt >= c.Retries {
+			return err
+		}
+	}
+}
+
+// Send a request with additional headers
+func (c *Client) do(method, path string, header http.Header, body, out interface{}) error {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		if reqBody, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.BaseURL, "/")+path, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		failure := &Error{Status: resp.StatusCode}
+		json.Unmarshal(data, &failure.ErrorResponse)
+		if failure.RequestId == "" {
+			failure.RequestId = resp.Header.Get("X-Request-Id")
+		}
+		return failure
+	}
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// Get the path of a tenant scoped route e.g. "secrets/" for the client tenant
+func (c *Client) tenantPath(path string) string {
+	if c.Tenant == "" {
+		return apiPath + path
+	}
+	return apiPath + "tenants/" + url.PathEscape(c.Tenant) + "/" + path
+}
+
+/**** Lifecycle ****/
+
+// Start a controller, returns its cid
+func (c *Client) StartController(req *ControllerStartReq) (string, error) {
+	resp := ControllerStartResp{}
+	err := c.doIdempotent("POST", c.tenantPath("lifecycle/start"), req, &resp)
+	return resp.CId, err
+}
+
+// Stop a controller
+func (c *Client) StopController(cid string) error {
+	return c.doIdempotent("POST", c.tenantPath("lifecycle/stop"), &ControllerStopReq{CId: cid}, nil)
+}
+
+// Push a configuration to a controller
+func (c *Client) ConfigureController(req *ControllerConfigReq) error {
+	return c.doIdempotent("POST", c.tenantPath("lifecycle/config"), req, nil)
+}
+
+/**** Watch ****/
+
+// The filters of a watch request
+type WatchQuery struct {
+	Bucket   string
+	Prefix   string
+	Revision uint64
+	Timeout  time.Duration
+}
+
+// Wait for the changes of the kv store made after query.Revision
+func (c *Client) Watch(query *WatchQuery) (*WatchResp, error) {
+	params := url.Values{}
+	if query.Bucket != "" {
+		params.Set("bucket", query.Bucket)
+	}
+	if query.Prefix != "" {
+		params.Set("prefix", query.Prefix)
+	}
+	if query.Revision > 0 {
+		params.Set("revision", strconv.FormatUint(query.Revision, 10))
+	}
+	if query.Timeout > 0 {
+		params.Set("timeout", query.Timeout.String())
+	}
+	resp := &WatchResp{}
+	if err := c.Do("GET", c.tenantPath("watch?"+params.Encode()), nil, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+/**** Secrets ****/
+
+// Create or update a secret
+func (c *Client) PutSecret(name, value string) error {
+	return c.Do("POST", c.tenantPath("secrets/"), &SecretPutReq{Name: name, Value: value}, nil)
+}
+
+// List the secrets, without their values
+func (c *Client) ListSecrets() ([]SecretInfo, error) {
+	var infos []SecretInfo
+	err := c.Do("GET", c.tenantPath("secrets/"), nil, &infos)
+	return infos, err
+}
+
+// Get a secret, without its value
+func (c *Client) GetSecret(name string) (*SecretInfo, error) {
+	info := &SecretInfo{}
+	if err := c.Do("GET", c.tenantPath("secrets/"+url.PathEscape(name)), nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Delete a secret
+func (c *Client) DeleteSecret(name string) error {
+	return c.Do("DELETE", c.tenantPath("secrets/"+url.PathEscape(name)), nil, nil)
+}
+
+/**** Audit ****/
+
+// The filters of an audit request
+type AuditQuery struct {
+	From     time.Time
+	To       time.Time
+	Identity string
+	Kind     string
+	Limit    int
+}
+
+// List the audit records
+func (c *Client) Audit(query *AuditQuery) ([]AuditRecord, error) {
+	params := url.Values{}
+	for param, value := range map[string]time.Time{"from": query.From, "to": query.To} {
+		if !value.IsZero() {
+			params.Set(param, value.Format(time.RFC3339))
+		}
+	}
+	for param, value := range map[string]string{"identity": query.Identity, "kind": query.Kind} {
+		if value != "" {
+			params.Set(param, value)
+		}
+	}
+	if query.Limit > 0 {
+		params.Set("limit", strconv.Itoa(query.Limit))
+	}
+	var records []AuditRecord
+	err := c.Do("GET", c.tenantPath("audit?"+params.Encode()), nil, &records)
+	return records, err
+}
+
+/**** Tenants ****/
+
+// List the tenants and their usage
+func (c *Client) ListTenants() ([]TenantInfo, error) {
+	var tenants []TenantInfo
+	err := c.Do("GET", apiPath+"tenants", nil, &tenants)
+	return tenants, err
+}
+
+// Get a tenant and its usage
+func (c *Client) GetTenant(name string) (*TenantInfo, error) {
+	tenant := &TenantInfo{}
+	if err := c.Do("GET", apiPath+"tenants/"+url.PathEscape(name), nil, tenant); err != nil {
+		return nil, err
+	}
+	return tenant, nil
+}
+
+// Create or update a tenant
+func (c *Client) SaveTenant(tenant *Tenant) error {
+	return c.Do("POST", apiPath+"tenants", tenant, nil)
+}
+
+// Delete a tenant without running controllers
+func (c *Client) DeleteTenant(name string) error {
+	return c.Do("DELETE", apiPath+"tenants/"+url.PathEscape(name), nil, nil)
+}
+
+/**** Users, tokens and role bindings ****/
+
+// List the users
+func (c *Client) ListUsers() ([]User, error) {
+	var users []User
+	err := c.Do("GET", apiPath+"auth/users", nil, &users)
+	return users, err
+}
+
+// Create or update a user
+func (c *Client) SaveUser(user *User) error {
+	return c.Do("POST", apiPath+"auth/users/", user, nil)
+}
+
+// Delete a user with its tokens and role bindings
+func (c *Client) DeleteUser(name string) error {
+	return c.Do("DELETE", apiPath+"auth/users/"+url.PathEscape(name), nil, nil)
+}
+
+// Create a token, the token is only returned once
+func (c *Client) CreateToken(req *TokenCreateReq) (*TokenCreateResp, error) {
+	resp := &TokenCreateResp{}
+	if err := c.Do("POST", apiPath+"auth/tokens/", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// List the tokens, without their values
+func (c *Client) ListTokens() ([]StoredToken, error) {
+	var tokens []StoredToken
+	err := c.Do("GET", apiPath+"auth/tokens", nil, &tokens)
+	return tokens, err
+}
+
+// Revoke a token
+func (c *Client) RevokeToken(id string) error {
+	return c.Do("DELETE", apiPath+"auth/tokens/"+url.PathEscape(id), nil, nil)
+}
+
+// Bind a role to an identity, returns the binding id
+func (c *Client) AddBinding(binding *RoleBinding) (string, error) {
+	resp := RoleBinding{}
+	err := c.Do("POST", apiPath+"auth/bindings/", binding, &resp)
+	return resp.Id, err
+}
+
+// List the role bindings
+func (c *Client) ListBindings() ([]RoleBinding, error) {
+	var bindings []RoleBinding
+	err := c.Do("GET", apiPath+"auth/bindings", nil, &bindings)
+	return bindings, err
+}
+
+// Delete a stored role binding
+func (c *Client) DeleteBinding(id string) error {
+	return c.Do("DELETE", apiPath+"auth/bindings/"+url.PathEscape(id), nil, nil)
+}
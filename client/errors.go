@@ -0,0 +1,34 @@
+package client
+
+// The error codes of the api
+const (
+	CodeInvalidRequest   = "invalid_request"    // 400
+	CodeUnauthenticated  = "unauthenticated"    // 401
+	CodeForbidden        = "forbidden"          // 403
+	CodeQuotaExceeded    = "quota_exceeded"     // 403
+	CodeNotFound         = "not_found"          // 404
+	CodeMethodNotAllowed = "method_not_allowed" // 405
+	CodeConflict         = "conflict"           // 409
+	CodeCompacted        = "revision_compacted" // 410, watch again from the current revision
+	CodeRateLimited      = "rate_limited"       // 429, retry after the Retry-After header
+	CodeInternal         = "internal"           // 500
+	CodeNotImplemented   = "not_implemented"    // 501, e.g. the plugin can't stream the logs
+	CodePluginFailure    = "plugin_failure"     // 502
+	CodePluginTimeout    = "plugin_timeout"     // 504, the plugin missed its deadline
+	CodeUnavailable      = "unavailable"        // 503
+)
+
+// The body of a failed v2 api request
+type ErrorResponse struct {
+	Code    string        `json:"code"`
+	Message string        `json:"message"`
+	Details []ErrorDetail `json:"details,omitempty"`
+	// The X-Request-Id of the request, to find it in the agent logs
+	RequestId string `json:"requestId,omitempty"`
+}
+
+// A detail of a failed request e.g. an invalid field of the request body
+type ErrorDetail struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,15 @@
+package client
+
+import (
+	_ "embed"
+)
+
+// The OpenAPI 3 document of the agent api
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// Get the OpenAPI 3 document of the agent api, served on /v1/api/openapi.json
+func OpenAPISpec() []byte {
+	return openAPISpec
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"encoding/json"
+	store "org.openappstack/singularity/store"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// The go types of the spec schemas, by x-go-type
+var specTypes = map[string]interface{}{
+	"client.Response":            Response{},
+	"client.ErrorResponse":       ErrorResponse{},
+	"client.ErrorDetail":         ErrorDetail{},
+	"client.ControllerStartReq":  ControllerStartReq{},
+	"client.ControllerStartResp": ControllerStartResp{},
+	"client.ControllerStopReq":   ControllerStopReq{},
+	"client.ControllerConfigReq": ControllerConfigReq{},
+	"client.OperationProgress":   OperationProgress{},
+	"client.LogLine":             LogLine{},
+	"client.PluginHealth":        PluginHealth{},
+	"client.WatchResp":           WatchResp{},
+	"store.Event":                store.Event{},
+	"client.SecretPutReq":        SecretPutReq{},
+	"client.SecretInfo":          SecretInfo{},
+	"client.TokenCreateReq":      TokenCreateReq{},
+	"client.TokenCreateResp":     TokenCreateResp{},
+	"client.StoredToken":         StoredToken{},
+	"client.User":                User{},
+	"client.Scope":               Scope{},
+	"client.RoleBinding":         RoleBinding{},
+	"client.AuditRecord":         AuditRecord{},
+	"client.Tenant":              Tenant{},
+	"client.TenantInfo":          TenantInfo{},
+}
+
+// Get the json field names of a struct type, as encoding/json does
+func jsonFields(t reflect.Type) []string {
+	var fields []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		switch {
+		case name == "-":
+		case field.Anonymous && name == "":
+			fields = append(fields, jsonFields(field.Type)...)
+		case name != "":
+			fields = append(fields, name)
+		default:
+			fields = append(fields, field.Name)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func TestOpenAPISpecMatchesTypes(t *testing.T) {
+	spec := struct {
+		Components struct {
+			Schemas map[string]struct {
+				GoType     string                 `json:"x-go-type"`
+				Properties map[string]interface{} `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}{}
+	if err := json.Unmarshal(OpenAPISpec(), &spec); err != nil {
+		t.Fatalf("Invalid spec: %v", err)
+	}
+
+	described := map[string]bool{}
+	for name, schema := range spec.Components.Schemas {
+		value, ok := specTypes[schema.GoType]
+		if !ok {
+			t.Errorf("Schema %s: unknown x-go-type %q", name, schema.GoType)
+			continue
+		}
+		described[schema.GoType] = true
+
+		var properties []string
+		for property := range schema.Properties {
+			properties = append(properties, property)
+		}
+		sort.Strings(properties)
+		if fields := jsonFields(reflect.TypeOf(value)); !reflect.DeepEqual(fields, properties) {
+			t.Errorf("Schema %s: properties %v, %s has json fields %v", name, properties, schema.GoType, fields)
+		}
+	}
+	for goType := range specTypes {
+		if !described[goType] {
+			t.Errorf("Type %s has no schema in the spec", goType)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package client
+
+import (
+	store "org.openappstack/singularity/store"
+	"time"
+)
+
+// The types of the agent api, shared by the agent and its clients. They
+// are described by openapi.json.
+
+type ControllerStartReq struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	CIL     string `json:"cil"` // The Controller Instance Location (a path in case of
+	// non-containerized and a container-id in case of containerzed)
+	Deploy string `json:"deploy"`
+	// The secrets delivered to the lifecycle plugin at init (parameter name -> secret name)
+	Secrets map[string]string `json:"secrets,omitempty"`
+}
+
+type ControllerStartResp struct {
+	CId string `json:"cid"` // The unique Controller Identifier
+}
+
+type ControllerStopReq struct {
+	CId string `json:"cid"` // The unique Controller Identifier
+}
+
+type ControllerConfigReq struct {
+	CId    string `json:"cid"`    // The unique Controller Identifier
+	Config string `json:"config"` // The configuration, as the plugin of the controller reads it
+	// The secrets delivered to the lifecycle plugin with the configuration (parameter name -> secret name)
+	Secrets map[string]string `json:"secrets,omitempty"`
+}
+
+// The outcome of a v1 api request. The v2 api returns the result itself on
+// success and an ErrorResponse on failure.
+type Response struct {
+	// Response is used for sending Json Response to the Client i.e. { "Success": "true", Message}
+	Success string `json:"Success"`
+	Message string `json:"Message"`
+}
+
+// An audit record of a mutating api request or of a plugin event
+type AuditRecord struct {
+	Id       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	Identity string    `json:"identity"`
+	Auth     string    `json:"auth,omitempty"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Source   string    `json:"source,omitempty"`
+	Route    string    `json:"route"` // e.g. "POST /v1/api/lifecycle/start" or "plugin crash"
+	Summary  string    `json:"summary,omitempty"`
+	CId      string    `json:"cid,omitempty"`
+	Status   int       `json:"status,omitempty"`
+	Outcome  string    `json:"outcome"`
+	Error    string    `json:"error,omitempty"`
+	// The X-Request-Id of an api request
+	RequestId string `json:"requestId,omitempty"`
+}
+
+// A token stored in the kv store, by hash
+type StoredToken struct {
+	Id       string    `json:"id"`
+	Identity string    `json:"identity"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires,omitempty"`
+}
+
+type TokenCreateReq struct {
+	Identity string `json:"identity"`
+	Tenant   string `json:"tenant,omitempty"` // Restrict the token to a tenant
+	TTL      string `json:"ttl,omitempty"`    // e.g. "720h", no expiry if empty
+}
+
+type TokenCreateResp struct {
+	Id    string `json:"id"`
+	Token string `json:"token"` // Only returned at creation
+}
+
+// The resources a binding is restricted to. An empty list matches everything.
+type Scope struct {
+	// Tenant names
+	Tenants []string `json:"tenants,omitempty"`
+	// Controller names e.g. "onos"
+	Controllers []string `json:"controllers,omitempty"`
+	// Controller identifiers
+	CIds []string `json:"cids,omitempty"`
+}
+
+// Grants a role to an identity on a scope
+type RoleBinding struct {
+	Id       string `json:"id"`
+	Identity string `json:"identity"`
+	Role     string `json:"role"`
+	Scope    Scope  `json:"scope"`
+}
+
+// An api user
+type User struct {
+	Name     string `json:"name"`
+	Disabled bool   `json:"disabled"`
+	// The tenant the user is restricted to, all the tenants if empty
+	Tenant  string    `json:"tenant,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+type SecretPutReq struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// The secret information returned by the read apis, without the value
+type SecretInfo struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// A tenant (a team or a project) owning controllers and secrets
+type Tenant struct {
+	Name string `json:"name"`
+	// Maximum number of running controllers, 0 for no limit
+	MaxControllers int `json:"maxControllers"`
+	// The controller plugins bound to the tenant, all of them if empty
+	Plugins []string `json:"plugins,omitempty"`
+}
+
+// The tenant information returned by the api
+type TenantInfo struct {
+	Tenant
+	RunningControllers int `json:"runningControllers"`
+}
+
+// The progress of an in-progress lifecycle operation, kept in the operations
+// bucket while the operation lasts and followed with the watch api
+type OperationProgress struct {
+	CId       string    `json:"cid"`
+	Name      string    `json:"name"`
+	CIL       string    `json:"cil"`
+	Operation string    `json:"operation"` // e.g. "start"
+	Percent   int       `json:"percent"`
+	Message   string    `json:"message,omitempty"`
+	Updated   time.Time `json:"updated"`
+}
+
+// A log line of a controller, the logs are streamed as json lines
+type LogLine struct {
+	Time time.Time `json:"time"`
+	Line string    `json:"line"`
+}
+
+// The health of a loaded plugin instance of a controller
+type PluginHealth struct {
+	Controller string    `json:"controller"`
+	Version    string    `json:"version"`
+	Status     string    `json:"status"` // "healthy" or "unhealthy"
+	Pid        int       `json:"pid"`
+	Protocol   int       `json:"protocol"`
+	Failures   int       `json:"failures"` // The failed checks in a row
+	LastCheck  time.Time `json:"lastCheck"`
+	LastError  string    `json:"lastError,omitempty"`
+	Reloads    int       `json:"reloads"`
+}
+
+type WatchResp struct {
+	Revision uint64        `json:"revision"` // The revision to resume the watch from
+	Events   []store.Event `json:"events"`
+}
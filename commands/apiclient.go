@@ -0,0 +1,61 @@
+package commands
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"net/http"
+	"org.openappstack/singularity/client"
+	"os"
+)
+
+// The agent api connection flags
+var (
+	apiAddress  string
+	apiToken    string
+	apiCA       string
+	apiInsecure bool
+)
+
+// Add the flags to reach the agent api to a command group
+func addApiFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVarP(&apiAddress, "address", "a", "https://127.0.0.1:8083", "the agent api address")
+	cmd.PersistentFlags().StringVarP(&apiToken, "token", "t", os.Getenv("SINGULARITY_TOKEN"), "the api token (default $SINGULARITY_TOKEN)")
+	cmd.PersistentFlags().StringVarP(&apiCA, "ca", "", "", "the CA certificate to verify the agent certificate")
+	cmd.PersistentFlags().BoolVarP(&apiInsecure, "insecure", "k", false, "skip the verification of the agent certificate")
+}
+
+// Get a client of the agent api from the connection flags
+func apiClient() *client.Client {
+	tlsConfig := &tls.Config{InsecureSkipVerify: apiInsecure}
+	if apiCA != "" {
+		pem, err := ioutil.ReadFile(apiCA)
+		exitOnError(err)
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pem)
+		tlsConfig.RootCAs = pool
+	}
+	return &client.Client{
+		BaseURL:    apiAddress,
+		Token:      apiToken,
+		HTTPClient: &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+	}
+}
+
+// Exit on a failed command
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// Exit with the usage unless the command got the expected number of arguments
+func expectArgs(cmd *cobra.Command, args []string, count int) {
+	if len(args) != count {
+		cmd.Usage()
+		os.Exit(1)
+	}
+}
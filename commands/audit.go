@@ -0,0 +1,59 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"org.openappstack/singularity/client"
+	"os"
+	"time"
+)
+
+var (
+	auditFrom     string
+	auditTo       string
+	auditIdentity string
+	auditKind     string
+	auditLimit    int
+	auditJsonl    bool
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Show the Singularity audit log",
+	Long: `Show the audit records of the mutating api requests and of the plugin
+events. Use --jsonl to export the records as json lines.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		query := &client.AuditQuery{Identity: auditIdentity, Kind: auditKind, Limit: auditLimit}
+		for t, flag := range map[*time.Time]string{&query.From: auditFrom, &query.To: auditTo} {
+			if flag != "" {
+				parsed, err := time.Parse(time.RFC3339, flag)
+				exitOnError(err)
+				*t = parsed
+			}
+		}
+
+		records, err := apiClient().Audit(query)
+		exitOnError(err)
+		encoder := json.NewEncoder(os.Stdout)
+		for _, record := range records {
+			if auditJsonl {
+				encoder.Encode(record)
+				continue
+			}
+			fmt.Printf("%s %-8s %-16s %-40s %-8s cid: %-6s %s %s\n", record.Time.Format("2006-01-02T15:04:05Z"), record.Outcome,
+				record.Identity, record.Route, record.Tenant, record.CId, record.Summary, record.Error)
+		}
+	},
+}
+
+func init() {
+	addApiFlags(auditCmd)
+
+	auditCmd.Flags().StringVar(&auditFrom, "from", "", "the start of the time range (RFC 3339)")
+	auditCmd.Flags().StringVar(&auditTo, "to", "", "the end of the time range (RFC 3339)")
+	auditCmd.Flags().StringVar(&auditIdentity, "identity", "", "only the records of this identity")
+	auditCmd.Flags().StringVar(&auditKind, "kind", "", `only the records of this kind ("api" or "plugin")`)
+	auditCmd.Flags().IntVarP(&auditLimit, "limit", "n", 0, "only the latest records")
+	auditCmd.Flags().BoolVarP(&auditJsonl, "jsonl", "", false, "export the records as json lines")
+}
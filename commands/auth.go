@@ -0,0 +1,238 @@
+package commands
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"org.openappstack/singularity/agent"
+	"org.openappstack/singularity/client"
+	"os"
+	"strings"
+)
+
+var authCmd = &cobra.Command{
+	Use:   "auth",
+	Short: "Manage the Singularity api authentication and authorization",
+	Long: `Manage the users, tokens and role bindings of the Singularity api.
+The roles are viewer, operator and admin. A binding may be restricted to
+some tenants, controller names or controller ids. A user or a token may be
+restricted to a tenant.`,
+}
+
+var authTokenHashCmd = &cobra.Command{
+	Use:   "token-hash [token]",
+	Short: "Hash a token for the configuration",
+	Long: `Print the hash of a token to use in Auth.Tokens of singularity.conf.
+A new random token is generated if none is given.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var token string
+		switch len(args) {
+		case 0:
+			var err error
+			if token, err = agent.GenerateToken(); err != nil {
+				fmt.Printf("Failed to generate a token: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Token: %s\n", token)
+		case 1:
+			token = args[0]
+		default:
+			cmd.Usage()
+			os.Exit(1)
+		}
+		fmt.Printf("Hash: sha256:%s\n", agent.HashToken(token))
+	},
+}
+
+/**** Users ****/
+
+var authUsersCmd = &cobra.Command{
+	Use:   "users",
+	Short: "Manage the api users",
+}
+
+var authUsersListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the users",
+	Run: func(cmd *cobra.Command, args []string) {
+		users, err := apiClient().ListUsers()
+		exitOnError(err)
+		for _, user := range users {
+			fmt.Printf("%-24s tenant: %-16s disabled: %-5v created: %s\n", user.Name, orAll(user.Tenant), user.Disabled, user.Created)
+		}
+	},
+}
+
+var userTenant string
+
+// Create a command saving a user with the given disabled state. The tenant
+// of an existing user is kept unless --tenant is given.
+func userSaveCmd(use, short string, disabled bool) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   use + " <name>",
+		Short: short,
+		Run: func(cmd *cobra.Command, args []string) {
+			expectArgs(cmd, args, 1)
+			user := &client.User{Name: args[0], Disabled: disabled, Tenant: userTenant}
+			if !cmd.Flags().Changed("tenant") {
+				users, err := apiClient().ListUsers()
+				exitOnError(err)
+				for _, existing := range users {
+					if existing.Name == user.Name {
+						user.Tenant = existing.Tenant
+					}
+				}
+			}
+			exitOnError(apiClient().SaveUser(user))
+			fmt.Printf("User %s saved\n", args[0])
+		},
+	}
+	cmd.Flags().StringVar(&userTenant, "tenant", "", "restrict the user to a tenant (all the tenants if empty)")
+	return cmd
+}
+
+// Display an empty tenant as all the tenants
+func orAll(tenant string) string {
+	if tenant == "" {
+		return "*"
+	}
+	return tenant
+}
+
+var authUsersRemoveCmd = &cobra.Command{
+	Use:   "remove <name>",
+	Short: "Remove a user with its tokens and role bindings",
+	Run: func(cmd *cobra.Command, args []string) {
+		expectArgs(cmd, args, 1)
+		exitOnError(apiClient().DeleteUser(args[0]))
+		fmt.Printf("User %s removed\n", args[0])
+	},
+}
+
+/**** Tokens ****/
+
+var (
+	tokenTTL    string
+	tokenTenant string
+)
+
+var authTokensCmd = &cobra.Command{
+	Use:   "tokens",
+	Short: "Manage the api tokens",
+}
+
+var authTokensCreateCmd = &cobra.Command{
+	Use:   "create <user>",
+	Short: "Create a token for a user, it is only displayed once",
+	Run: func(cmd *cobra.Command, args []string) {
+		expectArgs(cmd, args, 1)
+		resp, err := apiClient().CreateToken(&client.TokenCreateReq{Identity: args[0], Tenant: tokenTenant, TTL: tokenTTL})
+		exitOnError(err)
+		fmt.Printf("Id: %s\nToken: %s\n", resp.Id, resp.Token)
+	},
+}
+
+var authTokensListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the tokens",
+	Run: func(cmd *cobra.Command, args []string) {
+		tokens, err := apiClient().ListTokens()
+		exitOnError(err)
+		for _, token := range tokens {
+			fmt.Printf("%s  %-24s tenant: %-16s created: %s expires: %s\n", token.Id, token.Identity, orAll(token.Tenant), token.Created, token.Expires)
+		}
+	},
+}
+
+var authTokensRevokeCmd = &cobra.Command{
+	Use:   "revoke <id>",
+	Short: "Revoke a token",
+	Run: func(cmd *cobra.Command, args []string) {
+		expectArgs(cmd, args, 1)
+		exitOnError(apiClient().RevokeToken(args[0]))
+		fmt.Printf("Token %s revoked\n", args[0])
+	},
+}
+
+/**** Role bindings ****/
+
+var (
+	bindingTenants     []string
+	bindingControllers []string
+	bindingCIds        []string
+)
+
+var authBindingsCmd = &cobra.Command{
+	Use:   "bindings",
+	Short: "Manage the role bindings",
+}
+
+var authBindingsAddCmd = &cobra.Command{
+	Use:   "add <identity> <viewer|operator|admin>",
+	Short: "Bind a role to a user or a client certificate name",
+	Run: func(cmd *cobra.Command, args []string) {
+		expectArgs(cmd, args, 2)
+		binding := &client.RoleBinding{
+			Identity: args[0],
+			Role:     args[1],
+			Scope:    client.Scope{Tenants: bindingTenants, Controllers: bindingControllers, CIds: bindingCIds},
+		}
+		id, err := apiClient().AddBinding(binding)
+		exitOnError(err)
+		fmt.Printf("Binding %s added\n", id)
+	},
+}
+
+var authBindingsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the role bindings",
+	Run: func(cmd *cobra.Command, args []string) {
+		bindings, err := apiClient().ListBindings()
+		exitOnError(err)
+		for _, binding := range bindings {
+			id := binding.Id
+			if id == "" {
+				id = "(config)"
+			}
+			fmt.Printf("%-16s %-24s %-8s tenants: [%s] controllers: [%s] cids: [%s]\n", id, binding.Identity, binding.Role,
+				strings.Join(binding.Scope.Tenants, ","), strings.Join(binding.Scope.Controllers, ","), strings.Join(binding.Scope.CIds, ","))
+		}
+	},
+}
+
+var authBindingsRemoveCmd = &cobra.Command{
+	Use:   "remove <id>",
+	Short: "Remove a role binding",
+	Run: func(cmd *cobra.Command, args []string) {
+		expectArgs(cmd, args, 1)
+		exitOnError(apiClient().DeleteBinding(args[0]))
+		fmt.Printf("Binding %s removed\n", args[0])
+	},
+}
+
+func init() {
+	addApiFlags(authCmd)
+
+	authUsersCmd.AddCommand(authUsersListCmd)
+	authUsersCmd.AddCommand(userSaveCmd("add", "Add a user", false))
+	authUsersCmd.AddCommand(userSaveCmd("enable", "Enable a user", false))
+	authUsersCmd.AddCommand(userSaveCmd("disable", "Disable a user, its tokens are rejected", true))
+	authUsersCmd.AddCommand(authUsersRemoveCmd)
+
+	authTokensCreateCmd.Flags().StringVarP(&tokenTTL, "ttl", "", "", "the token validity e.g. 720h (no expiry by default)")
+	authTokensCreateCmd.Flags().StringVar(&tokenTenant, "tenant", "", "restrict the token to a tenant (the tenant of the user by default)")
+	authTokensCmd.AddCommand(authTokensCreateCmd)
+	authTokensCmd.AddCommand(authTokensListCmd)
+	authTokensCmd.AddCommand(authTokensRevokeCmd)
+
+	authBindingsAddCmd.Flags().StringSliceVar(&bindingTenants, "tenants", nil, "restrict the binding to these tenants")
+	authBindingsAddCmd.Flags().StringSliceVar(&bindingControllers, "controllers", nil, "restrict the binding to these controller names")
+	authBindingsAddCmd.Flags().StringSliceVar(&bindingCIds, "cids", nil, "restrict the binding to these controller ids")
+	authBindingsCmd.AddCommand(authBindingsAddCmd)
+	authBindingsCmd.AddCommand(authBindingsListCmd)
+	authBindingsCmd.AddCommand(authBindingsRemoveCmd)
+
+	authCmd.AddCommand(authTokenHashCmd)
+	authCmd.AddCommand(authUsersCmd)
+	authCmd.AddCommand(authTokensCmd)
+	authCmd.AddCommand(authBindingsCmd)
+}
@@ -21,4 +21,9 @@ func Execute() {
 func AddSubcommands() {
 	MainCmd.AddCommand(versionCmd)
 	MainCmd.AddCommand(startCmd)
+	MainCmd.AddCommand(storeCmd)
+	MainCmd.AddCommand(authCmd)
+	MainCmd.AddCommand(tenantsCmd)
+	MainCmd.AddCommand(auditCmd)
+	MainCmd.AddCommand(pdkCmd)
 }
@@ -0,0 +1,90 @@
+package commands
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"org.openappstack/singularity/pluginmanager"
+	"org.openappstack/singularity/pluginmanager/pdk"
+	"os"
+	"path/filepath"
+)
+
+var (
+	pdkController string
+	pdkVersion    string
+	pdkTransport  string
+	pdkOutput     string
+)
+
+var pdkCmd = &cobra.Command{
+	Use:   "pdk",
+	Short: "Develop the Singularity plugins",
+	Long: `The plugin development kit: generate a lifecycle plugin, build its binary,
+package it and validate the package before copying it to the plugin location
+of the agent.`,
+}
+
+var pdkInitCmd = &cobra.Command{
+	Use:   "init <dir>",
+	Short: "Generate the skeleton of a lifecycle plugin",
+	Run: func(cmd *cobra.Command, args []string) {
+		expectArgs(cmd, args, 1)
+		exitOnError(pdk.Init(args[0], &pdk.InitOptions{Controller: pdkController, Version: pdkVersion, Transport: pdkTransport}))
+		fmt.Printf("Plugin generated in %s\n", args[0])
+	},
+}
+
+var pdkBuildCmd = &cobra.Command{
+	Use:   "build <dir>",
+	Short: "Build the " + pluginmanager.PluginBinary + " binary of a plugin",
+	Run: func(cmd *cobra.Command, args []string) {
+		expectArgs(cmd, args, 1)
+		exitOnError(pdk.Build(args[0], os.Stdout))
+		fmt.Printf("Plugin built: %s\n", filepath.Join(args[0], pluginmanager.PluginBinary))
+	},
+}
+
+var pdkPackageCmd = &cobra.Command{
+	Use:   "package <dir>",
+	Short: "Package a built plugin with the checksums of its files",
+	Long: `Package a built plugin as <name>.tar, named after its directory by default.
+The plugin registry discovers the packages copied to its plugin location.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		expectArgs(cmd, args, 1)
+		output := pdkOutput
+		if output == "" {
+			dir, err := filepath.Abs(args[0])
+			exitOnError(err)
+			output = filepath.Base(dir) + pluginmanager.DefaultTarExt
+		}
+		exitOnError(pdk.Package(args[0], output))
+		fmt.Printf("Plugin packaged: %s\n", output)
+	},
+}
+
+var pdkValidateCmd = &cobra.Command{
+	Use:   "validate <package>",
+	Short: "Validate a plugin package before its deployment",
+	Run: func(cmd *cobra.Command, args []string) {
+		expectArgs(cmd, args, 1)
+		problems := pdk.Validate(args[0])
+		for _, problem := range problems {
+			fmt.Printf("%s: %v\n", args[0], problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Printf("Package %s is valid\n", args[0])
+	},
+}
+
+func init() {
+	pdkInitCmd.Flags().StringVarP(&pdkController, "controller", "c", "", "the controller served by the plugin")
+	pdkInitCmd.Flags().StringVarP(&pdkVersion, "version", "v", "", "the version of the controller")
+	pdkInitCmd.Flags().StringVarP(&pdkTransport, "transport", "", pluginmanager.TransportHttp, "the plugin transport: http or grpc")
+	pdkPackageCmd.Flags().StringVarP(&pdkOutput, "output", "o", "", "the package file (<dir name>.tar by default)")
+	pdkCmd.AddCommand(pdkInitCmd)
+	pdkCmd.AddCommand(pdkBuildCmd)
+	pdkCmd.AddCommand(pdkPackageCmd)
+	pdkCmd.AddCommand(pdkValidateCmd)
+}
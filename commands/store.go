@@ -0,0 +1,58 @@
+package commands
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"org.openappstack/singularity/agent"
+	store "org.openappstack/singularity/store"
+	"os"
+)
+
+var storeCmd = &cobra.Command{
+	Use:   "store",
+	Short: "Manage the Singularity kv store",
+	Long:  `Maintenance of the kv store. Run these commands while Singularity is stopped.`,
+}
+
+var storeKeygenCmd = &cobra.Command{
+	Use:   "keygen <keyfile>",
+	Short: "Generate a key file for the kv store encryption",
+	Long:  `Generate a random key to reference as Encryption.KeyFile in singularity.conf`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+		if _, err := os.Stat(args[0]); err == nil {
+			fmt.Printf("Key file %s already exists\n", args[0])
+			os.Exit(1)
+		}
+		if err := store.GenerateKeyFile(args[0]); err != nil {
+			fmt.Printf("Failed to generate the key file: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Key file %s generated\n", args[0])
+	},
+}
+
+var storeReencryptCmd = &cobra.Command{
+	Use:   "reencrypt",
+	Short: "Re-encrypt the kv store with the primary key",
+	Long: `Rewrite the values of the encrypted buckets with the configured primary key.
+To rotate the key, set the new key as Encryption.KeyFile (or Passphrase), move
+the previous one to Encryption.OldKeyFiles (or OldPassphrases) and run this command.
+Plaintext values written before the encryption was enabled are encrypted as well.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		count, err := agent.ReEncryptStore()
+		if err != nil {
+			fmt.Printf("Failed to re-encrypt the kv store: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Re-encrypted %d values\n", count)
+	},
+}
+
+func init() {
+	storeCmd.AddCommand(storeKeygenCmd)
+	storeCmd.AddCommand(storeReencryptCmd)
+}
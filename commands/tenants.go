@@ -0,0 +1,65 @@
+package commands
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"org.openappstack/singularity/client"
+	"strings"
+)
+
+var (
+	tenantMaxControllers int
+	tenantPlugins        []string
+)
+
+var tenantsCmd = &cobra.Command{
+	Use:   "tenants",
+	Short: "Manage the Singularity tenants",
+	Long: `Manage the tenants owning the controllers and the secrets. The tenant
+scoped api is served on /v1/api/tenants/<tenant>/, the unscoped api acts on
+the default tenant.`,
+}
+
+var tenantsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the tenants and their running controllers",
+	Run: func(cmd *cobra.Command, args []string) {
+		tenants, err := apiClient().ListTenants()
+		exitOnError(err)
+		for _, tenant := range tenants {
+			fmt.Printf("%-24s running: %d/%d plugins: [%s]\n", tenant.Name, tenant.RunningControllers,
+				tenant.MaxControllers, strings.Join(tenant.Plugins, ","))
+		}
+	},
+}
+
+var tenantsSaveCmd = &cobra.Command{
+	Use:   "save <name>",
+	Short: "Create or update a tenant",
+	Run: func(cmd *cobra.Command, args []string) {
+		expectArgs(cmd, args, 1)
+		tenant := &client.Tenant{Name: args[0], MaxControllers: tenantMaxControllers, Plugins: tenantPlugins}
+		exitOnError(apiClient().SaveTenant(tenant))
+		fmt.Printf("Tenant %s saved\n", args[0])
+	},
+}
+
+var tenantsRemoveCmd = &cobra.Command{
+	Use:   "remove <name>",
+	Short: "Remove a tenant without running controllers",
+	Run: func(cmd *cobra.Command, args []string) {
+		expectArgs(cmd, args, 1)
+		exitOnError(apiClient().DeleteTenant(args[0]))
+		fmt.Printf("Tenant %s removed\n", args[0])
+	},
+}
+
+func init() {
+	addApiFlags(tenantsCmd)
+
+	tenantsSaveCmd.Flags().IntVarP(&tenantMaxControllers, "max-controllers", "", 0, "the maximum number of running controllers (0 for no limit)")
+	tenantsSaveCmd.Flags().StringSliceVar(&tenantPlugins, "plugins", nil, "the controller plugins bound to the tenant (all of them by default)")
+	tenantsCmd.AddCommand(tenantsListCmd)
+	tenantsCmd.AddCommand(tenantsSaveCmd)
+	tenantsCmd.AddCommand(tenantsRemoveCmd)
+}
@@ -0,0 +1,112 @@
+package pluginmanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	PluginConn "org.openappstack/singularity/pluginmanager/pluginconn"
+	"time"
+)
+
+// The agent side of the event delivery: a subscription per callback streams
+// the events of the plugin, delivers them in order once and acknowledges them.
+// A failed subscription is reopened after a backoff, resuming after the last
+// delivered event.
+
+const (
+	// The backoff of the reopened subscriptions, doubled on every failure
+	EventsMinBackoff = 100 * time.Millisecond
+	EventsMaxBackoff = 30 * time.Second
+	// The deadline of an acknowledgement
+	EventsAckTimeout = 10 * time.Second
+)
+
+/* Internal: Run the receiving of the notifications of a callback until the context is done, retrying it with a backoff */
+func (plugin *Plugin) receiveEvents(ctx context.Context, funcName string, receive func(context.Context) (bool, error)) {
+	backoff := EventsMinBackoff
+	for {
+		delivered, err := receive(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if delivered {
+			backoff = EventsMinBackoff
+		}
+		log.ERROR.Printf("Events of callback %s of controller %s interrupted, retrying in %v: %v", funcName, plugin.Controller, backoff, err)
+		if _, connected := plugin.connection(); !connected {
+			if reconnectErr := plugin.ReConnect(); reconnectErr != nil {
+				log.DEBUG.Printf("Failed to reconnect plugin of controller %s: %v", plugin.Controller, reconnectErr)
+			}
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > EventsMaxBackoff {
+			backoff = EventsMaxBackoff
+		}
+	}
+}
+
+/* Internal: Deliver the events of a subscription until it fails, the next one resumes after the last delivered */
+func (plugin *Plugin) subscribeEvents(ctx context.Context, subscription *EventsRequest, function func([]byte)) (bool, error) {
+	// The delivered events are acknowledged in the background, the latest only
+	acks := make(chan EventsAck, 1)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go plugin.ackEvents(ctx, acks)
+
+	delivered := false
+	err := plugin.stream(ctx, MethodEventsSubscribe, subscription, PluginConn.NoTimeout, func(chunk json.RawMessage) error {
+		if err := ctx.Err(); err != nil {
+			// The received events are delivered again by the next subscription
+			return err
+		}
+		event := &Event{}
+		if err := json.Unmarshal(chunk, event); err != nil {
+			return fmt.Errorf("Invalid event: %v", err)
+		}
+		if event.Epoch != subscription.Epoch {
+			// The plugin restarted, its events are numbered again
+			subscription.Epoch, subscription.After = event.Epoch, 0
+		}
+		if event.Seq <= subscription.After {
+			// Delivered before the resumption
+			return nil
+		}
+		function(event.Data)
+		subscription.After = event.Seq
+		delivered = true
+
+		select {
+		case <-acks:
+		default:
+		}
+		acks <- EventsAck{Callback: subscription.Callback, Epoch: event.Epoch, Seq: event.Seq}
+		return nil
+	}, nil)
+	if err == nil {
+		err = fmt.Errorf("Subscription ended by the plugin")
+	}
+	return delivered, err
+}
+
+/* Internal: Acknowledge the delivered events until the context is done, the plugin buffers them until then */
+func (plugin *Plugin) ackEvents(ctx context.Context, acks <-chan EventsAck) {
+	for {
+		select {
+		case ack := <-acks:
+			ackCtx, cancel := context.WithTimeout(ctx, EventsAckTimeout)
+			if err := plugin.Call(ackCtx, MethodEventsAck, &ack, nil); err != nil && ctx.Err() == nil {
+				// The resumed subscription acknowledges them
+				log.DEBUG.Printf("Failed to acknowledge the events of callback %s: %v", ack.Callback, err)
+			}
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package pluginmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The plugin side of the event delivery: the notifications of each callback
+// are numbered and buffered until the agent acknowledges them, a subscription
+// interrupted by a reconnection resumes after the last delivered one.
+
+const (
+	// The unacknowledged notifications kept per callback, Notify waits for room beyond
+	DefaultEventBuffer = 1024
+	// The maximum wait of Notify for room in the buffer
+	NotifyTimeout = 30 * time.Second
+)
+
+var (
+	// The buffer of a callback stayed full, the agent is not acknowledging its events
+	ErrEventBufferFull = errors.New("Event buffer full")
+
+	// The event queues by callback name, created on the first notification or subscription
+	eventQueues = make(map[string]*eventQueue)
+	eventsLock  sync.Mutex
+	// The size of the event queues, from the plugin configuration
+	eventBufferSize = DefaultEventBuffer
+
+	// The epoch of the plugin process, the agent restarts the sequence numbers on a change
+	eventsEpoch = strconv.FormatInt(time.Now().UnixNano(), 36)
+)
+
+/* The unacknowledged events of a callback, in the order of the notifications */
+type eventQueue struct {
+	lock   sync.Mutex
+	events []*Event
+	// The sequence number of the last notification
+	seq uint64
+	// Closed and replaced on every change of the queue
+	changed chan struct{}
+}
+
+/* Internal: Get the event queue of a callback, created if none */
+func eventQueueOf(callback string) *eventQueue {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	queue, ok := eventQueues[callback]
+	if !ok {
+		queue = &eventQueue{changed: make(chan struct{})}
+		eventQueues[callback] = queue
+	}
+	return queue
+}
+
+/* Internal: Wake up the waiters of the queue, the queue is locked */
+func (queue *eventQueue) broadcast() {
+	close(queue.changed)
+	queue.changed = make(chan struct{})
+}
+
+/* Internal: Append a notification, waiting for room in the buffer until the context is done */
+func (queue *eventQueue) push(ctx context.Context, data []byte) error {
+	queue.lock.Lock()
+	for len(queue.events) >= eventBufferSize {
+		changed := queue.changed
+		queue.lock.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v", ErrEventBufferFull, ctx.Err())
+		}
+		queue.lock.Lock()
+	}
+	defer queue.lock.Unlock()
+	queue.seq++
+	queue.events = append(queue.events, &Event{Epoch: eventsEpoch, Seq: queue.seq, Data: append([]byte(nil), data...)})
+	queue.broadcast()
+	return nil
+}
+
+/* Internal: Drop the events acknowledged up to a sequence number, making room for the notifications */
+func (queue *eventQueue) ack(seq uint64) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	acked := 0
+	for acked < len(queue.events) && queue.events[acked].Seq <= seq {
+		acked++
+	}
+	if acked > 0 {
+		queue.events = append([]*Event(nil), queue.events[acked:]...)
+		queue.broadcast()
+	}
+}
+
+/* Internal: Wait for the events after a sequence number, nil if the context is done first */
+func (queue *eventQueue) after(ctx context.Context, seq uint64) []*Event {
+	for {
+		queue.lock.Lock()
+		var events []*Event
+		for _, event := range queue.events {
+			if event.Seq > seq {
+				events = append(events, event)
+			}
+		}
+		changed := queue.changed
+		queue.lock.Unlock()
+		if len(events) > 0 {
+			return events
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+/* Internal Method: Register the event delivery methods, served by every plugin */
+func (plugin *PluginImpl) registerEvents() {
+	plugin.RegisterStream(MethodEventsSubscribe, serveEvents)
+	plugin.RegisterCall(MethodEventsAck, serveEventsAck)
+}
+
+// The subscribe method, streaming the events of a callback until the agent cancels
+func serveEvents(ctx context.Context, payload json.RawMessage, send func(interface{}) error) (interface{}, error) {
+	request := &EventsRequest{}
+	if err := json.Unmarshal(payload, request); err != nil || request.Callback == "" {
+		return nil, &PluginError{Code: ErrCodeInvalidRequest, Message: "Invalid events subscription"}
+	}
+	queue := eventQueueOf(request.Callback)
+
+	// A resumed subscription acknowledges what was delivered, the events of
+	// a previous plugin process are lost and the agent starts over
+	after := request.After
+	if request.Epoch == eventsEpoch {
+		queue.ack(after)
+	} else {
+		after = 0
+	}
+	for {
+		events := queue.after(ctx, after)
+		if events == nil {
+			return nil, ctx.Err()
+		}
+		for _, event := range events {
+			if err := send(event); err != nil {
+				return nil, err
+			}
+			after = event.Seq
+		}
+	}
+}
+
+// The ack method, the acknowledgements of a previous plugin process are ignored
+func serveEventsAck(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	request := &EventsAck{}
+	if err := json.Unmarshal(payload, request); err != nil || request.Callback == "" {
+		return nil, &PluginError{Code: ErrCodeInvalidRequest, Message: "Invalid events acknowledgement"}
+	}
+	if request.Epoch == eventsEpoch {
+		eventQueueOf(request.Callback).ack(request.Seq)
+	}
+	return nil, nil
+}
+
+/* Internal: Wait for the next event of a callback and acknowledge it on delivery, for the agents without subscriptions */
+func nextEvent(ctx context.Context, callback string, deliver func(*Event) error) error {
+	queue := eventQueueOf(callback)
+	events := queue.after(ctx, 0)
+	if events == nil {
+		return ctx.Err()
+	}
+	if err := deliver(events[0]); err != nil {
+		return err
+	}
+	queue.ack(events[0].Seq)
+	return nil
+}
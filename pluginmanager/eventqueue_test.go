@@ -0,0 +1,167 @@
+package pluginmanager
+
+import (
+	"context"
+	"errors"
+	PluginConn "org.openappstack/singularity/pluginmanager/pluginconn"
+	"org.openappstack/singularity/pluginmanager/pluginrpc"
+	"testing"
+	"time"
+)
+
+func TestEventQueue(t *testing.T) {
+	saved := eventBufferSize
+	defer func() { eventBufferSize = saved }()
+	eventBufferSize = 2
+
+	queue := &eventQueue{changed: make(chan struct{})}
+	for _, data := range []string{"one", "two"} {
+		if err := queue.push(context.Background(), []byte(data)); err != nil {
+			t.Fatalf("Err: %s", err)
+		}
+	}
+
+	// The full buffer holds the notifications back
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := queue.push(ctx, []byte("three")); !errors.Is(err, ErrEventBufferFull) {
+		t.Errorf("Expected ErrEventBufferFull, got %v", err)
+	}
+	pushed := make(chan error)
+	go func() { pushed <- queue.push(context.Background(), []byte("three")) }()
+
+	events := queue.after(context.Background(), 0)
+	if len(events) != 2 || events[0].Seq != 1 || string(events[1].Data) != "two" {
+		t.Fatalf("Unexpected events %v", events)
+	}
+	queue.ack(1)
+	if err := <-pushed; err != nil {
+		t.Errorf("Err: %s", err)
+	}
+	if events := queue.after(context.Background(), 2); len(events) != 1 || events[0].Seq != 3 {
+		t.Errorf("Unexpected events %v", events)
+	}
+
+	// No event after the last one
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if events := queue.after(ctx, 3); events != nil {
+		t.Errorf("Unexpected events %v", events)
+	}
+}
+
+func TestEventDelivery(t *testing.T) {
+	for _, transport := range []string{TransportHttp, TransportGrpc} {
+		t.Run(transport, func(t *testing.T) {
+			impl := newProtocolImpl()
+			impl.registerEvents()
+			var plugin *Plugin
+			if transport == TransportGrpc {
+				sockFile := serveRpcPlugin(t, impl)
+				rpcConn, err := pluginrpc.Dial(sockFile)
+				if err != nil {
+					t.Fatalf("Err: %s", err)
+				}
+				pluginConn, err := PluginConn.NewPluginClient(sockFile)
+				if err != nil {
+					t.Fatalf("Err: %s", err)
+				}
+				defer rpcConn.Close()
+				defer pluginConn.Close()
+				plugin = &Plugin{PluginUrl: "unix://plugin", PluginSock: sockFile, pluginConn: pluginConn, rpcConn: rpcConn, connected: true, callbacks: map[string]bool{}, Controller: "onos", transport: TransportGrpc}
+			} else {
+				plugin = serveProtocolPlugin(t, impl)
+			}
+			if err := plugin.handshake(); err != nil {
+				t.Fatalf("Err: %s", err)
+			}
+
+			// The notifications before the subscription are buffered
+			received := make(chan string, 16)
+			callback := func(data []byte) { received <- string(data) }
+			name := getFuncName(callback)
+			for _, data := range []string{"one", "two"} {
+				if err := impl.Notify(name, []byte(data)); err != nil {
+					t.Fatalf("Err: %s", err)
+				}
+			}
+			if err := plugin.RegisterCallback(callback); err != nil {
+				t.Fatalf("Err: %s", err)
+			}
+			defer plugin.closeEvents()
+			impl.Notify(name, []byte("three"))
+			for _, expected := range []string{"one", "two", "three"} {
+				if data := <-received; data != expected {
+					t.Errorf("Expected %s, got %s", expected, data)
+				}
+			}
+
+			// The delivered events are acknowledged
+			queue := eventQueueOf(name)
+			for i := 0; ; i++ {
+				queue.lock.Lock()
+				pending := len(queue.events)
+				queue.lock.Unlock()
+				if pending == 0 {
+					break
+				}
+				if i > 1000 {
+					t.Fatalf("The events are not acknowledged")
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestEventResume(t *testing.T) {
+	impl := newProtocolImpl()
+	impl.registerEvents()
+	plugin := serveProtocolPlugin(t, impl)
+	if err := plugin.handshake(); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+
+	eventsLock.Lock()
+	delete(eventQueues, "test-resume")
+	eventsLock.Unlock()
+	for _, data := range []string{"one", "two", "three"} {
+		impl.Notify("test-resume", []byte(data))
+	}
+
+	// The subscription is interrupted after the first event
+	subscription := &EventsRequest{Callback: "test-resume"}
+	var received []string
+	ctx, cancel := context.WithCancel(context.Background())
+	delivered, err := plugin.subscribeEvents(ctx, subscription, func(data []byte) {
+		received = append(received, string(data))
+		cancel()
+	})
+	if !delivered || err == nil || subscription.After != 1 || subscription.Epoch != eventsEpoch {
+		t.Fatalf("Unexpected subscription %+v %v %v", subscription, delivered, err)
+	}
+
+	// The resumed subscription delivers the next ones only
+	ctx, cancel = context.WithCancel(context.Background())
+	plugin.subscribeEvents(ctx, subscription, func(data []byte) {
+		received = append(received, string(data))
+		if len(received) == 3 {
+			cancel()
+		}
+	})
+	if len(received) != 3 || received[1] != "two" || received[2] != "three" {
+		t.Errorf("Unexpected events %v", received)
+	}
+
+	// A subscription of a previous plugin process starts over
+	impl.Notify("test-resume", []byte("four"))
+	subscription = &EventsRequest{Callback: "test-resume", Epoch: "previous", After: 3}
+	ctx, cancel = context.WithCancel(context.Background())
+	plugin.subscribeEvents(ctx, subscription, func(data []byte) {
+		received = append(received, string(data))
+		cancel()
+	})
+	if len(received) != 4 || subscription.Epoch != eventsEpoch {
+		t.Errorf("Expected the events of the plugin process to be replayed, got %v", received)
+	}
+}
@@ -0,0 +1,215 @@
+package pluginmanager
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	"sync"
+	"time"
+)
+
+// The health checks of the loaded plugins: the plugin store pings them on an
+// interval, a failed check reconnects the plugin and a plugin failing the
+// threshold of checks in a row is unhealthy and reloaded. The changes of the
+// health are notified as plugin events.
+
+// The plugin health states
+const (
+	PluginHealthy   = "healthy"
+	PluginUnhealthy = "unhealthy"
+)
+
+const (
+	DefaultHealthInterval  = 10 * time.Second
+	DefaultHealthThreshold = 3
+)
+
+var (
+	// The interval of the health checks, none if 0, set before the plugin store init
+	HealthCheckInterval = DefaultHealthInterval
+	// The failed checks in a row making a plugin unhealthy
+	HealthFailureThreshold = DefaultHealthThreshold
+
+	// No plugin serves the controller
+	ErrPluginNotFound error = errors.New("Plugin not found")
+)
+
+// PluginHealth reports the health of a loaded plugin
+type PluginHealth struct {
+	Controller string
+	Version    string
+	Status     string
+	Pid        int
+	Protocol   int
+	// The failed checks in a row
+	Failures  int
+	LastCheck time.Time
+	LastError string
+	// The reloads of the unhealthy plugin
+	Reloads int
+}
+
+/* The health state of a plugin, synced by the plugin lock */
+type pluginHealth struct {
+	unhealthy bool
+	failures  int
+	lastCheck time.Time
+	lastError string
+	reloads   int
+}
+
+/* The periodic health checks of the plugin store */
+type healthChecker struct {
+	interval  time.Duration
+	threshold int
+	// Reloads an unhealthy plugin, unless its failing process pid was replaced already
+	reload func(*Plugin, int) error
+	stop   chan struct{}
+	// Closed once the checks are done
+	done chan struct{}
+}
+
+/* Internal: Create the health checker of the plugin store */
+func newHealthChecker(interval time.Duration, threshold int) *healthChecker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &healthChecker{interval: interval, threshold: threshold, reload: (*Plugin).reloadFrom, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+/* Internal: Check the loaded plugins on every interval until stopped */
+func (checker *healthChecker) run(plugins func() []*Plugin) {
+	defer close(checker.done)
+	ticker := time.NewTicker(checker.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// A plugin not answering doesn't delay the checks of the others
+			var wg sync.WaitGroup
+			for _, plugin := range plugins() {
+				wg.Add(1)
+				go func(plugin *Plugin) {
+					defer wg.Done()
+					checker.check(plugin)
+				}(plugin)
+			}
+			wg.Wait()
+		case <-checker.stop:
+			return
+		}
+	}
+}
+
+/* Internal: Stop the checks, waiting for the ones in progress */
+func (checker *healthChecker) close() {
+	close(checker.stop)
+	<-checker.done
+}
+
+/* Internal: Check the health of a plugin, reconnecting it on a failure and reloading it once unhealthy */
+func (checker *healthChecker) check(plugin *Plugin) {
+	// The failure is of this process, a concurrent reload may replace it
+	pid := plugin.processId()
+	err := plugin.Ping()
+	if err != nil {
+		if _, connected := plugin.connection(); !connected && plugin.ReConnect() == nil {
+			// A broken connection only
+			err = plugin.Ping()
+		}
+	}
+
+	plugin.lock.Lock()
+	health := &plugin.health
+	health.lastCheck = time.Now().UTC()
+	if err == nil {
+		health.failures = 0
+		health.lastError = ""
+	} else {
+		health.failures++
+		health.lastError = err.Error()
+	}
+	failures, unhealthy := health.failures, health.unhealthy
+	plugin.lock.Unlock()
+
+	switch {
+	case err == nil && unhealthy:
+		log.INFO.Printf("Plugin of controller %s is healthy again", plugin.Controller)
+		plugin.setHealth(false, nil)
+	case err != nil && failures >= checker.threshold:
+		if !unhealthy {
+			log.ERROR.Printf("Plugin of controller %s is unhealthy after %d failed checks: %v", plugin.Controller, failures, err)
+			plugin.setHealth(true, err)
+		}
+		if reloadErr := checker.reload(plugin, pid); reloadErr != nil {
+			log.ERROR.Printf("Failed to reload the unhealthy plugin of controller %s: %v", plugin.Controller, reloadErr)
+			return
+		}
+		plugin.lock.Lock()
+		plugin.health.reloads++
+		plugin.lock.Unlock()
+	case err != nil:
+		log.WARN.Printf("Health check %d of plugin of controller %s failed: %v", failures, plugin.Controller, err)
+	}
+}
+
+/* Internal: Set the health of a plugin and notify the change */
+func (plugin *Plugin) setHealth(unhealthy bool, err error) {
+	plugin.lock.Lock()
+	plugin.health.unhealthy = unhealthy
+	plugin.lock.Unlock()
+	if unhealthy {
+		notifyPluginEvent(PluginEventUnhealthy, plugin, err)
+	} else {
+		notifyPluginEvent(PluginEventHealthy, plugin, nil)
+	}
+}
+
+/* Internal: Get the health report of a plugin */
+func (plugin *Plugin) healthReport() PluginHealth {
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+	status := PluginHealthy
+	if plugin.health.unhealthy {
+		status = PluginUnhealthy
+	}
+	return PluginHealth{
+		Controller: plugin.Controller,
+		Version:    plugin.Version.start,
+		Status:     status,
+		Pid:        plugin.pid,
+		Protocol:   plugin.protocol,
+		Failures:   plugin.health.failures,
+		LastCheck:  plugin.health.lastCheck,
+		LastError:  plugin.health.lastError,
+		Reloads:    plugin.health.reloads,
+	}
+}
+
+/* Internal: Get the loaded plugins of the store */
+func (pluginStore *PluginStore) loadedPlugins() []*Plugin {
+	pluginStore.lock.Lock()
+	defer pluginStore.lock.Unlock()
+	plugins := make([]*Plugin, 0, len(pluginStore.allManagePlugins))
+	for _, plugin := range pluginStore.allManagePlugins {
+		plugins = append(plugins, plugin)
+	}
+	return plugins
+}
+
+/* Function to get the health of the loaded plugins of a controller, none if the plugin is not loaded yet */
+func GetPluginHealth(controller string) ([]PluginHealth, error) {
+	if pluginStore == nil {
+		return nil, fmt.Errorf("Plugin store not initialized")
+	}
+	healths := []PluginHealth{}
+	for _, plugin := range pluginStore.loadedPlugins() {
+		if plugin.Controller == controller {
+			healths = append(healths, plugin.healthReport())
+		}
+	}
+	if len(healths) == 0 && !pluginStore.pluginReg.servesController(controller) {
+		return nil, ErrPluginNotFound
+	}
+	return healths, nil
+}
@@ -0,0 +1,195 @@
+package pluginmanager
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	var failing atomic.Bool
+	impl := newProtocolImpl()
+	impl.methodRegistry["Ping"] = func(ctx context.Context, data []byte) []byte {
+		if failing.Load() {
+			return []byte("down")
+		}
+		return data
+	}
+	plugin := serveProtocolPlugin(t, impl)
+	plugin.Controller, plugin.Version = "health-test", VersionInfo{"1.0", "2.0"}
+
+	var lock sync.Mutex
+	var events []PluginEvent
+	AddPluginEventListener(func(event PluginEvent) {
+		if event.Controller == "health-test" {
+			lock.Lock()
+			events = append(events, event)
+			lock.Unlock()
+		}
+	})
+	eventTypes := func() (types []string) {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, event := range events {
+			types = append(types, event.Type)
+		}
+		return types
+	}
+
+	reloads := 0
+	checker := newHealthChecker(time.Hour, 2)
+	checker.reload = func(*Plugin, int) error {
+		reloads++
+		return nil
+	}
+
+	checker.check(plugin)
+	if health := plugin.healthReport(); health.Status != PluginHealthy || health.Failures != 0 || health.LastCheck.IsZero() {
+		t.Errorf("Unexpected health %+v", health)
+	}
+
+	// The plugin is unhealthy and reloaded at the threshold
+	failing.Store(true)
+	checker.check(plugin)
+	if health := plugin.healthReport(); health.Status != PluginHealthy || health.Failures != 1 || health.LastError == "" || reloads != 0 {
+		t.Errorf("Unexpected health %+v, reloads %d", health, reloads)
+	}
+	checker.check(plugin)
+	if health := plugin.healthReport(); health.Status != PluginUnhealthy || health.Reloads != 1 || reloads != 1 {
+		t.Errorf("Unexpected health %+v, reloads %d", health, reloads)
+	}
+	checker.check(plugin)
+	if types := eventTypes(); len(types) != 1 || types[0] != PluginEventUnhealthy || reloads != 2 {
+		t.Errorf("Unexpected events %v, reloads %d", types, reloads)
+	}
+
+	// The recovery is notified once
+	failing.Store(false)
+	checker.check(plugin)
+	checker.check(plugin)
+	if health := plugin.healthReport(); health.Status != PluginHealthy || health.Failures != 0 || health.LastError != "" {
+		t.Errorf("Unexpected health %+v", health)
+	}
+	if types := eventTypes(); len(types) != 2 || types[1] != PluginEventHealthy {
+		t.Errorf("Unexpected events %v", types)
+	}
+	if event := events[1]; !event.Serves("health-test", "1.5") || event.Serves("health-test", "3.0") || event.Serves("onos", "1.5") {
+		t.Errorf("Unexpected controllers served by %+v", event)
+	}
+
+	// A failed reload is retried by the next checks
+	failing.Store(true)
+	checker.reload = func(*Plugin, int) error { return errors.New("no plugin") }
+	checker.check(plugin)
+	checker.check(plugin)
+	if health := plugin.healthReport(); health.Status != PluginUnhealthy || health.Reloads != 2 {
+		t.Errorf("Unexpected health %+v", health)
+	}
+}
+
+func TestReloadOnce(t *testing.T) {
+	saved := pluginReg
+	defer func() { pluginReg = saved }()
+	pluginReg = &PluginReg{RegAccess: &sync.Mutex{}}
+	plugin := &Plugin{Controller: "reload-test", pid: 5}
+
+	// The reload of a replaced process is skipped
+	if err := plugin.reloadFrom(4); err != nil || plugin.processId() != 5 {
+		t.Errorf("Unexpected reload %v, pid %d", err, plugin.processId())
+	}
+
+	// The reloads are serialized, the second one sees the process replaced by the first
+	plugin.reloadLock.Lock()
+	done := make(chan error)
+	go func() { done <- plugin.reloadFrom(5) }()
+	select {
+	case <-done:
+		t.Fatalf("Expected the reload to wait for the reload in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	plugin.lock.Lock()
+	plugin.pid = 6
+	plugin.lock.Unlock()
+	plugin.reloadLock.Unlock()
+	if err := <-done; err != nil || plugin.processId() != 6 {
+		t.Errorf("Unexpected reload %v, pid %d", err, plugin.processId())
+	}
+}
+
+func TestReloadBackoff(t *testing.T) {
+	saved := pluginReg
+	defer func() { pluginReg = saved }()
+	pluginReg = &PluginReg{LifeCyclePlugins: map[ControllerInfo]string{}, RegAccess: &sync.Mutex{}}
+	process := exec.Command("sleep", "10")
+	if err := process.Start(); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	defer process.Process.Kill()
+	plugin := serveProtocolPlugin(t, newProtocolImpl())
+	plugin.Type = "lifecycle"
+	plugin.pid = process.Process.Pid
+
+	// The failed reload forgets the stopped process
+	if err := plugin.reloadFrom(plugin.pid); err == nil || errors.Is(err, ErrReloadBackoff) {
+		t.Fatalf("Expected the reload to fail, got %v", err)
+	}
+	if _, connected := plugin.connection(); connected || plugin.processId() != 0 {
+		t.Errorf("Expected the plugin without process, pid %d", plugin.processId())
+	}
+	if err := process.Wait(); err == nil {
+		t.Errorf("Expected the process to be stopped")
+	}
+
+	// The next reloads back off
+	if err := plugin.reloadFrom(0); !errors.Is(err, ErrReloadBackoff) {
+		t.Errorf("Expected the reload to back off, got %v", err)
+	}
+	plugin.reloadLock.Lock()
+	plugin.nextReload = time.Time{}
+	plugin.reloadLock.Unlock()
+	if err := plugin.reloadFrom(0); err == nil || errors.Is(err, ErrReloadBackoff) {
+		t.Errorf("Expected the reload to be attempted, got %v", err)
+	}
+	if plugin.reloadFailures != 2 || time.Until(plugin.nextReload) <= ReloadMinBackoff {
+		t.Errorf("Expected the backoff to double, %d failures until %v", plugin.reloadFailures, plugin.nextReload)
+	}
+}
+
+func TestGetPluginHealth(t *testing.T) {
+	saved := pluginStore
+	defer func() { pluginStore = saved }()
+	pluginReg := &PluginReg{LifeCyclePlugins: map[ControllerInfo]string{{Name: "odl", version: VersionInfo{"1.0", ""}}: "plugin/odl"}, RegAccess: &sync.Mutex{}}
+	pluginStore = &PluginStore{pluginReg: pluginReg, allManagePlugins: map[*ControllerInfo]*Plugin{
+		{Name: "onos", version: VersionInfo{"1.0", ""}}: {Controller: "onos", Version: VersionInfo{"1.0", ""}, pid: 42, protocol: ProtocolVersion},
+	}}
+
+	healths, err := GetPluginHealth("onos")
+	if err != nil || len(healths) != 1 || healths[0].Pid != 42 || healths[0].Status != PluginHealthy || healths[0].Version != "1.0" {
+		t.Errorf("Unexpected health %+v %v", healths, err)
+	}
+	// A discovered plugin not loaded yet
+	if healths, err := GetPluginHealth("odl"); err != nil || len(healths) != 0 {
+		t.Errorf("Unexpected health %+v %v", healths, err)
+	}
+	if _, err := GetPluginHealth("other"); !errors.Is(err, ErrPluginNotFound) {
+		t.Errorf("Expected ErrPluginNotFound, got %v", err)
+	}
+}
+
+func TestHealthCheckerStop(t *testing.T) {
+	checked := make(chan struct{}, 1)
+	checker := newHealthChecker(time.Millisecond, 1)
+	go checker.run(func() []*Plugin {
+		select {
+		case checked <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	<-checked
+	checker.close()
+}
@@ -0,0 +1,214 @@
+package pdk
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"org.openappstack/singularity/pluginmanager"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The files of a package, in the directory named after the package as the
+// plugin registry untars it in the plugin location
+var packageFiles = []string{pluginmanager.DefaultConfFile, pluginmanager.PluginBinary}
+
+/* Package a built plugin directory as a plugin tar, with the checksums of its files. The package is validated once written */
+func Package(dir, tarFile string) error {
+	name := strings.TrimSuffix(filepath.Base(tarFile), pluginmanager.DefaultTarExt)
+	if filepath.Ext(tarFile) != pluginmanager.DefaultTarExt || name == "" {
+		return fmt.Errorf("Invalid package name %s, expected <plugin>%s", tarFile, pluginmanager.DefaultTarExt)
+	}
+
+	files := make(map[string][]byte, len(packageFiles))
+	for _, file := range packageFiles {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return fmt.Errorf("Missing %s, build the plugin first: %v", file, err)
+		}
+		files[file] = data
+	}
+	if problems := validateConf(files[pluginmanager.DefaultConfFile]); len(problems) > 0 {
+		return fmt.Errorf("Invalid %s: %v", pluginmanager.DefaultConfFile, problems[0])
+	}
+	var checksums bytes.Buffer
+	for _, file := range packageFiles {
+		sum := sha256.Sum256(files[file])
+		fmt.Fprintf(&checksums, "%s  %s\n", hex.EncodeToString(sum[:]), file)
+	}
+	files[ChecksumsFile] = checksums.Bytes()
+
+	// The package appears once complete, the plugin registry may be watching its directory
+	tmp, err := os.CreateTemp(filepath.Dir(tarFile), "."+name+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	writer := tar.NewWriter(tmp)
+	now := time.Now()
+	err = writer.WriteHeader(&tar.Header{Name: name + "/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: now})
+	for _, file := range append(packageFiles, ChecksumsFile) {
+		mode := int64(0644)
+		if file == pluginmanager.PluginBinary {
+			mode = 0755
+		}
+		if err == nil {
+			err = writer.WriteHeader(&tar.Header{Name: name + "/" + file, Typeflag: tar.TypeReg, Mode: mode, Size: int64(len(files[file])), ModTime: now})
+		}
+		if err == nil {
+			_, err = writer.Write(files[file])
+		}
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), tarFile)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write the package: %v", err)
+	}
+
+	if problems := Validate(tarFile); len(problems) > 0 {
+		return fmt.Errorf("Invalid package: %v", problems[0])
+	}
+	return nil
+}
+
+/* Internal: Check a plugin manifest, its unknown fields are problems too */
+func validateConf(data []byte) []error {
+	conf := &pluginmanager.PluginConf{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(conf); err != nil {
+		return []error{err}
+	}
+	return conf.Validate()
+}
+
+/* A regular file of a package */
+type packageFile struct {
+	mode int64
+	data []byte
+}
+
+/* Lint a plugin package before its deployment, all the problems are returned */
+func Validate(tarFile string) []error {
+	var problems []error
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	name := strings.TrimSuffix(filepath.Base(tarFile), pluginmanager.DefaultTarExt)
+	if filepath.Ext(tarFile) != pluginmanager.DefaultTarExt {
+		problem("The package %s is not a %s file, the plugin registry ignores it", tarFile, pluginmanager.DefaultTarExt)
+	}
+	file, err := os.Open(tarFile)
+	if err != nil {
+		problem("%v", err)
+		return problems
+	}
+	defer file.Close()
+
+	// The files must follow the directory of the plugin, the registry
+	// untars them in order
+	files := map[string]*packageFile{}
+	dirSeen := false
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			problem("Invalid tar: %v", err)
+			return problems
+		}
+		entry := strings.TrimSuffix(header.Name, "/")
+		if entry == name && header.Typeflag == tar.TypeDir {
+			dirSeen = true
+			continue
+		}
+		rel := strings.TrimPrefix(entry, name+"/")
+		if rel == entry || path.IsAbs(header.Name) || path.Clean(entry) != entry || strings.Contains(rel, "..") {
+			problem("Entry %s outside of the plugin directory %s/", header.Name, name)
+			continue
+		}
+		switch header.Typeflag {
+		case tar.TypeReg:
+			if !dirSeen {
+				problem("Entry %s before the plugin directory %s/", header.Name, name)
+			}
+			data, err := io.ReadAll(reader)
+			if err != nil {
+				problem("Invalid tar: %v", err)
+				return problems
+			}
+			files[rel] = &packageFile{mode: header.Mode, data: data}
+		case tar.TypeDir:
+		default:
+			problem("Entry %s is not a regular file or a directory", header.Name)
+		}
+	}
+
+	if conf, ok := files[pluginmanager.DefaultConfFile]; !ok {
+		problem("Missing %s", pluginmanager.DefaultConfFile)
+	} else {
+		for _, confProblem := range validateConf(conf.data) {
+			problem("%s: %v", pluginmanager.DefaultConfFile, confProblem)
+		}
+	}
+	if binary, ok := files[pluginmanager.PluginBinary]; !ok {
+		problem("Missing %s", pluginmanager.PluginBinary)
+	} else if binary.mode&0111 == 0 {
+		problem("%s is not executable", pluginmanager.PluginBinary)
+	}
+
+	checksums, ok := files[ChecksumsFile]
+	if !ok {
+		problem("Missing %s", ChecksumsFile)
+		return problems
+	}
+	listed := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(checksums.data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			problem("%s: invalid line %q", ChecksumsFile, scanner.Text())
+			continue
+		}
+		sum, file := fields[0], strings.TrimPrefix(fields[1], "*")
+		listed[file] = true
+		packaged, ok := files[file]
+		if !ok {
+			problem("%s: missing file %s", ChecksumsFile, file)
+			continue
+		}
+		if actual := sha256.Sum256(packaged.data); hex.EncodeToString(actual[:]) != sum {
+			problem("%s: checksum mismatch of %s", ChecksumsFile, file)
+		}
+	}
+	var unlisted []string
+	for file := range files {
+		if file != ChecksumsFile && !listed[file] {
+			unlisted = append(unlisted, file)
+		}
+	}
+	sort.Strings(unlisted)
+	for _, file := range unlisted {
+		problem("%s: no checksum of %s", ChecksumsFile, file)
+	}
+	return problems
+}
@@ -0,0 +1,132 @@
+package pdk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"org.openappstack/singularity/pluginmanager"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"text/template"
+)
+
+// The plugin development kit: scaffold a lifecycle plugin, build its binary,
+// package it as the plugin registry discovers it and validate the packages.
+
+const (
+	// The checksums of the package files, as written by sha256sum
+	ChecksumsFile = "SHA256SUMS"
+)
+
+// InitOptions configures the plugin skeleton
+type InitOptions struct {
+	// The controller served by the plugin, and its version
+	Controller string
+	Version    string
+	// The transport of the plugin, pluginmanager.TransportHttp if empty
+	Transport string
+}
+
+// The plugin skeleton, a controller instance per controller started by the agent
+var mainTemplate = template.Must(template.New("main.go").Parse(`package main
+
+import (
+	"context"
+	"fmt"
+	"org.openappstack/singularity/pluginmanager"
+	"os"
+)
+
+// A {{.Controller}} controller instance, created by the agent before its start
+type controller struct {
+	// The data of the start request
+	data []byte
+}
+
+// Create a controller instance
+func newController(data []byte) (interface{}, error) {
+	return &controller{data: data}, nil
+}
+
+// Start the controller, reporting the progress to the agent
+func (c *controller) StartProgress(ctx context.Context, data []byte, progress func(*pluginmanager.Progress)) error {
+	progress(&pluginmanager.Progress{Percent: 0, Message: "starting {{.Controller}}"})
+	// TODO: start the controller
+	progress(&pluginmanager.Progress{Percent: 100, Message: "started"})
+	return nil
+}
+
+// Start the controller without progress, for the agents calling it by name
+func (c *controller) Start(data []byte) error {
+	return c.StartProgress(context.Background(), data, func(*pluginmanager.Progress) {})
+}
+
+// Stop the controller
+func (c *controller) Stop(data []byte) error {
+	// TODO: stop the controller
+	return nil
+}
+
+func main() {
+	plugin, err := pluginmanager.RegisterPlugin(newController)
+	if err != nil {
+		fmt.Printf("Failed to register the plugin: %v\n", err)
+		os.Exit(1)
+	}
+	plugin.StartPlugin()
+	plugin.WaitForPluginStop()
+}
+`))
+
+/* Generate the skeleton of a lifecycle plugin in a directory, the existing files are kept */
+func Init(dir string, options *InitOptions) error {
+	if options.Controller == "" || options.Version == "" {
+		return fmt.Errorf("The controller and its version are required")
+	}
+	conf := &pluginmanager.PluginConf{PluginTypes: []pluginmanager.PluginType{{
+		Type:        "lifecycle",
+		Controllers: []pluginmanager.Controller{{Name: options.Controller, EqualVersion: options.Version}},
+		Timeouts:    map[string]string{"start": "5m", pluginmanager.DefaultMethodTimeout: "1m"},
+		Transport:   options.Transport,
+	}}}
+	if problems := conf.Validate(); len(problems) > 0 {
+		return fmt.Errorf("Invalid plugin: %v", problems[0])
+	}
+	confData, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return err
+	}
+	var mainData bytes.Buffer
+	if err := mainTemplate.Execute(&mainData, options); err != nil {
+		return err
+	}
+
+	files := map[string][]byte{"main.go": mainData.Bytes(), pluginmanager.DefaultConfFile: append(confData, '\n')}
+	for name := range files {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return fmt.Errorf("%s already exists", filepath.Join(dir, name))
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Build the plugin binary of a plugin directory, the go output is written to output */
+func Build(dir string, output io.Writer) error {
+	cmd := exec.Command("go", "build", "-o", pluginmanager.PluginBinary, ".")
+	cmd.Dir = dir
+	cmd.Stdout, cmd.Stderr = output, output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Failed to build the plugin: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package pdk
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"org.openappstack/singularity/pluginmanager"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConf = `{"plugin-types": [{"plugin-type": "lifecycle", "controllers": [{"name": "onos", "equals-version": "1.0"}]}]}`
+
+func TestInit(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "onos-plugin")
+	if err := Init(dir, &InitOptions{Controller: "onos", Version: "1.0", Transport: pluginmanager.TransportGrpc}); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if _, err := parser.ParseFile(token.NewFileSet(), filepath.Join(dir, "main.go"), nil, 0); err != nil {
+		t.Errorf("Invalid plugin skeleton: %v", err)
+	}
+	conf, err := os.ReadFile(filepath.Join(dir, pluginmanager.DefaultConfFile))
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if problems := validateConf(conf); len(problems) > 0 || !strings.Contains(string(conf), `"transport": "grpc"`) {
+		t.Errorf("Unexpected plugin.conf %s %v", conf, problems)
+	}
+
+	// The existing plugins are kept
+	if err := Init(dir, &InitOptions{Controller: "onos", Version: "1.0"}); err == nil {
+		t.Errorf("Expected the existing plugin to be kept")
+	}
+	for _, options := range []*InitOptions{{Controller: "onos"}, {Controller: "onos", Version: "1.0", Transport: "udp"}} {
+		if err := Init(t.TempDir(), options); err == nil {
+			t.Errorf("Expected %+v to be invalid", options)
+		}
+	}
+}
+
+func TestPackage(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "onos-plugin")
+	if err := Init(dir, &InitOptions{Controller: "onos", Version: "1.0"}); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	tarFile := filepath.Join(t.TempDir(), "onos-plugin.tar")
+	if err := Package(dir, tarFile); err == nil {
+		t.Errorf("Expected the plugin without binary not to be packaged")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, pluginmanager.PluginBinary), []byte("binary"), 0755); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if err := Package(dir, tarFile); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if problems := Validate(tarFile); len(problems) > 0 {
+		t.Errorf("Unexpected problems %v", problems)
+	}
+	if err := Package(dir, filepath.Join(t.TempDir(), "onos-plugin.tgz")); err == nil {
+		t.Errorf("Expected the package name to be invalid")
+	}
+}
+
+// A tar entry, a directory if its name ends with /
+type entry struct {
+	name string
+	mode int64
+	data string
+}
+
+func writeTar(t *testing.T, name string, entries []entry) string {
+	tarFile := filepath.Join(t.TempDir(), name)
+	file, err := os.Create(tarFile)
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	defer file.Close()
+	writer := tar.NewWriter(file)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Typeflag: tar.TypeReg, Mode: e.mode, Size: int64(len(e.data))}
+		if strings.HasSuffix(e.name, "/") {
+			header.Typeflag, header.Size = tar.TypeDir, 0
+		}
+		writer.WriteHeader(header)
+		writer.Write([]byte(e.data))
+	}
+	writer.Close()
+	return tarFile
+}
+
+func checksums(files ...string) string {
+	var sums strings.Builder
+	for i := 0; i < len(files); i += 2 {
+		sum := sha256.Sum256([]byte(files[i+1]))
+		fmt.Fprintf(&sums, "%s  %s\n", hex.EncodeToString(sum[:]), files[i])
+	}
+	return sums.String()
+}
+
+func TestValidate(t *testing.T) {
+	valid := checksums("plugin.conf", testConf, "pluginmain", "binary")
+	for _, test := range []struct {
+		desc    string
+		entries []entry
+		problem string
+	}{
+		{"valid", []entry{{"p/", 0755, ""}, {"p/plugin.conf", 0644, testConf}, {"p/pluginmain", 0755, "binary"}, {"p/SHA256SUMS", 0644, valid}}, ""},
+		{"not executable", []entry{{"p/", 0755, ""}, {"p/plugin.conf", 0644, testConf}, {"p/pluginmain", 0644, "binary"}, {"p/SHA256SUMS", 0644, valid}}, "not executable"},
+		{"no directory", []entry{{"p/plugin.conf", 0644, testConf}, {"p/pluginmain", 0755, "binary"}, {"p/SHA256SUMS", 0644, valid}}, "before the plugin directory"},
+		{"outside", []entry{{"p/", 0755, ""}, {"p/plugin.conf", 0644, testConf}, {"p/pluginmain", 0755, "binary"}, {"p/SHA256SUMS", 0644, valid}, {"q/other", 0644, ""}}, "outside of the plugin directory"},
+		{"escaping", []entry{{"p/", 0755, ""}, {"p/../../etc/passwd", 0644, ""}}, "outside of the plugin directory"},
+		{"checksum", []entry{{"p/", 0755, ""}, {"p/plugin.conf", 0644, testConf}, {"p/pluginmain", 0755, "changed"}, {"p/SHA256SUMS", 0644, valid}}, "checksum mismatch of pluginmain"},
+		{"unlisted", []entry{{"p/", 0755, ""}, {"p/plugin.conf", 0644, testConf}, {"p/pluginmain", 0755, "binary"}, {"p/extra", 0644, ""}, {"p/SHA256SUMS", 0644, valid}}, "no checksum of extra"},
+		{"no checksums", []entry{{"p/", 0755, ""}, {"p/plugin.conf", 0644, testConf}, {"p/pluginmain", 0755, "binary"}}, "Missing SHA256SUMS"},
+		{"unknown field", []entry{{"p/", 0755, ""}, {"p/plugin.conf", 0644, `{"plugin-typs": []}`}}, "unknown field"},
+		{"no controller", []entry{{"p/", 0755, ""}, {"p/plugin.conf", 0644, `{"plugin-types": [{"plugin-type": "lifecycle"}]}`}}, "No controller"},
+		{"no version", []entry{{"p/", 0755, ""}, {"p/plugin.conf", 0644, `{"plugin-types": [{"plugin-type": "lifecycle", "controllers": [{"name": "onos"}]}]}`}}, "without equals-version"},
+		{"timeout", []entry{{"p/", 0755, ""}, {"p/plugin.conf", 0644, `{"plugin-types": [{"plugin-type": "lifecycle", "controllers": [{"name": "onos", "equals-version": "1"}], "timeouts": {"start": "soon"}}]}`}}, "Invalid timeout"},
+	} {
+		problems := Validate(writeTar(t, "p.tar", test.entries))
+		found := test.problem == "" && len(problems) == 0
+		for _, problem := range problems {
+			if test.problem != "" && strings.Contains(problem.Error(), test.problem) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: expected problem %q, got %v", test.desc, test.problem, problems)
+		}
+	}
+
+	if problems := Validate(writeTar(t, "p.tgz", nil)); len(problems) == 0 || !strings.Contains(problems[0].Error(), "not a .tar file") {
+		t.Errorf("Unexpected problems %v", problems)
+	}
+}
@@ -19,11 +19,13 @@ import (
 type SingularityPluginReq struct {
 	Appid string
 	Data  string
+	// The secrets delivered at init (parameter name -> value)
+	Secrets map[string][]byte `json:",omitempty"`
 }
 
 // Encapsule Data with AppId
 func encapsuleControllerId(controllerId string, data []byte) ([]byte, error) {
-	pluginreq := &SingularityPluginReq{controllerId, string(data)}
+	pluginreq := &SingularityPluginReq{Appid: controllerId, Data: string(data)}
 	// Encode the data
 	encodedData, encodeErr := json.Marshal(pluginreq)
 	if encodeErr != nil {
@@ -44,6 +46,29 @@ func decapsuleControllerId(data []byte) (string, []byte, error) {
 	return pluginreq.Appid, []byte(pluginreq.Data), nil
 }
 
+// Encapsule Data and secrets with AppId
+func encapsuleInitRequest(controllerId string, data []byte, secrets map[string][]byte) ([]byte, error) {
+	pluginreq := &SingularityPluginReq{Appid: controllerId, Data: string(data), Secrets: secrets}
+	// Encode the data
+	encodedData, encodeErr := json.Marshal(pluginreq)
+	if encodeErr != nil {
+		return nil, encodeErr
+	}
+	return encodedData, nil
+}
+
+// Decapsule Data and secrets with AppId
+func decapsuleInitRequest(data []byte) (string, []byte, map[string][]byte, error) {
+
+	pluginreq := &SingularityPluginReq{}
+	// Decode the data
+	decodeErr := json.Unmarshal(data, pluginreq)
+	if decodeErr != nil {
+		return "", nil, nil, decodeErr
+	}
+	return pluginreq.Appid, []byte(pluginreq.Data), pluginreq.Secrets, nil
+}
+
 // Function to copy a file
 func CopyFile(source string, dest string) (err error) {
 	sourcefile, err := os.Open(source)
@@ -2,20 +2,55 @@ package pluginmanager
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
-	httputil "net/http/httputil"
+	"net/url"
+	"time"
 )
 
+const (
+	// Default deadline of a request
+	DefaultRequestTimeout = 2 * time.Minute
+	// The request deadline of the long polls e.g. the callbacks
+	NoTimeout time.Duration = -1
+	// Maximum number of idle connections kept to a plugin
+	DefaultMaxIdleConns = 8
+	// The idle connections are closed after
+	DefaultIdleConnTimeout = 90 * time.Second
+
+	// The header carrying the deadline of a request to the plugin side
+	DeadlineHeader = "X-Plugin-Deadline"
+)
+
+var (
+	// The request never reached the plugin, it can be sent again
+	ErrNotSent = errors.New("Request not sent to the plugin")
+)
+
+// PluginClient sends the requests to a plugin over its unix socket. The requests
+// are concurrent, each on a pooled keep-alive connection, so a pending callback
+// poll doesn't block the other requests.
 type PluginClient struct {
-	Conn *httputil.ClientConn
+	// The http client over the plugin socket
+	Client *http.Client
+	// The plugin socket file
+	SockFile string
+	// The deadline of the requests without their own
+	Timeout time.Duration
 }
 
 type PluginRequest struct {
 	Url  string
 	Body []byte
+	// The deadline of the request, bounded by the context deadline. If 0 the
+	// client Timeout applies to the requests without a context deadline, and
+	// none applies if NoTimeout.
+	Timeout time.Duration
 }
 
 type PluginResponse struct {
@@ -25,58 +60,69 @@ type PluginResponse struct {
 
 func NewPluginClient(sockFile string) (*PluginClient, error) {
 
+	// Check the plugin is listening
 	conn, connErr := net.Dial("unix", sockFile)
 	if connErr != nil {
 		fmt.Printf("Connection could not be initiated")
 		return nil, connErr
 	}
-
-	/* Use default buffer */
-	clientConn := httputil.NewClientConn(conn, nil)
-	if clientConn == nil {
-		fmt.Printf("Connection Could not be Configured")
-		return nil, connErr
+	conn.Close()
+
+	dialer := &net.Dialer{}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", sockFile)
+		},
+		MaxIdleConns:        DefaultMaxIdleConns,
+		MaxIdleConnsPerHost: DefaultMaxIdleConns,
+		IdleConnTimeout:     DefaultIdleConnTimeout,
 	}
-	pluginConn := &PluginClient{clientConn}
+	pluginConn := &PluginClient{Client: &http.Client{Transport: transport}, SockFile: sockFile, Timeout: DefaultRequestTimeout}
 
 	return pluginConn, nil
 }
 
-func (pluginConn *PluginClient) Request(request *PluginRequest) (*PluginResponse, error) {
+// Get the http url of a plugin url e.g. unix://plugin/Ping, the host is
+// ignored as the requests are sent to the plugin socket
+func requestUrl(pluginUrl string) (string, error) {
+	u, err := url.Parse(pluginUrl)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = "http"
+	return u.String(), nil
+}
 
-	var url = request.Url
-	var req *http.Request
-	var newReqErr error
+/* Send a request to the plugin. The deadline and the cancellation of the context are propagated to the plugin side */
+func (pluginConn *PluginClient) Request(ctx context.Context, request *PluginRequest) (*PluginResponse, error) {
 
-	if request.Body != nil {
-		var jsonStr = request.Body
-		req, newReqErr = http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
-		if newReqErr != nil {
-			fmt.Printf("Request Could not be prepared")
-			return nil, newReqErr
-		}
-		req.Header.Set("Content-Type", "application/json")
-	} else {
-		req, newReqErr = http.NewRequest("POST", url, nil)
-		if newReqErr != nil {
-			fmt.Printf("Request Could not be prepared")
-			return nil, newReqErr
-		}
+	req, cancel, prepareErr := pluginConn.prepare(ctx, request)
+	if prepareErr != nil {
+		return nil, prepareErr
 	}
-	conn := pluginConn.Conn
+	defer cancel()
+	ctx = req.Context()
 
-	resp, reqErr := conn.Do(req)
+	resp, reqErr := pluginConn.Client.Do(req)
 	if reqErr != nil {
-		fmt.Printf("Request Could not be send")
-		return nil, reqErr
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, fmt.Errorf("Request interrupted: %w", ctxErr)
+		}
+		// The plugin may have handled the request unless the socket was never reached
+		var opErr *net.OpError
+		if errors.As(reqErr, &opErr) && opErr.Op == "dial" {
+			return nil, fmt.Errorf("%w: %v", ErrNotSent, reqErr)
+		}
+		return nil, fmt.Errorf("Request could not be sent: %v", reqErr)
 	}
 	defer resp.Body.Close()
 
-	fmt.Println("response Status:", resp.Status)
-	fmt.Println("response Headers:", resp.Header)
-	body, _ := ioutil.ReadAll(resp.Body)
-	if body != nil {
-		fmt.Println("response Body:", string(body))
+	body, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, fmt.Errorf("Response interrupted: %w", ctxErr)
+		}
+		return nil, fmt.Errorf("Response could not be read: %v", readErr)
 	}
 
 	response := &PluginResponse{}
@@ -86,8 +132,76 @@ func (pluginConn *PluginClient) Request(request *PluginRequest) (*PluginResponse
 	return response, nil
 }
 
+// A streamed response of the plugin, the body is read as the plugin writes it
+// and must be closed
+type PluginStream struct {
+	Status string
+	Body   io.ReadCloser
+	cancel context.CancelFunc
+}
+
+/* Send a request to the plugin and stream its response. The deadline of the request applies until the stream is closed */
+func (pluginConn *PluginClient) RequestStream(ctx context.Context, request *PluginRequest) (*PluginStream, error) {
+
+	req, cancel, prepareErr := pluginConn.prepare(ctx, request)
+	if prepareErr != nil {
+		return nil, prepareErr
+	}
+
+	resp, reqErr := pluginConn.Client.Do(req)
+	if reqErr != nil {
+		cancel()
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return nil, fmt.Errorf("Request interrupted: %w", ctxErr)
+		}
+		return nil, fmt.Errorf("Request could not be sent: %v", reqErr)
+	}
+
+	return &PluginStream{Status: resp.Status, Body: resp.Body, cancel: cancel}, nil
+}
+
+/* Close the stream, the plugin sees the request cancelled if it is still streaming */
+func (stream *PluginStream) Close() error {
+	err := stream.Body.Close()
+	stream.cancel()
+	return err
+}
+
+// Prepare the http request of a plugin request, bounded by its deadline until cancelled
+func (pluginConn *PluginClient) prepare(ctx context.Context, request *PluginRequest) (*http.Request, context.CancelFunc, error) {
+
+	url, urlErr := requestUrl(request.Url)
+	if urlErr != nil {
+		return nil, nil, fmt.Errorf("Invalid plugin url %s: %v", request.Url, urlErr)
+	}
+
+	timeout := request.Timeout
+	if _, hasDeadline := ctx.Deadline(); timeout == 0 && !hasDeadline {
+		timeout = pluginConn.Timeout
+	}
+	cancel := context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	req, newReqErr := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(request.Body))
+	if newReqErr != nil {
+		cancel()
+		fmt.Printf("Request Could not be prepared")
+		return nil, nil, newReqErr
+	}
+	if request.Body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(DeadlineHeader, deadline.UTC().Format(time.RFC3339Nano))
+	}
+	return req, cancel, nil
+}
+
+/* Close the idle connections, the requests in progress are not interrupted */
 func (pluginConn *PluginClient) Close() error {
 
-	pluginConn.Conn.Close()
+	pluginConn.Client.CloseIdleConnections()
 	return nil
 }
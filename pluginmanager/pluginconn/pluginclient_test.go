@@ -0,0 +1,148 @@
+package pluginmanager
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Serve a plugin on a unix socket, /Wait blocks until released
+func servePlugin(t *testing.T, release chan struct{}) string {
+	sockFile := filepath.Join(t.TempDir(), "plugin.sock")
+	listener, err := net.Listen("unix", sockFile)
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Wait", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.Write([]byte("released"))
+	})
+	mux.HandleFunc("/Ping", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pong"))
+	})
+	mux.HandleFunc("/Deadline", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := RequestContext(r)
+		defer cancel()
+		if deadline, ok := ctx.Deadline(); ok {
+			w.Write([]byte(time.Until(deadline).Round(time.Minute).String()))
+		}
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return sockFile
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	release := make(chan struct{})
+	client, err := NewPluginClient(servePlugin(t, release))
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	defer client.Close()
+
+	// A pending poll doesn't block the other requests
+	polled := make(chan *PluginResponse)
+	go func() {
+		resp, err := client.Request(context.Background(), &PluginRequest{Url: "unix://plugin/Wait", Timeout: NoTimeout})
+		if err != nil {
+			t.Errorf("Err: %s", err)
+		}
+		polled <- resp
+	}()
+	for i := 0; i < 3; i++ {
+		resp, err := client.Request(context.Background(), &PluginRequest{Url: "unix://plugin/Ping", Body: []byte("ping"), Timeout: time.Second})
+		if err != nil || string(resp.Body) != "pong" {
+			t.Fatalf("Ping blocked by the poll: %v %v", resp, err)
+		}
+	}
+	close(release)
+	if resp := <-polled; resp == nil || resp.Status != "200 OK" || string(resp.Body) != "released" {
+		t.Errorf("Unexpected poll response: %v", resp)
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	client, err := NewPluginClient(servePlugin(t, release))
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	defer client.Close()
+
+	begin := time.Now()
+	if _, err := client.Request(context.Background(), &PluginRequest{Url: "unix://plugin/Wait", Timeout: 50 * time.Millisecond}); err == nil {
+		t.Errorf("Expected the request to time out")
+	}
+	if elapsed := time.Since(begin); elapsed > 5*time.Second {
+		t.Errorf("The deadline was not honored: %s", elapsed)
+	}
+
+	if _, err := NewPluginClient(filepath.Join(t.TempDir(), "none.sock")); err == nil {
+		t.Errorf("Expected a missing plugin socket to fail")
+	}
+}
+
+func TestDeadlinePropagation(t *testing.T) {
+	client, err := NewPluginClient(servePlugin(t, make(chan struct{})))
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	resp, err := client.Request(ctx, &PluginRequest{Url: "unix://plugin/Deadline"})
+	if err != nil || string(resp.Body) != "10m0s" {
+		t.Errorf("Expected the plugin to get the 10m deadline, got %v %v", resp, err)
+	}
+	resp, err = client.Request(context.Background(), &PluginRequest{Url: "unix://plugin/Deadline", Timeout: NoTimeout})
+	if err != nil || len(resp.Body) != 0 {
+		t.Errorf("Expected no deadline, got %v %v", resp, err)
+	}
+
+	// The cancellation interrupts the request
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.Request(ctx, &PluginRequest{Url: "unix://plugin/Wait"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the cancellation, got %v", err)
+	}
+}
+
+func TestRequestNotSent(t *testing.T) {
+	sockFile := filepath.Join(t.TempDir(), "plugin.sock")
+	listener, err := net.Listen("unix", sockFile)
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	mux := http.NewServeMux()
+	// The plugin dies while handling the request
+	mux.HandleFunc("/Crash", func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := http.NewResponseController(w).Hijack()
+		conn.Close()
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	client, err := NewPluginClient(sockFile)
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Request(context.Background(), &PluginRequest{Url: "unix://plugin/Crash", Timeout: time.Second}); err == nil || errors.Is(err, ErrNotSent) {
+		t.Errorf("Expected the received request to fail as sent, got %v", err)
+	}
+	server.Close()
+	if _, err := client.Request(context.Background(), &PluginRequest{Url: "unix://plugin/Crash", Timeout: time.Second}); !errors.Is(err, ErrNotSent) {
+		t.Errorf("Expected the request to the stopped plugin not to be sent, got %v", err)
+	}
+}
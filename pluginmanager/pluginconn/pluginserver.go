@@ -1,10 +1,13 @@
 package pluginmanager
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
+	"time"
 )
 
 // interface for http handler registrations
@@ -18,6 +21,8 @@ type PluginServer struct {
 	Mux      *http.ServeMux
 	Listener net.Listener
 	Addr     string
+	// The handler of the grpc requests on the same socket, nil if none
+	Grpc http.Handler
 }
 
 // configuration for the http server
@@ -25,6 +30,8 @@ type ServerConfiguration struct {
 	Registrar HttpHandlerRegistrar
 	SockFile  string
 	Addr      string
+	// The handler of the grpc transport e.g. a grpc.Server
+	Grpc http.Handler
 }
 
 // Create a new HTTP Server
@@ -44,6 +51,7 @@ func NewPluginServer(config *ServerConfiguration) (*PluginServer, error) {
 		Mux:      nil,
 		Listener: listener,
 		Addr:     config.Addr,
+		Grpc:     config.Grpc,
 	}
 
 	// register the http handlers
@@ -55,9 +63,24 @@ func NewPluginServer(config *ServerConfiguration) (*PluginServer, error) {
 // Start the http Server
 func (s *PluginServer) Start() {
 
+	// The grpc clients speak HTTP/2 without TLS on the socket
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{Handler: http.HandlerFunc(s.serve), Protocols: protocols}
+
 	/* Each request is served in a separate thread */
-	go http.Serve(s.Listener, nil)
+	go server.Serve(s.Listener)
+
+}
 
+// Route the grpc requests to the grpc handler, the others to the registered handlers
+func (s *PluginServer) serve(w http.ResponseWriter, r *http.Request) {
+	if s.Grpc != nil && r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		s.Grpc.ServeHTTP(w, r)
+		return
+	}
+	http.DefaultServeMux.ServeHTTP(w, r)
 }
 
 // Shutdown is used to shutdown the HTTP server
@@ -73,6 +96,18 @@ func (s *PluginServer) Shutdown() error {
 	return nil
 }
 
+// Get the context of a plugin request, cancelled when the agent gives up the
+// request and bounded by the deadline of the agent
+func RequestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx := r.Context()
+	if header := r.Header.Get(DeadlineHeader); header != "" {
+		if deadline, err := time.Parse(time.RFC3339Nano, header); err == nil {
+			return context.WithDeadline(ctx, deadline)
+		}
+	}
+	return context.WithCancel(ctx)
+}
+
 // Write a json string with given header code
 func WriteJsonResponse(v interface{}, code int, w http.ResponseWriter) error {
 	js, err := json.Marshal(v)
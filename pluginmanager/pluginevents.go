@@ -0,0 +1,107 @@
+package pluginmanager
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The plugin event types
+const (
+	PluginEventLoad   = "load"
+	PluginEventUnload = "unload"
+	PluginEventCrash  = "crash"
+	// The health checks of the plugin failed, or succeed again
+	PluginEventUnhealthy = "unhealthy"
+	PluginEventHealthy   = "healthy"
+)
+
+// PluginEvent reports a change of the state of a plugin process
+type PluginEvent struct {
+	Type       string
+	PluginType string
+	Controller string
+	Version    string
+	Pid        int
+	Error      string
+	Time       time.Time
+	// The end of the version range of the plugin, if any
+	versionEnd string
+}
+
+var (
+	// The registered plugin event listeners
+	pluginEventListeners []func(PluginEvent)
+	pluginEventLock      sync.RWMutex
+
+	// The plugin processes stopped on purpose, their exit is not a crash
+	unloadedPids = make(map[int]bool)
+	unloadedLock sync.Mutex
+)
+
+/* Register a function called on every plugin event */
+func AddPluginEventListener(listener func(PluginEvent)) {
+	pluginEventLock.Lock()
+	defer pluginEventLock.Unlock()
+	pluginEventListeners = append(pluginEventListeners, listener)
+}
+
+/* Check if the plugin of an event serves a version of a controller */
+func (event PluginEvent) Serves(controller, version string) bool {
+	return event.Controller == controller && isVersionEqual(event.Version, event.versionEnd, version)
+}
+
+/* Notify the listeners of a plugin event */
+func notifyPluginEvent(eventType string, plugin *Plugin, err error) {
+	event := PluginEvent{
+		Type:       eventType,
+		PluginType: plugin.Type,
+		Controller: plugin.Controller,
+		Version:    plugin.Version.start,
+		versionEnd: plugin.Version.end,
+		Pid:        plugin.processId(),
+		Time:       time.Now().UTC(),
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	pluginEventLock.RLock()
+	defer pluginEventLock.RUnlock()
+	for _, listener := range pluginEventListeners {
+		listener(event)
+	}
+}
+
+/* Record that a plugin process is being stopped on purpose */
+func markUnloaded(pid int) {
+	unloadedLock.Lock()
+	defer unloadedLock.Unlock()
+	unloadedPids[pid] = true
+}
+
+/* Wait for a plugin process to exit, an unrequested exit is a crash */
+func (plugin *Plugin) watchProcess(pid int) {
+	var status syscall.WaitStatus
+	if _, err := syscall.Wait4(pid, &status, 0, nil); err != nil {
+		return
+	}
+
+	unloadedLock.Lock()
+	unloaded := unloadedPids[pid]
+	delete(unloadedPids, pid)
+	unloadedLock.Unlock()
+	if unloaded {
+		return
+	}
+
+	var exitErr error
+	if status.Signaled() {
+		exitErr = fmt.Errorf("killed by signal %v", status.Signal())
+	} else {
+		exitErr = fmt.Errorf("exited with status %d", status.ExitStatus())
+	}
+	crashed := &Plugin{Type: plugin.Type, Controller: plugin.Controller, Version: plugin.Version, pid: pid}
+	notifyPluginEvent(PluginEventCrash, crashed, exitErr)
+}
@@ -4,12 +4,15 @@
 package pluginmanager
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	log "github.com/spf13/jwalterweatherman"
 	"io/ioutil"
 	"net/http"
 	PluginConn "org.openappstack/singularity/pluginmanager/pluginconn"
+	"sort"
 	"strings"
 )
 
@@ -21,17 +24,28 @@ type PluginImplConf struct {
 	Activator func([]byte) []byte
 	// The Function that would be called on Plugin DeActivation
 	Stopper func([]byte) []byte
+	// The unacknowledged notifications kept per callback. Default is DefaultEventBuffer
+	EventBuffer int
 }
 
 /* The Plugin Implentaion Struct to represent a Plugin, provides all the methods to be implemented */
 type PluginImpl struct {
 	pluginServer   *PluginConn.PluginServer
-	methodRegistry map[string]func([]byte) []byte
+	methodRegistry map[string]func(context.Context, []byte) []byte
+	// The methods called by id with the negotiated protocol
+	callRegistry map[string]CallHandler
+	// The methods streaming their results, by id
+	streamRegistry map[string]StreamHandler
 	conf           *RuntimeConf
 }
 
-// channel list per callback that are registered
-var channelMap map[string]chan []byte
+/* A method called by id with the negotiated protocol, the payload and the result are json encoded.
+   A *PluginError is returned to the agent as is, the other errors with the ErrCodeFailed code */
+type CallHandler func(ctx context.Context, payload json.RawMessage) (interface{}, error)
+
+/* A method streaming its results e.g. the progress of an operation. Each chunk sent is json encoded and
+   delivered to the agent as it comes, the result ends the stream. Called as a CallHandler the chunks are dropped */
+type StreamHandler func(ctx context.Context, payload json.RawMessage, send func(chunk interface{}) error) (interface{}, error)
 
 /* Initialize a plugin as per the provided plugin implementation configuration.
    It returns a pointer to a PluginImpl that is used to perfom different operation on the implementde plugin */
@@ -45,12 +59,25 @@ func PluginInit(pluginImplConf PluginImplConf) (*PluginImpl, error) {
 		return nil, fmt.Errorf("Failed to load the config file")
 	}
 
-	plugin.methodRegistry = make(map[string]func([]byte) []byte)
-	channelMap = make(map[string]chan []byte)
+	plugin.methodRegistry = make(map[string]func(context.Context, []byte) []byte)
+	plugin.callRegistry = make(map[string]CallHandler)
+	plugin.streamRegistry = make(map[string]StreamHandler)
+	eventsLock.Lock()
+	eventQueues = make(map[string]*eventQueue)
+	eventBufferSize = DefaultEventBuffer
+	if pluginImplConf.EventBuffer > 0 {
+		eventBufferSize = pluginImplConf.EventBuffer
+	}
+	eventsLock.Unlock()
 
 	// Register the basic method
-	plugin.methodRegistry["Activate"] = pluginImplConf.Activator
-	plugin.methodRegistry["Stop"] = pluginImplConf.Stopper
+	plugin.methodRegistry["Activate"] = withoutContext(pluginImplConf.Activator)
+	plugin.methodRegistry["Stop"] = withoutContext(pluginImplConf.Stopper)
+	plugin.methodRegistry["Ping"] = withoutContext(ping)
+	plugin.methodRegistry["RegisterCallback"] = callbackExecute
+	plugin.methodRegistry[HandshakePath] = plugin.handshake
+	plugin.methodRegistry[CallPath] = plugin.call
+	plugin.registerEvents()
 
 	plugin.conf = &pluginConf
 
@@ -63,26 +90,30 @@ func ping(data []byte) []byte {
 	return data
 }
 
-/* Internal Method: To execute a callback -- wait for a data in a channel to be notified */
-func callbackExecute(data []byte) []byte {
+/* Internal Method: Adapt a method without context to the method registry */
+func withoutContext(method func([]byte) []byte) func(context.Context, []byte) []byte {
+	return func(_ context.Context, data []byte) []byte {
+		return method(data)
+	}
+}
+
+/* Internal Method: To execute a callback -- wait for the next notification, or for the agent to give up.
+   It is the long poll of the agents without event subscriptions, the notification is acknowledged once returned */
+func callbackExecute(ctx context.Context, data []byte) []byte {
 
 	// get the function name
 	var funcName string
 	err := json.Unmarshal(data, &funcName)
 	if err != nil {
-		log.FATAL.Fatalf("Failed to get the func name: %v", err)
+		log.ERROR.Printf("Failed to get the func name: %v", err)
 		return nil
 	}
 
-	// Create a new channel
-	channel := make(chan []byte, 0)
-
-	// Put the channel in the channelmap
-	channelMap[funcName] = channel
-
-	// Wait for data from channel
-	returnData := <-channel
-
+	var returnData []byte
+	nextEvent(ctx, funcName, func(event *Event) error {
+		returnData = event.Data
+		return nil
+	})
 	return returnData
 }
 
@@ -100,7 +131,9 @@ func (plugin *PluginImpl) ServeHTTP(res http.ResponseWriter, req *http.Request)
 		res.WriteHeader(400)
 	} else {
 		method, ok := plugin.methodRegistry[methodName]
-		if ok {
+		if methodName == StreamPath {
+			plugin.serveStream(res, req)
+		} else if ok {
 			// Check if the method is Activate
 			if methodName == "Activate" {
 				methodReg := plugin.methodRegistry
@@ -109,7 +142,7 @@ func (plugin *PluginImpl) ServeHTTP(res http.ResponseWriter, req *http.Request)
 				// get all the register method
 				for key, _ := range methodReg {
 					// Skip the implicit functions
-					if key != "Activate" && key != "Stop" && key != "RegisterCallback" && key != "Ping" {
+					if key != "Activate" && key != "Stop" && key != "RegisterCallback" && key != "Ping" && key != HandshakePath && key != CallPath {
 						methods[idx] = key
 						idx++
 					}
@@ -125,7 +158,10 @@ func (plugin *PluginImpl) ServeHTTP(res http.ResponseWriter, req *http.Request)
 
 			defer req.Body.Close()
 			body, _ := ioutil.ReadAll(req.Body)
-			returnData := method(body)
+			// The method gets the deadline and the cancellation of the agent request
+			ctx, cancel := PluginConn.RequestContext(req)
+			defer cancel()
+			returnData := method(ctx, body)
 			if returnData != nil {
 				res.Write(returnData)
 			}
@@ -141,23 +177,177 @@ func (plugin *PluginImpl) ServeHTTP(res http.ResponseWriter, req *http.Request)
 func (plugin *PluginImpl) RegisterMethod(method func([]byte) []byte) {
 	// Get the name of the method
 	funcName := getFuncName(method)
-	plugin.methodRegistry[funcName] = method
+	plugin.methodRegistry[funcName] = withoutContext(method)
+}
+
+/* Method to register a function getting the context of the request: it is cancelled when
+   the application gives up the request, and bounded by the application deadline.
+   Function Prototype: func (context.Context, []byte) []byte */
+func (plugin *PluginImpl) RegisterContextMethod(method func(context.Context, []byte) []byte) {
+	plugin.methodRegistry[getFuncName(method)] = method
+}
+
+/* Method to register a method called by id with the negotiated protocol e.g. MethodStart */
+func (plugin *PluginImpl) RegisterCall(method string, handler CallHandler) {
+	plugin.callRegistry[method] = handler
+}
+
+/* Method to register a method streaming its results by id e.g. MethodStart, called by the agents of protocol version 2 */
+func (plugin *PluginImpl) RegisterStream(method string, handler StreamHandler) {
+	plugin.streamRegistry[method] = handler
+}
+
+/* Internal Method: Negotiate the protocol version with the agent and activate the plugin */
+func (plugin *PluginImpl) handshake(ctx context.Context, data []byte) []byte {
+	request := &HandshakeRequest{}
+	var response *HandshakeResponse
+	if err := json.Unmarshal(data, request); err != nil {
+		response = &HandshakeResponse{Error: &PluginError{Code: ErrCodeInvalidRequest, Message: fmt.Sprintf("Invalid handshake: %v", err)}}
+	} else {
+		response = plugin.negotiate(ctx, request)
+	}
+	ret, _ := json.Marshal(response)
+	return ret
+}
+
+/* Internal Method: Negotiate the protocol version of a handshake, shared by the transports */
+func (plugin *PluginImpl) negotiate(ctx context.Context, request *HandshakeRequest) *HandshakeResponse {
+	response := &HandshakeResponse{}
+	if response.Version, response.Error = negotiateVersion(request); response.Error == nil {
+		if activator := plugin.methodRegistry["Activate"]; activator != nil {
+			activator(ctx, nil)
+		}
+		response.Methods = plugin.callMethods()
+	}
+	return response
+}
+
+/* Internal Method: Get the sorted method ids registered by RegisterCall */
+func (plugin *PluginImpl) callMethods() []string {
+	methods := make([]string, 0, len(plugin.callRegistry)+len(plugin.streamRegistry))
+	for method := range plugin.callRegistry {
+		methods = append(methods, method)
+	}
+	for method := range plugin.streamRegistry {
+		if _, ok := plugin.callRegistry[method]; !ok {
+			methods = append(methods, method)
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+/* Internal Method: Dispatch a method call of the agent by method id */
+func (plugin *PluginImpl) call(ctx context.Context, data []byte) []byte {
+	request := &RequestEnvelope{}
+	var response *ResponseEnvelope
+	if err := json.Unmarshal(data, request); err != nil {
+		response = &ResponseEnvelope{Version: ProtocolVersion, Encoding: EncodingJson, Error: &PluginError{Code: ErrCodeInvalidRequest, Message: fmt.Sprintf("Invalid request: %v", err)}}
+	} else {
+		response = plugin.dispatch(ctx, request)
+	}
+	ret, _ := json.Marshal(response)
+	return ret
+}
+
+/* Internal Method: Call the handler of a method id, shared by the transports */
+func (plugin *PluginImpl) dispatch(ctx context.Context, request *RequestEnvelope) *ResponseEnvelope {
+	return plugin.dispatchStream(ctx, request, nil)
+}
+
+/* Internal Method: Call the handler of a method id, the chunks of a streamed method are sent as they come (dropped if no send) */
+func (plugin *PluginImpl) dispatchStream(ctx context.Context, request *RequestEnvelope, send func(json.RawMessage) error) *ResponseEnvelope {
+	response := &ResponseEnvelope{Version: ProtocolVersion, Encoding: EncodingJson}
+	handler, isCall := plugin.callRegistry[request.Method]
+	streamHandler, isStream := plugin.streamRegistry[request.Method]
+	if request.Version < ProtocolMinVersion || request.Version > ProtocolVersion {
+		response.Error = &PluginError{Code: ErrCodeUnsupportedVersion, Message: fmt.Sprintf("Unsupported protocol version: %d", request.Version)}
+	} else if request.Encoding != "" && request.Encoding != EncodingJson {
+		response.Error = &PluginError{Code: ErrCodeInvalidRequest, Message: fmt.Sprintf("Unsupported payload encoding: %s", request.Encoding)}
+	} else if !isCall && !isStream {
+		response.Error = &PluginError{Code: ErrCodeUnknownMethod, Message: fmt.Sprintf("Unknown method: %s", request.Method)}
+	} else {
+		response.Version = request.Version
+		var result interface{}
+		var err error
+		if isStream && (send != nil || !isCall) {
+			result, err = streamHandler(ctx, request.Payload, func(chunk interface{}) error {
+				if send == nil {
+					return nil
+				}
+				data, err := json.Marshal(chunk)
+				if err != nil {
+					return fmt.Errorf("Json Marshal failed: %v", err)
+				}
+				return send(data)
+			})
+		} else {
+			result, err = handler(ctx, request.Payload)
+		}
+		if err != nil {
+			var pluginErr *PluginError
+			if !errors.As(err, &pluginErr) {
+				pluginErr = &PluginError{Code: ErrCodeFailed, Message: err.Error()}
+			}
+			response.Error = pluginErr
+		} else if result != nil {
+			if response.Result, err = json.Marshal(result); err != nil {
+				response.Error = &PluginError{Code: ErrCodeFailed, Message: fmt.Sprintf("Json Marshal failed: %v", err)}
+			}
+		}
+	}
+	return response
+}
+
+/* Internal Method: Serve a streamed method call, the frames are written as json lines as they come */
+func (plugin *PluginImpl) serveStream(res http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	request := &RequestEnvelope{}
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		res.WriteHeader(400)
+		return
+	}
+	ctx, cancel := PluginConn.RequestContext(req)
+	defer cancel()
+
+	res.Header().Set("Content-Type", "application/x-ndjson")
+	res.WriteHeader(200)
+	flusher, _ := res.(http.Flusher)
+	encoder := json.NewEncoder(res)
+	var seq int64
+	write := func(frame *StreamFrame) error {
+		seq++
+		frame.Seq = seq
+		if err := encoder.Encode(frame); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	response := plugin.dispatchStream(ctx, request, func(data json.RawMessage) error {
+		return write(&StreamFrame{Data: data})
+	})
+	write(&StreamFrame{End: true, Result: response.Result, Error: response.Error})
 }
 
 /* Method to notify a callback registered by the application by the name of the callback.
-   User could sent input bytes for the callback. Callback doesn't return anything */
+   User could sent input bytes for the callback. Callback doesn't return anything.
+   The notifications are buffered until the agent acknowledges them, Notify waits up to NotifyTimeout
+   while the buffer of the callback is full and then fails with ErrEventBufferFull */
 func (plugin *PluginImpl) Notify(callBack string, data []byte) error {
 
-	// Pnthread : on getting the notifcation and user data it puts the data on the channel
-	// Get the channel from global channel map
-	channel, ok := channelMap[callBack]
-	if !ok {
-		return fmt.Errorf("Callback could not be found for: %s", callBack)
-	}
-	// Send the data to the channel
-	channel <- data
+	ctx, cancel := context.WithTimeout(context.Background(), NotifyTimeout)
+	defer cancel()
+	return plugin.NotifyContext(ctx, callBack, data)
+}
 
-	return nil
+/* Method to notify a callback, waiting for room in the buffer of the callback until the context is done */
+func (plugin *PluginImpl) NotifyContext(ctx context.Context, callBack string, data []byte) error {
+
+	return eventQueueOf(callBack).push(ctx, data)
 }
 
 /* Used to start the Plugin Service. It makes a plugin operable and discoverable by application */
@@ -167,7 +357,8 @@ func (plugin *PluginImpl) Start() error {
 	addr := plugin.conf.Url
 
 	// Create the Plugin Server
-	config := &PluginConn.ServerConfiguration{Registrar: plugin, SockFile: sockFile, Addr: addr}
+	// The grpc transport is served on the same socket
+	config := &PluginConn.ServerConfiguration{Registrar: plugin, SockFile: sockFile, Addr: addr, Grpc: plugin.grpcServer()}
 	server, err := PluginConn.NewPluginServer(config)
 	if err != nil {
 		return fmt.Errorf("Failed to Create the server")
@@ -188,7 +379,3 @@ func (plugin *PluginImpl) Stop() error {
 	}
 	return nil
 }
-
-func init() {
-	channelMap = make(map[string]chan []byte)
-}
@@ -5,12 +5,15 @@
 package pluginmanager
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	log "github.com/spf13/jwalterweatherman"
+	"io"
 	"io/ioutil"
 	PluginConn "org.openappstack/singularity/pluginmanager/pluginconn"
+	"org.openappstack/singularity/pluginmanager/pluginrpc"
 	"os"
 	"os/exec"
 	"path"
@@ -33,6 +36,9 @@ var (
 	// An error to indicate the plugin is already loaded
 	PluginLoaded = errors.New("Plugin is already loaded")
 
+	// An error to indicate the reload is not attempted after the failed ones
+	ErrReloadBackoff = errors.New("Plugin reload backing off")
+
 	UntarError    = errors.New("Failed to unload the Tar file")
 	SaveConfError = errors.New("Failed to save the plugin conf")
 
@@ -47,11 +53,21 @@ var (
 	DefaultInterval = 500 * time.Millisecond
 	// Default Connection retry Count
 	ConnRetryCount = 20
+	// Deadline of a Ping request
+	PingTimeout = 5 * time.Second
+	// The backoff of the reloads after a failed one, doubled on every failure
+	ReloadMinBackoff = time.Second
+	ReloadMaxBackoff = 5 * time.Minute
+	// The manifest timeout of the methods without their own
+	DefaultMethodTimeout = "default"
 	//plugin registry
 	pluginReg *PluginReg = nil
 )
 
 type Plugin struct {
+	// The mutex to sync the access to the connection, the state, the pid,
+	// the methods and the callbacks, shared by the concurrent requests
+	lock sync.Mutex
 	// The URL to reach the Plugin
 	PluginUrl string
 	// The plugin socket file
@@ -62,7 +78,7 @@ type Plugin struct {
 	methods []string
 	// The plugin registered callback
 	callbacks map[string]bool
-	// Plugin disconnected state (currently Being set but not being used)
+	// Plugin connected state, a disconnected plugin is reconnected by the health checks
 	connected bool
 	// The Plugin instance PId
 	pid int
@@ -72,6 +88,26 @@ type Plugin struct {
 	Type string
 	// App Name
 	Controller string
+	// The default deadlines of the methods e.g. "start", from the manifest
+	timeouts map[string]time.Duration
+	// The negotiated protocol version, ProtocolLegacy for the legacy plugins
+	protocol int
+	// The transport of the manifest, set at load
+	transport string
+	// The connection of the grpc transport, nil for the http one
+	rpcConn *pluginrpc.Client
+	// The context of the event deliveries of the callbacks, cancelled at unload
+	events      context.Context
+	closeEvents context.CancelFunc
+	// The health of the plugin, from the checks of the plugin store
+	health pluginHealth
+	// Serializes the reloads, by the health checks and by the failed requests
+	reloadLock sync.Mutex
+	// The failed reloads in a row and the time of the next attempt, synced by the reloadLock
+	reloadFailures int
+	nextReload     time.Time
+	// Held by the requests in flight, a reload waits for them before stopping the process
+	requests sync.RWMutex
 }
 
 /* PluginRegConf provides the configuration to create a plugin registry
@@ -104,12 +140,88 @@ type Controller struct {
 type PluginType struct {
 	Type        string       `json:"plugin-type"`
 	Controllers []Controller `json:"controllers"`
+	// The default deadlines of the methods e.g. {"start": "5m", "default": "1m"}
+	Timeouts map[string]string `json:"timeouts,omitempty"`
+	// The transport of the plugin, TransportHttp if empty
+	Transport string `json:"transport,omitempty"`
+}
+
+// The plugin transports selectable in the manifest
+const (
+	TransportHttp = "http"
+	TransportGrpc = "grpc"
+)
+
+/* Get the transport of a plugin type */
+func (pluginType *PluginType) transport() (string, error) {
+	switch pluginType.Transport {
+	case "", TransportHttp:
+		return TransportHttp, nil
+	case TransportGrpc:
+		return TransportGrpc, nil
+	}
+	return "", fmt.Errorf("Invalid transport %q", pluginType.Transport)
+}
+
+/* Get the default deadlines of the methods of a plugin type */
+func (pluginType *PluginType) methodTimeouts() (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration, len(pluginType.Timeouts))
+	for method, value := range pluginType.Timeouts {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("Invalid timeout %q of method %s", value, method)
+		}
+		timeouts[method] = timeout
+	}
+	return timeouts, nil
+}
+
+/* Check if a plugin type is a lifecycle one */
+func isLifecycleType(plugType string) bool {
+	switch plugType {
+	case "Lifecycle", "LIFECYCLE", "lifecycle":
+		return true
+	}
+	return false
 }
 
 type PluginConf struct {
 	PluginTypes []PluginType `json:"plugin-types"`
 }
 
+/* Check a plugin manifest as the discovery does, all the problems are returned */
+func (conf *PluginConf) Validate() []error {
+	var problems []error
+	if len(conf.PluginTypes) == 0 {
+		problems = append(problems, fmt.Errorf("No plugin type"))
+	}
+	for _, pluginType := range conf.PluginTypes {
+		if !isLifecycleType(pluginType.Type) {
+			problems = append(problems, fmt.Errorf("Invalid plugin type %q", pluginType.Type))
+		}
+		if _, err := pluginType.transport(); err != nil {
+			problems = append(problems, err)
+		}
+		if _, err := pluginType.methodTimeouts(); err != nil {
+			problems = append(problems, err)
+		}
+		if len(pluginType.Controllers) == 0 {
+			problems = append(problems, fmt.Errorf("No controller for plugin type %q", pluginType.Type))
+		}
+		for _, controller := range pluginType.Controllers {
+			switch {
+			case controller.Name == "":
+				problems = append(problems, fmt.Errorf("Controller without name"))
+			case controller.EqualVersion == "" && controller.FromVersion == "":
+				problems = append(problems, fmt.Errorf("Controller %s without equals-version or from-version", controller.Name))
+			case controller.EqualVersion != "" && (controller.FromVersion != "" || controller.ToVersion != ""):
+				problems = append(problems, fmt.Errorf("Controller %s with both equals-version and a version range", controller.Name))
+			}
+		}
+	}
+	return problems
+}
+
 /*****/
 
 // Struct to define the runtime configuration of the plugin
@@ -128,7 +240,9 @@ type PluginReg struct {
 	Wg *sync.WaitGroup
 	// The Plugin search location
 	PluginLocation string
-	// The mutex to sync the Plugin reg access
+	// The mutex to sync the Plugin reg access: the discovered plugins, the
+	// lifecycle plugins and the stop flag are shared by the discovery routine
+	// and the plugin loads
 	RegAccess *sync.Mutex
 	// The flag to stop PluginRegistry Service
 	StopFlag bool
@@ -165,9 +279,18 @@ func (pluginReg *PluginReg) WaitForStop() {
 
 /* Function to stop the Plugin Registry service. It stops the discovery service */
 func (pluginReg *PluginReg) Stop() {
+	pluginReg.RegAccess.Lock()
+	defer pluginReg.RegAccess.Unlock()
 	pluginReg.StopFlag = true
 }
 
+/* Internal: Check if the Plugin Registry service is stopped */
+func (pluginReg *PluginReg) stopped() bool {
+	pluginReg.RegAccess.Lock()
+	defer pluginReg.RegAccess.Unlock()
+	return pluginReg.StopFlag
+}
+
 /* Function for the routine to discover services */
 func discoverPlugin(wg *sync.WaitGroup, pluginReg *PluginReg) {
 	defer wg.Done()
@@ -193,8 +316,7 @@ func discoverPlugin(wg *sync.WaitGroup, pluginReg *PluginReg) {
 				// Get the plugin name
 				tarName := fileName[0 : len(fileName)-len(ext)]
 				// Check if the plugin is already discovered
-				_, tarDiscovered := pluginReg.DiscoveredPlugin[tarName]
-				if !tarDiscovered {
+				if !pluginReg.isDiscovered(tarName) {
 					// Untar the tar file to get the pconf
 					tarFile := filepath.Join(pluginLocation, fileName)
 					// Untar the file in proper location
@@ -215,8 +337,18 @@ func discoverPlugin(wg *sync.WaitGroup, pluginReg *PluginReg) {
 						//return nil, confLoadError
 						continue
 					}
-					// Check for the available plugin type
+					// Check for the available plugin type, the discovered plugin is
+					// registered at once
+					lifeCyclePlugins := make(map[ControllerInfo]string)
 					for _, pluginType := range pluginConf.PluginTypes {
+						if _, timeoutsErr := pluginType.methodTimeouts(); timeoutsErr != nil {
+							log.ERROR.Println("Invalid timeouts. Ignoring: ", pluginType.Type, " for plugin : ", fileName, ", Error: ", timeoutsErr)
+							continue
+						}
+						if _, transportErr := pluginType.transport(); transportErr != nil {
+							log.ERROR.Println("Invalid transport. Ignoring: ", pluginType.Type, " for plugin : ", fileName, ", Error: ", transportErr)
+							continue
+						}
 						// Check for all the application
 						for _, controller := range pluginType.Controllers {
 							controllerInfo := &ControllerInfo{}
@@ -230,7 +362,7 @@ func discoverPlugin(wg *sync.WaitGroup, pluginReg *PluginReg) {
 							fmt.Printf("Plugin type: %s\n", pluginType.Type)
 							switch pluginType.Type {
 							case "Lifecycle", "LIFECYCLE", "lifecycle":
-								pluginReg.LifeCyclePlugins[*controllerInfo] = tarFold
+								lifeCyclePlugins[*controllerInfo] = tarFold
 								break
 							default:
 								log.ERROR.Println("Invalid pligin type. Ignoring: ", pluginType.Type, " for plugin : ", fileName)
@@ -238,13 +370,18 @@ func discoverPlugin(wg *sync.WaitGroup, pluginReg *PluginReg) {
 
 						}
 					}
+					pluginReg.RegAccess.Lock()
+					for controllerInfo, location := range lifeCyclePlugins {
+						pluginReg.LifeCyclePlugins[controllerInfo] = location
+					}
 					pluginReg.DiscoveredPlugin[tarName] = struct{}{}
+					pluginReg.RegAccess.Unlock()
 
 				}
 			}
 		}
 		// Check if stop file has been raised
-		if pluginReg.StopFlag {
+		if pluginReg.stopped() {
 			break
 		}
 		// Wait for 1 sec
@@ -258,8 +395,22 @@ func (pluginReg *PluginReg) IsDiscovered(pluginname string) bool {
 	return pluginReg.isDiscovered(pluginname)
 }
 
+/* Internal: Check if a discovered plugin serves a controller, of any version */
+func (pluginReg *PluginReg) servesController(controller string) bool {
+	pluginReg.RegAccess.Lock()
+	defer pluginReg.RegAccess.Unlock()
+	for controllerInfo := range pluginReg.LifeCyclePlugins {
+		if controllerInfo.Name == controller {
+			return true
+		}
+	}
+	return false
+}
+
 /* Internal: Check if a plugin is already discovered */
 func (pluginReg *PluginReg) isDiscovered(appPlugin string) bool {
+	pluginReg.RegAccess.Lock()
+	defer pluginReg.RegAccess.Unlock()
 	_, pluginDiscovered := pluginReg.DiscoveredPlugin[appPlugin]
 	if !pluginDiscovered {
 		return false
@@ -267,13 +418,27 @@ func (pluginReg *PluginReg) isDiscovered(appPlugin string) bool {
 	return true
 }
 
-/* Unload a Plugin from the plugin Registry. It invokes a stop request to the plugin.
-   (It doesn't remove the Plugin from Discovered Plugin List) */
+/* Unload a Plugin from the plugin Registry. It invokes a stop request to the plugin and ends the callbacks.
+   (It doesn't remove the Plugin from Discovered Plugin List, the registry is not locked) */
 func (plugin *Plugin) UnloadPlugin() error {
 
-	// Initiate Locking
-	//pluginReg.RegAccess.Lock()
-	//defer pluginReg.RegAccess.Unlock()
+	// The callbacks end, they outlive the reloads only
+	plugin.lock.Lock()
+	if plugin.closeEvents != nil {
+		plugin.closeEvents()
+		plugin.events, plugin.closeEvents = nil, nil
+	}
+	plugin.callbacks = make(map[string]bool)
+	plugin.lock.Unlock()
+
+	return plugin.unload()
+}
+
+/* Internal: Stop the plugin process and close its connections */
+func (plugin *Plugin) unload() error {
+
+	pid := plugin.processId()
+	markUnloaded(pid)
 
 	// Send the Stop request
 	stopErr := plugin.stop()
@@ -282,21 +447,49 @@ func (plugin *Plugin) UnloadPlugin() error {
 	}
 
 	// Close the connection
-	plugin.pluginConn.Close()
+	pluginConn, _ := plugin.connection()
+	pluginConn.Close()
+	if rpcConn, _ := plugin.rpcConnection(); rpcConn != nil {
+		rpcConn.Close()
+	}
 
 	// Kill the plugin process
-	stoppErr := stopProcess(plugin.pid)
+	stoppErr := stopProcess(pid)
 	if stoppErr != nil {
 		log.ERROR.Println("Failed to stop the plugin process: ", stoppErr)
 	}
+	notifyPluginEvent(PluginEventUnload, plugin, stoppErr)
 
 	return nil
 }
 
 /* Function to reload a plugin */
 func (plugin *Plugin) ReloadPlugin() error {
+	return plugin.reloadFrom(plugin.processId())
+}
+
+/* Internal: Reload a plugin seen failing on its process failedPid, unless a concurrent reload already replaced the process */
+func (plugin *Plugin) reloadFrom(failedPid int) error {
+
+	// The plugins connected by ConnectPlugin have no registry to reload from
+	if pluginReg == nil {
+		return fmt.Errorf("Failed to reload plugin: no plugin registry")
+	}
+
+	plugin.reloadLock.Lock()
+	defer plugin.reloadLock.Unlock()
+	if current := plugin.processId(); current != failedPid {
+		log.DEBUG.Printf("Plugin of controller %s already reloaded (pid %d -> %d)", plugin.Controller, failedPid, current)
+		return nil
+	}
+	if wait := time.Until(plugin.nextReload); wait > 0 {
+		return fmt.Errorf("Failed to reload plugin: %w for %v", ErrReloadBackoff, wait.Round(time.Millisecond))
+	}
 
-	plugin.UnloadPlugin()
+	// The requests in flight end before the process is stopped
+	plugin.requests.Lock()
+	plugin.unload()
+	plugin.requests.Unlock()
 
 	// Get the plugin reload info
 	name := plugin.Controller
@@ -305,21 +498,87 @@ func (plugin *Plugin) ReloadPlugin() error {
 
 	newPlugin, err := pluginReg.LoadPluginInstance(plugType, name, version)
 	if err != nil {
+		// The process started without being activated is stopped, and the
+		// pid of the stopped one forgotten as it may be reused
+		if newPlugin != nil {
+			newPlugin.unload()
+		}
+		plugin.lock.Lock()
+		plugin.pid = 0
+		plugin.connected = false
+		plugin.lock.Unlock()
+
+		backoff := ReloadMinBackoff
+		for i := 0; i < plugin.reloadFailures && backoff < ReloadMaxBackoff; i++ {
+			backoff *= 2
+		}
+		if backoff > ReloadMaxBackoff {
+			backoff = ReloadMaxBackoff
+		}
+		plugin.reloadFailures++
+		plugin.nextReload = time.Now().Add(backoff)
+		log.ERROR.Printf("Failed to reload plugin of controller %s, next attempt in %v: %v", name, backoff, err)
 		return fmt.Errorf("Failed to reload plugin: %v", err)
 	}
-
+	plugin.reloadFailures, plugin.nextReload = 0, time.Time{}
+	pluginConn, connected := newPlugin.connection()
+	rpcConn, _ := newPlugin.rpcConnection()
+	pid := newPlugin.processId()
+	methods := newPlugin.GetMethods()
+	protocol := newPlugin.protocolVersion()
+
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
 	// The plugin Connection
-	plugin.pluginConn = newPlugin.pluginConn
-	// Plugin disconnected state (currently Being set but not being used)
-	plugin.connected = newPlugin.connected
+	plugin.pluginConn = pluginConn
+	plugin.rpcConn = rpcConn
+	// Plugin connected state
+	plugin.connected = connected
 	// The Plugin instance PId
-	plugin.pid = newPlugin.pid
+	plugin.pid = pid
+	// The methods, their deadlines and the protocol of the new instance
+	plugin.methods = methods
+	plugin.timeouts = newPlugin.timeouts
+	plugin.protocol = protocol
 
 	return nil
 }
 
+/* Internal: Get the connection of a plugin and its state */
+func (plugin *Plugin) connection() (*PluginConn.PluginClient, bool) {
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+	return plugin.pluginConn, plugin.connected
+}
+
+/* Internal: Get the grpc connection of a plugin and its state */
+func (plugin *Plugin) rpcConnection() (*pluginrpc.Client, bool) {
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+	return plugin.rpcConn, plugin.connected
+}
+
+/* Internal: Set the connection state of a plugin */
+func (plugin *Plugin) setConnected(connected bool) {
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+	plugin.connected = connected
+}
+
+/* Internal: Get the process id of a plugin instance */
+func (plugin *Plugin) processId() int {
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+	return plugin.pid
+}
+
 func stopProcess(pid int) error {
 
+	// Never signal the process group
+	if pid <= 0 {
+		return fmt.Errorf("No plugin process")
+	}
+
 	process, err := os.FindProcess(pid)
 	if err != nil {
 		return fmt.Errorf("Failed to get Process of Id: %d", pid)
@@ -335,7 +594,21 @@ func stopProcess(pid int) error {
 }
 
 // Get LifeCycle Plugin Loc
+/* Internal: Stop a plugin process that was never connected, and reap it */
+func abandonProcess(pid int) {
+	if pid <= 0 {
+		return
+	}
+	if err := stopProcess(pid); err != nil {
+		log.ERROR.Println("Failed to stop the plugin process: ", err)
+		return
+	}
+	go syscall.Wait4(pid, nil, 0, nil)
+}
+
 func (pluginReg *PluginReg) getLifeCyclePluginLoc(controller string, version string) (string, *VersionInfo) {
+	pluginReg.RegAccess.Lock()
+	defer pluginReg.RegAccess.Unlock()
 
 	// Check every monitor plugin
 	for controllerInfo, location := range pluginReg.LifeCyclePlugins {
@@ -370,6 +643,20 @@ func (pluginReg *PluginReg) LoadPluginInstance(plugType string, controller strin
 	// Get the plugin tar location
 	tarFold := pluginLoc
 
+	// The method deadlines and the transport of the manifest
+	pluginType, typeErr := loadPluginType(filepath.Join(tarFold, DefaultConfFile), plugType)
+	if typeErr != nil {
+		return nil, typeErr
+	}
+	timeouts, timeoutsErr := pluginType.methodTimeouts()
+	if timeoutsErr != nil {
+		return nil, timeoutsErr
+	}
+	transport, transportErr := pluginType.transport()
+	if transportErr != nil {
+		return nil, transportErr
+	}
+
 	// Runtime Conf file
 	confFile := filepath.Join(tarFold, DefaultPluginConfFile)
 
@@ -415,8 +702,20 @@ func (pluginReg *PluginReg) LoadPluginInstance(plugType string, controller strin
 		time.Sleep(DefaultInterval)
 	}
 	if pluginConn == nil {
+		abandonProcess(pid)
 		return nil, PluginConnFailed
 	}
+	// The grpc transport is served on the same socket
+	var rpcConn *pluginrpc.Client = nil
+	if transport == TransportGrpc {
+		var rpcErr error
+		rpcConn, rpcErr = pluginrpc.Dial(sockFile)
+		if rpcErr != nil {
+			pluginConn.Close()
+			abandonProcess(pid)
+			return nil, PluginConnFailed
+		}
+	}
 
 	plugin := &Plugin{}
 	plugin.PluginSock = sockFile
@@ -429,9 +728,18 @@ func (pluginReg *PluginReg) LoadPluginInstance(plugType string, controller strin
 	plugin.Version = *versionInfo
 	plugin.Type = plugType
 	plugin.Controller = controller
+	plugin.timeouts = timeouts
+	plugin.transport = transport
+	plugin.rpcConn = rpcConn
+
+	// Report the plugin crashes
+	if pid > 0 {
+		go plugin.watchProcess(pid)
+	}
 
 	// Activate the plugin
-	activateErr := plugin.activate()
+	activateErr := plugin.handshake()
+	notifyPluginEvent(PluginEventLoad, plugin, activateErr)
 	if activateErr != nil {
 		return plugin, activateErr
 	}
@@ -439,6 +747,73 @@ func (pluginReg *PluginReg) LoadPluginInstance(plugType string, controller strin
 	return plugin, nil
 }
 
+/* Connect to a plugin started outside of the plugin registry and activate it, as LoadPluginInstance does.
+   The plugin process pid receives the SIGUSR1 of the unload, the plugin tests drive the plugins with it */
+func ConnectPlugin(sockFile string, controller string, pluginType *PluginType, pid int) (*Plugin, error) {
+	timeouts, err := pluginType.methodTimeouts()
+	if err != nil {
+		return nil, err
+	}
+	transport, err := pluginType.transport()
+	if err != nil {
+		return nil, err
+	}
+
+	pluginConn, err := PluginConn.NewPluginClient(sockFile)
+	if err != nil {
+		return nil, PluginConnFailed
+	}
+	var rpcConn *pluginrpc.Client = nil
+	if transport == TransportGrpc {
+		if rpcConn, err = pluginrpc.Dial(sockFile); err != nil {
+			pluginConn.Close()
+			return nil, PluginConnFailed
+		}
+	}
+
+	plugin := &Plugin{PluginSock: sockFile, PluginUrl: PluginUrl, pluginConn: pluginConn, rpcConn: rpcConn, connected: true, callbacks: make(map[string]bool),
+		pid: pid, Type: pluginType.Type, Controller: controller, timeouts: timeouts, transport: transport}
+	if err := plugin.handshake(); err != nil {
+		pluginConn.Close()
+		if rpcConn != nil {
+			rpcConn.Close()
+		}
+		return nil, err
+	}
+	return plugin, nil
+}
+
+/* Internal: Load a plugin type from a plugin manifest, an empty one if the manifest has none */
+func loadPluginType(confFile string, plugType string) (*PluginType, error) {
+	pluginConf, err := loadPluginConfigs(confFile)
+	if err != nil {
+		return nil, fmt.Errorf("Configuration load failed for file %s: %v", confFile, err)
+	}
+	for _, pluginType := range pluginConf.PluginTypes {
+		if pluginType.Type == plugType || (isLifecycleType(pluginType.Type) && isLifecycleType(plugType)) {
+			return &pluginType, nil
+		}
+	}
+	return &PluginType{Type: plugType}, nil
+}
+
+/* Internal: Get the context of a method, bounded by its default deadline if the caller didn't set one */
+func (plugin *Plugin) methodContext(ctx context.Context, method string) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	plugin.lock.Lock()
+	timeout, ok := plugin.timeouts[method]
+	if !ok {
+		timeout, ok = plugin.timeouts[DefaultMethodTimeout]
+	}
+	plugin.lock.Unlock()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
 func (pluginReg *PluginReg) startPlugin(startFile string) (int, error) {
 
 	// Change the file permission
@@ -480,28 +855,86 @@ func (plugin *Plugin) ReConnect() error {
 
 	// Connect to the plugin
 	pluginConn, connErr := PluginConn.NewPluginClient(plugin.PluginSock)
+	var rpcConn *pluginrpc.Client = nil
+	if connErr == nil && plugin.transport == TransportGrpc {
+		rpcConn, connErr = pluginrpc.Dial(plugin.PluginSock)
+	}
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
 	if connErr != nil {
 		plugin.connected = false
 		return fmt.Errorf("Failed to reconnect: %v", connErr)
 	}
-	// Set connection object
+	// Set connection object, the previous one keeps serving its requests
+	if plugin.pluginConn != nil {
+		plugin.pluginConn.Close()
+	}
 	plugin.pluginConn = pluginConn
+	if rpcConn != nil {
+		// The calls in progress on the previous grpc connection are interrupted
+		if plugin.rpcConn != nil {
+			plugin.rpcConn.Close()
+		}
+		plugin.rpcConn = rpcConn
+	}
 	plugin.connected = true
 
 	return nil
 }
 
-// Activate a plugin
+// Negotiate the protocol version with a plugin and activate it, the legacy
+// plugins don't know the handshake and are activated as before
+func (plugin *Plugin) handshake() error {
+	if plugin.transport == TransportGrpc {
+		return plugin.rpcActivate()
+	}
+	pluginConn, _ := plugin.connection()
+
+	data, _ := json.Marshal(&HandshakeRequest{MinVersion: ProtocolMinVersion, MaxVersion: ProtocolVersion})
+	request := &PluginConn.PluginRequest{Url: plugin.PluginUrl + "/" + HandshakePath, Body: data}
+
+	resp, reqerr := pluginConn.Request(context.Background(), request)
+	if reqerr != nil {
+		plugin.setConnected(false)
+		return reqerr
+	}
+	if resp.Status != "200 OK" {
+		if !AllowLegacyProtocol {
+			return fmt.Errorf("Plugin of controller %s uses the legacy protocol, which is no longer allowed", plugin.Controller)
+		}
+		log.WARN.Printf("Plugin of controller %s uses the deprecated legacy protocol, rebuild it with the current plugin SDK", plugin.Controller)
+		return plugin.activate()
+	}
+
+	handshake := &HandshakeResponse{}
+	if err := json.Unmarshal(resp.Body, handshake); err != nil {
+		return fmt.Errorf("Invalid handshake response: %v", err)
+	}
+	if handshake.Error != nil {
+		return handshake.Error
+	}
+	if handshake.Version < ProtocolMinVersion || handshake.Version > ProtocolVersion {
+		return fmt.Errorf("Plugin negotiated the unsupported protocol version %d", handshake.Version)
+	}
+	plugin.lock.Lock()
+	plugin.protocol = handshake.Version
+	plugin.methods = handshake.Methods
+	plugin.lock.Unlock()
+	log.INFO.Printf("Plugin of controller %s speaks protocol version %d", plugin.Controller, handshake.Version)
+	return nil
+}
+
+// Activate a legacy plugin
 func (plugin *Plugin) activate() error {
 	pluginUrl := plugin.PluginUrl
-	pluginConn := plugin.pluginConn
+	pluginConn, _ := plugin.connection()
 
 	requestUrl := pluginUrl + "/Activate"
 	request := &PluginConn.PluginRequest{Url: requestUrl, Body: nil}
 
-	resp, reqerr := pluginConn.Request(request)
+	resp, reqerr := pluginConn.Request(context.Background(), request)
 	if reqerr != nil {
-		plugin.connected = false
+		plugin.setConnected(false)
 		return reqerr
 	}
 	if resp.Status != "200 OK" {
@@ -509,23 +942,30 @@ func (plugin *Plugin) activate() error {
 	}
 
 	// Get the response
-	unmarshalError := json.Unmarshal(resp.Body, &plugin.methods)
+	var methods []string
+	unmarshalError := json.Unmarshal(resp.Body, &methods)
 	if unmarshalError != nil {
 		return fmt.Errorf("Json Unmarshal failed: %s", unmarshalError)
 	}
+	plugin.lock.Lock()
+	plugin.methods = methods
+	plugin.lock.Unlock()
 
 	return nil
 }
 
 // Deactivate a plugin
 func (plugin *Plugin) stop() error {
+	if plugin.transport == TransportGrpc {
+		return plugin.rpcStop()
+	}
 	pluginUrl := plugin.PluginUrl
-	pluginConn := plugin.pluginConn
+	pluginConn, _ := plugin.connection()
 
 	requestUrl := pluginUrl + "/Stop"
 	request := &PluginConn.PluginRequest{Url: requestUrl, Body: nil}
 
-	resp, err := pluginConn.Request(request)
+	resp, err := pluginConn.Request(context.Background(), request)
 	if err != nil {
 		return err
 	}
@@ -539,137 +979,368 @@ func (plugin *Plugin) stop() error {
 /* Get the list of available (registered) methods for a specific plugin */
 func (plugin *Plugin) GetMethods() []string {
 
-	var methods []string
-	methods = plugin.methods
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+	methods := make([]string, len(plugin.methods))
+	copy(methods, plugin.methods)
 	return methods
 }
 
-/* Register a callback that will be called on notification from the plugin */
+/* Register a callback that will be called on notification from the plugin. The notifications are delivered
+   in order until the plugin is unloaded, the delivery resumes after the reconnections and the reloads */
 func (plugin *Plugin) RegisterCallback(function func([]byte)) error {
 
-	if !plugin.connected {
-		return fmt.Errorf("Plugin is not connected")
-	}
-
 	funcName := getFuncName(function)
 	if funcName == "" {
 		return fmt.Errorf("Failed to get the method name")
 	}
+	return plugin.RegisterNamedCallback(funcName, function)
+}
+
+/* Register a callback under the name the plugin notifies, instead of the function name */
+func (plugin *Plugin) RegisterNamedCallback(funcName string, function func([]byte)) error {
+
+	plugin.lock.Lock()
+	if !plugin.connected {
+		plugin.lock.Unlock()
+		return fmt.Errorf("Plugin is not connected")
+	}
 	// Check if the callback is already registered
 	_, ok := plugin.callbacks[funcName]
 	if ok {
+		plugin.lock.Unlock()
 		return fmt.Errorf("The callback is already Registerd")
 	}
 	// Put the callback function in the callbacks map
 	plugin.callbacks[funcName] = false
-
-	// Start the execution thread
-	go plugin.executeCallback(funcName, function)
+	if plugin.events == nil {
+		plugin.events, plugin.closeEvents = context.WithCancel(context.Background())
+	}
+	ctx := plugin.events
+	plugin.lock.Unlock()
+
+	// Start the execution thread, the plugins of the previous SDKs don't buffer their events
+	switch {
+	case plugin.hasMethod(MethodEventsSubscribe):
+		subscription := &EventsRequest{Callback: funcName}
+		go plugin.receiveEvents(ctx, funcName, func(ctx context.Context) (bool, error) {
+			return plugin.subscribeEvents(ctx, subscription, function)
+		})
+	case plugin.transport == TransportGrpc:
+		go plugin.receiveEvents(ctx, funcName, func(ctx context.Context) (bool, error) {
+			return plugin.streamEvents(ctx, funcName, function)
+		})
+	default:
+		go plugin.receiveEvents(ctx, funcName, func(ctx context.Context) (bool, error) {
+			return plugin.executeCallback(ctx, funcName, function)
+		})
+	}
 
 	return nil
 }
 
-// Internal:  thread body to execute a callback request
-func (plugin *Plugin) executeCallback(funcName string, function func([]byte)) {
+// Internal: long poll of the notifications of a callback, for the legacy plugins. Returns on the first failure
+func (plugin *Plugin) executeCallback(ctx context.Context, funcName string, function func([]byte)) (bool, error) {
 	// wrap the method name in bytes
 	data, marshalErr := json.Marshal(funcName)
 	if marshalErr != nil {
-		log.ERROR.Printf("Json Marshal Failed to encode method name")
-		return
+		return false, fmt.Errorf("Json Marshal Failed to encode method name")
 	}
 
-	pluginUrl := plugin.PluginUrl
-	pluginConn := plugin.pluginConn
-
-	requestUrl := pluginUrl + "/" + "RegisterCallback"
-	request := &PluginConn.PluginRequest{Url: requestUrl, Body: data}
+	requestUrl := plugin.PluginUrl + "/" + "RegisterCallback"
+	// The poll waits for the plugin notification, without deadline
+	request := &PluginConn.PluginRequest{Url: requestUrl, Body: data, Timeout: PluginConn.NoTimeout}
 
-	//	for plugin.callbacks[funcName] == false {
-	for true {
-		resp, err := pluginConn.Request(request)
+	delivered := false
+	for {
+		pluginConn, _ := plugin.connection()
+		resp, err := pluginConn.Request(ctx, request)
 		if err != nil {
-			plugin.connected = false
-			log.FATAL.Fatalf("Failed to sent CallBack Execution Request: %v", err)
-			return
+			plugin.setConnected(false)
+			return delivered, fmt.Errorf("Failed to sent CallBack Execution Request: %v", err)
 		}
 		if resp.Status != "200 OK" {
-			log.FATAL.Fatalf("Failed to sent callback request")
-			return
+			return delivered, fmt.Errorf("Failed to sent callback request. Status: %s", resp.Status)
 		}
-		// get the data from resp
-		callBackInput := resp.Body
-		// call the callback
-		function(callBackInput)
+		// call the callback with the data of the resp
+		function(resp.Body)
+		delivered = true
 	}
 }
 
 /* Executes a specific plugin method by the method name. Each method takes a byte array as input
-   and returns a byte array as output */
-func (plugin *Plugin) Execute(funcName string, body []byte) (error, []byte) {
+   and returns a byte array as output. The deadline and the cancellation of the context reach the plugin.
+   It is the legacy protocol, the plugins negotiating a protocol version are called by Call */
+func (plugin *Plugin) Execute(ctx context.Context, funcName string, body []byte) (error, []byte) {
 
-	found := false
+	if plugin.transport == TransportGrpc {
+		return fmt.Errorf("Method of name : %s can't be executed over the grpc transport, use Call", funcName), nil
+	}
+	if !plugin.hasMethod(funcName) {
+		return fmt.Errorf("Method of name : %s is not registered", funcName), nil
+	}
 
-	if !plugin.connected {
-		return fmt.Errorf("Plugin is not connected"), nil
+	requestUrl := plugin.PluginUrl + "/" + funcName
+	resp, err := plugin.send(ctx, &PluginConn.PluginRequest{Url: requestUrl, Body: body}, false)
+	if err != nil {
+		return err, nil
+	}
+	if resp.Status != "200 OK" {
+		return fmt.Errorf("request failed"), nil
 	}
 
-	// check if method is registered
-	for _, method := range plugin.methods {
-		if method == funcName {
-			found = true
-			break
+	ret := resp.Body
+
+	if string(resp.Body) == "<nil>" {
+		ret = nil
+	}
+
+	return nil, ret
+}
+
+/* Call a plugin method by id with the negotiated protocol. The payload and the result are
+   json encoded, a failure of the method is returned as a *PluginError */
+func (plugin *Plugin) Call(ctx context.Context, method string, payload interface{}, result interface{}) error {
+
+	version := plugin.protocolVersion()
+	if version < ProtocolMinVersion {
+		return fmt.Errorf("Plugin uses the legacy protocol, method %s can't be called", method)
+	}
+	if !plugin.hasMethod(method) {
+		return fmt.Errorf("Method of id : %s is not registered", method)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("Json Marshal failed: %v", err)
+	}
+	request := &RequestEnvelope{Version: version, Method: method, Encoding: EncodingJson, Payload: data}
+
+	var envelope *ResponseEnvelope
+	if plugin.transport == TransportGrpc {
+		envelope, err = plugin.rpcInvoke(ctx, request)
+	} else {
+		envelope, err = plugin.httpCall(ctx, request)
+	}
+	if err != nil {
+		return err
+	}
+	if envelope.Error != nil {
+		return envelope.Error
+	}
+	if result != nil && len(envelope.Result) > 0 {
+		if err := json.Unmarshal(envelope.Result, result); err != nil {
+			return fmt.Errorf("Invalid result of method %s: %v", method, err)
 		}
 	}
-	if !found {
-		return fmt.Errorf("Method of name : %s is not registered", funcName), nil
+	return nil
+}
+
+/* Call a plugin method by id streaming its results, each chunk is passed json encoded to the chunk function
+   as it comes and the result ends the stream. The plugin must speak the protocol version 2 */
+func (plugin *Plugin) Stream(ctx context.Context, method string, payload interface{}, chunk func(json.RawMessage) error, result interface{}) error {
+	return plugin.stream(ctx, method, payload, 0, chunk, result)
+}
+
+/* Internal: Stream a method call, the timeout applies to the http transport as to the PluginRequest */
+func (plugin *Plugin) stream(ctx context.Context, method string, payload interface{}, timeout time.Duration, chunk func(json.RawMessage) error, result interface{}) error {
+
+	if version := plugin.protocolVersion(); version < ProtocolStreamVersion {
+		return fmt.Errorf("Plugin speaks the protocol version %d, method %s can't be streamed", version, method)
+	}
+	if !plugin.hasMethod(method) {
+		return fmt.Errorf("Method of id : %s is not registered", method)
 	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("Json Marshal failed: %v", err)
+	}
+	request := &RequestEnvelope{Version: plugin.protocolVersion(), Method: method, Encoding: EncodingJson, Payload: data}
 
-	pluginUrl := plugin.PluginUrl
-	pluginConn := plugin.pluginConn
+	// The reloads wait for the streams, but for the log follows lasting until the client leaves
+	if method != MethodLogs {
+		plugin.requests.RLock()
+		defer plugin.requests.RUnlock()
+	}
+
+	// The streams are not retried, a chunk may have been handled already
+	var end *StreamFrame
+	if plugin.transport == TransportGrpc {
+		end, err = plugin.rpcStream(ctx, request, chunk)
+	} else {
+		end, err = plugin.httpStream(ctx, request, timeout, chunk)
+	}
+	if err != nil {
+		return err
+	}
+	if end == nil {
+		return fmt.Errorf("Stream of method %s ended without a result", method)
+	}
+	if end.Error != nil {
+		return end.Error
+	}
+	if result != nil && len(end.Result) > 0 {
+		if err := json.Unmarshal(end.Result, result); err != nil {
+			return fmt.Errorf("Invalid result of method %s: %v", method, err)
+		}
+	}
+	return nil
+}
 
-	requestUrl := pluginUrl + "/" + funcName
-	request := &PluginConn.PluginRequest{Url: requestUrl, Body: body}
+/* Internal: Stream a method call over the http transport, the frames are json lines. Get the end frame, nil if none */
+func (plugin *Plugin) httpStream(ctx context.Context, request *RequestEnvelope, timeout time.Duration, chunk func(json.RawMessage) error) (*StreamFrame, error) {
 
-	resp, err := pluginConn.Request(request)
+	pluginConn, connected := plugin.connection()
+	if !connected {
+		return nil, fmt.Errorf("Plugin is not connected")
+	}
+	body, err := json.Marshal(request)
 	if err != nil {
-		plugin.connected = false
-		// try to reconnect the plugin
-		err := plugin.ReConnect()
-		if err != nil {
-			err = plugin.ReloadPlugin()
+		return nil, fmt.Errorf("Json Marshal failed: %v", err)
+	}
+	stream, err := pluginConn.RequestStream(ctx, &PluginConn.PluginRequest{Url: plugin.PluginUrl + "/" + StreamPath, Body: body, Timeout: timeout})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("Request to plugin interrupted: %w", ctx.Err())
 		}
-		if err != nil {
-			return fmt.Errorf("Failed to communicate with plugin"), nil
+		return nil, err
+	}
+	defer stream.Close()
+	if stream.Status != "200 OK" {
+		return nil, fmt.Errorf("request failed. Status: %s", stream.Status)
+	}
+
+	decoder := json.NewDecoder(stream.Body)
+	for {
+		frame := &StreamFrame{}
+		if err := decoder.Decode(frame); err != nil {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("Stream of method %s interrupted: %w", request.Method, ctx.Err())
+			}
+			if err == io.EOF {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("Invalid stream of method %s: %v", request.Method, err)
 		}
+		if frame.End {
+			return frame, nil
+		}
+		if err := chunk(frame.Data); err != nil {
+			return nil, err
+		}
+	}
+}
+
+/* Internal: Send a method call in a json envelope over the http transport */
+func (plugin *Plugin) httpCall(ctx context.Context, request *RequestEnvelope) (*ResponseEnvelope, error) {
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("Json Marshal failed: %v", err)
+	}
+	resp, err := plugin.send(ctx, &PluginConn.PluginRequest{Url: plugin.PluginUrl + "/" + CallPath, Body: body}, idempotentMethods[request.Method])
+	if err != nil {
+		return nil, err
 	}
 	if resp.Status != "200 OK" {
-		return fmt.Errorf("request failed"), nil
+		return nil, fmt.Errorf("request failed. Status: %s", resp.Status)
 	}
+	envelope := &ResponseEnvelope{}
+	if err := json.Unmarshal(resp.Body, envelope); err != nil {
+		return nil, fmt.Errorf("Invalid response of method %s: %v", request.Method, err)
+	}
+	return envelope, nil
+}
 
-	ret := resp.Body
+/* Internal: Check if a method is registered by the plugin */
+func (plugin *Plugin) hasMethod(name string) bool {
+	for _, method := range plugin.GetMethods() {
+		if method == name {
+			return true
+		}
+	}
+	return false
+}
 
-	if string(resp.Body) == "<nil>" {
-		ret = nil
+/* Get the protocol version negotiated with the plugin, ProtocolLegacy for the legacy plugins */
+func (plugin *Plugin) ProtocolVersion() int {
+	return plugin.protocolVersion()
+}
+
+/* Internal: Get the protocol version negotiated with the plugin */
+func (plugin *Plugin) protocolVersion() int {
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+	return plugin.protocol
+}
+
+/* Internal: Send a request to the plugin, reconnecting (or reloading) the plugin once if it can't be reached.
+   The request is sent again if it never reached the plugin, or if it is idempotent */
+func (plugin *Plugin) send(ctx context.Context, request *PluginConn.PluginRequest, idempotent bool) (*PluginConn.PluginResponse, error) {
+
+	pluginConn, connected := plugin.connection()
+	if !connected {
+		return nil, fmt.Errorf("Plugin is not connected")
 	}
+	pid := plugin.processId()
 
-	return nil, ret
+	resp, err := plugin.request(ctx, pluginConn, request)
+	if err != nil && ctx.Err() != nil {
+		// The caller gave up, the plugin is not at fault
+		return nil, fmt.Errorf("Request to plugin interrupted: %w", ctx.Err())
+	}
+	if err != nil {
+		plugin.setConnected(false)
+		// A request the plugin may have handled, e.g. a start, is not sent twice
+		retry := idempotent || errors.Is(err, PluginConn.ErrNotSent)
+		// try to reconnect the plugin, and retry on the new connection
+		sendErr := err
+		err := plugin.ReConnect()
+		if err != nil {
+			err = plugin.reloadFrom(pid)
+		}
+		if err == nil && !retry {
+			return nil, fmt.Errorf("Request to plugin failed: %v", sendErr)
+		}
+		if err == nil {
+			pluginConn, _ = plugin.connection()
+			resp, err = plugin.request(ctx, pluginConn, request)
+		}
+		if err != nil && ctx.Err() != nil {
+			return nil, fmt.Errorf("Request to plugin interrupted: %w", ctx.Err())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to communicate with plugin")
+		}
+	}
+	return resp, nil
+}
+
+/* Internal: Send a request on a connection of the plugin, the reloads wait for its end */
+func (plugin *Plugin) request(ctx context.Context, pluginConn *PluginConn.PluginClient, request *PluginConn.PluginRequest) (*PluginConn.PluginResponse, error) {
+	plugin.requests.RLock()
+	defer plugin.requests.RUnlock()
+	return pluginConn.Request(ctx, request)
 }
 
 /* Ping a specific plugin to check the plugin status */
 func (plugin *Plugin) Ping() error {
+	if plugin.transport == TransportGrpc {
+		return plugin.rpcHealth()
+	}
 
 	pluginUrl := plugin.PluginUrl
-	pluginConn := plugin.pluginConn
+	pluginConn, _ := plugin.connection()
 
 	testData := "Test Data"
 	sendData := []byte(testData)
 
 	requestUrl := pluginUrl + "/" + "Ping"
-	request := &PluginConn.PluginRequest{Url: requestUrl, Body: sendData}
+	request := &PluginConn.PluginRequest{Url: requestUrl, Body: sendData, Timeout: PingTimeout}
 
-	resp, err := pluginConn.Request(request)
+	resp, err := pluginConn.Request(context.Background(), request)
 	if err != nil {
-		plugin.connected = false
+		plugin.setConnected(false)
 		return err
 	}
 	if resp.Status != "200 OK" {
@@ -0,0 +1,176 @@
+package pluginmanager
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Write a plugin tar with its plugin.conf, renamed in place once complete
+func writePluginTar(t *testing.T, dir, name, controller string) {
+	conf := fmt.Sprintf(`{"plugin-types": [{"plugin-type": "lifecycle", "controllers": [{"name": %q, "equals-version": "1.0"}]}]}`, controller)
+	tmp := filepath.Join(dir, name+".tmp")
+	file, err := os.Create(tmp)
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	writer := tar.NewWriter(file)
+	writer.WriteHeader(&tar.Header{Name: name + "/", Typeflag: tar.TypeDir, Mode: 0755})
+	writer.WriteHeader(&tar.Header{Name: name + "/" + DefaultConfFile, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(conf))})
+	writer.Write([]byte(conf))
+	writer.Close()
+	file.Close()
+	if err := os.Rename(tmp, filepath.Join(dir, name+DefaultTarExt)); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+}
+
+// Hammer the registry while the discovery routine registers plugins, run with -race
+func TestConcurrentDiscovery(t *testing.T) {
+	saved := DefaultInterval
+	DefaultInterval = 5 * time.Millisecond
+	defer func() { DefaultInterval = saved }()
+
+	dir := t.TempDir()
+	reg, err := PluginRegInit(PluginRegConf{PluginLocation: dir})
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+
+	const plugins = 8
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deadline := time.Now().Add(5 * time.Second)
+			for time.Now().Before(deadline) {
+				found := 0
+				for p := 0; p < plugins; p++ {
+					if loc, _ := reg.getLifeCyclePluginLoc(fmt.Sprintf("controller-%d", p), "1.0"); loc != "" && reg.IsDiscovered(fmt.Sprintf("plugin-%d", p)) {
+						found++
+					}
+				}
+				if found == plugins {
+					return
+				}
+			}
+			t.Errorf("The plugins were not all discovered")
+		}()
+	}
+	for p := 0; p < plugins; p++ {
+		writePluginTar(t, dir, fmt.Sprintf("plugin-%d", p), fmt.Sprintf("controller-%d", p))
+	}
+	wg.Wait()
+
+	reg.Stop()
+	reg.WaitForStop()
+}
+
+// Hammer the loaded plugins, the plugin state and the callbacks, run with -race
+func TestConcurrentPluginStore(t *testing.T) {
+	saved := pluginStore
+	pluginStore = &PluginStore{allManagePlugins: make(map[*ControllerInfo]*Plugin)}
+	defer func() { pluginStore = saved }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			plugin := &Plugin{connected: true, methods: []string{"pluginmanager.manageStart"}, callbacks: map[string]bool{}, Controller: fmt.Sprintf("controller-%d", i)}
+			info := &ControllerInfo{Name: plugin.Controller, version: VersionInfo{"1.0", ""}, plugtype: "manage"}
+			pluginStore.lock.Lock()
+			pluginStore.allManagePlugins[info] = plugin
+			pluginStore.lock.Unlock()
+			for j := 0; j < 100; j++ {
+				plugin.setConnected(j%2 == 0)
+				plugin.GetMethods()
+				plugin.processId()
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if plugin := getLoadedPlugin("lifecycle", fmt.Sprintf("controller-%d", i), "1.0"); plugin != nil {
+					plugin.connection()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 8; i++ {
+		if getLoadedPlugin("lifecycle", fmt.Sprintf("controller-%d", i), "1.0") == nil {
+			t.Errorf("Plugin of controller-%d is not loaded", i)
+		}
+	}
+}
+
+func TestConcurrentCallbacks(t *testing.T) {
+	var wg sync.WaitGroup
+	received := make([][]byte, 8)
+	for i := range received {
+		name := fmt.Sprintf("callback-%d", i)
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			received[i] = callbackExecute(context.Background(), []byte(fmt.Sprintf("%q", name)))
+		}(i)
+		go func() {
+			defer wg.Done()
+			plugin := &PluginImpl{}
+			for plugin.Notify(name, []byte(name)) != nil {
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, data := range received {
+		if string(data) != fmt.Sprintf("callback-%d", i) {
+			t.Errorf("Expected callback-%d, got %s", i, data)
+		}
+	}
+}
+
+func TestMethodTimeouts(t *testing.T) {
+	pluginType := &PluginType{Type: "lifecycle", Timeouts: map[string]string{"start": "5m", "default": "1m"}}
+	timeouts, err := pluginType.methodTimeouts()
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if _, err := (&PluginType{Timeouts: map[string]string{"stop": "soon"}}).methodTimeouts(); err == nil {
+		t.Errorf("Expected an invalid timeout to fail")
+	}
+
+	plugin := &Plugin{timeouts: timeouts}
+	for method, expected := range map[string]time.Duration{"start": 5 * time.Minute, "stop": time.Minute} {
+		ctx, cancel := plugin.methodContext(context.Background(), method)
+		deadline, ok := ctx.Deadline()
+		cancel()
+		if remaining := time.Until(deadline); !ok || remaining > expected || remaining < expected-time.Minute/2 {
+			t.Errorf("Expected a deadline of %s for %s, got %s", expected, method, remaining)
+		}
+	}
+
+	// The deadline of the caller wins
+	caller, cancelCaller := context.WithTimeout(context.Background(), time.Hour)
+	defer cancelCaller()
+	ctx, cancel := plugin.methodContext(caller, "start")
+	defer cancel()
+	if deadline, _ := ctx.Deadline(); time.Until(deadline) < 30*time.Minute {
+		t.Errorf("The caller deadline was not kept")
+	}
+
+	ctx, cancel = (&Plugin{}).methodContext(context.Background(), "start")
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("Expected no deadline without manifest timeouts")
+	}
+}
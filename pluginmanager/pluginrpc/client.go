@@ -0,0 +1,29 @@
+package pluginrpc
+
+import (
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Client is the connection to a plugin of the grpc transport over its unix
+// socket. The calls are concurrent on the connection, which reconnects by
+// itself while the plugin socket is there.
+type Client struct {
+	PluginClient
+	conn *grpc.ClientConn
+}
+
+// Connect to the plugin served on a unix socket
+func Dial(sockFile string) (*Client, error) {
+	conn, err := grpc.NewClient("unix:"+sockFile, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to %s: %v", sockFile, err)
+	}
+	return &Client{PluginClient: NewPluginClient(conn), conn: conn}, nil
+}
+
+// Close the connection, the calls in progress are interrupted
+func (client *Client) Close() error {
+	return client.conn.Close()
+}
@@ -1,29 +1,58 @@
 package pluginmanager
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	log "github.com/spf13/jwalterweatherman"
 	store "org.openappstack/singularity/store"
+	"sync"
 )
 
 type AppPlugin struct {
 	appName string
 }
 
-// Manage Plugin Interface
+// Manage Plugin Interface, the requests are bounded by the context and by
+// the default deadlines of the plugin manifest ("init", "start", "stop", "config")
 type ManagePlugin interface {
-	Init(controllerId string, data []byte) error
-	Start(controllerId string, data []byte) error
-	Stop(controllerId string, data []byte) error
+	Init(ctx context.Context, controllerId string, data []byte, secrets map[string][]byte) error
+	// The progress reported by the plugin reaches the function set by WithProgress
+	Start(ctx context.Context, controllerId string, data []byte) error
+	Stop(ctx context.Context, controllerId string, data []byte) error
+	// Stream the log lines of a controller, ErrNotSupported if the plugin can't
+	Logs(ctx context.Context, request *LogsRequest, line func(*LogLine) error) error
+	// Push a configuration and its secrets to a controller, ErrNotSupported if the plugin can't
+	Configure(ctx context.Context, controllerId string, data []byte, secrets map[string][]byte) error
+}
+
+// The context key of the progress function of a lifecycle operation
+type progressKey struct{}
+
+/* Get a context reporting the progress of a lifecycle operation to a function */
+func WithProgress(ctx context.Context, progress func(*Progress)) context.Context {
+	return context.WithValue(ctx, progressKey{}, progress)
+}
+
+/* Internal: Report a progress to the function of the context, if any */
+func reportProgress(ctx context.Context, progress *Progress) {
+	if report, ok := ctx.Value(progressKey{}).(func(*Progress)); ok {
+		report(progress)
+	}
 }
 
 type PluginStore struct {
 	pluginReg *PluginReg
-	// Map of all plugin mapped againest a instance Id
+	// Map of all plugin mapped againest a instance Id, synced by the lock
 	allManagePlugins map[*ControllerInfo]*Plugin
+	lock             sync.Mutex
+	// Serializes the plugin loads, a plugin is loaded once
+	loadLock sync.Mutex
 	// The kvstore
-	kvstore *store.KVStore
+	kvstore store.Store
+	// The health checks of the loaded plugins, nil if disabled
+	health *healthChecker
 }
 
 type MonitorPluginInstance struct {
@@ -36,12 +65,15 @@ type ManagePluginInstance struct {
 
 var (
 	NotInitialized error = errors.New("Controller Not initialized")
+
+	// The plugin doesn't implement a method e.g. the controller logs
+	ErrNotSupported error = errors.New("Not supported by the plugin")
 )
 
 var pluginStore *PluginStore
 
 /* Function to initialize the singularity Plugin store */
-func PluginStoreInit(kvstore *store.KVStore) error {
+func PluginStoreInit(kvstore store.Store) error {
 
 	// init Monitor plugin store
 	conf := PluginRegConf{PluginLocation: "plugin"}
@@ -63,6 +95,12 @@ func PluginStoreInit(kvstore *store.KVStore) error {
 		return fmt.Errorf("KVStore load failed: %v", err)
 	}
 
+	// Start the health checks of the loaded plugins
+	if HealthCheckInterval > 0 {
+		pluginStore.health = newHealthChecker(HealthCheckInterval, HealthFailureThreshold)
+		go pluginStore.health.run(pluginStore.loadedPlugins)
+	}
+
 	return nil
 }
 
@@ -91,7 +129,9 @@ func saveToStore(k, v []byte) error {
 	}
 	switch controllerInfo.plugtype {
 	case "manage":
+		pluginStore.lock.Lock()
 		pluginStore.allManagePlugins[&controllerInfo] = plugin
+		pluginStore.lock.Unlock()
 		break
 	}
 	return nil
@@ -109,6 +149,15 @@ func GetManagePlugin(controller string, version string) (ManagePlugin, error) {
 		return ManagePlugin(appPlugin), nil
 	}
 
+	// Check again once the concurrent loads are done
+	pluginStore.loadLock.Lock()
+	defer pluginStore.loadLock.Unlock()
+	plugin = getLoadedPlugin("lifecycle", controller, version)
+	if plugin != nil {
+		appPlugin := &ManagePluginInstance{plugin}
+		return ManagePlugin(appPlugin), nil
+	}
+
 	// get the plugin from the plugin reg
 	plugin, loadErr := pluginReg.LoadPluginInstance("lifecycle", controller, version)
 	if loadErr != nil {
@@ -118,7 +167,9 @@ func GetManagePlugin(controller string, version string) (ManagePlugin, error) {
 	controllerInfo := &ControllerInfo{controller, plugin.Version, "manage"}
 
 	// Store in the all plugin list
+	pluginStore.lock.Lock()
 	pluginStore.allManagePlugins[controllerInfo] = plugin
+	pluginStore.lock.Unlock()
 
 	// Set the plugin in the kvstore
 	setErr := pluginStore.kvstore.Set(store.Plugin_instances_bucket, getBytes(&plugin.Version), getBytes(plugin))
@@ -133,6 +184,9 @@ func GetManagePlugin(controller string, version string) (ManagePlugin, error) {
 
 /* get a plugin which is already loaded */
 func getLoadedPlugin(plugType, controller, version string) *Plugin {
+	pluginStore.lock.Lock()
+	defer pluginStore.lock.Unlock()
+
 	// check plugin type
 	var pluginMap map[*ControllerInfo]*Plugin
 	switch plugType {
@@ -148,89 +202,139 @@ func getLoadedPlugin(plugType, controller, version string) *Plugin {
 	return nil
 }
 
-/* Function to perform init on a Manage Plugin Instance*/
-func (appPlugin *ManagePluginInstance) Init(controllerId string, data []byte) error {
+/* Get the lifecycle methods of a plugin, e.g. connected by ConnectPlugin */
+func NewManagePlugin(plugin *Plugin) ManagePlugin {
+	return &ManagePluginInstance{plugin}
+}
 
-	// Get the Plugin
-	plugin := appPlugin.plugin
+/* Function to perform init on a Manage Plugin Instance, the secrets are delivered along (never log them) */
+func (appPlugin *ManagePluginInstance) Init(ctx context.Context, controllerId string, data []byte, secrets map[string][]byte) error {
 
-	reqdata, err := encapsuleControllerId(controllerId, data)
-	if err != nil {
-		return fmt.Errorf("Failed to encapsule controllerId")
-	}
+	request := &LifecycleRequest{ControllerId: controllerId, Data: data, Secrets: secrets}
+	return appPlugin.call(ctx, "init", MethodInit, "pluginmanager.manageInit", request)
+}
 
-	// Execute the Init request
-	exeErr, returnByte := plugin.Execute("pluginmanager.manageInit", reqdata)
-	if exeErr != nil {
-		return fmt.Errorf("Request to plugin could not be made: %v", exeErr)
+/* Function to perform Start on a manage Plugin instance, the plugins speaking the protocol version 2 stream the progress */
+func (appPlugin *ManagePluginInstance) Start(ctx context.Context, controllerId string, data []byte) error {
+
+	request := &LifecycleRequest{ControllerId: controllerId, Data: data}
+	plugin := appPlugin.plugin
+	if plugin.protocolVersion() < ProtocolStreamVersion {
+		return appPlugin.call(ctx, "start", MethodStart, "pluginmanager.manageStart", request)
 	}
-	// Check if return byte is nil
-	if returnByte != nil {
-		retString := string(returnByte)
-		if retString != "" || retString != "<nil>" {
-			return fmt.Errorf(retString)
+
+	ctx, cancel := plugin.methodContext(ctx, "start")
+	defer cancel()
+	err := plugin.Stream(ctx, MethodStart, request, func(chunk json.RawMessage) error {
+		progress := &Progress{}
+		if err := json.Unmarshal(chunk, progress); err != nil {
+			log.WARN.Printf("Invalid progress of controller %s: %v", controllerId, err)
+			return nil
 		}
+		reportProgress(ctx, progress)
+		return nil
+	}, nil)
+	var pluginErr *PluginError
+	if err != nil && !errors.As(err, &pluginErr) {
+		return fmt.Errorf("Request to plugin could not be made: %w", err)
 	}
-	return nil
+	return err
 }
 
-/* Function to perform Start on a manage Plugin instance */
-func (appPlugin *ManagePluginInstance) Start(controllerId string, data []byte) error {
+/* Function to perform Stop on a manage Plugin instance */
+func (appPlugin *ManagePluginInstance) Stop(ctx context.Context, controllerId string, data []byte) error {
 
-	// Get the Plugin
-	plugin := appPlugin.plugin
+	request := &LifecycleRequest{ControllerId: controllerId, Data: data}
+	return appPlugin.call(ctx, "stop", MethodStop, "pluginmanager.manageStop", request)
+}
 
-	reqdata, err := encapsuleControllerId(controllerId, data)
-	if err != nil {
-		return fmt.Errorf("Failed to encapsule controllerId")
+/* Function to push a configuration to a controller of a manage Plugin instance, the secrets are delivered along (never log them) */
+func (appPlugin *ManagePluginInstance) Configure(ctx context.Context, controllerId string, data []byte, secrets map[string][]byte) error {
+
+	plugin := appPlugin.plugin
+	if plugin.protocolVersion() < ProtocolMinVersion || !plugin.hasMethod(MethodConfig) {
+		return ErrNotSupported
+	}
+	request := &LifecycleRequest{ControllerId: controllerId, Data: data, Secrets: secrets}
+	err := appPlugin.call(ctx, "config", MethodConfig, "", request)
+	var pluginErr *PluginError
+	if errors.As(err, &pluginErr) && pluginErr.Code == ErrCodeNotSupported {
+		return ErrNotSupported
 	}
+	return err
+}
 
-	// Execute the Init request
-	exeErr, returnByte := plugin.Execute("pluginmanager.manageStart", reqdata)
-	if exeErr != nil {
-		return fmt.Errorf("Request to plugin could not be made: %v", exeErr)
+/* Function to stream the log lines of a controller of a manage Plugin instance, until the context is done if following */
+func (appPlugin *ManagePluginInstance) Logs(ctx context.Context, request *LogsRequest, line func(*LogLine) error) error {
+
+	plugin := appPlugin.plugin
+	if plugin.protocolVersion() < ProtocolStreamVersion || !plugin.hasMethod(MethodLogs) {
+		return ErrNotSupported
 	}
-	// Check if return byte is nil
-	if returnByte != nil {
-		retString := string(returnByte)
-		if retString != "" {
-			return fmt.Errorf(retString)
+	err := plugin.Stream(ctx, MethodLogs, request, func(chunk json.RawMessage) error {
+		logLine := &LogLine{}
+		if err := json.Unmarshal(chunk, logLine); err != nil {
+			return fmt.Errorf("Invalid log line: %v", err)
 		}
+		return line(logLine)
+	}, nil)
+	var pluginErr *PluginError
+	if errors.As(err, &pluginErr) && pluginErr.Code == ErrCodeNotSupported {
+		return ErrNotSupported
 	}
-	return nil
+	if err != nil && !errors.As(err, &pluginErr) {
+		return fmt.Errorf("Request to plugin could not be made: %w", err)
+	}
+	return err
 }
 
-/* Function to perform Stop on a manage Plugin instance */
-func (appPlugin *ManagePluginInstance) Stop(controllerId string, data []byte) error {
+/* Internal: Call a lifecycle method of the plugin, by id with the negotiated protocol or by function name with the legacy one */
+func (appPlugin *ManagePluginInstance) call(ctx context.Context, operation, method, legacyFunc string, request *LifecycleRequest) error {
 
 	// Get the Plugin
 	plugin := appPlugin.plugin
 
-	reqdata, err := encapsuleControllerId(controllerId, data)
+	ctx, cancel := plugin.methodContext(ctx, operation)
+	defer cancel()
+
+	if plugin.protocolVersion() >= ProtocolMinVersion {
+		err := plugin.Call(ctx, method, request, nil)
+		var pluginErr *PluginError
+		if err != nil && !errors.As(err, &pluginErr) {
+			return fmt.Errorf("Request to plugin could not be made: %w", err)
+		}
+		return err
+	}
+
+	var reqdata []byte
+	var err error
+	if request.Secrets != nil {
+		reqdata, err = encapsuleInitRequest(request.ControllerId, request.Data, request.Secrets)
+	} else {
+		reqdata, err = encapsuleControllerId(request.ControllerId, request.Data)
+	}
 	if err != nil {
 		return fmt.Errorf("Failed to encapsule controllerId")
 	}
 
-	// Execute the Init request
-	exeErr, returnByte := plugin.Execute("pluginmanager.manageStop", reqdata)
+	// Execute the request
+	exeErr, returnByte := plugin.Execute(ctx, legacyFunc, reqdata)
 	if exeErr != nil {
-		return fmt.Errorf("Request to plugin could not be made: %v", exeErr)
-	}
-	// Check if return byte is nil
-	if returnByte != nil {
-		retString := string(returnByte)
-		if retString != "" {
-			return fmt.Errorf(retString)
-		}
+		return fmt.Errorf("Request to plugin could not be made: %w", exeErr)
 	}
-	return nil
+	return legacyError(returnByte)
 }
 
 /* Function to stop the singularity Plugin store */
 func PlugStoreStop() error {
 
-	// Unload all the manage plugins
-	for _, plugin := range pluginStore.allManagePlugins {
+	// The unloaded plugins are not checked anymore
+	if pluginStore.health != nil {
+		pluginStore.health.close()
+	}
+
+	// Unload all the manage plugins, out of the lock
+	for _, plugin := range pluginStore.loadedPlugins() {
 		err := plugin.UnloadPlugin()
 		if err != nil {
 			log.ERROR.Println("Failed to unload plugin ", plugin, " : ", err)
@@ -0,0 +1,143 @@
+package plugintest
+
+import (
+	"context"
+	"errors"
+	"org.openappstack/singularity/pluginmanager"
+	"testing"
+	"time"
+)
+
+const (
+	// The deadline of each request of the conformance suite
+	DefaultRequestTimeout = 30 * time.Second
+)
+
+// Suite configures the conformance suite of a plugin
+type Suite struct {
+	// The data of the init and start requests of the controllers
+	Data []byte
+	// The data the plugin fails to init or to start a controller with, no error propagation check if nil
+	FailData []byte
+	// The callback the plugin notifies on the start of a controller, no callback check if empty
+	Callback string
+	// The deadline of each request, DefaultRequestTimeout if 0
+	Timeout time.Duration
+}
+
+/* Run the conformance suite on a plugin, the plugin is shut down at the end */
+func RunConformance(t *testing.T, agent *Agent, suite *Suite) {
+	timeout := suite.Timeout
+	if timeout == 0 {
+		timeout = DefaultRequestTimeout
+	}
+	requestContext := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+
+	t.Run("Handshake", func(t *testing.T) {
+		if version := agent.Plugin.ProtocolVersion(); version < pluginmanager.ProtocolMinVersion {
+			t.Fatalf("The plugin speaks the legacy protocol, rebuild it with the current plugin SDK")
+		}
+		methods := map[string]bool{}
+		for _, method := range agent.Plugin.GetMethods() {
+			methods[method] = true
+		}
+		for _, method := range []string{pluginmanager.MethodInit, pluginmanager.MethodStart, pluginmanager.MethodStop} {
+			if !methods[method] {
+				t.Errorf("The plugin doesn't serve %s", method)
+			}
+		}
+		if err := agent.Plugin.Ping(); err != nil {
+			t.Errorf("Ping failed: %v", err)
+		}
+	})
+
+	t.Run("Lifecycle", func(t *testing.T) {
+		ctx, cancel := requestContext()
+		defer cancel()
+		if err := agent.Lifecycle.Init(ctx, "conformance-1", suite.Data, nil); err != nil {
+			t.Fatalf("Init failed: %v", err)
+		}
+		if err := agent.Lifecycle.Start(ctx, "conformance-1", suite.Data); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		if err := agent.Lifecycle.Stop(ctx, "conformance-1", suite.Data); err != nil {
+			t.Errorf("Stop failed: %v", err)
+		}
+	})
+
+	t.Run("UnknownControllerId", func(t *testing.T) {
+		ctx, cancel := requestContext()
+		defer cancel()
+		for operation, err := range map[string]error{
+			"Start": agent.Lifecycle.Start(ctx, "conformance-unknown", suite.Data),
+			"Stop":  agent.Lifecycle.Stop(ctx, "conformance-unknown", suite.Data),
+		} {
+			var pluginErr *pluginmanager.PluginError
+			if !errors.As(err, &pluginErr) || pluginErr.Code != pluginmanager.ErrCodeNotInitialized {
+				t.Errorf("Expected %s of an unknown controller to fail with %s, got %v", operation, pluginmanager.ErrCodeNotInitialized, err)
+			}
+		}
+	})
+
+	t.Run("InvalidRequest", func(t *testing.T) {
+		ctx, cancel := requestContext()
+		defer cancel()
+		err := agent.Plugin.Call(ctx, pluginmanager.MethodStart, &pluginmanager.LifecycleRequest{}, nil)
+		var pluginErr *pluginmanager.PluginError
+		if !errors.As(err, &pluginErr) || pluginErr.Code != pluginmanager.ErrCodeInvalidRequest {
+			t.Errorf("Expected a start without controller id to fail with %s, got %v", pluginmanager.ErrCodeInvalidRequest, err)
+		}
+	})
+
+	t.Run("ErrorPropagation", func(t *testing.T) {
+		if suite.FailData == nil {
+			t.Skip("No failing data")
+		}
+		ctx, cancel := requestContext()
+		defer cancel()
+		err := agent.Lifecycle.Init(ctx, "conformance-2", suite.FailData, nil)
+		if err == nil {
+			err = agent.Lifecycle.Start(ctx, "conformance-2", suite.FailData)
+		}
+		var pluginErr *pluginmanager.PluginError
+		if !errors.As(err, &pluginErr) || pluginErr.Message == "" {
+			t.Errorf("Expected the failure to reach the agent as a plugin error, got %v", err)
+		}
+		// The plugin outlives its failures
+		if err := agent.Plugin.Ping(); err != nil {
+			t.Errorf("Ping failed after the failure: %v", err)
+		}
+	})
+
+	t.Run("Callbacks", func(t *testing.T) {
+		if suite.Callback == "" {
+			t.Skip("No callback")
+		}
+		received := make(chan []byte, 16)
+		if err := agent.Plugin.RegisterNamedCallback(suite.Callback, func(data []byte) { received <- data }); err != nil {
+			t.Fatalf("Err: %s", err)
+		}
+		ctx, cancel := requestContext()
+		defer cancel()
+		if err := agent.Lifecycle.Init(ctx, "conformance-3", suite.Data, nil); err != nil {
+			t.Fatalf("Init failed: %v", err)
+		}
+		if err := agent.Lifecycle.Start(ctx, "conformance-3", suite.Data); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		select {
+		case <-received:
+		case <-ctx.Done():
+			t.Errorf("No notification of callback %s after the start", suite.Callback)
+		}
+		agent.Lifecycle.Stop(ctx, "conformance-3", suite.Data)
+	})
+
+	t.Run("Shutdown", func(t *testing.T) {
+		if err := agent.Shutdown(); err != nil {
+			t.Error(err)
+		}
+	})
+}
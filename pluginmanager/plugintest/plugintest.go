@@ -0,0 +1,228 @@
+package plugintest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"org.openappstack/singularity/pluginmanager"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The plugin test harness: a fake agent starting a lifecycle plugin, its
+// binary or in process, and activating it over a temporary unix socket as the
+// plugin registry does. The tests drive the plugin through the agent side of
+// the plugin protocol, RunConformance checks the behavior every agent expects.
+
+const (
+	// The deadline of the plugin activation and of its shutdown
+	StartTimeout    = 10 * time.Second
+	ShutdownTimeout = 10 * time.Second
+	// The name of the controller of the in-process plugins
+	InProcessController = "plugintest"
+)
+
+var (
+	// The plugin SDK serves a single plugin per process
+	ErrInProcessStarted = errors.New("An in-process plugin was already started by this process")
+	inProcessStarted    atomic.Bool
+)
+
+// Agent is the fake agent of a plugin under test
+type Agent struct {
+	// The agent side of the plugin, and its lifecycle methods
+	Plugin    *pluginmanager.Plugin
+	Lifecycle pluginmanager.ManagePlugin
+	// The plugin of an in-process agent, nil for a plugin binary
+	Impl *pluginmanager.SingularityPluginImpl
+
+	// The directory of the runtime conf and of the socket
+	dir string
+	// Receives the end of the plugin: the exit of its process, or the return of WaitForPluginStop
+	stopped chan error
+	// The process of a plugin binary
+	process *os.Process
+	// Keeps the SIGUSR1 of the in-process plugin shutdown from killing the tests
+	signals chan os.Signal
+	done    bool
+}
+
+/* Start the plugin binary of a plugin directory, as built by "singularity pdk build", and activate it */
+func Launch(dir string) (*Agent, error) {
+	conf, err := os.ReadFile(filepath.Join(dir, pluginmanager.DefaultConfFile))
+	if err != nil {
+		return nil, err
+	}
+	pluginConf := &pluginmanager.PluginConf{}
+	if err := json.Unmarshal(conf, pluginConf); err != nil {
+		return nil, fmt.Errorf("Invalid %s: %v", pluginmanager.DefaultConfFile, err)
+	}
+	if problems := pluginConf.Validate(); len(problems) > 0 {
+		return nil, fmt.Errorf("Invalid %s: %v", pluginmanager.DefaultConfFile, problems[0])
+	}
+	pluginType := &pluginConf.PluginTypes[0]
+	binary, err := os.ReadFile(filepath.Join(dir, pluginmanager.PluginBinary))
+	if err != nil {
+		return nil, err
+	}
+
+	// The plugin runs in a copy of its directory, as in the plugin location
+	agent, err := newAgent()
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(filepath.Join(agent.dir, pluginmanager.DefaultConfFile), conf, 0644)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(agent.dir, pluginmanager.PluginBinary), binary, 0755)
+	}
+	if err == nil {
+		err = agent.writeRuntimeConf(pluginmanager.PluginSockFile)
+	}
+	if err != nil {
+		agent.Close()
+		return nil, err
+	}
+
+	cmd := exec.Command("./" + pluginmanager.PluginBinary)
+	cmd.Dir = agent.dir
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Start(); err != nil {
+		agent.Close()
+		return nil, fmt.Errorf("Failed to start the plugin: %v", err)
+	}
+	agent.process = cmd.Process
+	go func() { agent.stopped <- cmd.Wait() }()
+
+	if err := agent.connect(pluginType.Controllers[0].Name, pluginType, cmd.Process.Pid); err != nil {
+		agent.Close()
+		return nil, err
+	}
+	return agent, nil
+}
+
+/* Start a plugin in process, registered as RegisterPlugin does, and activate it over a transport. One per process, the plugin SDK serves it on the default http mux */
+func InProcess(registrar func([]byte) (interface{}, error), transport string) (*Agent, error) {
+	if !inProcessStarted.CompareAndSwap(false, true) {
+		return nil, ErrInProcessStarted
+	}
+	agent, err := newAgent()
+	if err != nil {
+		return nil, err
+	}
+	if err := agent.writeRuntimeConf(filepath.Join(agent.dir, pluginmanager.PluginSockFile)); err != nil {
+		agent.Close()
+		return nil, err
+	}
+
+	// The shutdown signals the test process, the plugin catches it
+	agent.signals = make(chan os.Signal, 1)
+	signal.Notify(agent.signals, syscall.SIGUSR1)
+	impl, err := pluginmanager.RegisterPluginAt(registrar, filepath.Join(agent.dir, pluginmanager.DefaultPluginConfFile))
+	if err != nil {
+		agent.Close()
+		return nil, err
+	}
+	agent.Impl = impl
+	impl.StartPlugin()
+	go func() { agent.stopped <- impl.WaitForPluginStop() }()
+
+	pluginType := &pluginmanager.PluginType{Type: "lifecycle", Transport: transport}
+	if err := agent.connect(InProcessController, pluginType, os.Getpid()); err != nil {
+		agent.Close()
+		return nil, err
+	}
+	return agent, nil
+}
+
+/* Internal: Create an agent and its directory, short enough for the unix socket paths */
+func newAgent() (*Agent, error) {
+	dir, err := os.MkdirTemp("", "plugintest-")
+	if err != nil {
+		return nil, err
+	}
+	return &Agent{dir: dir, stopped: make(chan error, 1)}, nil
+}
+
+/* Internal: Write the runtime conf of the plugin, as the plugin registry does before its start */
+func (agent *Agent) writeRuntimeConf(sockFile string) error {
+	data, err := json.Marshal(&pluginmanager.RuntimeConf{Url: pluginmanager.PluginUrl, Sock: sockFile})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(agent.dir, pluginmanager.DefaultPluginConfFile), data, 0644)
+}
+
+/* Internal: Connect to the plugin once it serves its socket, and activate it */
+func (agent *Agent) connect(controller string, pluginType *pluginmanager.PluginType, pid int) error {
+	sockFile := filepath.Join(agent.dir, pluginmanager.PluginSockFile)
+	deadline := time.Now().Add(StartTimeout)
+	for {
+		plugin, err := pluginmanager.ConnectPlugin(sockFile, controller, pluginType, pid)
+		if err == nil {
+			agent.Plugin, agent.Lifecycle = plugin, pluginmanager.NewManagePlugin(plugin)
+			return nil
+		}
+		if !errors.Is(err, pluginmanager.PluginConnFailed) {
+			return fmt.Errorf("Failed to activate the plugin: %v", err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("The plugin is not serving %s after %v", sockFile, StartTimeout)
+		}
+		select {
+		case stopErr := <-agent.stopped:
+			agent.done = true
+			return fmt.Errorf("The plugin stopped before its activation: %v", stopErr)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+/* Unload the plugin as the agent does, with a stop request and a SIGUSR1, and wait for the plugin to stop cleanly */
+func (agent *Agent) Shutdown() error {
+	if agent.done {
+		return fmt.Errorf("The plugin is already stopped")
+	}
+	agent.Plugin.UnloadPlugin()
+
+	timeout := time.After(ShutdownTimeout)
+	retry := time.NewTicker(100 * time.Millisecond)
+	defer retry.Stop()
+	for {
+		select {
+		case err := <-agent.stopped:
+			agent.done = true
+			agent.Close()
+			if err != nil {
+				return fmt.Errorf("The plugin stopped with an error: %v", err)
+			}
+			return nil
+		case <-retry.C:
+			if agent.Impl != nil {
+				// The in-process plugin may not be waiting for the signal yet
+				syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+			}
+		case <-timeout:
+			agent.Close()
+			return fmt.Errorf("The plugin did not stop within %v of the SIGUSR1", ShutdownTimeout)
+		}
+	}
+}
+
+/* Release the plugin, a plugin binary still running is killed. An in-process plugin stops with Shutdown only */
+func (agent *Agent) Close() {
+	if agent.process != nil && !agent.done {
+		agent.process.Kill()
+		<-agent.stopped
+		agent.done = true
+	}
+	if agent.signals != nil {
+		signal.Stop(agent.signals)
+		agent.signals = nil
+	}
+	os.RemoveAll(agent.dir)
+}
@@ -0,0 +1,116 @@
+package plugintest
+
+import (
+	"context"
+	"errors"
+	"org.openappstack/singularity/pluginmanager"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// Set in the environment of the test binary started as a plugin binary
+const pluginEnv = "PLUGINTEST_PLUGIN"
+
+const startedCallback = "plugintest.started"
+
+// The plugin of the tests, notified by the controller instances
+var testPlugin atomic.Pointer[pluginmanager.SingularityPluginImpl]
+
+// A controller instance failing on the data "fail"
+type testController struct{}
+
+func (controller *testController) StartProgress(ctx context.Context, data []byte, progress func(*pluginmanager.Progress)) error {
+	if string(data) == "fail" {
+		return errors.New("Controller failed to start")
+	}
+	progress(&pluginmanager.Progress{Percent: 100})
+	if plugin := testPlugin.Load(); plugin != nil {
+		plugin.Notify(startedCallback, data)
+	}
+	return nil
+}
+
+func (controller *testController) Start(data []byte) error {
+	return controller.StartProgress(context.Background(), data, func(*pluginmanager.Progress) {})
+}
+
+func (controller *testController) Stop(data []byte) error {
+	return nil
+}
+
+func testRegistrar(data []byte) (interface{}, error) {
+	return &testController{}, nil
+}
+
+var testSuite = &Suite{Data: []byte("data"), FailData: []byte("fail"), Callback: startedCallback}
+
+// The test binary is the plugin binary of the launch test
+func TestMain(m *testing.M) {
+	if os.Getenv(pluginEnv) != "" {
+		plugin, err := pluginmanager.RegisterPlugin(testRegistrar)
+		if err != nil {
+			os.Exit(1)
+		}
+		testPlugin.Store(plugin)
+		plugin.StartPlugin()
+		plugin.WaitForPluginStop()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestInProcess(t *testing.T) {
+	agent, err := InProcess(testRegistrar, pluginmanager.TransportGrpc)
+	if errors.Is(err, ErrInProcessStarted) {
+		t.Skip("The in-process plugin ran in a previous run of the tests")
+	}
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	defer agent.Close()
+	testPlugin.Store(agent.Impl)
+	defer testPlugin.Store(nil)
+
+	RunConformance(t, agent, testSuite)
+}
+
+func TestLaunch(t *testing.T) {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	dir := t.TempDir()
+	if err := os.Symlink(executable, filepath.Join(dir, pluginmanager.PluginBinary)); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	conf := `{"plugin-types": [{"plugin-type": "lifecycle", "transport": "http", "controllers": [{"name": "plugintest", "equals-version": "1.0"}]}]}`
+	if err := os.WriteFile(filepath.Join(dir, pluginmanager.DefaultConfFile), []byte(conf), 0644); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	t.Setenv(pluginEnv, "1")
+
+	agent, err := Launch(dir)
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	defer agent.Close()
+
+	RunConformance(t, agent, testSuite)
+}
+
+func TestLaunchFailures(t *testing.T) {
+	if _, err := Launch(t.TempDir()); err == nil {
+		t.Errorf("Expected the plugin without manifest not to start")
+	}
+
+	// The plugin exits before serving its socket
+	dir := t.TempDir()
+	conf := `{"plugin-types": [{"plugin-type": "lifecycle", "controllers": [{"name": "plugintest", "equals-version": "1.0"}]}]}`
+	os.WriteFile(filepath.Join(dir, pluginmanager.DefaultConfFile), []byte(conf), 0644)
+	os.WriteFile(filepath.Join(dir, pluginmanager.PluginBinary), []byte("#!/bin/sh\nexit 3\n"), 0755)
+	if _, err := Launch(dir); err == nil {
+		t.Errorf("Expected the exited plugin not to be activated")
+	}
+}
@@ -0,0 +1,195 @@
+package pluginmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The plugin wire protocol. The agent opens with a handshake negotiating the
+// protocol version, then calls the methods by id in versioned envelopes. The
+// plugins not answering the handshake speak the legacy protocol: raw bodies
+// posted to the function names, and errors as strings.
+const (
+	// The legacy protocol, deprecated
+	ProtocolLegacy = 0
+	// The enveloped protocol versions supported by this build
+	ProtocolMinVersion = 1
+	ProtocolVersion    = 2
+	// The first version streaming the method results
+	ProtocolStreamVersion = 2
+
+	// The url paths of the handshake, of the enveloped calls and of the streamed ones
+	HandshakePath = "Handshake"
+	CallPath      = "Call"
+	StreamPath    = "Stream"
+
+	// The payload encodings
+	EncodingJson = "json"
+)
+
+// The method ids of the lifecycle plugins
+const (
+	MethodInit  = "lifecycle.init"
+	MethodStart = "lifecycle.start"
+	MethodStop  = "lifecycle.stop"
+	// Streams the log lines of a controller, version 2
+	MethodLogs = "lifecycle.logs"
+	// Pushes a configuration to a controller, with its secrets
+	MethodConfig = "lifecycle.config"
+)
+
+// The method ids of the event delivery, served by every plugin of the SDK.
+// The agent subscribes to the events of a callback with a stream and
+// acknowledges the delivered ones, the plugin buffers them until then.
+const (
+	MethodEventsSubscribe = "events.subscribe"
+	MethodEventsAck       = "events.ack"
+)
+
+// The error codes of the plugin responses
+const (
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnknownMethod      = "unknown_method"
+	ErrCodeInvalidRequest     = "invalid_request"
+	ErrCodeNotInitialized     = "not_initialized"
+	ErrCodeNotSupported       = "not_supported"
+	// The controller operation failed
+	ErrCodeFailed = "failed"
+)
+
+var (
+	// The methods sent again after a failure of the plugin even if the plugin may
+	// have received them, the others are sent again only if they never reached it
+	idempotentMethods = map[string]bool{MethodEventsAck: true}
+
+	// The legacy protocol is accepted during the deprecation window, the
+	// plugins using it are reported at load
+	AllowLegacyProtocol = true
+)
+
+// The handshake of the agent, with the protocol versions it supports
+type HandshakeRequest struct {
+	MinVersion int `json:"minVersion"`
+	MaxVersion int `json:"maxVersion"`
+}
+
+// The handshake of the plugin, with the negotiated version and its method ids
+type HandshakeResponse struct {
+	Version int          `json:"version"`
+	Methods []string     `json:"methods,omitempty"`
+	Error   *PluginError `json:"error,omitempty"`
+}
+
+// A method call of the agent
+type RequestEnvelope struct {
+	Version  int             `json:"version"`
+	Method   string          `json:"method"`
+	Encoding string          `json:"encoding,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+}
+
+// The outcome of a method call, a result or an error
+type ResponseEnvelope struct {
+	Version  int             `json:"version"`
+	Encoding string          `json:"encoding,omitempty"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	Error    *PluginError    `json:"error,omitempty"`
+}
+
+// A frame of a streamed method call, the data frames are followed by the
+// end frame with the result or the error. Over http the frames are json lines.
+type StreamFrame struct {
+	Seq    int64           `json:"seq"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	End    bool            `json:"end,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *PluginError    `json:"error,omitempty"`
+}
+
+// A failed method call
+type PluginError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *PluginError) Error() string {
+	return fmt.Sprintf("%s: %s", err.Code, err.Message)
+}
+
+// The payload of the lifecycle methods
+type LifecycleRequest struct {
+	ControllerId string `json:"controllerId"`
+	Data         []byte `json:"data,omitempty"`
+	// The secrets delivered at init and with the configurations (parameter
+	// name -> value), never logged
+	Secrets map[string][]byte `json:"secrets,omitempty"`
+}
+
+// The progress of a lifecycle operation, streamed by the plugin during Start
+type Progress struct {
+	// The completion in percent, 0 if unknown
+	Percent int    `json:"percent"`
+	Message string `json:"message,omitempty"`
+}
+
+// The payload of the logs method
+type LogsRequest struct {
+	ControllerId string `json:"controllerId"`
+	// Keep streaming the new lines until the agent cancels
+	Follow bool `json:"follow,omitempty"`
+	// The number of the last lines to start with, all of them if 0
+	Tail int `json:"tail,omitempty"`
+}
+
+// A log line of a controller
+type LogLine struct {
+	Time time.Time `json:"time"`
+	Line string    `json:"line"`
+}
+
+// The subscription to the events of a callback. The events of the same epoch
+// after the sequence number After are replayed, and the ones up to it are
+// acknowledged: it resumes an interrupted subscription.
+type EventsRequest struct {
+	Callback string `json:"callback"`
+	Epoch    string `json:"epoch,omitempty"`
+	After    uint64 `json:"after,omitempty"`
+}
+
+// A notification of a callback. The sequence numbers count the notifications
+// of the callback from 1, they restart with the epoch of the plugin process.
+type Event struct {
+	Epoch string `json:"epoch"`
+	Seq   uint64 `json:"seq"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+// The acknowledgement of the events of a callback up to a sequence number
+type EventsAck struct {
+	Callback string `json:"callback"`
+	Epoch    string `json:"epoch"`
+	Seq      uint64 `json:"seq"`
+}
+
+// Negotiate the protocol version of a handshake, the highest supported by both
+func negotiateVersion(request *HandshakeRequest) (int, *PluginError) {
+	version := ProtocolVersion
+	if request.MaxVersion < version {
+		version = request.MaxVersion
+	}
+	if version < ProtocolMinVersion || version < request.MinVersion {
+		return 0, &PluginError{Code: ErrCodeUnsupportedVersion, Message: fmt.Sprintf("No common protocol version: the agent supports %d to %d, the plugin %d to %d",
+			request.MinVersion, request.MaxVersion, ProtocolMinVersion, ProtocolVersion)}
+	}
+	return version, nil
+}
+
+// Get the error of a legacy plugin response, empty or "<nil>" on success
+func legacyError(returnByte []byte) error {
+	retString := string(returnByte)
+	if retString == "" || retString == "<nil>" {
+		return nil
+	}
+	return &PluginError{Code: ErrCodeFailed, Message: retString}
+}
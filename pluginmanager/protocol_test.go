@@ -0,0 +1,163 @@
+package pluginmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	PluginConn "org.openappstack/singularity/pluginmanager/pluginconn"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// Serve a plugin implementation on a unix socket and get the agent side plugin
+func serveProtocolPlugin(t *testing.T, impl *PluginImpl) *Plugin {
+	sockFile := filepath.Join(t.TempDir(), "plugin.sock")
+	listener, err := net.Listen("unix", sockFile)
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	server := &http.Server{Handler: impl}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	pluginConn, err := PluginConn.NewPluginClient(sockFile)
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	t.Cleanup(func() { pluginConn.Close() })
+	return &Plugin{PluginUrl: "unix://plugin", PluginSock: sockFile, pluginConn: pluginConn, connected: true, callbacks: map[string]bool{}, Controller: "onos"}
+}
+
+func newProtocolImpl() *PluginImpl {
+	impl := &PluginImpl{methodRegistry: map[string]func(context.Context, []byte) []byte{}, callRegistry: map[string]CallHandler{}, streamRegistry: map[string]StreamHandler{}}
+	impl.methodRegistry[HandshakePath] = impl.handshake
+	impl.methodRegistry[CallPath] = impl.call
+	impl.RegisterCall(MethodStart, func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		request := &LifecycleRequest{}
+		if err := json.Unmarshal(payload, request); err != nil {
+			return nil, err
+		}
+		if request.ControllerId == "" {
+			return nil, &PluginError{Code: ErrCodeNotInitialized, Message: "No controller"}
+		}
+		return "started " + request.ControllerId, nil
+	})
+	impl.RegisterCall(MethodStop, func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		return nil, fmt.Errorf("Stop failed")
+	})
+	return impl
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	if version, err := negotiateVersion(&HandshakeRequest{MinVersion: 1, MaxVersion: ProtocolVersion + 3}); err != nil || version != ProtocolVersion {
+		t.Errorf("Expected version %d, got %d %v", ProtocolVersion, version, err)
+	}
+	if _, err := negotiateVersion(&HandshakeRequest{MinVersion: ProtocolVersion + 1, MaxVersion: ProtocolVersion + 2}); err == nil || err.Code != ErrCodeUnsupportedVersion {
+		t.Errorf("Expected unsupported_version, got %v", err)
+	}
+	if _, err := negotiateVersion(&HandshakeRequest{MinVersion: 0, MaxVersion: 0}); err == nil {
+		t.Errorf("Expected the legacy version to be refused")
+	}
+
+	if err := legacyError([]byte("<nil>")); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	var pluginErr *PluginError
+	if err := legacyError([]byte("Start failed")); !errors.As(err, &pluginErr) || pluginErr.Code != ErrCodeFailed {
+		t.Errorf("Expected a failed PluginError, got %v", err)
+	}
+}
+
+func TestCallDispatch(t *testing.T) {
+	impl := newProtocolImpl()
+	for _, test := range []struct {
+		request string
+		code    string
+	}{
+		{`{"version": 1, "method": "lifecycle.init"}`, ErrCodeUnknownMethod},
+		{`{"version": 99, "method": "lifecycle.start"}`, ErrCodeUnsupportedVersion},
+		{`{"version": 1, "method": "lifecycle.start", "encoding": "xml"}`, ErrCodeInvalidRequest},
+		{`{"version": 1, "method": "lifecycle.start", "payload": {}}`, ErrCodeNotInitialized},
+		{`{"version": 1, "method": "lifecycle.stop"}`, ErrCodeFailed},
+		{`not json`, ErrCodeInvalidRequest},
+	} {
+		response := &ResponseEnvelope{}
+		if err := json.Unmarshal(impl.call(context.Background(), []byte(test.request)), response); err != nil {
+			t.Fatalf("Err: %s", err)
+		}
+		if response.Error == nil || response.Error.Code != test.code {
+			t.Errorf("Expected %s for %s, got %v", test.code, test.request, response.Error)
+		}
+	}
+}
+
+func TestProtocolHandshake(t *testing.T) {
+	plugin := serveProtocolPlugin(t, newProtocolImpl())
+	if err := plugin.handshake(); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if plugin.protocolVersion() != ProtocolVersion || !plugin.hasMethod(MethodStart) || !plugin.hasMethod(MethodStop) {
+		t.Fatalf("Unexpected handshake: version %d methods %v", plugin.protocolVersion(), plugin.GetMethods())
+	}
+
+	var result string
+	if err := plugin.Call(context.Background(), MethodStart, &LifecycleRequest{ControllerId: "1"}, &result); err != nil || result != "started 1" {
+		t.Errorf("Unexpected result %q %v", result, err)
+	}
+	var pluginErr *PluginError
+	if err := plugin.Call(context.Background(), MethodStart, &LifecycleRequest{}, nil); !errors.As(err, &pluginErr) || pluginErr.Code != ErrCodeNotInitialized {
+		t.Errorf("Expected not_initialized, got %v", err)
+	}
+	if err := plugin.Call(context.Background(), MethodInit, &LifecycleRequest{}, nil); err == nil {
+		t.Errorf("Expected the unregistered method to fail")
+	}
+}
+
+func TestLegacyProtocol(t *testing.T) {
+	// A plugin of the legacy SDK only knows Activate and its functions
+	legacy := &PluginImpl{methodRegistry: map[string]func(context.Context, []byte) []byte{}}
+	legacy.methodRegistry["Activate"] = func(context.Context, []byte) []byte { return nil }
+	legacy.methodRegistry["pluginmanager.manageStart"] = func(context.Context, []byte) []byte { return []byte("Start failed") }
+
+	plugin := serveProtocolPlugin(t, legacy)
+	if err := plugin.handshake(); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if plugin.protocolVersion() != ProtocolLegacy || !plugin.hasMethod("pluginmanager.manageStart") {
+		t.Errorf("Expected a legacy plugin, got version %d methods %v", plugin.protocolVersion(), plugin.GetMethods())
+	}
+	if err := plugin.Call(context.Background(), MethodStart, nil, nil); err == nil {
+		t.Errorf("Expected Call to fail on a legacy plugin")
+	}
+
+	AllowLegacyProtocol = false
+	defer func() { AllowLegacyProtocol = true }()
+	if err := serveProtocolPlugin(t, legacy).handshake(); err == nil {
+		t.Errorf("Expected the legacy plugin to be refused")
+	}
+}
+
+func TestSendNotRepeated(t *testing.T) {
+	var received atomic.Int32
+	impl := newProtocolImpl()
+	// The plugin connection breaks once the start is received
+	impl.methodRegistry["Crash"] = func(ctx context.Context, data []byte) []byte {
+		received.Add(1)
+		panic(http.ErrAbortHandler)
+	}
+	plugin := serveProtocolPlugin(t, impl)
+
+	if _, err := plugin.send(context.Background(), &PluginConn.PluginRequest{Url: plugin.PluginUrl + "/Crash"}, false); err == nil || received.Load() != 1 {
+		t.Errorf("Expected the received request to fail once, got %v after %d requests", err, received.Load())
+	}
+	if _, connected := plugin.connection(); !connected {
+		t.Errorf("Expected the plugin to be reconnected")
+	}
+	if _, err := plugin.send(context.Background(), &PluginConn.PluginRequest{Url: plugin.PluginUrl + "/Crash"}, true); err == nil || received.Load() != 3 {
+		t.Errorf("Expected the idempotent request to be sent again, got %v after %d requests", err, received.Load())
+	}
+}
@@ -0,0 +1,91 @@
+package pluginmanager
+
+import (
+	"context"
+	"encoding/json"
+	"google.golang.org/grpc"
+	"org.openappstack/singularity/pluginmanager/pluginrpc"
+)
+
+/* The plugin service of the grpc transport, serving the methods of a PluginImpl as the http transport does */
+type rpcServer struct {
+	pluginrpc.UnimplementedPluginServer
+	plugin *PluginImpl
+}
+
+/* Internal Method: Get the grpc server of the plugin, served on the plugin socket */
+func (plugin *PluginImpl) grpcServer() *grpc.Server {
+	server := grpc.NewServer()
+	pluginrpc.RegisterPluginServer(server, &rpcServer{plugin: plugin})
+	return server
+}
+
+func (server *rpcServer) Activate(ctx context.Context, request *pluginrpc.ActivateRequest) (*pluginrpc.ActivateResponse, error) {
+	response := server.plugin.negotiate(ctx, &HandshakeRequest{MinVersion: int(request.MinVersion), MaxVersion: int(request.MaxVersion)})
+	return &pluginrpc.ActivateResponse{Version: int32(response.Version), Methods: response.Methods, Error: toRpcError(response.Error)}, nil
+}
+
+func (server *rpcServer) Methods(ctx context.Context, request *pluginrpc.MethodsRequest) (*pluginrpc.MethodsResponse, error) {
+	return &pluginrpc.MethodsResponse{Methods: server.plugin.callMethods()}, nil
+}
+
+func (server *rpcServer) Invoke(ctx context.Context, request *pluginrpc.InvokeRequest) (*pluginrpc.InvokeResponse, error) {
+	response := server.plugin.dispatch(ctx, &RequestEnvelope{Version: int(request.Version), Method: request.Method, Encoding: request.Encoding, Payload: request.Payload})
+	return &pluginrpc.InvokeResponse{Version: int32(response.Version), Encoding: response.Encoding, Result: response.Result, Error: toRpcError(response.Error)}, nil
+}
+
+func (server *rpcServer) InvokeStream(request *pluginrpc.InvokeRequest, stream pluginrpc.Plugin_InvokeStreamServer) error {
+	var seq int64
+	send := func(frame *pluginrpc.StreamFrame) error {
+		seq++
+		frame.Seq = seq
+		return stream.Send(frame)
+	}
+	response := server.plugin.dispatchStream(stream.Context(), &RequestEnvelope{Version: int(request.Version), Method: request.Method, Encoding: request.Encoding, Payload: request.Payload}, func(data json.RawMessage) error {
+		return send(&pluginrpc.StreamFrame{Data: data})
+	})
+	return send(&pluginrpc.StreamFrame{End: true, Result: response.Result, Error: toRpcError(response.Error)})
+}
+
+// The notifications of the callback are sent on the stream until the agent cancels it, each is
+// acknowledged once sent. It is the stream of the agents without event subscriptions.
+func (server *rpcServer) StreamEvents(request *pluginrpc.StreamEventsRequest, stream pluginrpc.Plugin_StreamEventsServer) error {
+	for {
+		err := nextEvent(stream.Context(), request.Callback, func(event *Event) error {
+			return stream.Send(&pluginrpc.Event{Callback: request.Callback, Data: event.Data})
+		})
+		if stream.Context().Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (server *rpcServer) Health(ctx context.Context, request *pluginrpc.HealthRequest) (*pluginrpc.HealthResponse, error) {
+	return &pluginrpc.HealthResponse{Status: pluginrpc.HealthResponse_SERVING}, nil
+}
+
+func (server *rpcServer) Stop(ctx context.Context, request *pluginrpc.StopRequest) (*pluginrpc.StopResponse, error) {
+	if stopper := server.plugin.methodRegistry["Stop"]; stopper != nil {
+		stopper(ctx, nil)
+	}
+	return &pluginrpc.StopResponse{}, nil
+}
+
+// Convert a plugin error to the grpc message, nil if none
+func toRpcError(err *PluginError) *pluginrpc.Error {
+	if err == nil {
+		return nil
+	}
+	return &pluginrpc.Error{Code: err.Code, Message: err.Message}
+}
+
+// Convert a grpc error message to a plugin error, nil if none
+func fromRpcError(err *pluginrpc.Error) *PluginError {
+	if err == nil {
+		return nil
+	}
+	return &PluginError{Code: err.Code, Message: err.Message}
+}
@@ -0,0 +1,174 @@
+package pluginmanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"org.openappstack/singularity/pluginmanager/pluginrpc"
+)
+
+// The requests to the plugins of the grpc transport, the counterpart of the
+// http requests of the registry
+
+/* Internal: Negotiate the protocol version with a plugin of the grpc transport and activate it */
+func (plugin *Plugin) rpcActivate() error {
+	rpcConn, _ := plugin.rpcConnection()
+
+	resp, err := rpcConn.Activate(context.Background(), &pluginrpc.ActivateRequest{MinVersion: ProtocolMinVersion, MaxVersion: ProtocolVersion})
+	if err != nil {
+		plugin.setConnected(false)
+		return fmt.Errorf("Failed to activate the plugin over grpc: %v", err)
+	}
+	if resp.Error != nil {
+		return fromRpcError(resp.Error)
+	}
+	version := int(resp.Version)
+	if version < ProtocolMinVersion || version > ProtocolVersion {
+		return fmt.Errorf("Plugin negotiated the unsupported protocol version %d", version)
+	}
+	plugin.lock.Lock()
+	plugin.protocol = version
+	plugin.methods = resp.Methods
+	plugin.lock.Unlock()
+	log.INFO.Printf("Plugin of controller %s speaks protocol version %d over grpc", plugin.Controller, version)
+	return nil
+}
+
+/* Internal: Call a method by id over the grpc transport */
+func (plugin *Plugin) rpcInvoke(ctx context.Context, request *RequestEnvelope) (*ResponseEnvelope, error) {
+	rpcRequest := &pluginrpc.InvokeRequest{Version: int32(request.Version), Method: request.Method, Encoding: request.Encoding, Payload: request.Payload}
+
+	var resp *pluginrpc.InvokeResponse
+	err := plugin.rpcSend(ctx, idempotentMethods[request.Method], func(rpcConn *pluginrpc.Client) (err error) {
+		resp, err = rpcConn.Invoke(ctx, rpcRequest)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ResponseEnvelope{Version: int(resp.Version), Encoding: resp.Encoding, Result: resp.Result, Error: fromRpcError(resp.Error)}, nil
+}
+
+/* Internal: Stream a method call over the grpc transport. Get the end frame, nil if none */
+func (plugin *Plugin) rpcStream(ctx context.Context, request *RequestEnvelope, chunk func(json.RawMessage) error) (*StreamFrame, error) {
+	rpcConn, connected := plugin.rpcConnection()
+	if !connected || rpcConn == nil {
+		return nil, fmt.Errorf("Plugin is not connected")
+	}
+
+	// The stream ends with the context
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := rpcConn.InvokeStream(ctx, &pluginrpc.InvokeRequest{Version: int32(request.Version), Method: request.Method, Encoding: request.Encoding, Payload: request.Payload})
+	for err == nil {
+		var frame *pluginrpc.StreamFrame
+		if frame, err = stream.Recv(); err != nil {
+			break
+		}
+		if frame.End {
+			return &StreamFrame{Seq: frame.Seq, End: true, Result: frame.Result, Error: fromRpcError(frame.Error)}, nil
+		}
+		if chunkErr := chunk(frame.Data); chunkErr != nil {
+			return nil, chunkErr
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("Stream of method %s interrupted: %w", request.Method, ctx.Err())
+	}
+	if err == io.EOF {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("Stream of method %s failed: %v", request.Method, err)
+}
+
+/* Internal: Send a request over the grpc connection, reloading the plugin once if it is unavailable. Only the idempotent requests are sent again, the plugin may have received them */
+func (plugin *Plugin) rpcSend(ctx context.Context, idempotent bool, request func(*pluginrpc.Client) error) error {
+
+	rpcConn, connected := plugin.rpcConnection()
+	if !connected || rpcConn == nil {
+		return fmt.Errorf("Plugin is not connected")
+	}
+	pid := plugin.processId()
+	send := func(rpcConn *pluginrpc.Client) error {
+		// The reloads wait for the requests in flight
+		plugin.requests.RLock()
+		defer plugin.requests.RUnlock()
+		return request(rpcConn)
+	}
+
+	err := send(rpcConn)
+	if err != nil && ctx.Err() != nil {
+		// The caller gave up, the plugin is not at fault
+		return fmt.Errorf("Request to plugin interrupted: %w", ctx.Err())
+	}
+	if status.Code(err) == codes.Unavailable {
+		plugin.setConnected(false)
+		// the connection retries by itself, a plugin not answering is reloaded
+		if reloadErr := plugin.reloadFrom(pid); reloadErr != nil {
+			return fmt.Errorf("Failed to communicate with plugin")
+		}
+		if !idempotent {
+			return fmt.Errorf("Request to plugin failed: %v", err)
+		}
+		rpcConn, _ = plugin.rpcConnection()
+		err = send(rpcConn)
+		if err != nil && ctx.Err() != nil {
+			return fmt.Errorf("Request to plugin interrupted: %w", ctx.Err())
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Request to plugin failed: %v", err)
+	}
+	return nil
+}
+
+/* Internal: Check a plugin of the grpc transport is serving */
+func (plugin *Plugin) rpcHealth() error {
+	rpcConn, _ := plugin.rpcConnection()
+
+	ctx, cancel := context.WithTimeout(context.Background(), PingTimeout)
+	defer cancel()
+	resp, err := rpcConn.Health(ctx, &pluginrpc.HealthRequest{})
+	if err != nil {
+		plugin.setConnected(false)
+		return err
+	}
+	if resp.Status != pluginrpc.HealthResponse_SERVING {
+		return fmt.Errorf("Plugin is not serving: %s", resp.Status)
+	}
+	return nil
+}
+
+/* Internal: Deactivate a plugin of the grpc transport */
+func (plugin *Plugin) rpcStop() error {
+	rpcConn, _ := plugin.rpcConnection()
+
+	_, err := rpcConn.Stop(context.Background(), &pluginrpc.StopRequest{})
+	return err
+}
+
+// Internal: receive the notifications of a callback over the grpc transport, for the plugins without
+// event subscriptions. Returns on the first failure
+func (plugin *Plugin) streamEvents(ctx context.Context, funcName string, function func([]byte)) (bool, error) {
+	rpcConn, _ := plugin.rpcConnection()
+
+	stream, err := rpcConn.StreamEvents(ctx, &pluginrpc.StreamEventsRequest{Callback: funcName})
+	if err != nil {
+		plugin.setConnected(false)
+		return false, fmt.Errorf("Failed to stream the events: %v", err)
+	}
+	delivered := false
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			return delivered, fmt.Errorf("Events interrupted: %v", err)
+		}
+		// call the callback
+		function(event.Data)
+		delivered = true
+	}
+}
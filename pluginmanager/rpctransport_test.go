@@ -0,0 +1,136 @@
+package pluginmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	PluginConn "org.openappstack/singularity/pluginmanager/pluginconn"
+	"org.openappstack/singularity/pluginmanager/pluginrpc"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Register the http handler of the plugin, the default mux is shared by the
+// tests and serves the plugin of the last registration
+type testRegistrar struct {
+	plugin *PluginImpl
+}
+
+var (
+	registerOnce sync.Once
+	testPlugin   *PluginImpl
+	testLock     sync.Mutex
+)
+
+func (registrar testRegistrar) Register() {
+	testLock.Lock()
+	testPlugin = registrar.plugin
+	testLock.Unlock()
+	registerOnce.Do(func() {
+		http.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			testLock.Lock()
+			plugin := testPlugin
+			testLock.Unlock()
+			plugin.ServeHTTP(w, r)
+		}))
+	})
+}
+
+// Serve a plugin implementation with both transports on one socket, as the SDK does
+func serveRpcPlugin(t *testing.T, impl *PluginImpl) string {
+	sockFile := filepath.Join(t.TempDir(), "plugin.sock")
+	server, err := PluginConn.NewPluginServer(&PluginConn.ServerConfiguration{Registrar: testRegistrar{impl}, SockFile: sockFile, Grpc: impl.grpcServer()})
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	server.Start()
+	t.Cleanup(func() { server.Shutdown() })
+	return sockFile
+}
+
+func TestPluginTransport(t *testing.T) {
+	for transport, valid := range map[string]bool{"": true, "http": true, "grpc": true, "soap": false} {
+		if _, err := (&PluginType{Transport: transport}).transport(); (err == nil) != valid {
+			t.Errorf("Unexpected validation of transport %q: %v", transport, err)
+		}
+	}
+}
+
+func TestGrpcTransport(t *testing.T) {
+	impl := newProtocolImpl()
+	impl.methodRegistry["Ping"] = withoutContext(ping)
+	sockFile := serveRpcPlugin(t, impl)
+
+	rpcConn, err := pluginrpc.Dial(sockFile)
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	pluginConn, err := PluginConn.NewPluginClient(sockFile)
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	plugin := &Plugin{PluginUrl: "unix://plugin", PluginSock: sockFile, pluginConn: pluginConn, rpcConn: rpcConn, connected: true, callbacks: map[string]bool{}, Controller: "onos", transport: TransportGrpc}
+	defer rpcConn.Close()
+	defer pluginConn.Close()
+
+	if err := plugin.handshake(); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if plugin.protocolVersion() != ProtocolVersion || !plugin.hasMethod(MethodStart) {
+		t.Fatalf("Unexpected activation: version %d methods %v", plugin.protocolVersion(), plugin.GetMethods())
+	}
+	if err := plugin.Ping(); err != nil {
+		t.Errorf("Health check failed: %v", err)
+	}
+
+	var result string
+	if err := plugin.Call(context.Background(), MethodStart, &LifecycleRequest{ControllerId: "1"}, &result); err != nil || result != "started 1" {
+		t.Errorf("Unexpected result %q %v", result, err)
+	}
+	var pluginErr *PluginError
+	if err := plugin.Call(context.Background(), MethodStart, &LifecycleRequest{}, nil); !errors.As(err, &pluginErr) || pluginErr.Code != ErrCodeNotInitialized {
+		t.Errorf("Expected not_initialized, got %v", err)
+	}
+	if err, _ := plugin.Execute(context.Background(), "pluginmanager.manageStart", nil); err == nil {
+		t.Errorf("Expected the legacy Execute to fail over grpc")
+	}
+
+	// The deadline of the caller reaches the plugin
+	impl.RegisterCall("test.wait", func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	plugin.lock.Lock()
+	plugin.methods = append(plugin.methods, "test.wait")
+	plugin.lock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := plugin.Call(ctx, "test.wait", nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to be exceeded, got %v", err)
+	}
+
+	// The notifications are streamed
+	received := make(chan []byte)
+	callback := func(data []byte) { received <- data }
+	if err := plugin.RegisterCallback(callback); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	for i := 0; impl.Notify(getFuncName(callback), []byte("event")) != nil; i++ {
+		if i > 1000 {
+			t.Fatalf("The callback stream was not opened")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if data := <-received; string(data) != "event" {
+		t.Errorf("Expected the event, got %s", data)
+	}
+
+	// The http transport is served on the same socket
+	resp, err := pluginConn.Request(context.Background(), &PluginConn.PluginRequest{Url: "unix://plugin/Ping", Body: []byte("ping")})
+	if err != nil || resp.Status != "200 OK" {
+		t.Errorf("The http transport is not served: %v %v", resp, err)
+	}
+}
@@ -0,0 +1,118 @@
+package pluginmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	PluginConn "org.openappstack/singularity/pluginmanager/pluginconn"
+	"org.openappstack/singularity/pluginmanager/pluginrpc"
+	"reflect"
+	"testing"
+)
+
+// A plugin streaming the progress of its start, following its logs until cancelled
+func newStreamImpl(cancelled chan struct{}) *PluginImpl {
+	impl := newProtocolImpl()
+	impl.RegisterStream(MethodStart, func(ctx context.Context, payload json.RawMessage, send func(interface{}) error) (interface{}, error) {
+		for _, percent := range []int{50, 100} {
+			if err := send(&Progress{Percent: percent}); err != nil {
+				return nil, err
+			}
+		}
+		return "started", nil
+	})
+	impl.RegisterStream(MethodLogs, func(ctx context.Context, payload json.RawMessage, send func(interface{}) error) (interface{}, error) {
+		request := &LogsRequest{}
+		json.Unmarshal(payload, request)
+		if !request.Follow {
+			return nil, &PluginError{Code: ErrCodeNotSupported, Message: "The logs can only be followed"}
+		}
+		send(&LogLine{Line: "first"})
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	})
+	return impl
+}
+
+func TestStream(t *testing.T) {
+	for _, transport := range []string{TransportHttp, TransportGrpc} {
+		t.Run(transport, func(t *testing.T) {
+			cancelled := make(chan struct{})
+			impl := newStreamImpl(cancelled)
+			var plugin *Plugin
+			if transport == TransportGrpc {
+				sockFile := serveRpcPlugin(t, impl)
+				rpcConn, err := pluginrpc.Dial(sockFile)
+				if err != nil {
+					t.Fatalf("Err: %s", err)
+				}
+				pluginConn, err := PluginConn.NewPluginClient(sockFile)
+				if err != nil {
+					t.Fatalf("Err: %s", err)
+				}
+				defer rpcConn.Close()
+				defer pluginConn.Close()
+				plugin = &Plugin{PluginUrl: "unix://plugin", PluginSock: sockFile, pluginConn: pluginConn, rpcConn: rpcConn, connected: true, callbacks: map[string]bool{}, Controller: "onos", transport: TransportGrpc}
+			} else {
+				plugin = serveProtocolPlugin(t, impl)
+			}
+			if err := plugin.handshake(); err != nil {
+				t.Fatalf("Err: %s", err)
+			}
+			manage := &ManagePluginInstance{plugin: plugin}
+
+			// The chunks are received before the result
+			chunks := 0
+			var result string
+			if err := plugin.Stream(context.Background(), MethodStart, &LifecycleRequest{ControllerId: "1"}, func(chunk json.RawMessage) error {
+				chunks++
+				return nil
+			}, &result); err != nil || chunks != 2 || result != "started" {
+				t.Errorf("Unexpected stream: %d chunks, result %q %v", chunks, result, err)
+			}
+
+			// The progress of the start is reported
+			var percents []int
+			ctx := WithProgress(context.Background(), func(progress *Progress) { percents = append(percents, progress.Percent) })
+			if err := manage.Start(ctx, "1", nil); err != nil || !reflect.DeepEqual(percents, []int{50, 100}) {
+				t.Errorf("Unexpected progress %v %v", percents, err)
+			}
+
+			// The plugin errors end the stream
+			if err := manage.Logs(context.Background(), &LogsRequest{ControllerId: "1"}, func(*LogLine) error { return nil }); !errors.Is(err, ErrNotSupported) {
+				t.Errorf("Expected ErrNotSupported, got %v", err)
+			}
+
+			// A followed stream ends on the plugin side when the agent cancels it
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var lines []string
+			err := manage.Logs(ctx, &LogsRequest{ControllerId: "1", Follow: true}, func(line *LogLine) error {
+				lines = append(lines, line.Line)
+				cancel()
+				return nil
+			})
+			if !errors.Is(err, context.Canceled) || len(lines) != 1 || lines[0] != "first" {
+				t.Errorf("Unexpected follow %v %v", lines, err)
+			}
+			<-cancelled
+
+			// The plugins of protocol version 1 are called without streaming
+			plugin.lock.Lock()
+			plugin.protocol = 1
+			plugin.lock.Unlock()
+			if err := plugin.Stream(context.Background(), MethodStart, &LifecycleRequest{ControllerId: "1"}, func(json.RawMessage) error { return nil }, nil); err == nil {
+				t.Errorf("Expected a version 1 stream to fail")
+			}
+			percents = nil
+			ctx = WithProgress(context.Background(), func(progress *Progress) { percents = append(percents, progress.Percent) })
+			if err := manage.Start(ctx, "1", nil); err != nil || len(percents) != 0 {
+				t.Errorf("Unexpected version 1 start %v %v", percents, err)
+			}
+			if err := manage.Logs(context.Background(), &LogsRequest{ControllerId: "1"}, func(*LogLine) error { return nil }); !errors.Is(err, ErrNotSupported) {
+				t.Errorf("Expected ErrNotSupported, got %v", err)
+			}
+		})
+	}
+}
@@ -1,9 +1,13 @@
 package pluginmanager
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 )
 
@@ -13,11 +17,56 @@ type LifecycleAppInstance interface {
 	Stop(data []byte) error
 }
 
+// Implemented by the controller instances honoring the deadline and the
+// cancellation of the agent requests, called instead of Start and Stop
+type ContextLifecycleAppInstance interface {
+	StartContext(ctx context.Context, data []byte) error
+	StopContext(ctx context.Context, data []byte) error
+}
+
+// Implemented by the controller instances reporting the progress of their
+// start, called instead of Start and StartContext
+type ProgressLifecycleAppInstance interface {
+	StartProgress(ctx context.Context, data []byte, progress func(*Progress)) error
+}
+
+// Implemented by the controller instances streaming their logs. The lines are
+// passed to line until the context is done if request.Follow, the instance
+// stops when line fails.
+type LogsLifecycleAppInstance interface {
+	Logs(ctx context.Context, request *LogsRequest, line func(*LogLine) error) error
+}
+
+// Implemented by the controller instances accepting the configurations pushed
+// to the running controller. The secrets referenced in the push are passed
+// along, they must never be logged.
+type ConfigLifecycleAppInstance interface {
+	Configure(ctx context.Context, data []byte, secrets map[string][]byte) error
+}
+
+// Implemented by the controller instances that need the secrets referenced in
+// the controller start request. SetSecrets is called right after the instance
+// is created, the secrets must never be logged.
+type SecretsReceiver interface {
+	SetSecrets(secrets map[string][]byte) error
+}
+
 // The singularity plugin Impl
 type SingularityPluginImpl struct {
 	pluginReg                    *PluginImpl
 	controllerInstanceRegisterer func([]byte) (interface{}, error)
-	controllerInstanceMap        map[string]interface{}
+	// The controller instances by controller id, synced by the instanceLock
+	// as the plugin requests are concurrent
+	controllerInstanceMap map[string]interface{}
+	instanceLock          sync.Mutex
+}
+
+// Get a controller instance by controller id
+func (plugin *SingularityPluginImpl) controllerInstance(controllerid string) (interface{}, bool) {
+	plugin.instanceLock.Lock()
+	defer plugin.instanceLock.Unlock()
+	instance, found := plugin.controllerInstanceMap[controllerid]
+	return instance, found
 }
 
 const (
@@ -30,8 +79,14 @@ var (
 
 // Function to register a plugin
 func RegisterPlugin(registrar func([]byte) (interface{}, error)) (*SingularityPluginImpl, error) {
+	return RegisterPluginAt(registrar, runtimeConf)
+}
+
+// Function to register a plugin with the runtime conf written by the agent at
+// another location, e.g. by the plugin tests
+func RegisterPluginAt(registrar func([]byte) (interface{}, error), runtimeConfFile string) (*SingularityPluginImpl, error) {
 
-	pluginConf := PluginImplConf{PluginLoc: runtimeConf, Activator: pluginStarter, Stopper: pluginStopper}
+	pluginConf := PluginImplConf{PluginLoc: runtimeConfFile, Activator: pluginStarter, Stopper: pluginStopper}
 	// Implement the Plugin
 	regPlugin, pluginInitError := PluginInit(pluginConf)
 	if pluginInitError != nil {
@@ -43,6 +98,17 @@ func RegisterPlugin(registrar func([]byte) (interface{}, error)) (*SingularityPl
 	singularityPluginImpl.controllerInstanceRegisterer = registrar
 	singularityPluginImpl.controllerInstanceMap = make(map[string]interface{})
 
+	// Register the lifecycle methods called by the agent, by id and by
+	// function name for the legacy agents
+	regPlugin.RegisterCall(MethodInit, lifecycleCall(initController))
+	regPlugin.RegisterStream(MethodStart, startStream)
+	regPlugin.RegisterCall(MethodStop, lifecycleCall(stopController))
+	regPlugin.RegisterStream(MethodLogs, logsStream)
+	regPlugin.RegisterCall(MethodConfig, lifecycleCall(configController))
+	regPlugin.RegisterContextMethod(manageInit)
+	regPlugin.RegisterContextMethod(manageStart)
+	regPlugin.RegisterContextMethod(manageStop)
+
 	singularityPlugin = singularityPluginImpl
 
 	return singularityPluginImpl, nil
@@ -56,61 +122,162 @@ func pluginStopper(data []byte) []byte {
 	return nil
 }
 
-func manageInit(reqdata []byte) []byte {
+// Create the controller instance of a controller id, with its secrets
+func initController(ctx context.Context, request *LifecycleRequest) error {
 
-	controllerid, data, err := decapsuleControllerId(reqdata)
-	if err != nil {
-		return []byte(fmt.Sprintf("Failed to decapsule controllerid: %s", err))
+	lifecycleinstance, initerr := singularityPlugin.controllerInstanceRegisterer(request.Data)
+	if initerr != nil {
+		return fmt.Errorf("failed to initialize controller instance: %s", initerr)
 	}
 
-	lifecycleinstance, initerr := singularityPlugin.controllerInstanceRegisterer(data)
-	if initerr != nil {
-		return []byte(fmt.Sprintf("failed to initialize controller instance: %s", initerr))
+	// Deliver the secrets to the instance
+	if receiver, ok := lifecycleinstance.(SecretsReceiver); ok && len(request.Secrets) > 0 {
+		if secretErr := receiver.SetSecrets(request.Secrets); secretErr != nil {
+			return fmt.Errorf("failed to set the controller instance secrets: %s", secretErr)
+		}
 	}
 
-	singularityPlugin.controllerInstanceMap[controllerid] = lifecycleinstance
+	singularityPlugin.instanceLock.Lock()
+	singularityPlugin.controllerInstanceMap[request.ControllerId] = lifecycleinstance
+	singularityPlugin.instanceLock.Unlock()
 
 	return nil
 }
 
-func manageStart(reqdata []byte) []byte {
+// Start the controller instance of a controller id, reporting its progress if it can
+func startController(ctx context.Context, request *LifecycleRequest, progress func(*Progress)) error {
 
-	controllerid, data, decodeerr := decapsuleControllerId(reqdata)
-	if decodeerr != nil {
-		return []byte(fmt.Sprintf("Failed to decalsule controllerid %s", decodeerr))
+	// Get the lifecycleinstance from the map
+	controllerInstance, found := singularityPlugin.controllerInstance(request.ControllerId)
+	if !found {
+		return &PluginError{Code: ErrCodeNotInitialized, Message: "Appinstance not initialized"}
+	}
+
+	if lifecycleApp, ok := controllerInstance.(ProgressLifecycleAppInstance); ok {
+		return lifecycleApp.StartProgress(ctx, request.Data, progress)
+	}
+	if lifecycleApp, ok := controllerInstance.(ContextLifecycleAppInstance); ok {
+		return lifecycleApp.StartContext(ctx, request.Data)
 	}
+	return controllerInstance.(LifecycleAppInstance).Start(request.Data)
+}
+
+// Stop the controller instance of a controller id
+func stopController(ctx context.Context, request *LifecycleRequest) error {
 
 	// Get the lifecycleinstance from the map
-	controllerInstance, found := singularityPlugin.controllerInstanceMap[controllerid]
+	controllerInstance, found := singularityPlugin.controllerInstance(request.ControllerId)
 	if !found {
-		return []byte(fmt.Sprintf("Appinstance not initialized"))
+		return &PluginError{Code: ErrCodeNotInitialized, Message: "Appinstance not initialized"}
 	}
 
-	lifecycleApp := controllerInstance.(LifecycleAppInstance)
+	if lifecycleApp, ok := controllerInstance.(ContextLifecycleAppInstance); ok {
+		return lifecycleApp.StopContext(ctx, request.Data)
+	}
+	return controllerInstance.(LifecycleAppInstance).Stop(request.Data)
+}
+
+// Push a configuration and its secrets to the controller instance of a controller id
+func configController(ctx context.Context, request *LifecycleRequest) error {
 
-	err := lifecycleApp.Start(data)
-	retData := []byte(fmt.Sprintf("%v", err))
-	return retData
+	controllerInstance, found := singularityPlugin.controllerInstance(request.ControllerId)
+	if !found {
+		return &PluginError{Code: ErrCodeNotInitialized, Message: "Appinstance not initialized"}
+	}
+	lifecycleApp, ok := controllerInstance.(ConfigLifecycleAppInstance)
+	if !ok {
+		return &PluginError{Code: ErrCodeNotSupported, Message: "The controller instance doesn't accept configurations"}
+	}
+	return lifecycleApp.Configure(ctx, request.Data, request.Secrets)
 }
 
-func manageStop(reqdata []byte) []byte {
+// Stream the log lines of the controller instance of a controller id
+func logsController(ctx context.Context, request *LogsRequest, line func(*LogLine) error) error {
+
+	controllerInstance, found := singularityPlugin.controllerInstance(request.ControllerId)
+	if !found {
+		return &PluginError{Code: ErrCodeNotInitialized, Message: "Appinstance not initialized"}
+	}
+	lifecycleApp, ok := controllerInstance.(LogsLifecycleAppInstance)
+	if !ok {
+		return &PluginError{Code: ErrCodeNotSupported, Message: "The controller instance doesn't stream its logs"}
+	}
+	return lifecycleApp.Logs(ctx, request, line)
+}
+
+// Adapt a lifecycle operation to a method called by id
+func lifecycleCall(operation func(context.Context, *LifecycleRequest) error) CallHandler {
+	return func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		request := &LifecycleRequest{}
+		if err := json.Unmarshal(payload, request); err != nil || request.ControllerId == "" {
+			return nil, &PluginError{Code: ErrCodeInvalidRequest, Message: "Invalid lifecycle request"}
+		}
+		return nil, operation(ctx, request)
+	}
+}
+
+// The start method, streaming the progress of the controller instance
+func startStream(ctx context.Context, payload json.RawMessage, send func(interface{}) error) (interface{}, error) {
+	request := &LifecycleRequest{}
+	if err := json.Unmarshal(payload, request); err != nil || request.ControllerId == "" {
+		return nil, &PluginError{Code: ErrCodeInvalidRequest, Message: "Invalid lifecycle request"}
+	}
+	return nil, startController(ctx, request, func(progress *Progress) {
+		// The agent gone, the start goes on until the context is done
+		send(progress)
+	})
+}
+
+// The logs method, streaming the log lines of the controller instance
+func logsStream(ctx context.Context, payload json.RawMessage, send func(interface{}) error) (interface{}, error) {
+	request := &LogsRequest{}
+	if err := json.Unmarshal(payload, request); err != nil || request.ControllerId == "" {
+		return nil, &PluginError{Code: ErrCodeInvalidRequest, Message: "Invalid logs request"}
+	}
+	return nil, logsController(ctx, request, func(line *LogLine) error {
+		return send(line)
+	})
+}
+
+// Get the response of a legacy method, the error string or nothing on success
+func legacyResponse(err error) []byte {
+	if err == nil {
+		return nil
+	}
+	var pluginErr *PluginError
+	if errors.As(err, &pluginErr) {
+		return []byte(pluginErr.Message)
+	}
+	return []byte(err.Error())
+}
+
+// The legacy lifecycle methods, called by function name by the agents not
+// negotiating a protocol version
+func manageInit(ctx context.Context, reqdata []byte) []byte {
+
+	controllerid, data, secrets, err := decapsuleInitRequest(reqdata)
+	if err != nil {
+		return []byte(fmt.Sprintf("Failed to decapsule controllerid: %s", err))
+	}
+	return legacyResponse(initController(ctx, &LifecycleRequest{ControllerId: controllerid, Data: data, Secrets: secrets}))
+}
+
+func manageStart(ctx context.Context, reqdata []byte) []byte {
 
 	controllerid, data, decodeerr := decapsuleControllerId(reqdata)
 	if decodeerr != nil {
 		return []byte(fmt.Sprintf("Failed to decalsule controllerid %s", decodeerr))
 	}
+	return legacyResponse(startController(ctx, &LifecycleRequest{ControllerId: controllerid, Data: data}, func(*Progress) {}))
+}
 
-	// Get the lifecycleinstance from the map
-	controllerInstance, found := singularityPlugin.controllerInstanceMap[controllerid]
-	if !found {
-		return []byte(fmt.Sprintf("Appinstance not initialized"))
-	}
-
-	lifecycleApp := controllerInstance.(LifecycleAppInstance)
+func manageStop(ctx context.Context, reqdata []byte) []byte {
 
-	err := lifecycleApp.Stop(data)
-	retData := []byte(fmt.Sprintf("%v", err))
-	return retData
+	controllerid, data, decodeerr := decapsuleControllerId(reqdata)
+	if decodeerr != nil {
+		return []byte(fmt.Sprintf("Failed to decalsule controllerid %s", decodeerr))
+	}
+	return legacyResponse(stopController(ctx, &LifecycleRequest{ControllerId: controllerid, Data: data}))
 }
 
 // Function to start a plugin
@@ -123,6 +290,12 @@ func (plugin *SingularityPluginImpl) StartPlugin() error {
 	return nil
 }
 
+// Function to notify the agent callback registered under a name, the
+// notifications are buffered until the agent receives them
+func (plugin *SingularityPluginImpl) Notify(callBack string, data []byte) error {
+	return plugin.pluginReg.Notify(callBack, data)
+}
+
 // Function to wait for a plugin to stop. The wait finish when the plugin gets a SIGUSR1 from agent
 func (plugin *SingularityPluginImpl) WaitForPluginStop() error {
 	pluginExitChannel := makeExitChannel()
@@ -0,0 +1,263 @@
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	// Size of the key encryption keys and of the data keys
+	keySize = 32
+
+	// PBKDF2 iterations used to derive a key from a passphrase
+	passphraseIterations = 200000
+
+	// Default salt of the passphrase derived keys
+	defaultSalt = "singularity"
+)
+
+var (
+	// Prefix of every encrypted value, the values without it are plaintext
+	// written before the bucket was encrypted
+	envelopeMagic = []byte("enc:v1:")
+
+	// An error indicating the key that encrypted a value is not in the keyring
+	ErrUnknownKey = errors.New("value encrypted with an unknown key")
+
+	// An error indicating a value could not be decrypted
+	ErrDecrypt = errors.New("failed to decrypt value")
+)
+
+// EncryptionConfig selects the encrypted buckets and the keys to use
+type EncryptionConfig struct {
+	// The buckets whose values are encrypted
+	Buckets []string
+	// The file holding the primary key (64 hex chars), takes precedence over Passphrase
+	KeyFile string
+	// The passphrase the primary key is derived from
+	Passphrase string
+	// The salt used to derive the passphrase keys
+	Salt string
+	// Previous key files and passphrases, still accepted for decryption
+	// until the data is re-encrypted with the primary key
+	OldKeyFiles    []string
+	OldPassphrases []string
+}
+
+// Enabled checks if a primary key is configured
+func (conf *EncryptionConfig) Enabled() bool {
+	return conf.KeyFile != "" || conf.Passphrase != ""
+}
+
+// Keyring holds the key encryption keys by key id. New values are always
+// encrypted with the primary key.
+type Keyring struct {
+	primary string
+	keys    map[string][]byte
+}
+
+// envelope is the encoded form of an encrypted value. The value is encrypted
+// with a random data key, which is itself encrypted (wrapped) with a key of
+// the keyring.
+type envelope struct {
+	KeyId      string `json:"kid"`
+	WrappedKey []byte `json:"dek"`
+	Nonce      []byte `json:"nonce"`
+	Data       []byte `json:"data"`
+}
+
+// NewKeyring loads the keys of an encryption configuration
+func NewKeyring(conf EncryptionConfig) (*Keyring, error) {
+	keyring := &Keyring{keys: make(map[string][]byte)}
+
+	salt := conf.Salt
+	if salt == "" {
+		salt = defaultSalt
+	}
+
+	var primary []byte
+	var err error
+	if conf.KeyFile != "" {
+		primary, err = LoadKeyFile(conf.KeyFile)
+	} else if conf.Passphrase != "" {
+		primary, err = DeriveKey(conf.Passphrase, salt)
+	} else {
+		return nil, fmt.Errorf("No encryption key configured")
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyring.primary = keyring.add(primary)
+
+	for _, file := range conf.OldKeyFiles {
+		key, err := LoadKeyFile(file)
+		if err != nil {
+			return nil, err
+		}
+		keyring.add(key)
+	}
+	for _, passphrase := range conf.OldPassphrases {
+		key, err := DeriveKey(passphrase, salt)
+		if err != nil {
+			return nil, err
+		}
+		keyring.add(key)
+	}
+
+	return keyring, nil
+}
+
+// add puts a key in the keyring and returns its id
+func (k *Keyring) add(key []byte) string {
+	id := keyId(key)
+	k.keys[id] = key
+	return id
+}
+
+// keyId is a stable identifier of a key that doesn't reveal it
+func keyId(key []byte) string {
+	sum := sha256.Sum256(append([]byte("singularity-key-id:"), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
+// LoadKeyFile reads a key from a file holding either 64 hex chars or 32 raw bytes
+func LoadKeyFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read key file: %v", err)
+	}
+	if key, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil && len(key) == keySize {
+		return key, nil
+	}
+	if len(data) == keySize {
+		return data, nil
+	}
+	return nil, fmt.Errorf("Invalid key file %s: expected %d bytes key", path, keySize)
+}
+
+// GenerateKeyFile writes a new random key to a file
+func GenerateKeyFile(path string) error {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), dbFileMode)
+}
+
+// DeriveKey derives a key from a passphrase
+func DeriveKey(passphrase, salt string) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, passphrase, []byte(salt), passphraseIterations, keySize)
+}
+
+// isEncrypted checks if a stored value is an envelope
+func isEncrypted(value []byte) bool {
+	return bytes.HasPrefix(value, envelopeMagic)
+}
+
+// seal encrypts data with the given key, binding it to the additional data
+func seal(key, data, additional []byte) ([]byte, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, gcm.Seal(nil, nonce, data, additional), nil
+}
+
+// unseal decrypts data sealed with the given key
+func unseal(key, nonce, data, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	plain, err := gcm.Open(nil, nonce, data, additional)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+// Encrypt seals a value with a new data key wrapped by the primary key. The
+// location (bucket and key) is authenticated so a value can't be moved around.
+func (k *Keyring) Encrypt(location, value []byte) ([]byte, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	env := envelope{KeyId: k.primary}
+	keyNonce, wrapped, err := seal(k.keys[k.primary], dataKey, []byte(k.primary))
+	if err != nil {
+		return nil, err
+	}
+	env.WrappedKey = append(keyNonce, wrapped...)
+	if env.Nonce, env.Data, err = seal(dataKey, value, location); err != nil {
+		return nil, err
+	}
+
+	encoded, err := json.Marshal(&env)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, envelopeMagic...), encoded...), nil
+}
+
+// Decrypt opens a value sealed by Encrypt. It also returns the id of the key
+// that encrypted it. Plaintext values are returned as is with an empty id.
+func (k *Keyring) Decrypt(location, value []byte) ([]byte, string, error) {
+	if !isEncrypted(value) {
+		return value, "", nil
+	}
+
+	env := envelope{}
+	if err := json.Unmarshal(value[len(envelopeMagic):], &env); err != nil {
+		return nil, "", ErrDecrypt
+	}
+	kek, ok := k.keys[env.KeyId]
+	if !ok {
+		return nil, env.KeyId, ErrUnknownKey
+	}
+
+	const nonceSize = 12
+	if len(env.WrappedKey) < nonceSize {
+		return nil, env.KeyId, ErrDecrypt
+	}
+	dataKey, err := unseal(kek, env.WrappedKey[:nonceSize], env.WrappedKey[nonceSize:], []byte(env.KeyId))
+	if err != nil {
+		return nil, env.KeyId, err
+	}
+	plain, err := unseal(dataKey, env.Nonce, env.Data, location)
+	if err != nil {
+		return nil, env.KeyId, err
+	}
+	return plain, env.KeyId, nil
+}
+
+// Primary returns the id of the key used for encryption
+func (k *Keyring) Primary() string {
+	return k.primary
+}
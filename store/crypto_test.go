@@ -0,0 +1,144 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestEncryptedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crypto")
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldKey := filepath.Join(dir, "old.key")
+	newKey := filepath.Join(dir, "new.key")
+	for _, file := range []string{oldKey, newKey} {
+		if err := GenerateKeyFile(file); err != nil {
+			t.Fatalf("Err: %s", err)
+		}
+	}
+
+	backend := NewMemStore()
+	defer backend.Close()
+
+	// Write a plaintext value and an encrypted one with the old key
+	if err := backend.Set(Plugin_instances_bucket, []byte("plain"), []byte("secret1")); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	oldStore, err := NewEncryptedStore(backend, EncryptionConfig{Buckets: []string{string(Plugin_instances_bucket)}, KeyFile: oldKey})
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if err := oldStore.Set(Plugin_instances_bucket, []byte("old"), []byte("secret2")); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	raw, _ := backend.Get(Plugin_instances_bucket, []byte("old"))
+	if !isEncrypted(raw) {
+		t.Fatalf("Value stored in plaintext: %s", raw)
+	}
+
+	// Rotate to the new key
+	newStore, err := NewEncryptedStore(backend, EncryptionConfig{
+		Buckets:     []string{string(Plugin_instances_bucket)},
+		KeyFile:     newKey,
+		OldKeyFiles: []string{oldKey},
+	})
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	count, err := newStore.ReEncrypt()
+	if err != nil || count != 2 {
+		t.Fatalf("Unexpected re-encryption count: %d, Err: %v", count, err)
+	}
+
+	// The old key alone can no longer read the data
+	if _, err := oldStore.Get(Plugin_instances_bucket, []byte("old")); err != ErrUnknownKey {
+		t.Fatalf("Expected ErrUnknownKey, got: %v", err)
+	}
+	for k, expected := range map[string]string{"plain": "secret1", "old": "secret2"} {
+		val, err := newStore.Get(Plugin_instances_bucket, []byte(k))
+		if err != nil || string(val) != expected {
+			t.Fatalf("Unexpected value for %s: %s, Err: %v", k, val, err)
+		}
+	}
+
+	// A value can't be moved to another key
+	raw, _ = backend.Get(Plugin_instances_bucket, []byte("old"))
+	backend.Set(Plugin_instances_bucket, []byte("moved"), raw)
+	if _, err := newStore.Get(Plugin_instances_bucket, []byte("moved")); err != ErrDecrypt {
+		t.Fatalf("Expected ErrDecrypt, got: %v", err)
+	}
+}
+
+// The relay of a consumer no longer reading ends with its watcher
+func TestSensitiveBucketsEncrypted(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "store.key")
+	if err := GenerateKeyFile(keyFile); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	backend := NewMemStore()
+	defer backend.Close()
+	encrypted, err := NewEncryptedStore(backend, EncryptionConfig{KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+
+	// The controllers and the plugin instances are encrypted without being configured
+	values := map[string][]byte{
+		string(Controllers_bucket):      []byte(`{"Name": "onos", "InitParam": "admin-password"}`),
+		string(Plugin_instances_bucket): []byte(`{"Controller": "onos", "Token": "plugin-token"}`),
+		string(Secrets_bucket):          []byte(`{"Name": "db", "Value": "secret-value"}`),
+	}
+	for bucket, value := range values {
+		if err := encrypted.Set([]byte(bucket), []byte("1"), value); err != nil {
+			t.Fatalf("Err: %s", err)
+		}
+		raw, _ := backend.Get([]byte(bucket), []byte("1"))
+		if !isEncrypted(raw) || bytes.Contains(raw, []byte("password")) || bytes.Contains(raw, []byte("token")) || bytes.Contains(raw, []byte("secret-value")) {
+			t.Errorf("Value of bucket %s stored in plaintext: %s", bucket, raw)
+		}
+		if plain, err := encrypted.Get([]byte(bucket), []byte("1")); err != nil || !bytes.Equal(plain, value) {
+			t.Errorf("Unexpected value of bucket %s: %s, Err: %v", bucket, plain, err)
+		}
+	}
+}
+
+func TestRelayClose(t *testing.T) {
+	backend := NewMemStore()
+	defer backend.Close()
+	goroutines := runtime.NumGoroutine()
+
+	watcher := relay(backend.Watch(Plugin_instances_bucket, nil), func(ev Event) Event { return ev })
+	set := func(i int) {
+		if err := backend.Set(Plugin_instances_bucket, []byte(strconv.Itoa(i)), []byte("v")); err != nil {
+			t.Fatalf("Err: %s", err)
+		}
+	}
+	// The relay blocks on a full buffer
+	for i := 0; i < watcherBufferSize; i++ {
+		set(i)
+	}
+	for len(watcher.Events) < watcherBufferSize {
+		time.Sleep(time.Millisecond)
+	}
+	set(watcherBufferSize)
+	set(watcherBufferSize + 1)
+	watcher.Close()
+	watcher.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			t.Fatalf("The relay of the closed watcher is still running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,145 @@
+package store
+
+import (
+	log "github.com/spf13/jwalterweatherman"
+)
+
+// EncryptedStore transparently encrypts the values of selected buckets of
+// the underlying store. The values of the other buckets are left as is.
+type EncryptedStore struct {
+	Store
+
+	keyring *Keyring
+	buckets map[string]bool
+}
+
+// NewEncryptedStore wraps a store, encrypting the configured buckets
+func NewEncryptedStore(inner Store, conf EncryptionConfig) (*EncryptedStore, error) {
+	keyring, err := NewKeyring(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &EncryptedStore{
+		Store:   inner,
+		keyring: keyring,
+		buckets: make(map[string]bool),
+	}
+	for _, bucket := range conf.Buckets {
+		store.buckets[bucket] = true
+	}
+	// The sensitive buckets are always encrypted
+	for _, bucket := range sensitiveBuckets {
+		store.buckets[string(bucket)] = true
+	}
+
+	return store, nil
+}
+
+// location is the authenticated data binding a value to its bucket and key
+func location(bucket, k []byte) []byte {
+	return []byte(string(bucket) + "/" + string(k))
+}
+
+// IsEncrypted checks if the values of a bucket are encrypted
+func (e *EncryptedStore) IsEncrypted(bucket []byte) bool {
+	return e.buckets[string(bucket)]
+}
+
+// Set is used to set a key/value, encrypting the value if needed
+func (e *EncryptedStore) Set(bucketToInsertIn, k, v []byte) error {
+	if !e.IsEncrypted(bucketToInsertIn) {
+		return e.Store.Set(bucketToInsertIn, k, v)
+	}
+	sealed, err := e.keyring.Encrypt(location(bucketToInsertIn, k), v)
+	if err != nil {
+		return err
+	}
+	return e.Store.Set(bucketToInsertIn, k, sealed)
+}
+
+// Get is used to retrieve a value by key, decrypting it if needed
+func (e *EncryptedStore) Get(bucketToReadFrom, k []byte) ([]byte, error) {
+	val, err := e.Store.Get(bucketToReadFrom, k)
+	if err != nil || !e.IsEncrypted(bucketToReadFrom) {
+		return val, err
+	}
+	plain, _, err := e.keyring.Decrypt(location(bucketToReadFrom, k), val)
+	return plain, err
+}
+
+// GetAll is used to iterate over the key/values of a bucket, decrypting them if needed
+func (e *EncryptedStore) GetAll(bucketToReadFrom []byte, fn func(k, v []byte) error) error {
+	if !e.IsEncrypted(bucketToReadFrom) {
+		return e.Store.GetAll(bucketToReadFrom, fn)
+	}
+	return e.Store.GetAll(bucketToReadFrom, func(k, v []byte) error {
+		plain, _, err := e.keyring.Decrypt(location(bucketToReadFrom, k), v)
+		if err != nil {
+			return err
+		}
+		return fn(k, plain)
+	})
+}
+
+// Watch subscribes to the changes, the event values are decrypted
+func (e *EncryptedStore) Watch(bucket, prefix []byte) *Watcher {
+	return relay(e.Store.Watch(bucket, prefix), e.decryptEvent)
+}
+
+// WatchFrom subscribes to the changes after a revision, the event values are decrypted
+func (e *EncryptedStore) WatchFrom(bucket, prefix []byte, revision uint64) (*Watcher, error) {
+	w, err := e.Store.WatchFrom(bucket, prefix, revision)
+	if err != nil {
+		return nil, err
+	}
+	return relay(w, e.decryptEvent), nil
+}
+
+// decryptEvent decrypts the value carried by an event
+func (e *EncryptedStore) decryptEvent(ev Event) Event {
+	if ev.Value == nil || !e.buckets[ev.Bucket] {
+		return ev
+	}
+	plain, _, err := e.keyring.Decrypt(location([]byte(ev.Bucket), []byte(ev.Key)), ev.Value)
+	if err != nil {
+		log.ERROR.Printf("Failed to decrypt event value for %s/%s: %v", ev.Bucket, ev.Key, err)
+		plain = nil
+	}
+	ev.Value = plain
+	return ev
+}
+
+// ReEncrypt rewrites every value of the encrypted buckets that is plaintext or
+// encrypted with an old key, using the primary key. It returns the number of
+// values rewritten.
+func (e *EncryptedStore) ReEncrypt() (int, error) {
+	count := 0
+	for bucket := range e.buckets {
+		// Collect first, the store may not be written while iterating
+		pending := make(map[string][]byte)
+		err := e.Store.GetAll([]byte(bucket), func(k, v []byte) error {
+			plain, kid, err := e.keyring.Decrypt(location([]byte(bucket), k), v)
+			if err != nil {
+				return err
+			}
+			if kid != e.keyring.Primary() {
+				pending[string(k)] = plain
+			}
+			return nil
+		})
+		if err == ErrNoSuchBucket {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		for k, plain := range pending {
+			if err := e.Set([]byte(bucket), []byte(k), plain); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
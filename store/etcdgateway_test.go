@@ -0,0 +1,319 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fake of the etcd v3 json gateway serving the kv, the watch and the auth
+// requests from memory. The int64 fields are sent as strings, like the gateway.
+type fakeEtcdGateway struct {
+	lock     sync.Mutex
+	revision int64
+	kvs      map[string]etcdKeyValue
+	history  []etcdWatchEvent
+	// Closed and replaced on every change, wakes the watch streams
+	changed chan struct{}
+	// The frames the open watch stream sends before it ends
+	frames []string
+	// The start revisions of the watch streams
+	watches []int64
+	// The valid token if the authentication is enabled, and the authentications
+	auth            bool
+	token           string
+	authentications int
+}
+
+func newFakeEtcdGateway() *fakeEtcdGateway {
+	return &fakeEtcdGateway{revision: 1, kvs: map[string]etcdKeyValue{}, changed: make(chan struct{})}
+}
+
+// Check if a key is in the range of a request, a single key without range end
+func inEtcdRange(key, start, end []byte) bool {
+	switch {
+	case len(end) == 0:
+		return bytes.Equal(key, start)
+	case bytes.Equal(end, []byte{0}):
+		return bytes.Compare(key, start) >= 0
+	default:
+		return bytes.Compare(key, start) >= 0 && bytes.Compare(key, end) < 0
+	}
+}
+
+func gatewayHeader(revision int64) map[string]interface{} {
+	return map[string]interface{}{"revision": strconv.FormatInt(revision, 10)}
+}
+
+func gatewayKv(kv etcdKeyValue) map[string]interface{} {
+	return map[string]interface{}{"key": kv.Key, "value": kv.Value, "mod_revision": strconv.FormatInt(int64(kv.ModRevision), 10)}
+}
+
+// Record a change and wake the watch streams, with the lock held
+func (g *fakeEtcdGateway) change(eventType string, kv etcdKeyValue) {
+	g.history = append(g.history, etcdWatchEvent{Type: eventType, Kv: kv})
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// End the open watch stream with the frames
+func (g *fakeEtcdGateway) sendFrames(frames ...string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.frames = append(g.frames, frames...)
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+func (g *fakeEtcdGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v3/auth/authenticate" {
+		g.lock.Lock()
+		g.authentications++
+		g.token = fmt.Sprintf("token-%d", g.authentications)
+		token := g.token
+		g.lock.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"token": token})
+		return
+	}
+	g.lock.Lock()
+	expired := g.auth && r.Header.Get("Authorization") != g.token
+	g.lock.Unlock()
+	if expired {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "etcdserver: invalid auth token", "code": 16, "message": "etcdserver: invalid auth token"})
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		req := &etcdRangeReq{}
+		json.NewDecoder(r.Body).Decode(req)
+		g.lock.Lock()
+		var keys []string
+		for key := range g.kvs {
+			if inEtcdRange([]byte(key), req.Key, req.RangeEnd) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		kvs := []interface{}{}
+		for _, key := range keys {
+			kvs = append(kvs, gatewayKv(g.kvs[key]))
+		}
+		resp := map[string]interface{}{"header": gatewayHeader(g.revision)}
+		if len(kvs) > 0 {
+			resp["kvs"] = kvs
+		}
+		g.lock.Unlock()
+		json.NewEncoder(w).Encode(resp)
+	case "/v3/kv/put":
+		req := &etcdPutReq{}
+		json.NewDecoder(r.Body).Decode(req)
+		g.lock.Lock()
+		g.revision++
+		kv := etcdKeyValue{Key: req.Key, Value: req.Value, ModRevision: etcdInt(g.revision)}
+		g.kvs[string(req.Key)] = kv
+		g.change("PUT", kv)
+		resp := map[string]interface{}{"header": gatewayHeader(g.revision)}
+		g.lock.Unlock()
+		json.NewEncoder(w).Encode(resp)
+	case "/v3/kv/deleterange":
+		req := &etcdRangeReq{}
+		json.NewDecoder(r.Body).Decode(req)
+		g.lock.Lock()
+		deleted := 0
+		if _, ok := g.kvs[string(req.Key)]; ok {
+			deleted = 1
+			g.revision++
+			delete(g.kvs, string(req.Key))
+			g.change("DELETE", etcdKeyValue{Key: req.Key, ModRevision: etcdInt(g.revision)})
+		}
+		resp := map[string]interface{}{"header": gatewayHeader(g.revision), "deleted": strconv.Itoa(deleted)}
+		g.lock.Unlock()
+		json.NewEncoder(w).Encode(resp)
+	case "/v3/watch":
+		g.watch(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Stream the changes from the start revision till the frames or the client end it
+func (g *fakeEtcdGateway) watch(w http.ResponseWriter, r *http.Request) {
+	req := &etcdWatchReq{}
+	json.NewDecoder(r.Body).Decode(req)
+	create := req.CreateRequest
+
+	g.lock.Lock()
+	g.watches = append(g.watches, create.StartRevision)
+	header := gatewayHeader(g.revision)
+	g.lock.Unlock()
+
+	flusher := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	encoder.Encode(map[string]interface{}{"result": map[string]interface{}{"header": header, "created": true}})
+	flusher.Flush()
+
+	next := create.StartRevision
+	for {
+		g.lock.Lock()
+		var events []interface{}
+		for _, ev := range g.history {
+			if int64(ev.Kv.ModRevision) >= next && inEtcdRange(ev.Kv.Key, create.Key, create.RangeEnd) {
+				events = append(events, map[string]interface{}{"type": ev.Type, "kv": gatewayKv(ev.Kv)})
+				next = int64(ev.Kv.ModRevision) + 1
+			}
+		}
+		frames := g.frames
+		g.frames = nil
+		changed := g.changed
+		header = gatewayHeader(g.revision)
+		g.lock.Unlock()
+
+		if len(events) > 0 {
+			encoder.Encode(map[string]interface{}{"result": map[string]interface{}{"header": header, "events": events}})
+			flusher.Flush()
+		}
+		if len(frames) > 0 {
+			for _, frame := range frames {
+				fmt.Fprintln(w, frame)
+			}
+			flusher.Flush()
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Connect an etcd store to a fake gateway
+func newTestGatewayStore(t *testing.T, gateway *fakeEtcdGateway, conf EtcdConfig) *EtcdStore {
+	saved := etcdWatchRetryInterval
+	etcdWatchRetryInterval = 10 * time.Millisecond
+	server := httptest.NewServer(gateway)
+	conf.Endpoints = []string{server.URL}
+	etcdstore, err := NewEtcdStore(conf)
+	if err != nil {
+		server.Close()
+		t.Fatalf("Err: %s", err)
+	}
+	t.Cleanup(func() {
+		etcdstore.Close()
+		server.Close()
+		etcdWatchRetryInterval = saved
+	})
+	return etcdstore
+}
+
+func TestEtcdGateway(t *testing.T) {
+	tests := map[string]func(t *testing.T, kvstore Store){
+		"SetGetDel":         testSetGetDel,
+		"WatchEvents":       testWatchEvents,
+		"WatchFromRevision": testWatchFromRevision,
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			test(t, newTestGatewayStore(t, newFakeEtcdGateway(), EtcdConfig{Prefix: "test"}))
+		})
+	}
+}
+
+// Wait for the next event of a watcher
+func nextEvent(t *testing.T, watcher *Watcher) Event {
+	select {
+	case ev := <-watcher.Events:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No watch event")
+		return Event{}
+	}
+}
+
+// Wait for the watch streams opened on a gateway
+func waitWatches(t *testing.T, gateway *fakeEtcdGateway, count int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		gateway.lock.Lock()
+		watches := len(gateway.watches)
+		gateway.lock.Unlock()
+		if watches >= count {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("The watch stream was not opened again")
+}
+
+func TestEtcdGatewayWatchFrames(t *testing.T) {
+	gateway := newFakeEtcdGateway()
+	gateway.auth = true
+	etcdstore := newTestGatewayStore(t, gateway, EtcdConfig{Username: "root", Password: "root"})
+	watcher := etcdstore.Watch(Plugin_instances_bucket, nil)
+	defer watcher.Close()
+
+	if err := etcdstore.Set(Plugin_instances_bucket, []byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if ev := nextEvent(t, watcher); ev.Key != "a" || string(ev.Value) != "1" {
+		t.Fatalf("Unexpected event: %+v", ev)
+	}
+
+	// The error frame of the expired token: the store authenticates again and
+	// resumes after the last event
+	gateway.lock.Lock()
+	gateway.token = "expired"
+	gateway.lock.Unlock()
+	gateway.sendFrames(`{"error": {"grpc_code": 16, "http_code": 401, "message": "etcdserver: invalid auth token", "http_status": "Unauthorized"}}`)
+	waitWatches(t, gateway, 2)
+	if err := etcdstore.Set(Plugin_instances_bucket, []byte("b"), []byte("2")); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if ev := nextEvent(t, watcher); ev.Key != "b" || string(ev.Value) != "2" {
+		t.Fatalf("Unexpected event: %+v", ev)
+	}
+	gateway.lock.Lock()
+	authentications, watches := gateway.authentications, append([]int64{}, gateway.watches...)
+	gateway.lock.Unlock()
+	if authentications < 2 || watches[len(watches)-1] != 3 {
+		t.Errorf("Expected the watch to resume from revision 3 with a new token, got %d authentications, watches %v", authentications, watches)
+	}
+
+	// The cancel frame of a compaction resumes from the compact revision, the
+	// changes before it are lost
+	gateway.sendFrames(`{"result": {"header": {"revision": "3"}, "canceled": true, "compact_revision": "5", "cancel_reason": "mvcc: required revision has been compacted"}}`)
+	waitWatches(t, gateway, 3)
+	for _, k := range []string{"c", "d"} {
+		if err := etcdstore.Set(Plugin_instances_bucket, []byte(k), []byte(k)); err != nil {
+			t.Fatalf("Err: %s", err)
+		}
+	}
+	if ev := nextEvent(t, watcher); ev.Key != "d" || ev.Revision != 5 {
+		t.Fatalf("Unexpected event: %+v", ev)
+	}
+
+	// The other cancel frames resume after the last event
+	gateway.sendFrames(`{"result": {"header": {"revision": "5"}, "canceled": true, "cancel_reason": "etcdserver: permission denied"}}`)
+	waitWatches(t, gateway, 4)
+	if err := etcdstore.Del(Plugin_instances_bucket, []byte("a")); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if ev := nextEvent(t, watcher); ev.Type != EventDelete || ev.Key != "a" {
+		t.Fatalf("Unexpected event: %+v", ev)
+	}
+	gateway.lock.Lock()
+	watches = append([]int64{}, gateway.watches...)
+	gateway.lock.Unlock()
+	if len(watches) != 4 || watches[2] != 5 || watches[3] != 6 {
+		t.Errorf("Expected the watches to resume from the compact revision 5 then from 6, watches %v", watches)
+	}
+}
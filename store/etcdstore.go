@@ -0,0 +1,584 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/spf13/jwalterweatherman"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Default key prefix under which the buckets are stored in etcd
+	defaultEtcdPrefix = "singularity"
+
+	// Default timeout of a single etcd request
+	defaultEtcdTimeout = 5 * time.Second
+)
+
+var (
+	// An error indicating no etcd endpoint could be reached
+	ErrEtcdUnavailable = errors.New("no etcd endpoint available")
+
+	// Delay before reopening a broken watch stream
+	etcdWatchRetryInterval = time.Second
+)
+
+// EtcdConfig is the configuration of the etcd backend
+type EtcdConfig struct {
+	// The client urls of the etcd members e.g. "http://127.0.0.1:2379"
+	Endpoints []string
+	// The key prefix under which the buckets are stored
+	Prefix string
+	// The timeout of a single request e.g. "5s"
+	Timeout string
+	// Credentials, if etcd authentication is enabled
+	Username string
+	Password string
+	// TLS client configuration, if the endpoints are https
+	CACert string
+	Cert   string
+	Key    string
+}
+
+// EtcdStore is the etcd backend of the Store. It talks to the etcd v3 API
+// through its json gateway, so the state can be shared between agents.
+// Every change, including the ones made by other agents, is delivered to
+// the watchers through a watch stream on the prefix.
+type EtcdStore struct {
+	conf      EtcdConfig
+	prefix    string
+	client    *http.Client
+	watchConn *http.Client
+
+	// guards the auth token, the endpoint in use and the written revision
+	lock     sync.Mutex
+	token    string
+	endpoint int
+	written  uint64
+
+	// the hub notifying the watchers of the changes
+	hub *watchHub
+
+	// closed to stop the watch stream
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// etcdInt decodes the int64 fields that the json gateway sends as strings
+type etcdInt int64
+
+func (i *etcdInt) UnmarshalJSON(data []byte) error {
+	v, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = etcdInt(v)
+	return nil
+}
+
+type etcdHeader struct {
+	Revision etcdInt `json:"revision"`
+}
+
+type etcdKeyValue struct {
+	Key         []byte  `json:"key"`
+	Value       []byte  `json:"value"`
+	ModRevision etcdInt `json:"mod_revision"`
+}
+
+type etcdRangeReq struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type etcdRangeResp struct {
+	Header etcdHeader     `json:"header"`
+	Kvs    []etcdKeyValue `json:"kvs"`
+}
+
+type etcdPutReq struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdDeleteResp struct {
+	Header  etcdHeader `json:"header"`
+	Deleted etcdInt    `json:"deleted"`
+}
+
+type etcdWatchCreate struct {
+	Key           []byte `json:"key"`
+	RangeEnd      []byte `json:"range_end"`
+	StartRevision int64  `json:"start_revision,omitempty"`
+}
+
+type etcdWatchReq struct {
+	CreateRequest etcdWatchCreate `json:"create_request"`
+}
+
+type etcdWatchEvent struct {
+	Type string       `json:"type"`
+	Kv   etcdKeyValue `json:"kv"`
+}
+
+type etcdWatchResp struct {
+	Result struct {
+		Header          etcdHeader       `json:"header"`
+		Canceled        bool             `json:"canceled"`
+		CancelReason    string           `json:"cancel_reason"`
+		CompactRevision etcdInt          `json:"compact_revision"`
+		Events          []etcdWatchEvent `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type etcdAuthReq struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type etcdAuthResp struct {
+	Token string `json:"token"`
+}
+
+type etcdErrorResp struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// NewEtcdStore connects to etcd and starts watching the store prefix
+func NewEtcdStore(conf EtcdConfig) (*EtcdStore, error) {
+
+	if len(conf.Endpoints) == 0 {
+		return nil, fmt.Errorf("No etcd endpoint configured")
+	}
+
+	timeout := defaultEtcdTimeout
+	if conf.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(conf.Timeout); err != nil {
+			return nil, fmt.Errorf("Invalid etcd timeout: %s", conf.Timeout)
+		}
+	}
+
+	transport := &http.Transport{}
+	if conf.CACert != "" || conf.Cert != "" {
+		tlsConfig, err := etcdTLSConfig(conf)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	prefix := conf.Prefix
+	if prefix == "" {
+		prefix = defaultEtcdPrefix
+	}
+
+	store := &EtcdStore{
+		conf:   conf,
+		prefix: strings.TrimSuffix(prefix, "/") + "/",
+		client: &http.Client{Transport: transport, Timeout: timeout},
+		// The watch stream is long lived, it must not time out
+		watchConn: &http.Client{Transport: transport},
+		stopCh:    make(chan struct{}),
+	}
+
+	if conf.Username != "" {
+		if err := store.authenticate(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Get the current revision to start the watch from
+	resp := &etcdRangeResp{}
+	if err := store.call("/v3/kv/range", &etcdRangeReq{Key: []byte(store.prefix), RangeEnd: prefixEnd([]byte(store.prefix))}, resp); err != nil {
+		return nil, err
+	}
+	revision := uint64(resp.Header.Revision)
+	store.hub = newWatchHub(DefaultHistorySize, revision)
+
+	store.wg.Add(1)
+	go store.watchLoop(int64(revision) + 1)
+
+	return store, nil
+}
+
+// Build the tls configuration to reach the etcd endpoints
+func etcdTLSConfig(conf EtcdConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if conf.CACert != "" {
+		pem, err := ioutil.ReadFile(conf.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read etcd CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Invalid etcd CA: %s", conf.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if conf.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load etcd client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// prefixEnd returns the range end covering all the keys starting with prefix
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// The prefix is all 0xff, range till the end of the keyspace
+	return []byte{0}
+}
+
+// The etcd key of a bucket key
+func (e *EtcdStore) key(bucket, k []byte) []byte {
+	return []byte(e.prefix + string(bucket) + "/" + string(k))
+}
+
+// authenticate gets a token for the configured user
+func (e *EtcdStore) authenticate() error {
+	resp := &etcdAuthResp{}
+	if err := e.post("/v3/auth/authenticate", &etcdAuthReq{e.conf.Username, e.conf.Password}, resp); err != nil {
+		return fmt.Errorf("etcd authentication failed: %v", err)
+	}
+	e.lock.Lock()
+	e.token = resp.Token
+	e.lock.Unlock()
+	return nil
+}
+
+// tokenExpired checks if an etcd error reports the expiry of the auth token
+func (e *EtcdStore) tokenExpired(message string) bool {
+	return e.conf.Username != "" && strings.Contains(message, "invalid auth token")
+}
+
+// call sends a request, authenticating again once if the token expired
+func (e *EtcdStore) call(path string, req, resp interface{}) error {
+	err := e.post(path, req, resp)
+	if err != nil && e.tokenExpired(err.Error()) {
+		if authErr := e.authenticate(); authErr != nil {
+			return authErr
+		}
+		err = e.post(path, req, resp)
+	}
+	return err
+}
+
+// post sends a json request to the first endpoint that answers
+func (e *EtcdStore) post(path string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	first, token := e.endpoint, e.token
+	e.lock.Unlock()
+
+	endpoints := e.conf.Endpoints
+	for i := 0; i < len(endpoints); i++ {
+		idx := (first + i) % len(endpoints)
+		httpReq, err := http.NewRequest("POST", strings.TrimSuffix(endpoints[idx], "/")+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			httpReq.Header.Set("Authorization", token)
+		}
+
+		httpResp, err := e.client.Do(httpReq)
+		if err != nil {
+			log.DEBUG.Printf("etcd endpoint %s unavailable: %v", endpoints[idx], err)
+			continue
+		}
+		data, err := ioutil.ReadAll(httpResp.Body)
+		httpResp.Body.Close()
+		if err != nil {
+			continue
+		}
+
+		// Stick to the endpoint that answered
+		e.lock.Lock()
+		e.endpoint = idx
+		e.lock.Unlock()
+
+		if httpResp.StatusCode != 200 {
+			errResp := &etcdErrorResp{}
+			json.Unmarshal(data, errResp)
+			msg := errResp.Message
+			if msg == "" {
+				msg = errResp.Error
+			}
+			return fmt.Errorf("etcd request %s failed: %s: %s", path, httpResp.Status, msg)
+		}
+		return json.Unmarshal(data, resp)
+	}
+	return ErrEtcdUnavailable
+}
+
+// Close stops the watch stream and releases the watchers
+func (e *EtcdStore) Close() error {
+	close(e.stopCh)
+	e.wg.Wait()
+	e.hub.closeAll()
+	return nil
+}
+
+// Set is used to set a key/value
+func (e *EtcdStore) Set(bucketToInsertIn, k, v []byte) error {
+	if !isBucket(bucketToInsertIn) {
+		return ErrNoSuchBucket
+	}
+	resp := &etcdRangeResp{}
+	if err := e.call("/v3/kv/put", &etcdPutReq{Key: e.key(bucketToInsertIn, k), Value: v}, resp); err != nil {
+		return err
+	}
+	e.setWritten(uint64(resp.Header.Revision))
+	return nil
+}
+
+// setWritten records the revision of a write made by this store
+func (e *EtcdStore) setWritten(revision uint64) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if revision > e.written {
+		e.written = revision
+	}
+}
+
+// Get is used to retrieve a value by key
+func (e *EtcdStore) Get(bucketToReadFrom, k []byte) ([]byte, error) {
+	if !isBucket(bucketToReadFrom) {
+		return nil, ErrNoSuchBucket
+	}
+	resp := &etcdRangeResp{}
+	if err := e.call("/v3/kv/range", &etcdRangeReq{Key: e.key(bucketToReadFrom, k)}, resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrNoSuchKey
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+// GetAll is used to iterate over the key/values of a bucket in key order
+func (e *EtcdStore) GetAll(bucketToReadFrom []byte, fn func(k, v []byte) error) error {
+	if !isBucket(bucketToReadFrom) {
+		return ErrNoSuchBucket
+	}
+	bucketPrefix := e.key(bucketToReadFrom, nil)
+	resp := &etcdRangeResp{}
+	if err := e.call("/v3/kv/range", &etcdRangeReq{Key: bucketPrefix, RangeEnd: prefixEnd(bucketPrefix)}, resp); err != nil {
+		return err
+	}
+	for _, kv := range resp.Kvs {
+		if err := fn(kv.Key[len(bucketPrefix):], kv.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Del is used to delete a key
+func (e *EtcdStore) Del(bucketToReadFrom, k []byte) error {
+	if !isBucket(bucketToReadFrom) {
+		return ErrNoSuchBucket
+	}
+	resp := &etcdDeleteResp{}
+	if err := e.call("/v3/kv/deleterange", &etcdRangeReq{Key: e.key(bucketToReadFrom, k)}, resp); err != nil {
+		return err
+	}
+	if resp.Deleted > 0 {
+		e.setWritten(uint64(resp.Header.Revision))
+	}
+	return nil
+}
+
+// Revision returns the etcd revision of the last change seen on the prefix,
+// the writes of this store are accounted before their watch event arrives
+func (e *EtcdStore) Revision() uint64 {
+	e.hub.lock.Lock()
+	revision := e.hub.revision
+	e.hub.lock.Unlock()
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.written > revision {
+		return e.written
+	}
+	return revision
+}
+
+// Watch subscribes to the changes made in a bucket for the keys starting with prefix
+func (e *EtcdStore) Watch(bucket, prefix []byte) *Watcher {
+	w, _ := e.hub.watch(bucket, prefix, 0)
+	return w
+}
+
+// WatchFrom subscribes to the changes made after the given revision
+func (e *EtcdStore) WatchFrom(bucket, prefix []byte, revision uint64) (*Watcher, error) {
+	return e.hub.watch(bucket, prefix, revision)
+}
+
+// watchLoop keeps a watch stream open on the prefix and feeds the hub
+func (e *EtcdStore) watchLoop(startRevision int64) {
+	defer e.wg.Done()
+
+	for {
+		next, err := e.watchStream(startRevision)
+		if next > startRevision {
+			startRevision = next
+		}
+		select {
+		case <-e.stopCh:
+			return
+		default:
+		}
+		if err != nil {
+			log.ERROR.Printf("etcd watch stream failed: %v", err)
+		}
+		select {
+		case <-e.stopCh:
+			return
+		case <-time.After(etcdWatchRetryInterval):
+		}
+	}
+}
+
+// watchStream reads a single watch stream till it breaks. It returns the
+// revision to resume from.
+func (e *EtcdStore) watchStream(startRevision int64) (int64, error) {
+	prefix := []byte(e.prefix)
+	body, err := json.Marshal(&etcdWatchReq{etcdWatchCreate{prefix, prefixEnd(prefix), startRevision}})
+	if err != nil {
+		return startRevision, err
+	}
+
+	e.lock.Lock()
+	endpoint, token := e.conf.Endpoints[e.endpoint], e.token
+	e.lock.Unlock()
+
+	// Abort the stream when the store is closed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-e.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(endpoint, "/")+"/v3/watch", bytes.NewReader(body))
+	if err != nil {
+		return startRevision, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	resp, err := e.watchConn.Do(req)
+	if err != nil {
+		// Try another endpoint on the next attempt
+		e.lock.Lock()
+		e.endpoint = (e.endpoint + 1) % len(e.conf.Endpoints)
+		e.lock.Unlock()
+		return startRevision, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		errResp := &etcdErrorResp{}
+		json.NewDecoder(resp.Body).Decode(errResp)
+		msg := errResp.Message
+		if msg == "" {
+			msg = errResp.Error
+		}
+		return startRevision, e.watchError(fmt.Errorf("etcd watch failed: %s: %s", resp.Status, msg))
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		msg := &etcdWatchResp{}
+		if err := decoder.Decode(msg); err != nil {
+			return startRevision, err
+		}
+		// The gateway reports the stream errors in a frame, e.g. the expiry of the token
+		if msg.Error != nil {
+			return startRevision, e.watchError(fmt.Errorf("etcd watch error: %s", msg.Error.Message))
+		}
+		if msg.Result.Canceled {
+			if msg.Result.CompactRevision > 0 {
+				// The missed changes are gone, resume from the oldest available
+				log.WARN.Printf("etcd watch compacted, changes before revision %d are lost", msg.Result.CompactRevision)
+				if compacted := int64(msg.Result.CompactRevision); compacted > startRevision {
+					startRevision = compacted
+				}
+				return startRevision, fmt.Errorf("etcd watch canceled: %s", msg.Result.CancelReason)
+			}
+			return startRevision, e.watchError(fmt.Errorf("etcd watch canceled: %s", msg.Result.CancelReason))
+		}
+		for _, ev := range msg.Result.Events {
+			e.publish(ev)
+			startRevision = int64(ev.Kv.ModRevision) + 1
+		}
+	}
+}
+
+// watchError authenticates again if a watch failed on the expired token, the
+// next stream then uses the new one
+func (e *EtcdStore) watchError(err error) error {
+	if !e.tokenExpired(err.Error()) {
+		return err
+	}
+	if authErr := e.authenticate(); authErr != nil {
+		return fmt.Errorf("%v, %v", err, authErr)
+	}
+	return err
+}
+
+// publish converts an etcd event to a store event and notify the watchers
+func (e *EtcdStore) publish(ev etcdWatchEvent) {
+	key := strings.TrimPrefix(string(ev.Kv.Key), e.prefix)
+	sep := strings.Index(key, "/")
+	if sep < 0 {
+		return
+	}
+	event := Event{
+		Type:     EventPut,
+		Bucket:   key[:sep],
+		Key:      key[sep+1:],
+		Value:    ev.Kv.Value,
+		Revision: uint64(ev.Kv.ModRevision),
+	}
+	if ev.Type == "DELETE" {
+		event.Type = EventDelete
+		event.Value = nil
+	}
+	e.hub.publish(event)
+}
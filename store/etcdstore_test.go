@@ -0,0 +1,75 @@
+//go:build etcd
+// +build etcd
+
+package store
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// Start an embedded etcd server and connect an etcd store to it.
+// Run with: go test -tags etcd ./store/
+func newTestEtcdStore(t *testing.T) (Store, func()) {
+	dir, err := ioutil.TempDir("", "etcdstore")
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+
+	clientUrl, _ := url.Parse("http://127.0.0.1:23790")
+	peerUrl, _ := url.Parse("http://127.0.0.1:23800")
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+	cfg.ListenClientUrls = []url.URL{*clientUrl}
+	cfg.AdvertiseClientUrls = []url.URL{*clientUrl}
+	cfg.ListenPeerUrls = []url.URL{*peerUrl}
+	cfg.AdvertisePeerUrls = []url.URL{*peerUrl}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Err: %s", err)
+	}
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		server.Close()
+		os.RemoveAll(dir)
+		t.Fatalf("Embedded etcd did not start")
+	}
+
+	etcdstore, err := NewEtcdStore(EtcdConfig{Endpoints: []string{clientUrl.String()}, Prefix: "test"})
+	if err != nil {
+		server.Close()
+		os.RemoveAll(dir)
+		t.Fatalf("Err: %s", err)
+	}
+	return etcdstore, func() {
+		etcdstore.Close()
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestEtcdStore(t *testing.T) {
+	tests := map[string]func(t *testing.T, kvstore Store){
+		"SetGetDel":         testSetGetDel,
+		"WatchEvents":       testWatchEvents,
+		"WatchFromRevision": testWatchFromRevision,
+	}
+	for name, test := range tests {
+		kvstore, cleanup := newTestEtcdStore(t)
+		t.Run(name, func(t *testing.T) {
+			test(t, kvstore)
+		})
+		cleanup()
+	}
+}
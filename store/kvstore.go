@@ -1,8 +1,10 @@
 package store
 
 import (
+	"encoding/binary"
 	"errors"
 	"github.com/boltdb/bolt"
+	"sync"
 )
 
 const (
@@ -12,9 +14,42 @@ const (
 )
 
 var (
-	// Bucket for storing all Loaded plugin instance
+	// Bucket for storing all Loaded plugin instance (always encrypted)
 	Plugin_instances_bucket = []byte("plugin_instances")
 
+	// Bucket for storing the named secrets (always encrypted)
+	Secrets_bucket = []byte("secrets")
+
+	// Bucket for storing the api tokens by hash
+	Tokens_bucket = []byte("api_tokens")
+
+	// Bucket for storing the api users
+	Users_bucket = []byte("auth_users")
+
+	// Bucket for storing the role bindings of the users
+	Bindings_bucket = []byte("auth_bindings")
+
+	// Bucket for storing the tenants
+	Tenants_bucket = []byte("tenants")
+
+	// Bucket for storing the controllers by tenant (always encrypted)
+	Controllers_bucket = []byte("controllers")
+
+	// Bucket for storing the audit records by time
+	Audit_bucket = []byte("audit")
+
+	// Bucket for storing the results of the requests by idempotency key
+	Idempotency_bucket = []byte("idempotency_keys")
+
+	// Bucket for storing the progress of the lifecycle operations by tenant
+	Operations_bucket = []byte("operations")
+
+	// Bucket for storing the store internal metadata (e.g. revision)
+	meta_bucket = []byte("_meta")
+
+	// Key of the last committed revision in the meta bucket
+	revisionKey = []byte("revision")
+
 	// An error indicating a given key does not exist
 	ErrNoSuchKey = errors.New("no such key exists")
 
@@ -22,13 +57,19 @@ var (
 	ErrNoSuchBucket = errors.New("no such bucket exists")
 )
 
-// KVStore provides key/value storage
+// KVStore is the bolt backend of the Store
 type KVStore struct {
 	// conn is the handle to the db
 	conn *bolt.DB
 
 	// The path to the Bolt database file
 	path string
+
+	// serializes the writers so events are published in revision order
+	writeLock sync.Mutex
+
+	// the hub notifying the watchers of the changes
+	hub *watchHub
 }
 
 // NewKVStore takes a file path and returns a new kvstore
@@ -64,19 +105,55 @@ func (b *KVStore) initialize() error {
 	}
 	defer tx.Rollback()
 
-	if _, err = tx.CreateBucketIfNotExists(Plugin_instances_bucket); err != nil {
+	for _, bucket := range buckets {
+		if _, err = tx.CreateBucketIfNotExists(bucket); err != nil {
+			return err
+		}
+	}
+	meta, err := tx.CreateBucketIfNotExists(meta_bucket)
+	if err != nil {
 		return err
 	}
+
+	// Resume the revision from the last committed one
+	b.hub = newWatchHub(DefaultHistorySize, decodeRevision(meta.Get(revisionKey)))
+
 	return tx.Commit()
 }
 
+// nextRevision increments the store revision within a write transaction
+func nextRevision(tx *bolt.Tx) (uint64, error) {
+	meta := tx.Bucket(meta_bucket)
+	rev := decodeRevision(meta.Get(revisionKey)) + 1
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, rev)
+	if err := meta.Put(revisionKey, buf); err != nil {
+		return 0, err
+	}
+	return rev, nil
+}
+
+// decodeRevision reads a revision stored in the meta bucket
+func decodeRevision(v []byte) uint64 {
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
 // Close is used to close the DB connection.
 func (b *KVStore) Close() error {
+	if b.hub != nil {
+		b.hub.closeAll()
+	}
 	return b.conn.Close()
 }
 
 // Set is used to set a key/value
 func (b *KVStore) Set(bucketToInsertIn, k, v []byte) error {
+	b.writeLock.Lock()
+	defer b.writeLock.Unlock()
+
 	tx, err := b.conn.Begin(true)
 	if err != nil {
 		return err
@@ -84,11 +161,29 @@ func (b *KVStore) Set(bucketToInsertIn, k, v []byte) error {
 	defer tx.Rollback()
 
 	bucket := tx.Bucket(bucketToInsertIn)
+	if bucket == nil {
+		return ErrNoSuchBucket
+	}
 	if err := bucket.Put(k, v); err != nil {
 		return err
 	}
+	rev, err := nextRevision(tx)
+	if err != nil {
+		return err
+	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	b.hub.publish(Event{
+		Type:     EventPut,
+		Bucket:   string(bucketToInsertIn),
+		Key:      string(k),
+		Value:    append([]byte{}, v...),
+		Revision: rev,
+	})
+	return nil
 }
 
 // Get is used to retrieve a value from the k/v store by key
@@ -100,6 +195,9 @@ func (b *KVStore) Get(bucketToReadFrom, k []byte) ([]byte, error) {
 	defer tx.Rollback()
 
 	bucket := tx.Bucket(bucketToReadFrom)
+	if bucket == nil {
+		return nil, ErrNoSuchBucket
+	}
 	val := bucket.Get(k)
 
 	if val == nil {
@@ -117,6 +215,9 @@ func (b *KVStore) GetAll(bucketToReadFrom []byte, fn func(k, v []byte) error) er
 	defer tx.Rollback()
 
 	bucket := tx.Bucket(bucketToReadFrom)
+	if bucket == nil {
+		return ErrNoSuchBucket
+	}
 
 	err = bucket.ForEach(fn)
 	if err != nil {
@@ -128,6 +229,9 @@ func (b *KVStore) GetAll(bucketToReadFrom []byte, fn func(k, v []byte) error) er
 
 // Del is used to delete a key from the k/v store by key
 func (b *KVStore) Del(bucketToReadFrom, k []byte) error {
+	b.writeLock.Lock()
+	defer b.writeLock.Unlock()
+
 	tx, err := b.conn.Begin(true)
 	if err != nil {
 		return err
@@ -138,10 +242,49 @@ func (b *KVStore) Del(bucketToReadFrom, k []byte) error {
 	if bucket == nil {
 		return ErrNoSuchBucket
 	}
+	// Nothing to delete nor to notify
+	if bucket.Get(k) == nil {
+		return nil
+	}
 	err = bucket.Delete(k)
 	if err != nil {
-		return nil
+		return err
+	}
+	rev, err := nextRevision(tx)
+	if err != nil {
+		return err
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	b.hub.publish(Event{
+		Type:     EventDelete,
+		Bucket:   string(bucketToReadFrom),
+		Key:      string(k),
+		Revision: rev,
+	})
+	return nil
+}
+
+// Revision returns the revision of the last committed change
+func (b *KVStore) Revision() uint64 {
+	b.hub.lock.Lock()
+	defer b.hub.lock.Unlock()
+	return b.hub.revision
+}
+
+// Watch subscribes to the changes made in a bucket for the keys starting with
+// prefix. An empty bucket watches all the buckets.
+func (b *KVStore) Watch(bucket, prefix []byte) *Watcher {
+	w, _ := b.hub.watch(bucket, prefix, 0)
+	return w
+}
+
+// WatchFrom subscribes to the changes like Watch, first replaying the changes
+// committed after the given revision. ErrCompacted is returned if they are
+// no longer available.
+func (b *KVStore) WatchFrom(bucket, prefix []byte, revision uint64) (*Watcher, error) {
+	return b.hub.watch(bucket, prefix, revision)
 }
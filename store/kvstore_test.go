@@ -0,0 +1,141 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Create a bolt store in a temporary directory
+func newTestStore(t *testing.T) (Store, func()) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	kvstore, err := NewKVStore(filepath.Join(dir, "test_store"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Err: %s", err)
+	}
+	return kvstore, func() {
+		kvstore.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// Create an in-memory store
+func newTestMemStore(t *testing.T) (Store, func()) {
+	memstore := NewMemStore()
+	return memstore, func() {
+		memstore.Close()
+	}
+}
+
+// Run a test against every local backend
+func forEachBackend(t *testing.T, test func(t *testing.T, kvstore Store)) {
+	backends := map[string]func(t *testing.T) (Store, func()){
+		BoltBackend:   newTestStore,
+		MemoryBackend: newTestMemStore,
+	}
+	for name, newStore := range backends {
+		kvstore, cleanup := newStore(t)
+		t.Run(name, func(t *testing.T) {
+			test(t, kvstore)
+		})
+		cleanup()
+	}
+}
+
+func TestSetGetDel(t *testing.T) {
+	forEachBackend(t, testSetGetDel)
+}
+
+func TestWatchEvents(t *testing.T) {
+	forEachBackend(t, testWatchEvents)
+}
+
+func TestWatchFromRevision(t *testing.T) {
+	forEachBackend(t, testWatchFromRevision)
+}
+
+func testSetGetDel(t *testing.T, kvstore Store) {
+	if err := kvstore.Set(Plugin_instances_bucket, []byte("b"), []byte("2")); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if err := kvstore.Set(Plugin_instances_bucket, []byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if err := kvstore.Set([]byte("unknown"), []byte("a"), []byte("1")); err != ErrNoSuchBucket {
+		t.Fatalf("Expected ErrNoSuchBucket, got: %v", err)
+	}
+
+	val, err := kvstore.Get(Plugin_instances_bucket, []byte("a"))
+	if err != nil || string(val) != "1" {
+		t.Fatalf("Unexpected value: %s, Err: %v", val, err)
+	}
+
+	var keys string
+	kvstore.GetAll(Plugin_instances_bucket, func(k, v []byte) error {
+		keys += string(k)
+		return nil
+	})
+	if keys != "ab" {
+		t.Fatalf("Unexpected keys: %s", keys)
+	}
+
+	if err := kvstore.Del(Plugin_instances_bucket, []byte("a")); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if _, err := kvstore.Get(Plugin_instances_bucket, []byte("a")); err != ErrNoSuchKey {
+		t.Fatalf("Expected ErrNoSuchKey, got: %v", err)
+	}
+}
+
+func testWatchEvents(t *testing.T, kvstore Store) {
+	watcher := kvstore.Watch(Plugin_instances_bucket, []byte("onos"))
+	defer watcher.Close()
+
+	start := kvstore.Revision()
+	if err := kvstore.Set(Plugin_instances_bucket, []byte("odl/1"), []byte("skipped")); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if err := kvstore.Set(Plugin_instances_bucket, []byte("onos/1"), []byte("v1")); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	if err := kvstore.Del(Plugin_instances_bucket, []byte("onos/1")); err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+
+	put := <-watcher.Events
+	if put.Type != EventPut || put.Key != "onos/1" || string(put.Value) != "v1" || put.Revision <= start {
+		t.Fatalf("Unexpected event: %+v", put)
+	}
+	del := <-watcher.Events
+	if del.Type != EventDelete || del.Key != "onos/1" || del.Revision <= put.Revision {
+		t.Fatalf("Unexpected event: %+v", del)
+	}
+}
+
+func testWatchFromRevision(t *testing.T, kvstore Store) {
+	var revisions []uint64
+	for _, k := range []string{"a", "b", "c"} {
+		if err := kvstore.Set(Plugin_instances_bucket, []byte(k), []byte(k)); err != nil {
+			t.Fatalf("Err: %s", err)
+		}
+		revisions = append(revisions, kvstore.Revision())
+	}
+
+	watcher, err := kvstore.WatchFrom(nil, nil, revisions[0])
+	if err != nil {
+		t.Fatalf("Err: %s", err)
+	}
+	defer watcher.Close()
+
+	for _, k := range []string{"b", "c"} {
+		ev := <-watcher.Events
+		if ev.Key != k {
+			t.Fatalf("Expected replay of %s, got: %+v", k, ev)
+		}
+	}
+}
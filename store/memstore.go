@@ -0,0 +1,146 @@
+package store
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemStore is the in-memory backend of the Store. Nothing is persisted,
+// it is meant for tests and throwaway agents.
+type MemStore struct {
+	// guards the buckets and the revision
+	lock sync.RWMutex
+
+	// bucket name -> key -> value
+	data map[string]map[string][]byte
+
+	// The last committed revision
+	revision uint64
+
+	// the hub notifying the watchers of the changes
+	hub *watchHub
+}
+
+// NewMemStore returns a new empty in-memory store
+func NewMemStore() *MemStore {
+	store := &MemStore{
+		data: make(map[string]map[string][]byte),
+		hub:  newWatchHub(DefaultHistorySize, 0),
+	}
+	for _, bucket := range buckets {
+		store.data[string(bucket)] = make(map[string][]byte)
+	}
+	return store
+}
+
+// Close is used to release the watchers
+func (m *MemStore) Close() error {
+	m.hub.closeAll()
+	return nil
+}
+
+// Set is used to set a key/value
+func (m *MemStore) Set(bucketToInsertIn, k, v []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	bucket, ok := m.data[string(bucketToInsertIn)]
+	if !ok {
+		return ErrNoSuchBucket
+	}
+	bucket[string(k)] = append([]byte{}, v...)
+	m.revision++
+
+	m.hub.publish(Event{
+		Type:     EventPut,
+		Bucket:   string(bucketToInsertIn),
+		Key:      string(k),
+		Value:    append([]byte{}, v...),
+		Revision: m.revision,
+	})
+	return nil
+}
+
+// Get is used to retrieve a value by key
+func (m *MemStore) Get(bucketToReadFrom, k []byte) ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	bucket, ok := m.data[string(bucketToReadFrom)]
+	if !ok {
+		return nil, ErrNoSuchBucket
+	}
+	val, ok := bucket[string(k)]
+	if !ok {
+		return nil, ErrNoSuchKey
+	}
+	return append([]byte{}, val...), nil
+}
+
+// GetAll is used to iterate over the key/values of a bucket in key order
+func (m *MemStore) GetAll(bucketToReadFrom []byte, fn func(k, v []byte) error) error {
+	m.lock.RLock()
+	bucket, ok := m.data[string(bucketToReadFrom)]
+	if !ok {
+		m.lock.RUnlock()
+		return ErrNoSuchBucket
+	}
+	// Take a snapshot so fn may use the store
+	keys := make([]string, 0, len(bucket))
+	values := make(map[string][]byte, len(bucket))
+	for key, val := range bucket {
+		keys = append(keys, key)
+		values[key] = append([]byte{}, val...)
+	}
+	m.lock.RUnlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn([]byte(key), values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Del is used to delete a key
+func (m *MemStore) Del(bucketToReadFrom, k []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	bucket, ok := m.data[string(bucketToReadFrom)]
+	if !ok {
+		return ErrNoSuchBucket
+	}
+	if _, ok := bucket[string(k)]; !ok {
+		return nil
+	}
+	delete(bucket, string(k))
+	m.revision++
+
+	m.hub.publish(Event{
+		Type:     EventDelete,
+		Bucket:   string(bucketToReadFrom),
+		Key:      string(k),
+		Revision: m.revision,
+	})
+	return nil
+}
+
+// Revision returns the revision of the last committed change
+func (m *MemStore) Revision() uint64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.revision
+}
+
+// Watch subscribes to the changes made in a bucket for the keys starting with prefix
+func (m *MemStore) Watch(bucket, prefix []byte) *Watcher {
+	w, _ := m.hub.watch(bucket, prefix, 0)
+	return w
+}
+
+// WatchFrom subscribes to the changes made after the given revision
+func (m *MemStore) WatchFrom(bucket, prefix []byte, revision uint64) (*Watcher, error) {
+	return m.hub.watch(bucket, prefix, revision)
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// The bolt backend, a local database file (default)
+	BoltBackend = "bolt"
+
+	// The in-memory backend, nothing survives a restart (meant for tests)
+	MemoryBackend = "memory"
+
+	// The etcd backend, state shared through an etcd v3 cluster
+	EtcdBackend = "etcd"
+)
+
+var (
+	// All the buckets created by the backends on start
+	buckets = [][]byte{Plugin_instances_bucket, Secrets_bucket, Tokens_bucket, Users_bucket, Bindings_bucket,
+		Tenants_bucket, Controllers_bucket, Audit_bucket, Idempotency_bucket, Operations_bucket}
+
+	// The buckets always encrypted when encryption is configured: the secrets,
+	// the controllers with their init parameters and the plugin instances
+	sensitiveBuckets = [][]byte{Secrets_bucket, Controllers_bucket, Plugin_instances_bucket}
+
+	// An error indicating the backend name is unknown
+	ErrUnknownBackend = errors.New("unknown kv store backend")
+)
+
+// Store provides key/value storage, it is implemented by every backend
+type Store interface {
+	// Set is used to set a key/value
+	Set(bucket, k, v []byte) error
+
+	// Get is used to retrieve a value by key
+	Get(bucket, k []byte) ([]byte, error)
+
+	// GetAll is used to iterate over all the key/values of a bucket
+	GetAll(bucket []byte, fn func(k, v []byte) error) error
+
+	// Del is used to delete a key
+	Del(bucket, k []byte) error
+
+	// Revision returns the revision of the last committed change
+	Revision() uint64
+
+	// Watch subscribes to the changes of a bucket for the keys starting with prefix
+	Watch(bucket, prefix []byte) *Watcher
+
+	// WatchFrom subscribes to the changes after the given revision
+	WatchFrom(bucket, prefix []byte, revision uint64) (*Watcher, error)
+
+	// Close releases the backend resources
+	Close() error
+}
+
+// Config selects the backend and carries its configuration
+type Config struct {
+	// The backend name: "bolt" (default), "memory" or "etcd"
+	Backend string
+	// The path of the bolt database file
+	Path string
+	// The etcd backend configuration
+	Etcd EtcdConfig
+	// The encryption at rest configuration
+	Encryption EncryptionConfig
+}
+
+// New creates the store for the configured backend. If an encryption key is
+// configured the store encrypts the selected buckets.
+func New(conf Config) (Store, error) {
+	var backend Store
+	var err error
+
+	switch conf.Backend {
+	case "", BoltBackend:
+		backend, err = NewKVStore(conf.Path)
+	case MemoryBackend:
+		backend = NewMemStore()
+	case EtcdBackend:
+		backend, err = NewEtcdStore(conf.Etcd)
+	default:
+		return nil, fmt.Errorf("%v: %s", ErrUnknownBackend, conf.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !conf.Encryption.Enabled() {
+		return backend, nil
+	}
+	encrypted, err := NewEncryptedStore(backend, conf.Encryption)
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+	return encrypted, nil
+}
+
+// isBucket checks if a bucket is one created by the backends
+func isBucket(name []byte) bool {
+	for _, bucket := range buckets {
+		if string(bucket) == string(name) {
+			return true
+		}
+	}
+	return false
+}
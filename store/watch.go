@@ -0,0 +1,220 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+const (
+	// Number of past events kept in memory so a watcher can resume
+	// from an older revision
+	DefaultHistorySize = 1024
+
+	// Number of events buffered per watcher before it is considered too slow
+	watcherBufferSize = 64
+)
+
+var (
+	// An error indicating the requested revision is no longer in the history
+	ErrCompacted = errors.New("requested revision has been compacted")
+
+	// An error indicating a watcher could not keep up and was dropped
+	ErrWatcherOverflow = errors.New("watcher could not keep up with the changes")
+)
+
+// EventType describes the kind of change reported by a watch event
+type EventType string
+
+const (
+	EventPut    EventType = "put"
+	EventDelete EventType = "delete"
+)
+
+// Event describes a single change made to the kv store
+type Event struct {
+	Type     EventType `json:"type"`
+	Bucket   string    `json:"bucket"`
+	Key      string    `json:"key"`
+	Value    []byte    `json:"value,omitempty"`
+	Revision uint64    `json:"revision"`
+}
+
+// Watcher receives the events matching a bucket and a key prefix.
+// The Events channel is closed once the watcher is closed or dropped.
+type Watcher struct {
+	// Channel on which matching events are delivered
+	Events chan Event
+
+	bucket []byte
+	prefix []byte
+	after  uint64
+	hub    *watchHub
+	err    error
+
+	// The watcher whose events are relayed, if any
+	source *Watcher
+	// Closed by Close, ends the relay of a consumer no longer reading
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// relay returns a watcher delivering the events of source transformed by fn
+func relay(source *Watcher, fn func(Event) Event) *Watcher {
+	w := &Watcher{
+		Events: make(chan Event, watcherBufferSize),
+		source: source,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(w.Events)
+		for ev := range source.Events {
+			select {
+			case w.Events <- fn(ev):
+			case <-w.done:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+// Close stops the delivery of events to the watcher
+func (w *Watcher) Close() {
+	if w.source != nil {
+		w.closeOnce.Do(func() { close(w.done) })
+		w.source.Close()
+		return
+	}
+	w.hub.remove(w, nil)
+}
+
+// Err returns the reason the watcher was dropped, nil if it was closed normally
+func (w *Watcher) Err() error {
+	if w.source != nil {
+		return w.source.Err()
+	}
+	w.hub.lock.Lock()
+	defer w.hub.lock.Unlock()
+	return w.err
+}
+
+// matches checks if an event is of interest for the watcher
+func (w *Watcher) matches(ev *Event) bool {
+	if ev.Revision <= w.after {
+		return false
+	}
+	if len(w.bucket) != 0 && string(w.bucket) != ev.Bucket {
+		return false
+	}
+	return bytes.HasPrefix([]byte(ev.Key), w.prefix)
+}
+
+// watchHub fans out the store events to all the registered watchers and
+// keeps a bounded history of the recent events
+type watchHub struct {
+	lock     sync.Mutex
+	watchers map[*Watcher]struct{}
+	history  []Event
+	size     int
+	revision uint64
+	// every change after this revision is in the history
+	base uint64
+}
+
+// newWatchHub creates a hub keeping at most size past events, starting
+// at the given store revision
+func newWatchHub(size int, revision uint64) *watchHub {
+	return &watchHub{
+		watchers: make(map[*Watcher]struct{}),
+		size:     size,
+		revision: revision,
+		base:     revision,
+	}
+}
+
+// publish delivers an event to every matching watcher
+func (h *watchHub) publish(ev Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.revision = ev.Revision
+	h.history = append(h.history, ev)
+	if len(h.history) > h.size {
+		trimmed := len(h.history) - h.size
+		h.base = h.history[trimmed-1].Revision
+		h.history = h.history[trimmed:]
+	}
+
+	for w := range h.watchers {
+		if !w.matches(&ev) {
+			continue
+		}
+		select {
+		case w.Events <- ev:
+		default:
+			// Never block the writer on a slow watcher
+			h.drop(w, ErrWatcherOverflow)
+		}
+	}
+}
+
+// watch registers a new watcher. If revision is non zero all the events
+// after the revision are replayed from the history first.
+func (h *watchHub) watch(bucket, prefix []byte, revision uint64) (*Watcher, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	w := &Watcher{
+		bucket: append([]byte{}, bucket...),
+		prefix: append([]byte{}, prefix...),
+		after:  revision,
+		hub:    h,
+	}
+
+	var replay []Event
+	if revision > 0 && revision < h.revision {
+		if revision < h.base {
+			return nil, ErrCompacted
+		}
+		for _, ev := range h.history {
+			if w.matches(&ev) {
+				replay = append(replay, ev)
+			}
+		}
+	}
+
+	w.Events = make(chan Event, len(replay)+watcherBufferSize)
+	for _, ev := range replay {
+		w.Events <- ev
+	}
+	h.watchers[w] = struct{}{}
+
+	return w, nil
+}
+
+// remove unregisters a watcher
+func (h *watchHub) remove(w *Watcher, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.drop(w, err)
+}
+
+// drop unregisters a watcher, the hub lock must be held
+func (h *watchHub) drop(w *Watcher, err error) {
+	if _, ok := h.watchers[w]; !ok {
+		return
+	}
+	delete(h.watchers, w)
+	w.err = err
+	close(w.Events)
+}
+
+// closeAll drops every registered watcher
+func (h *watchHub) closeAll() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for w := range h.watchers {
+		h.drop(w, nil)
+	}
+}